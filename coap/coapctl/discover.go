@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/linkformat"
+	"os"
+	"strings"
+)
+
+// discoverCommand lists the resources the server describes in /.well-known/core
+// Filters are sent to the server as query options, as in section 4.1 of RFC 6690, and applied again to the response
+// since servers are allowed to ignore them.
+func discoverCommand(o *options, args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	filters := fs.Args()
+	for _, f := range filters {
+		if !strings.Contains(f, "=") {
+			return fmt.Errorf("filter \"%s\" must be in the form name=value", f)
+		}
+	}
+
+	conn, err := o.dial()
+	if err != nil {
+		return fmt.Errorf("error dialing: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+	defer cancel()
+	msg, err := conn.NewGetRequest("/.well-known/core")
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	for _, f := range filters {
+		msg.AddOption(coap.URIQuery, f)
+	}
+	response, err := conn.ExchangeWithContext(ctx, msg)
+	if err != nil {
+		return fmt.Errorf("error sending request: %v", err)
+	}
+	if !success(response.Code()) {
+		printResponse(o, response, response.Payload(), nil)
+		return fmt.Errorf("discovery failed with %s", codeString(response.Code()))
+	}
+	links, err := linkformat.Parse(string(response.Payload()))
+	if err != nil {
+		return err
+	}
+	links = linkformat.Filter(links, filters)
+
+	if o.json {
+		if links == nil {
+			links = []linkformat.Link{}
+		}
+		return json.NewEncoder(os.Stdout).Encode(links)
+	}
+	for _, l := range links {
+		params := make([]string, len(l.Params))
+		for i, p := range l.Params {
+			params[i] = p.Name
+			if p.Value != "" {
+				params[i] += "=" + p.Value
+			}
+		}
+		fmt.Printf("%-30s %s\n", l.Target, strings.Join(params, " "))
+	}
+	return nil
+}
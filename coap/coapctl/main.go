@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// options are the global flags shared by every command
+type options struct {
+	transport   coaptransport.Transport
+	addr        string
+	timeout     time.Duration
+	json        bool
+	pskIdentity string
+	psk         string
+	cert        string
+	key         string
+	serverCert  string
+}
+
+// command is a coapctl subcommand
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(o *options, args []string) error
+}
+
+var commands = []command{
+	{"get", "get [flags] <path>", "Send a GET request", requestCommand("get", coap.GET)},
+	{"post", "post [flags] <path>", "Send a POST request", requestCommand("post", coap.POST)},
+	{"put", "put [flags] <path>", "Send a PUT request", requestCommand("put", coap.PUT)},
+	{"delete", "delete [flags] <path>", "Send a DELETE request", requestCommand("delete", coap.DELETE)},
+	{"observe", "observe [flags] <path>", "Observe a resource and print every notification", observeCommand},
+	{"discover", "discover [flags] [filter...]", "List the resources in /.well-known/core, filtered by name=value", discoverCommand},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: coapctl [flags] <command> [command flags] [args]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-30s %s\n", c.usage, c.summary)
+	}
+	fmt.Fprintf(out, "\nRun coapctl <command> -h for the command flags.\n\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// loadCredentials creates the client credentials required by the transport
+func (o *options) loadCredentials() (*coaptransport.Credentials, error) {
+	creds := new(coaptransport.Credentials)
+	var err error
+	switch o.transport {
+	case coaptransport.TLS:
+		creds.TLS, err = coaptransport.ClientTLSConfig(o.cert, o.key, o.serverCert)
+	case coaptransport.DTLS:
+		creds.DTLS, err = coaptransport.ClientPSKConfig(o.pskIdentity, []byte(o.psk))
+	}
+	return creds, err
+}
+
+// dial connects to the server
+func (o *options) dial() (*coap.ClientConn, error) {
+	creds, err := o.loadCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load credentials: %v", err)
+	}
+	return coaptransport.Dial(o.transport, o.addr, creds)
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("coapctl: ")
+	flag.Usage = usage
+
+	var o options
+	transport := flag.String("transport", "udp", "COAP transport: udp, tcp, tcp-tls, ws or udp-dtls")
+	flag.StringVar(&o.addr, "addr", "localhost:5688", "Address of the server")
+	flag.DurationVar(&o.timeout, "timeout", 5*time.Second, "Time to wait for each response")
+	flag.BoolVar(&o.json, "json", false, "Print one JSON object per response, for scripts")
+	flag.StringVar(&o.pskIdentity, "psk-identity", "client", "Identity of the pre-shared key")
+	flag.StringVar(&o.psk, "psk", "", "Pre-shared key, required by udp-dtls")
+	flag.StringVar(&o.cert, "cert", "testdata/client-cert.pem", "Client certificate, for tcp-tls")
+	flag.StringVar(&o.key, "key", "testdata/client-key.pem", "Client key, for tcp-tls")
+	flag.StringVar(&o.serverCert, "server-cert", "testdata/server-cert.pem", "Trusted server certificate, for tcp-tls")
+	flag.Parse()
+
+	var err error
+	if o.transport, err = coaptransport.ParseTransport(*transport); err != nil {
+		log.Fatal(err)
+	}
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	name := strings.ToLower(flag.Arg(0))
+	for _, c := range commands {
+		if c.name == name {
+			err := c.run(&o, flag.Args()[1:])
+			if err == flag.ErrHelp {
+				os.Exit(2)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	log.Printf("unknown command \"%s\"", name)
+	usage()
+	os.Exit(2)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	flynn "github.com/flynn/noise"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaplimit"
+	"github.com/limaechocharlie/cwb/shared/noise"
+)
+
+// session encrypts a request payload and decrypts the matching response payload
+type session interface {
+	seal(payload []byte) ([]byte, error)
+	open(payload []byte) ([]byte, error)
+}
+
+// newSession establishes a Noise session with the server using the pattern, nn or nk
+func newSession(ctx context.Context, conn *coap.ClientConn, pattern string) (session, error) {
+	var s session
+	var err error
+	switch pattern {
+	case "":
+		return nil, nil
+	case "nn":
+		s, err = newNNSession(ctx, conn)
+	case "nk":
+		s, err = newNKSession(ctx, conn)
+	default:
+		return nil, fmt.Errorf("unknown noise pattern \"%s\", expected nn or nk", pattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// coapClientMessenger satisfies the ClientMessenger in the noise wrapper library
+type coapClientMessenger struct {
+	ctx  context.Context
+	conn *coap.ClientConn
+}
+
+// Exchange posts the handshake message, answering the Echo challenge of the server
+func (c coapClientMessenger) Exchange(message []byte) ([]byte, error) {
+	reply, err := coaplimit.ExchangeWithEcho(c.ctx, c.conn, func() (coap.Message, error) {
+		return c.conn.NewPostRequest("/handshake", coap.TextPlain, bytes.NewReader(message))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reply.Code() != coap.Changed {
+		return nil, fmt.Errorf("unexpected handshake response: %s", codeString(reply.Code()))
+	}
+	return reply.Payload(), nil
+}
+
+// nnSession talks to the noise-nn server
+// The handshake is made with /handshake and every request carries the channel ID alongside the encrypted payload.
+type nnSession struct {
+	channelID noise.ChannelID
+	csPair    noise.CipherStatePair
+}
+
+func newNNSession(ctx context.Context, conn *coap.ClientConn) (*nnSession, error) {
+	channelID, csPair, err := noise.ClientHandshake(coapClientMessenger{ctx, conn})
+	if err != nil {
+		return nil, fmt.Errorf("noise handshake failed: %v", err)
+	}
+	return &nnSession{channelID: channelID, csPair: csPair}, nil
+}
+
+func (s *nnSession) seal(payload []byte) ([]byte, error) {
+	return json.Marshal(struct {
+		ChannelID noise.ChannelID
+		Payload   []byte
+	}{s.channelID, s.csPair.Encrypter.Encrypt(nil, nil, payload)})
+}
+
+func (s *nnSession) open(payload []byte) ([]byte, error) {
+	return s.csPair.Decrypter.Decrypt(nil, nil, payload)
+}
+
+// nkSession talks to the noise-nk server
+// The server key is fetched from /key and the request and response are carried by the two handshake messages.
+type nkSession struct {
+	hs *flynn.HandshakeState
+}
+
+func newNKSession(ctx context.Context, conn *coap.ClientConn) (*nkSession, error) {
+	key, err := conn.GetWithContext(ctx, "/key")
+	if err != nil {
+		return nil, fmt.Errorf("cannot get server key: %v", err)
+	}
+	if key.Code() != coap.Content {
+		return nil, fmt.Errorf("unexpected key response: %s", codeString(key.Code()))
+	}
+	hs, err := flynn.NewHandshakeState(flynn.Config{
+		CipherSuite: flynn.NewCipherSuite(flynn.DH25519, flynn.CipherAESGCM, flynn.HashSHA256),
+		Random:      rand.Reader,
+		Pattern:     flynn.HandshakeNK,
+		Initiator:   true,
+		PeerStatic:  key.Payload(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &nkSession{hs: hs}, nil
+}
+
+func (s *nkSession) seal(payload []byte) ([]byte, error) {
+	msg, _, _, err := s.hs.WriteMessage(nil, payload)
+	return msg, err
+}
+
+func (s *nkSession) open(payload []byte) ([]byte, error) {
+	msg, _, _, err := s.hs.ReadMessage(nil, payload)
+	return msg, err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// observeCommand registers interest in a resource and prints every notification until it is interrupted, the
+// duration has passed or the count has been reached
+func observeCommand(o *options, args []string) error {
+	fs := flag.NewFlagSet("observe", flag.ContinueOnError)
+	var rf requestFlags
+	rf.register(fs)
+	count := fs.Int("count", 0, "Stop after this many notifications, 0 to observe until interrupted")
+	duration := fs.Duration("duration", 0, "Stop after this long, 0 to observe until interrupted")
+	path, err := parsePath(fs, &rf, args)
+	if err != nil {
+		return err
+	}
+
+	conn, err := o.dial()
+	if err != nil {
+		return fmt.Errorf("error dialing: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	var mutex sync.Mutex
+	var received int
+	var failure error
+	handler := func(req *coap.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		sequence := req.Sequence
+		if err := printResponse(o, req.Msg, req.Msg.Payload(), &sequence); err != nil {
+			log.Printf("Cannot print notification: %v", err)
+		}
+		received++
+		switch {
+		case !success(req.Msg.Code()):
+			failure = fmt.Errorf("observation ended with %s", codeString(req.Msg.Code()))
+			cancel()
+		case *count > 0 && received >= *count:
+			cancel()
+		}
+	}
+
+	registerCtx, registerCancel := context.WithTimeout(ctx, o.timeout)
+	defer registerCancel()
+	obs, err := conn.ObserveWithContext(registerCtx, path, handler, rf.apply)
+	if err != nil {
+		return fmt.Errorf("cannot observe %s: %v", path, err)
+	}
+
+	select {
+	case <-signals:
+	case <-ctx.Done():
+	}
+	cancelCtx, cancelCancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancelCancel()
+	if err := obs.CancelWithContext(cancelCtx); err != nil {
+		log.Printf("Cannot cancel observation: %v", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	return failure
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/endpoint"
+	"github.com/limaechocharlie/cwb/shared/senml"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// formats names the content formats that can be chosen on the command line
+var formats = map[string]coap.MediaType{
+	"text":        coap.TextPlain,
+	"link-format": coap.AppLinkFormat,
+	"octets":      coap.AppOctets,
+	"json":        coap.AppJSON,
+	"cbor":        coap.AppCBOR,
+	"senml+json":  senml.JSONFormat,
+	"senml+cbor":  senml.CBORFormat,
+	"msgpack":     coap.MediaType(65000),
+}
+
+// parseFormat converts a content format name or number into a media type
+func parseFormat(s string) (coap.MediaType, error) {
+	if mt, ok := formats[strings.ToLower(s)]; ok {
+		return mt, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		names := make([]string, 0, len(formats))
+		for name := range formats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return 0, fmt.Errorf("unknown content format \"%s\", expected a number or one of %s", s, strings.Join(names, ", "))
+	}
+	return coap.MediaType(n), nil
+}
+
+// formatName names the media type, falling back to its number
+func formatName(mt coap.MediaType) string {
+	for name, f := range formats {
+		if f == mt {
+			return name
+		}
+	}
+	return strconv.Itoa(int(mt))
+}
+
+// codecByFormat finds the endpoint codec for a content format
+// SenML is handled by the senml package instead, since a pack decodes into records rather than a struct.
+func codecByFormat(mt coap.MediaType) *endpoint.Codec {
+	if mt == senml.JSONFormat || mt == senml.CBORFormat {
+		return nil
+	}
+	for _, c := range endpoint.Codecs {
+		if c.Format == mt {
+			return c
+		}
+	}
+	return nil
+}
+
+// encodePayload converts the payload typed on the command line into the content format
+// Text is sent as is unless the format is a binary representation known to the endpoint package, in which case the
+// payload is read as JSON and transcoded. SenML CBOR is written as SenML JSON.
+func encodePayload(mt coap.MediaType, data []byte) ([]byte, error) {
+	if mt == senml.CBORFormat {
+		pack, err := senml.DecodeJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("payload for content format %s must be written as SenML JSON: %v", formatName(mt), err)
+		}
+		return senml.EncodeCBOR(pack)
+	}
+	c := codecByFormat(mt)
+	if c == nil || c == endpoint.JSON {
+		return data, nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("payload for content format %s must be written as JSON: %v", formatName(mt), err)
+	}
+	return c.Marshal(v)
+}
+
+// decodePayload converts the payload into a value that can be written as JSON
+// Payloads in a representation known to the endpoint package are decoded, SenML is written as SenML JSON, text is
+// returned as a string and anything else as bytes.
+func decodePayload(mt coap.MediaType, hasFormat bool, payload []byte) interface{} {
+	if len(payload) == 0 {
+		return nil
+	}
+	if hasFormat && (mt == senml.JSONFormat || mt == senml.CBORFormat) {
+		if pack, err := senml.Decode(mt, payload); err == nil {
+			if b, err := senml.EncodeJSON(pack); err == nil {
+				return json.RawMessage(b)
+			}
+		}
+	}
+	if c := codecByFormat(mt); hasFormat && c != nil {
+		var v interface{}
+		if err := c.Unmarshal(payload, &v); err == nil {
+			return jsonable(v)
+		}
+	}
+	if !hasFormat || mt == coap.TextPlain || mt == coap.AppLinkFormat {
+		return string(payload)
+	}
+	return payload
+}
+
+// jsonable converts the maps produced by the binary decoders, which may have keys of any type, into JSON objects
+func jsonable(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = jsonable(e)
+		}
+		return m
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonable(e)
+		}
+		return v
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonable(e)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// codeString writes the response code in the dotted form used by the spec, e.g. 2.05 Content
+func codeString(code coap.COAPCode) string {
+	return fmt.Sprintf("%d.%02d %s", code>>5, code&0x1f, code)
+}
+
+// success reports whether the response code is in the 2.xx class
+func success(code coap.COAPCode) bool {
+	return code>>5 == 2
+}
+
+// result is the JSON output for a single response
+type result struct {
+	Code    string      `json:"code"`
+	Format  *uint16     `json:"format,omitempty"`
+	Observe *uint64     `json:"observe,omitempty"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// printResponse writes the response to stdout
+// The code goes to stderr in human readable mode so that the payload can be piped on its own.
+func printResponse(o *options, msg coap.Message, payload []byte, observe *uint64) error {
+	mt, hasFormat := msg.Option(coap.ContentFormat).(coap.MediaType)
+	value := decodePayload(mt, hasFormat, payload)
+	if o.json {
+		r := result{Code: codeString(msg.Code()), Observe: observe, Payload: value}
+		if hasFormat {
+			f := uint16(mt)
+			r.Format = &f
+		}
+		return json.NewEncoder(os.Stdout).Encode(r)
+	}
+
+	header := codeString(msg.Code())
+	if hasFormat {
+		header += " (" + formatName(mt) + ")"
+	}
+	if observe != nil {
+		header = fmt.Sprintf("[%d] %s", *observe, header)
+	}
+	fmt.Fprintln(os.Stderr, header)
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		_, err := fmt.Println(v)
+		return err
+	case []byte:
+		_, err := fmt.Printf("%x\n", v)
+		return err
+	default:
+		b, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Println(string(b))
+		return err
+	}
+}
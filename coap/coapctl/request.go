@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// queryFlag collects repeated -query flags
+type queryFlag []string
+
+func (q *queryFlag) String() string {
+	return strings.Join(*q, "&")
+}
+
+func (q *queryFlag) Set(s string) error {
+	*q = append(*q, s)
+	return nil
+}
+
+// requestFlags are the flags that shape a request
+type requestFlags struct {
+	query  queryFlag
+	accept string
+	format *coap.MediaType
+}
+
+func (f *requestFlags) register(fs *flag.FlagSet) {
+	fs.Var(&f.query, "query", "Uri-Query option as key=value, may be repeated")
+	fs.StringVar(&f.accept, "accept", "", "Content format to ask for, by name or number")
+}
+
+// parse parses the flags and checks the values
+func (f *requestFlags) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if f.accept != "" {
+		mt, err := parseFormat(f.accept)
+		if err != nil {
+			return err
+		}
+		f.format = &mt
+	}
+	return nil
+}
+
+// apply adds the options to the message
+func (f *requestFlags) apply(msg coap.Message) {
+	for _, q := range f.query {
+		msg.AddOption(coap.URIQuery, q)
+	}
+	if f.format != nil {
+		msg.SetOption(coap.Accept, *f.format)
+	}
+}
+
+// parsePath parses the flags and returns the single path argument
+func parsePath(fs *flag.FlagSet, rf *requestFlags, args []string) (string, error) {
+	if err := rf.parse(fs, args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return "", errors.New("expected a single path")
+	}
+	path := fs.Arg(0)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path, nil
+}
+
+// readData reads the payload from the flag value; @file reads a file and - reads stdin
+func readData(data string) ([]byte, error) {
+	switch {
+	case data == "-":
+		return ioutil.ReadAll(os.Stdin)
+	case strings.HasPrefix(data, "@"):
+		return ioutil.ReadFile(strings.TrimPrefix(data, "@"))
+	default:
+		return []byte(data), nil
+	}
+}
+
+// newRequest creates a request with the method
+func newRequest(conn *coap.ClientConn, code coap.COAPCode, path string, format coap.MediaType, payload []byte) (coap.Message, error) {
+	switch code {
+	case coap.GET:
+		return conn.NewGetRequest(path)
+	case coap.POST:
+		return conn.NewPostRequest(path, format, bytes.NewReader(payload))
+	case coap.PUT:
+		return conn.NewPutRequest(path, format, bytes.NewReader(payload))
+	case coap.DELETE:
+		return conn.NewDeleteRequest(path)
+	default:
+		return nil, fmt.Errorf("unsupported method %s", code)
+	}
+}
+
+// requestCommand sends a single request with the method and prints the response
+func requestCommand(name string, code coap.COAPCode) func(o *options, args []string) error {
+	return func(o *options, args []string) error {
+		fs := flag.NewFlagSet(name, flag.ContinueOnError)
+		var rf requestFlags
+		rf.register(fs)
+		format := fs.String("format", "text", "Content format of the payload, by name or number; binary formats are written as JSON")
+		data := fs.String("data", "", "Payload, @file to read a file or - to read stdin")
+		noisePattern := fs.String("noise", "", "Encrypt the payload in a Noise session with the noise-nn or noise-nk server: nn or nk")
+		path, err := parsePath(fs, &rf, args)
+		if err != nil {
+			return err
+		}
+		if (code == coap.GET || code == coap.DELETE) && *data != "" {
+			return fmt.Errorf("%s requests don't carry a payload", name)
+		}
+		if code != coap.POST && *noisePattern != "" {
+			return errors.New("the noise servers only accept POST requests")
+		}
+
+		mt, err := parseFormat(*format)
+		if err != nil {
+			return err
+		}
+		payload, err := readData(*data)
+		if err != nil {
+			return err
+		}
+		if payload, err = encodePayload(mt, payload); err != nil {
+			return err
+		}
+
+		conn, err := o.dial()
+		if err != nil {
+			return fmt.Errorf("error dialing: %v", err)
+		}
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), o.timeout)
+		defer cancel()
+		s, err := newSession(ctx, conn, *noisePattern)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			if payload, err = s.seal(payload); err != nil {
+				return err
+			}
+		}
+
+		msg, err := newRequest(conn, code, path, mt, payload)
+		if err != nil {
+			return fmt.Errorf("error creating request: %v", err)
+		}
+		rf.apply(msg)
+		response, err := conn.ExchangeWithContext(ctx, msg)
+		if err != nil {
+			return fmt.Errorf("error sending request: %v", err)
+		}
+
+		payload = response.Payload()
+		if s != nil && success(response.Code()) {
+			if payload, err = s.open(payload); err != nil {
+				return fmt.Errorf("cannot decrypt response: %v", err)
+			}
+		}
+		if err := printResponse(o, response, payload, nil); err != nil {
+			return err
+		}
+		if !success(response.Code()) {
+			return fmt.Errorf("request failed with %s", codeString(response.Code()))
+		}
+		return nil
+	}
+}
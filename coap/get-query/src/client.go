@@ -2,15 +2,46 @@ package main
 
 import (
 	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
 	"log"
 	"os"
 	"bufio"
 	"time"
 	"context"
+	"flag"
 )
 
+// loadCredentials creates the client credentials required by the transport
+func loadCredentials(transport coaptransport.Transport, pskIdentity, psk string) (*coaptransport.Credentials, error) {
+	creds := new(coaptransport.Credentials)
+	var err error
+	switch transport {
+	case coaptransport.TLS:
+		creds.TLS, err = coaptransport.ClientTLSConfig("testdata/client-cert.pem", "testdata/client-key.pem", "testdata/server-cert.pem")
+	case coaptransport.DTLS:
+		creds.DTLS, err = coaptransport.ClientPSKConfig(pskIdentity, []byte(psk))
+	}
+	return creds, err
+}
+
 func main() {
-	clientConn, err := coap.Dial("udp", "localhost:5688")
+	transportFlag := flag.String("transport", "udp", "COAP transport: udp, tcp, tcp-tls, ws or udp-dtls")
+	addr := flag.String("addr", "localhost:5688", "Address of the server")
+	pskIdentity := flag.String("psk-identity", "client", "Identity of the pre-shared key")
+	psk := flag.String("psk", "", "Pre-shared key, required by udp-dtls")
+	mode := flag.String("mode", "graphemes", "What to reverse: words, runes or graphemes")
+	flag.Parse()
+
+	transport, err := coaptransport.ParseTransport(*transportFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	creds, err := loadCredentials(transport, *pskIdentity, *psk)
+	if err != nil {
+		log.Fatalf("failed to load credentials: %v", err)
+	}
+
+	clientConn, err := coaptransport.Dial(transport, *addr, creds)
 	if err != nil {
 		log.Fatalf("Error dialing: %v", err)
 	}
@@ -33,7 +64,8 @@ func main() {
 			continue
 		}
 		log.Printf("Sending: \"%s\"", scanner.Text())
-		message.SetQueryString(scanner.Text())
+		message.AddOption(coap.URIQuery, "text="+scanner.Text())
+		message.AddOption(coap.URIQuery, "mode="+*mode)
 
 		response, err := clientConn.ExchangeWithContext(ctx, message)
 		if err != nil {
@@ -43,7 +75,7 @@ func main() {
 		if response.Code() == coap.Content {
 			log.Printf("Received: \"%s\"", string(response.Payload()))
 		} else {
-			log.Printf("Unexpected code: \"%s\"", response.Code())
+			log.Printf("Unexpected code: \"%s\" %s", response.Code(), response.Payload())
 		}
 	}
 
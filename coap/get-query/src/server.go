@@ -2,26 +2,39 @@ package main
 
 import (
 	"context"
+	"flag"
 	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaplimit"
+	"github.com/limaechocharlie/cwb/shared/coapquery"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
+	"github.com/limaechocharlie/cwb/shared/transform"
 	"log"
 	"time"
 )
 
+// reverseQuery is the query of a reverse request
+type reverseQuery struct {
+	Text string `query:"text" validate:"required"`
+	Mode string `query:"mode" default:"graphemes" validate:"oneof=words runes graphemes"`
+}
+
+// operations maps the modes to the transformations that reverse by that unit
+var operations = map[string]transform.Operation{
+	"words":     transform.ReverseWords,
+	"runes":     transform.ReverseRunes,
+	"graphemes": transform.Reverse,
+}
+
 func reverseHandler(w coap.ResponseWriter, req *coap.Request) {
-	// get query
-	query := req.Msg.Query()
-	if len(query) == 0 {
-		w.SetCode(coap.BadRequest)
+	// bind query
+	var query reverseQuery
+	if err := coapquery.Bind(req.Msg, &query); err != nil {
+		coapquery.WriteError(w, req, err)
 		return
 	}
-	log.Printf("Received \"%s\"", query[0])
+	log.Printf("Received \"%s\" to reverse by %s", query.Text, query.Mode)
 
-	// reverse first query
-	runes := []rune(query[0])
-	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
-		runes[i], runes[j] = runes[j], runes[i]
-	}
-	reply := string(runes)
+	reply := operations[query.Mode](query.Text)
 
 	// send response
 	log.Printf("Replying \"%s\"", reply)
@@ -33,10 +46,40 @@ func reverseHandler(w coap.ResponseWriter, req *coap.Request) {
 	}
 }
 
+// loadCredentials creates the server credentials required by the transport
+func loadCredentials(transport coaptransport.Transport, pskIdentity, psk string) (*coaptransport.Credentials, error) {
+	creds := new(coaptransport.Credentials)
+	var err error
+	switch transport {
+	case coaptransport.TLS:
+		creds.TLS, err = coaptransport.ServerTLSConfig("testdata/server-cert.pem", "testdata/server-key.pem", "testdata/client-cert.pem")
+	case coaptransport.DTLS:
+		creds.DTLS, err = coaptransport.ServerPSKConfig(map[string][]byte{pskIdentity: []byte(psk)})
+	}
+	return creds, err
+}
+
 func main() {
+	transportFlag := flag.String("transport", "udp", "COAP transport: udp, tcp, tcp-tls, ws or udp-dtls")
+	addr := flag.String("addr", ":5688", "Address to listen to")
+	pskIdentity := flag.String("psk-identity", "client", "Identity of the client pre-shared key")
+	psk := flag.String("psk", "", "Client pre-shared key, required by udp-dtls")
+	rate := flag.Float64("rate", 10, "Requests per second allowed from each peer")
+	burst := flag.Int("burst", 20, "Requests allowed at once from each peer")
+	flag.Parse()
+
+	transport, err := coaptransport.ParseTransport(*transportFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	creds, err := loadCredentials(transport, *pskIdentity, *psk)
+	if err != nil {
+		log.Fatalf("failed to load credentials: %v", err)
+	}
+
 	mux := coap.NewServeMux()
 	mux.Handle("/reverse", coap.HandlerFunc(reverseHandler))
-	log.Println("Starting COAP server...")
+	log.Printf("Starting COAP server over %s...", transport)
 
-	log.Fatal(coap.ListenAndServe("udp", ":5688", mux))
+	log.Fatal(coaptransport.ListenAndServe(transport, *addr, creds, coaplimit.NewLimiter(*rate, *burst).Limit(mux)))
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"github.com/limaechocharlie/cwb/shared/netsim"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	target := flag.String("target", "localhost:5688", "Address of the UDP server")
+	seed := flag.Int64("seed", 1, "Seed of the simulated network, the same seed gives every packet the same fate")
+	var c netsim.Conditions
+	flag.Float64Var(&c.Loss, "loss", 0, "Probability that a packet is dropped")
+	flag.Float64Var(&c.Duplicate, "duplicate", 0, "Probability that a packet is delivered twice")
+	flag.Float64Var(&c.Reorder, "reorder", 0, "Probability that a packet is delivered after the next one")
+	flag.DurationVar(&c.Delay, "delay", 0, "Time taken to cross the network")
+	flag.DurationVar(&c.Jitter, "jitter", 0, "Maximum extra delay")
+	flag.Parse()
+
+	network := netsim.NewNetwork(*seed, c)
+	relay, err := network.Relay(*target)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Relaying %s to %s with %+v", relay.Addr(), *target, c)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	relay.Close()
+	log.Printf("Packets: %+v", network.Stats())
+}
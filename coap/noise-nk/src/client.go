@@ -10,10 +10,20 @@ import (
 	"crypto/rand"
 	"time"
 	"bytes"
+	"flag"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
 )
 
 func main() {
-	clientConn, err := coap.Dial("udp", "localhost:5688")
+	transportFlag := flag.String("transport", "udp", "COAP transport: udp, tcp or ws")
+	addr := flag.String("addr", "localhost:5688", "Address of the server")
+	flag.Parse()
+
+	transport, err := coaptransport.ParseTransport(*transportFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientConn, err := coaptransport.Dial(transport, *addr, nil)
 	if err != nil {
 		log.Fatalf("Error dialing: %v", err)
 	}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"context"
+	"flag"
 	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaplimit"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
 	"log"
 	"time"
 	"crypto/rand"
 	"github.com/flynn/noise"
+	"github.com/limaechocharlie/cwb/shared/transform"
 )
 
 // handle requests for the public key of the server
@@ -48,9 +52,7 @@ func reverseHandler(cs noise.CipherSuite, staticKey noise.DHKey) coap.HandlerFun
 			log.Fatal(err)
 		}
 		log.Printf("Received %q, decrypted \"%s\"", string(payload), string(message))
-		for i, j := 0, len(message)-1; i < j; i, j = i+1, j-1 {
-			message[i], message[j] = message[j], message[i]
-		}
+		message = transform.ReverseBytes(message)
 		reply, _, _, err := hs.WriteMessage(nil, message)
 		if err != nil {
 			log.Fatal(err)
@@ -67,6 +69,17 @@ func reverseHandler(cs noise.CipherSuite, staticKey noise.DHKey) coap.HandlerFun
 }
 
 func main() {
+	transportFlag := flag.String("transport", "udp", "COAP transport: udp, tcp or ws")
+	addr := flag.String("addr", ":5688", "Address to listen to")
+	rate := flag.Float64("rate", 10, "Requests per second allowed from each peer")
+	burst := flag.Int("burst", 20, "Requests allowed at once from each peer")
+	flag.Parse()
+
+	transport, err := coaptransport.ParseTransport(*transportFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
 	staticKey, err := cs.GenerateKeypair(rand.Reader)
 	if err != nil {
@@ -75,7 +88,7 @@ func main() {
 	mux := coap.NewServeMux()
 	mux.Handle("/key", keyHandler(staticKey.Public))
 	mux.Handle("/reverse", reverseHandler(cs, staticKey))
-	log.Println("Starting COAP server...")
+	log.Printf("Starting COAP server over %s...", transport)
 
-	log.Fatal(coap.ListenAndServe("udp", ":5688", mux))
+	log.Fatal(coaptransport.ListenAndServe(transport, *addr, nil, coaplimit.NewLimiter(*rate, *burst).Limit(mux)))
 }
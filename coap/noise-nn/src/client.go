@@ -5,8 +5,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaplimit"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
 	"github.com/limaechocharlie/cwb/shared/noise"
 	"log"
 	"os"
@@ -19,8 +22,16 @@ type coapClientMessenger struct {
 	token      []byte // hold the token used during the handshake
 }
 
+// Exchange posts the handshake message, answering the Echo challenge of the server
 func (c *coapClientMessenger) Exchange(message []byte) (reply []byte, err error) {
-	replyMessage, err := c.clientConn.Post("/handshake", coap.TextPlain, bytes.NewReader(message))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	replyMessage, err := coaplimit.ExchangeWithEcho(ctx, c.clientConn, func() (coap.Message, error) {
+		return c.clientConn.NewPostRequest("/handshake", coap.TextPlain, bytes.NewReader(message))
+	})
+	if err != nil {
+		return nil, err
+	}
 	if replyMessage.Code() != coap.Changed {
 		err = fmt.Errorf("unexpected status response: %s", replyMessage.Code())
 	}
@@ -39,7 +50,15 @@ type reverseRequest struct {
 }
 
 func main() {
-	clientConn, err := coap.Dial("udp", "localhost:5688")
+	transportFlag := flag.String("transport", "udp", "COAP transport: udp, tcp or ws")
+	addr := flag.String("addr", "localhost:5688", "Address of the server")
+	flag.Parse()
+
+	transport, err := coaptransport.ParseTransport(*transportFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clientConn, err := coaptransport.Dial(transport, *addr, nil)
 	if err != nil {
 		log.Fatalf("Error dialing: %v", err)
 	}
@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaplimit"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
 	"github.com/limaechocharlie/cwb/shared/noise"
+	"github.com/limaechocharlie/cwb/shared/transform"
 	"log"
 	"time"
 )
@@ -83,10 +87,7 @@ func reverseHandler(ciphers clientCiphers) coap.HandlerFunc {
 		}
 		log.Printf("Received %q, decrypted \"%s\"", inbound.Payload, string(msg))
 
-		// reverse first query
-		for i, j := 0, len(msg)-1; i < j; i, j = i+1, j-1 {
-			msg[i], msg[j] = msg[j], msg[i]
-		}
+		msg = transform.ReverseBytes(msg)
 
 		// encrypt response
 		encryptedReply := csPair.Encrypter.Encrypt(nil, nil, msg)
@@ -103,11 +104,28 @@ func reverseHandler(ciphers clientCiphers) coap.HandlerFunc {
 }
 
 func main() {
+	transportFlag := flag.String("transport", "udp", "COAP transport: udp, tcp or ws")
+	addr := flag.String("addr", ":5688", "Address to listen to")
+	rate := flag.Float64("rate", 10, "Requests per second allowed from each peer")
+	burst := flag.Int("burst", 20, "Requests allowed at once from each peer")
+	freshness := flag.Duration("echo-freshness", 30*time.Second, "How long an Echo challenge can be answered for")
+	flag.Parse()
+
+	transport, err := coaptransport.ParseTransport(*transportFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// the handshake does a Diffie-Hellman exchange, so only peers that have answered a challenge get one
+	challenge, err := coaplimit.NewChallenge(*freshness)
+	if err != nil {
+		log.Fatal(err)
+	}
 	ciphers := make(clientCiphers)
 	mux := coap.NewServeMux()
-	mux.Handle("/handshake", handshakeHandler(ciphers))
+	mux.Handle("/handshake", challenge.Require(handshakeHandler(ciphers)))
 	mux.Handle("/reverse", reverseHandler(ciphers))
-	log.Println("Starting COAP server...")
+	log.Printf("Starting COAP server over %s...", transport)
 
-	log.Fatal(coap.ListenAndServe("udp", ":5688", mux))
+	log.Fatal(coaptransport.ListenAndServe(transport, *addr, nil, coaplimit.NewLimiter(*rate, *burst).Limit(mux), challenge.Conn))
 }
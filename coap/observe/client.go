@@ -7,34 +7,29 @@ import (
 	"fmt"
 	"context"
 	"bufio"
+	"flag"
 	"os"
-	"math"
+	"github.com/limaechocharlie/cwb/shared/coapobserve"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
 )
 
-var twentyFourBitLimit = uint64(math.Pow(2, 23))
-
-// checks whether the new observe value from the server is truly newer than the old one
-// see reordering in spec
-func newerMessage(oldValue, newValue uint64) bool {
-	return ((oldValue < newValue) && (newValue-oldValue) < twentyFourBitLimit) ||
-	((oldValue > newValue) && (oldValue-newValue > twentyFourBitLimit))
-	//|| (T2 > T1 + 128 seconds)
-}
-
 // observes the resource at the given path
 // exits if the context has been cancelled or the held representation has become too old
 // see freshness in spec
 func observe(ctx context.Context, co *coap.ClientConn, path string, defaultMaxAge time.Duration)  {
-	var prevSequence uint64 = 0
+	var prevSequence uint32
+	received := false
 	t := time.NewTimer(defaultMaxAge)
 	obs, err := co.Observe(path, func(req *coap.Request) {
-		// check whether the current message is newer than the one received previously
-		if !newerMessage(prevSequence, req.Sequence) {
-			log.Println("Ignoring stale message")
-			fmt.Println(prevSequence, req.Sequence)
-			return
+		// check whether the current message is newer than the one received previously, by its Observe option
+		if sequence, ok := req.Msg.Option(coap.Observe).(uint32); ok {
+			if received && !coapobserve.Newer(prevSequence, sequence) {
+				log.Println("Ignoring stale message")
+				fmt.Println(prevSequence, sequence)
+				return
+			}
+			prevSequence, received = sequence, true
 		}
-		prevSequence = req.Sequence
 
 		// get max age from message, if it has been set, and use the value to reset the timer
 		if maxAge, ok := req.Msg.Option(coap.MaxAge).(uint32); ok {
@@ -56,10 +51,16 @@ func observe(ctx context.Context, co *coap.ClientConn, path string, defaultMaxAg
 }
 
 func main() {
+	transportFlag := flag.String("transport", "udp", "COAP transport: udp, tcp or ws")
+	addr := flag.String("addr", "localhost:5688", "Address of the server, e.g. a lossy relay in front of it")
+	flag.Parse()
 	path := "/device/config"
-	client := &coap.Client{}
 
-	co, err := client.Dial("localhost:5688")
+	transport, err := coaptransport.ParseTransport(*transportFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	co, err := coaptransport.Dial(transport, *addr, nil)
 	if err != nil {
 		log.Fatalf("Error dialing: %v", err)
 	}
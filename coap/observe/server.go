@@ -1,31 +1,168 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"net"
+	"sync"
 	"time"
 
 	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaplimit"
+	"github.com/limaechocharlie/cwb/shared/coaprd"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
+	"github.com/limaechocharlie/cwb/shared/linkformat"
+	"github.com/limaechocharlie/cwb/shared/senml"
+	"math"
 	"math/rand"
 	"context"
 )
 
 var observers = make(map[string]context.CancelFunc)
 
-// send a single response with the server uptime in the payload
-func sendResponse(w coap.ResponseWriter, req *coap.Request, startTime time.Time) error {
+// schemes are the URI schemes of the transports that don't need credentials, advertised to the resource directory
+var schemes = map[coaptransport.Transport]string{
+	coaptransport.UDP:       "coap",
+	coaptransport.TCP:       "coap+tcp",
+	coaptransport.WebSocket: "coap+ws",
+}
+
+// paces the notifications to each observer to the NSTART and PROBING_RATE of RFC 7252
+var pacer = coaplimit.NewPacer()
+
+// waits for each notification to be acknowledged, so that the pacer holds its slot until then
+var acks = coaplimit.NewAcks()
+
+// representation returns the current state of a resource in a content format
+type representation func() (coap.MediaType, []byte)
+
+// uptime represents the server uptime as text
+func uptime(startTime time.Time) func(req *coap.Request) (representation, error) {
+	return func(req *coap.Request) (representation, error) {
+		return func() (coap.MediaType, []byte) {
+			return coap.TextPlain, []byte(fmt.Sprintf("uptime %v", time.Since(startTime)))
+		}, nil
+	}
+}
+
+// maxSamples is the number of sensor samples the device keeps
+const maxSamples = 15
+
+// sample is a reading of every sensor of the device
+type sample struct {
+	at          time.Time
+	temperature float64
+	humidity    float64
+	battery     float64
+}
+
+// telemetry simulates the sensors of the device, sampling them every second
+type telemetry struct {
+	name    string
+	mutex   sync.Mutex
+	samples []sample // oldest first
+}
+
+// samples the sensors until the context is cancelled, each reading drifting randomly from the previous one
+func (t *telemetry) run(ctx context.Context) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	s := sample{temperature: 21, humidity: 45, battery: 100}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		s.at = time.Now()
+		s.temperature += r.NormFloat64() * 0.1
+		s.humidity = math.Max(0, math.Min(100, s.humidity+r.NormFloat64()*0.5))
+		s.battery = math.Max(0, s.battery-0.01)
+		t.mutex.Lock()
+		t.samples = append(t.samples, s)
+		if len(t.samples) > maxSamples {
+			t.samples = t.samples[1:]
+		}
+		t.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pack holds the samples taken after the time, or the latest sample if there are none, as a SenML pack
+// Records share the base name of the device and are timed relative to the latest sample.
+func (t *telemetry) pack(since time.Time) (senml.Pack, time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(t.samples) == 0 {
+		return nil, since
+	}
+	i := len(t.samples) - 1
+	for i > 0 && t.samples[i-1].at.After(since) {
+		i--
+	}
+	latest := t.samples[len(t.samples)-1].at
+	baseTime := math.Round(float64(latest.UnixNano())/1e6) / 1e3
+	var p senml.Pack
+	for _, s := range t.samples[i:] {
+		offset := math.Round(s.at.Sub(latest).Seconds()*1e3) / 1e3
+		p = append(p,
+			senml.Record{Name: "temperature", Unit: "Cel", Value: senml.Float(math.Round(s.temperature*100) / 100), Time: offset},
+			senml.Record{Name: "humidity", Unit: "%RH", Value: senml.Float(math.Round(s.humidity*10) / 10), Time: offset},
+			senml.Record{Name: "battery", Unit: "%EL", Value: senml.Float(math.Round(s.battery*100) / 100), Time: offset},
+		)
+	}
+	p[0].BaseName = t.name + ":"
+	p[0].BaseTime = baseTime
+	return p, latest
+}
+
+// representation represents the samples as SenML, in JSON unless CBOR is accepted
+// Each observer gets the samples taken since its previous notification.
+func (t *telemetry) representation(req *coap.Request) (representation, error) {
+	format := senml.JSONFormat
+	if accept, ok := req.Msg.Option(coap.Accept).(coap.MediaType); ok {
+		if accept != senml.JSONFormat && accept != senml.CBORFormat {
+			return nil, fmt.Errorf("content format %d is not SenML", accept)
+		}
+		format = accept
+	}
+	var since time.Time
+	return func() (coap.MediaType, []byte) {
+		var p senml.Pack
+		p, since = t.pack(since)
+		payload, err := senml.Encode(format, p)
+		if err != nil {
+			log.Printf("Cannot encode telemetry: %v", err)
+		}
+		return format, payload
+	}, nil
+}
+
+// creates a response with the payload
+func newResponse(w coap.ResponseWriter, format coap.MediaType, payload []byte) coap.Message {
 	resp := w.NewResponse(coap.Content)
-	resp.SetOption(coap.ContentFormat, coap.TextPlain)
+	resp.SetOption(coap.ContentFormat, format)
 	resp.SetOption(coap.MaxAge, 10)
-	resp.SetPayload([]byte(fmt.Sprintf("uptime %v", time.Since(startTime))))
-	return w.WriteMsg(resp)
+	resp.SetPayload(payload)
+	return resp
+}
+
+// send a single response with the payload
+func sendResponse(w coap.ResponseWriter, format coap.MediaType, payload []byte) error {
+	return w.WriteMsg(newResponse(w, format, payload))
 }
 
 // repeatably transmits on the same channel with random time gaps between the responses
-func randomTransmitter(ctx context.Context, w coap.ResponseWriter, req *coap.Request, startTime time.Time) {
+// The first response answers the request, the following ones are confirmable notifications: the pacer holds the slot
+// of the observer until one is acknowledged, and skips a notification to an unresponsive observer, which gets the
+// state in the next one. A notification that is never acknowledged, or reset, ends the observation (RFC 7641 4.5).
+func randomTransmitter(ctx context.Context, w coap.ResponseWriter, req *coap.Request, represent representation) {
 	s1 := rand.NewSource(2)
 	r1 := rand.New(s1)
 	t := time.NewTimer(0)
+	first := true
 	for {
 		select {
 		case <-ctx.Done():
@@ -36,12 +173,23 @@ func randomTransmitter(ctx context.Context, w coap.ResponseWriter, req *coap.Req
 
 		case <- t.C:
 			// timer has fired, send a response
-			err := sendResponse(w, req, startTime)
-			if err != nil {
+			format, payload := represent()
+			err := pacer.Send(ctx, coaplimit.Peer(req), len(payload), func(ctx context.Context) error {
+				if first {
+					return sendResponse(w, format, payload)
+				}
+				return acks.SendConfirmable(ctx, w, req, newResponse(w, format, payload))
+			})
+			first = false
+			switch err {
+			case nil:
+				log.Printf("[%x] notification sent", string(req.Msg.Token()))
+			case coaplimit.ErrPaced:
+				log.Printf("[%x] notification skipped, observer is unresponsive", string(req.Msg.Token()))
+			default:
 				log.Printf("Error on transmitter, stopping: %v", err)
 				return
 			}
-			log.Printf("[%x] notification sent", string(req.Msg.Token()))
 			t.Reset(time.Second * time.Duration(r1.Intn(15)))
 		}
 	}
@@ -68,46 +216,117 @@ func observeAction(msg coap.Message)(register, ok bool){
 	}
 }
 
+// observable serves GET requests for a resource, notifying the observers that register with the observe option
+func observable(newRepresentation func(req *coap.Request) (representation, error)) coap.HandlerFunc {
+	return func(w coap.ResponseWriter, req *coap.Request) {
+		// only support GET requests
+		if req.Msg.Code() != coap.GET {
+			w.SetCode(coap.BadRequest)
+			return
+		}
+		strToken := string(req.Msg.Token())
+		log.Printf("[%x] received GET request", strToken)
+		represent, err := newRepresentation(req)
+		if err != nil {
+			log.Printf("[%x] %v", strToken, err)
+			w.SetCode(coap.NotAcceptable)
+			return
+		}
+
+		// switch behaviour on type of GET request
+		// GET, observe = register; register observer, start a random transmitter
+		// GET, observe = deregister; deregister observer, stop random transmitter, send one-off response
+		// GET, no observe option; send one-off response
+		registerObserver, observeRequest := observeAction(req.Msg)
+		switch {
+		case observeRequest && registerObserver:
+			// start random transmitter and add token to the observer list
+			log.Printf("[%x] register observer", strToken)
+			ctx, cancel := context.WithCancel(context.Background())
+			observers[strToken] = cancel
+			go randomTransmitter(ctx, w, req, represent)
+			return
+		case observeRequest && !registerObserver:
+			// cancel random the transmitter associated with the token and remove from observer list
+			if cancel, ok := observers[strToken]; ok {
+				log.Printf("[%x] unregister observer", strToken)
+				cancel()
+				delete(observers, strToken)
+			}
+		}
+		log.Printf("[%x] sending one-off response", strToken)
+		format, payload := represent()
+		if err := sendResponse(w, format, payload); err != nil {
+			log.Printf("[%x] error on transmitter: %v", strToken, err)
+		}
+	}
+}
+
+// registerWithDirectory keeps the device registered with the resource directory at the address
+// The directory is reached over UDP, the base advertises the scheme of the transport the device serves.
+func registerWithDirectory(rdAddr, endpoint, scheme, port string, lifetime time.Duration) {
+	conn, err := coap.Dial("udp", rdAddr)
+	if err != nil {
+		log.Printf("Cannot reach resource directory: %v", err)
+		return
+	}
+	// advertise the address the directory can reach this device on
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		log.Printf("Cannot find local address: %v", err)
+		return
+	}
+	client := &coaprd.Client{
+		Conn:     conn,
+		Endpoint: endpoint,
+		Base:     scheme + "://" + net.JoinHostPort(host, port),
+		Lifetime: lifetime,
+		Links: []linkformat.Link{{Target: "/device/config", Params: []linkformat.Param{
+			{Name: "rt", Value: "device.config"},
+			{Name: "ct", Value: "0"},
+			{Name: "obs"},
+		}}, {Target: "/device/telemetry", Params: []linkformat.Param{
+			{Name: "rt", Value: "device.telemetry"},
+			{Name: "ct", Value: "110 112"},
+			{Name: "obs"},
+		}}},
+	}
+	client.Run(context.Background(), 5*time.Second)
+}
+
 func main() {
+	transportFlag := flag.String("transport", "udp", "COAP transport: udp, tcp or ws")
+	addr := flag.String("addr", ":5688", "Address to listen to")
+	rdAddr := flag.String("rd", "", "Address of a resource directory to register with, e.g. localhost:5683")
+	endpoint := flag.String("ep", "device", "Endpoint name to register with")
+	lifetime := flag.Duration("lt", time.Minute, "Lifetime of the registration, it is refreshed at half of it")
+	rate := flag.Float64("rate", 10, "Requests per second allowed from each peer")
+	burst := flag.Int("burst", 20, "Requests allowed at once from each peer")
+	flag.Parse()
+
+	transport, err := coaptransport.ParseTransport(*transportFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scheme, ok := schemes[transport]
+	if !ok {
+		log.Fatalf("transport %s is not supported", transport)
+	}
+
 	startTime := time.Now()
+	sensors := &telemetry{name: *endpoint}
+	go sensors.run(context.Background())
 	mux := coap.NewServeMux()
-	mux.HandleFunc("/device/config",
-		coap.HandlerFunc(func(w coap.ResponseWriter, req *coap.Request) {
-			// only support GET requests
-			if req.Msg.Code() != coap.GET {
-				w.SetCode(coap.BadRequest)
-				return
-			}
-			strToken := string(req.Msg.Token())
-			log.Printf("[%x] received GET request", strToken)
-
-			// switch behaviour on type of GET request
-			// GET, observe = register; register observer, start a random transmitter
-			// GET, observe = deregister; deregister observer, stop random transmitter, send one-off response
-			// GET, no observe option; send one-off response
-			registerObserver, observeRequest := observeAction(req.Msg)
-			switch {
-			case observeRequest && registerObserver:
-				// start random transmitter and add token to the observer list
-				log.Printf("[%x] register observer", strToken)
-				ctx, cancel := context.WithCancel(context.Background())
-				observers[strToken] = cancel
-				go randomTransmitter(ctx, w, req, startTime)
-				return
-			case observeRequest && !registerObserver:
-				// cancel random the transmitter associated with the token and remove from observer list
-				if cancel, ok := observers[strToken]; ok {
-					log.Printf("[%x] unregister observer", strToken)
-					cancel()
-					delete(observers, strToken)
-				}
-			}
-			log.Printf("[%x] sending one-off response", strToken)
-			err := sendResponse(w, req, startTime)
-			if err != nil {
-				log.Printf("[%x] error on transmitter: %v", strToken, err)
-			}
-		}))
+	mux.HandleFunc("/device/config", observable(uptime(startTime)))
+	mux.HandleFunc("/device/telemetry", observable(sensors.representation))
 
-	log.Fatal(coap.ListenAndServe("udp", ":5688", mux))
+	if *rdAddr != "" {
+		_, port, err := net.SplitHostPort(*addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go registerWithDirectory(*rdAddr, *endpoint, scheme, port, *lifetime)
+	}
+	log.Printf("Starting COAP server over %s...", transport)
+	log.Fatal(coaptransport.ListenAndServe(transport, *addr, nil, coaplimit.NewLimiter(*rate, *burst).Limit(mux), acks.Conn))
 }
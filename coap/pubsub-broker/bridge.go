@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coappubsub"
+	"log"
+	"strings"
+	"sync"
+)
+
+// bridge relays messages both ways between CoAP topics and the MQTT topics of a RabbitMQ broker
+// Messages are published to MQTT as retained so that MQTT subscribers also get the last value.
+type bridge struct {
+	client mqtt.Client
+	broker *coappubsub.Broker
+	topics map[string]string // CoAP topic, as cleaned by the broker, to MQTT topic
+
+	// messages the bridge has relayed, which come back to it from the side they were relayed to
+	mutex  sync.Mutex
+	echoes map[string]int
+}
+
+// topicFlag collects repeated -bridge flags in the form coap-topic=mqtt-topic
+type topicFlag map[string]string
+
+func (t topicFlag) String() string {
+	var s []string
+	for c, m := range t {
+		s = append(s, c+"="+m)
+	}
+	return strings.Join(s, ",")
+}
+
+func (t topicFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected coap-topic=mqtt-topic, not \"%s\"", s)
+	}
+	t[parts[0]] = parts[1]
+	return nil
+}
+
+// expectEcho records a relayed message so that it isn't relayed back
+func (b *bridge) expectEcho(side, topic string, payload []byte) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.echoes[side+"\x00"+topic+"\x00"+string(payload)]++
+}
+
+// isEcho reports whether the message is one the bridge relayed, forgetting it
+func (b *bridge) isEcho(side, topic string, payload []byte) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := side + "\x00" + topic + "\x00" + string(payload)
+	if b.echoes[key] == 0 {
+		return false
+	}
+	b.echoes[key]--
+	if b.echoes[key] == 0 {
+		delete(b.echoes, key)
+	}
+	return true
+}
+
+// createTopic creates the CoAP topic and any parent it needs
+func createTopic(broker *coappubsub.Broker, path string) error {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := range segments {
+		err := broker.CreateTopic(strings.Join(segments[:i+1], "/"), nil)
+		if err != nil && err != coappubsub.ErrTopicExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// newBridge connects to the MQTT broker and starts relaying the topics
+func newBridge(broker *coappubsub.Broker, opts *mqtt.ClientOptions, topics map[string]string) (*bridge, error) {
+	b := &bridge{broker: broker, topics: make(map[string]string), echoes: make(map[string]int)}
+	// the broker hands listeners cleaned topics, so e.g. /sensors must be looked up as sensors
+	for coapTopic, mqttTopic := range topics {
+		b.topics[coappubsub.CleanPath(coapTopic)] = mqttTopic
+	}
+	for coapTopic := range b.topics {
+		if err := createTopic(broker, coapTopic); err != nil {
+			return nil, fmt.Errorf("cannot create topic %s: %v", coapTopic, err)
+		}
+	}
+
+	b.client = mqtt.NewClient(opts)
+	if token := b.client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, token.Error()
+	}
+	for coapTopic, mqttTopic := range b.topics {
+		coapTopic := coapTopic
+		token := b.client.Subscribe(mqttTopic, 1, func(_ mqtt.Client, m mqtt.Message) {
+			if b.isEcho("mqtt", m.Topic(), m.Payload()) {
+				return
+			}
+			log.Printf("Bridging %q from MQTT %s to COAP %s", m.Payload(), m.Topic(), coapTopic)
+			b.expectEcho("coap", coapTopic, m.Payload())
+			err := broker.Publish(coappubsub.Message{Topic: coapTopic, Format: coap.TextPlain, Payload: m.Payload()})
+			if err != nil {
+				b.isEcho("coap", coapTopic, m.Payload())
+				log.Printf("Cannot bridge to COAP %s: %v", coapTopic, err)
+			}
+		})
+		if token.Wait() && token.Error() != nil {
+			return nil, token.Error()
+		}
+	}
+	broker.Listen(b.relay)
+	return b, nil
+}
+
+// relay publishes a message from a CoAP topic to its MQTT topic
+func (b *bridge) relay(m coappubsub.Message) {
+	mqttTopic, ok := b.topics[m.Topic]
+	if !ok || b.isEcho("coap", m.Topic, m.Payload) {
+		return
+	}
+	log.Printf("Bridging %q from COAP %s to MQTT %s", m.Payload, m.Topic, mqttTopic)
+	b.expectEcho("mqtt", mqttTopic, m.Payload)
+	token := b.client.Publish(mqttTopic, 1, true, m.Payload)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			b.isEcho("mqtt", mqttTopic, m.Payload)
+			log.Printf("Cannot bridge to MQTT %s: %v", mqttTopic, token.Error())
+		}
+	}()
+}
+
+// close disconnects from the MQTT broker
+func (b *bridge) close() {
+	b.client.Disconnect(250)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaplimit"
+	"github.com/limaechocharlie/cwb/shared/coappubsub"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
+	"log"
+)
+
+func main() {
+	transportFlag := flag.String("transport", "udp", "COAP transport: udp, tcp or ws")
+	addr := flag.String("addr", ":5689", "Address to listen to")
+	mqttURI := flag.String("mqtt", "", "RabbitMQ MQTT address to bridge to, e.g. tcp://127.0.0.1:1883; no bridge if empty")
+	mqttUsername := flag.String("mqtt-username", "cottontail", "RabbitMQ username")
+	mqttPassword := flag.String("mqtt-password", "password", "RabbitMQ password")
+	topics := topicFlag{}
+	flag.Var(topics, "bridge", "Topics to bridge as coap-topic=mqtt-topic, may be repeated (default mqtt-example=mqtt-example)")
+	rate := flag.Float64("rate", 10, "Requests per second allowed from each peer")
+	burst := flag.Int("burst", 20, "Requests allowed at once from each peer")
+	flag.Parse()
+
+	transport, err := coaptransport.ParseTransport(*transportFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	broker := coappubsub.NewBroker()
+	if *mqttURI != "" {
+		if len(topics) == 0 {
+			topics["mqtt-example"] = "mqtt-example"
+		}
+		opts := mqtt.NewClientOptions()
+		opts.AddBroker(*mqttURI).SetUsername(*mqttUsername).SetPassword(*mqttPassword).SetClientID("coap-pubsub-bridge")
+		b, err := newBridge(broker, opts, topics)
+		if err != nil {
+			log.Fatalf("failed to start MQTT bridge: %v", err)
+		}
+		defer b.close()
+		log.Printf("Bridging %s to %s", topics, *mqttURI)
+	}
+
+	mux := coap.NewServeMux()
+	broker.RegisterCOAP(mux)
+	log.Printf("Starting COAP pub-sub broker over %s...", transport)
+
+	log.Fatal(coaptransport.ListenAndServe(transport, *addr, nil, coaplimit.NewLimiter(*rate, *burst).Limit(mux), broker.Acks.Conn))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaplimit"
+	"github.com/limaechocharlie/cwb/shared/coaprd"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
+	"log"
+)
+
+// schemes are the URI schemes of the transports that don't need credentials
+var schemes = map[coaptransport.Transport]string{
+	coaptransport.UDP:       "coap",
+	coaptransport.TCP:       "coap+tcp",
+	coaptransport.WebSocket: "coap+ws",
+}
+
+func main() {
+	transportFlag := flag.String("transport", "udp", "COAP transport: udp, tcp or ws")
+	addr := flag.String("addr", ":5683", "Address to listen to")
+	storePath := flag.String("store", "", "JSON file to keep the registrations in, they are kept in memory if empty")
+	rate := flag.Float64("rate", 10, "Requests per second allowed from each peer")
+	burst := flag.Int("burst", 20, "Requests allowed at once from each peer")
+	flag.Parse()
+
+	transport, err := coaptransport.ParseTransport(*transportFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scheme, ok := schemes[transport]
+	if !ok {
+		log.Fatalf("transport %s is not supported", transport)
+	}
+
+	var store coaprd.Store = coaprd.NewMemoryStore()
+	if *storePath != "" {
+		if store, err = coaprd.NewFileStore(*storePath); err != nil {
+			log.Fatalf("failed to open store: %v", err)
+		}
+	}
+	directory := coaprd.NewDirectory(store)
+	directory.Scheme = scheme
+
+	mux := coap.NewServeMux()
+	directory.RegisterCOAP(mux)
+	log.Printf("Starting COAP resource directory over %s...", transport)
+
+	log.Fatal(coaptransport.ListenAndServe(transport, *addr, nil, coaplimit.NewLimiter(*rate, *burst).Limit(mux)))
+}
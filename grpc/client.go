@@ -7,9 +7,13 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 	"image"
+	"io"
 	"io/ioutil"
 	"log"
 	"syml"
@@ -49,8 +53,46 @@ func mustDial(addr string) *grpc.ClientConn {
 	return conn
 }
 
+// printStatus prints the status of a failed call with its details
+func printStatus(err error) {
+	if err == nil {
+		fmt.Println("unexpected success")
+		return
+	}
+	st := status.Convert(err)
+	fmt.Printf("%s: %s\n", st.Code(), st.Message())
+	for _, detail := range st.Details() {
+		switch d := detail.(type) {
+		case *errdetails.ErrorInfo:
+			fmt.Printf("  reason %s in %s\n", d.Reason, d.Domain)
+			if commands, ok := d.Metadata["commands"]; ok {
+				fmt.Printf("  the server runs %s\n", commands)
+			}
+		case *errdetails.BadRequest:
+			for _, v := range d.FieldViolations {
+				field := v.Field
+				if field == "" {
+					field = "parameters"
+				}
+				fmt.Printf("  %s: %s\n", field, v.Description)
+			}
+		default:
+			fmt.Printf("  %v\n", d)
+		}
+	}
+}
+
 func runFullWorkflow(client syml.SimpleServiceClient) (err error) {
 	const id = "holl"
+	fmt.Println("list custom commands")
+	list, err := client.ListCommands(defaultContext, &syml.Empty{})
+	if err != nil {
+		return err
+	}
+	for _, c := range list.Commands {
+		fmt.Printf("%s: %s %s\n", c.Name, c.Description, c.Schema)
+	}
+
 	fmt.Println("run custom command")
 	var cmdResponse *syml.CommandResponse
 	b, _ := json.Marshal(image.Rect(1, 2, 3, 5))
@@ -59,21 +101,173 @@ func runFullWorkflow(client syml.SimpleServiceClient) (err error) {
 	}
 	fmt.Println(cmdResponse)
 
+	fmt.Println("run transform command")
+	b, _ = json.Marshal(map[string]string{"operation": "reverse", "text": "hello"})
+	if cmdResponse, err = client.CustomCommand(defaultContext, &syml.CommandRequest{Id: id, Name: "transform", Parameters: b}); err != nil {
+		return err
+	}
+	fmt.Println(cmdResponse)
+
+	fmt.Println("run custom command with invalid parameters")
+	_, expectedErr := client.CustomCommand(defaultContext, &syml.CommandRequest{Id: id, Name: "area", Parameters: []byte(`{"Min":{"X":1}}`)})
+	printStatus(expectedErr)
+
 	fmt.Println("run custom command with unexpected command name")
-	_, expectedErr := client.CustomCommand(defaultContext, &syml.CommandRequest{Id: id, Name: "wrong", Parameters: b})
-	fmt.Println(expectedErr)
+	_, expectedErr = client.CustomCommand(defaultContext, &syml.CommandRequest{Id: id, Name: "wrong", Parameters: b})
+	printStatus(expectedErr)
 
 	fmt.Println("run snooze")
-	if _, err = client.Snooze(defaultContext, &syml.SnoozeRequest{Id: id, Secs: 2}); err != nil {
+	return snooze(client, id, 2, 0)
+
+}
+
+// snooze runs a snooze, cancelled once the deadline passes if it isn't zero
+// A deadline that passes is reported rather than returned, since it is how cancellation is checked.
+func snooze(client syml.SimpleServiceClient, id string, secs int64, deadline time.Duration) error {
+	ctx := defaultContext
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+	response, err := client.Snooze(ctx, &syml.SnoozeRequest{Id: id, Secs: secs})
+	if status.Code(err) == codes.DeadlineExceeded && deadline > 0 {
+		fmt.Printf("snooze (%s) cancelled by its %v deadline\n", id, deadline)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	slept := time.Duration(response.SleptMs) * time.Millisecond
+	if response.Capped {
+		fmt.Printf("snooze (%s) slept %v, cut to the maximum of the server\n", id, slept)
+	} else {
+		fmt.Printf("snooze (%s) slept %v\n", id, slept)
+	}
+	return nil
+}
+
+// countdown runs a countdown, printing its progress, with a deadline a little after its end
+// The countdown is cancelled after cancelAfter, if not zero.
+func countdown(client syml.SimpleServiceClient, id string, secs int64, cancelAfter time.Duration) error {
+	ctx, cancel := context.WithTimeout(defaultContext, time.Duration(secs)*time.Second+5*time.Second)
+	defer cancel()
+	if cancelAfter > 0 {
+		time.AfterFunc(cancelAfter, cancel)
+	}
+	stream, err := client.Countdown(ctx, &syml.CountdownRequest{Id: id, Secs: secs, IntervalMs: 500})
+	if err != nil {
+		return err
+	}
+	for {
+		progress, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if status.Code(err) == codes.Canceled && cancelAfter > 0 {
+			fmt.Printf("countdown (%s) cancelled after %v\n", id, cancelAfter)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("countdown (%s): %d ms elapsed, %d ms remaining\n", id, progress.ElapsedMs, progress.RemainingMs)
+	}
+}
+
+// chat sends the texts on a stream while reading the replies, like parallel unary calls on a single stream
+func chat(client syml.SimpleServiceClient, id string, texts []string) error {
+	ctx, cancel := context.WithTimeout(defaultContext, 10*time.Second)
+	defer cancel()
+	stream, err := client.Chat(ctx)
+	if err != nil {
+		return err
+	}
+	sent := make(chan error, 1)
+	go func() {
+		for i, text := range texts {
+			// Send blocks while the flow control window is full
+			if err := stream.Send(&syml.ChatMessage{Id: id, Seq: int64(i), Text: text, Operation: "reverse"}); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- stream.CloseSend()
+	}()
+	for {
+		reply, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// cancelling the context on return stops the sender as well
+			return err
+		}
+		if reply.Seq < 0 || reply.Seq >= int64(len(texts)) {
+			return fmt.Errorf("reply to unknown message #%d", reply.Seq)
+		}
+		fmt.Printf("chat (%s) #%d: %s -> %s\n", id, reply.Seq, texts[reply.Seq], reply.Text)
+	}
+	// a failed send shows up as the error of Recv, io.EOF means the server hung up
+	if err := <-sent; err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// upload streams the parameters and prints the summary of the server
+func upload(client syml.SimpleServiceClient, params map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(defaultContext, 10*time.Second)
+	defer cancel()
+	stream, err := client.UploadParams(ctx)
+	if err != nil {
 		return err
 	}
+	for name, value := range params {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		// io.EOF means the server ended the stream, its reason comes with CloseAndRecv
+		if err := stream.Send(&syml.Param{Name: name, Value: b}); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	summary, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("upload: %d parameters (%v), %d bytes\n", summary.Count, summary.Names, summary.Size)
 	return nil
+}
 
+// runStreamWorkflow runs the streaming RPCs
+func runStreamWorkflow(client syml.SimpleServiceClient, cancelAfter time.Duration) error {
+	const id = "holl"
+	fmt.Println("run chat")
+	if err := chat(client, id, []string{"hello", "streaming", "world"}); err != nil {
+		return err
+	}
+
+	fmt.Println("run upload")
+	params := map[string]interface{}{"rect": image.Rect(1, 2, 3, 5), "scale": 2.5, "label": "area"}
+	if err := upload(client, params); err != nil {
+		return err
+	}
+
+	fmt.Println("run countdown")
+	return countdown(client, id, 2, cancelAfter)
 }
 
 func main() {
 	addr := flag.String("addr", "localhost:9090", "Address to listen to")
 	nClients := flag.Int("multi", 0, "Number of clients")
+	streams := flag.Bool("streams", false, "Use the streaming RPCs, Countdown in place of Snooze with -multi")
+	cancelAfter := flag.Duration("cancel", 0, "Cancel countdowns after this time, never if 0")
+	secs := flag.Int64("secs", 10, "Length in seconds of the snooze or countdown of each -multi client")
+	deadline := flag.Duration("deadline", 0, "Deadline of the snooze of each -multi client, none if 0")
 	flag.Parse()
 
 	var wg sync.WaitGroup
@@ -83,6 +277,12 @@ func main() {
 		defer conn.Close()
 		// create a client and call snooze
 		client := syml.NewSimpleServiceClient(conn)
+		if *streams {
+			if err := runStreamWorkflow(client, *cancelAfter); err != nil {
+				log.Fatalf("could not run stream workflow: %v", err)
+			}
+			return
+		}
 		err := runFullWorkflow(client)
 		if err != nil {
 			log.Fatalf("could not run full workflow: %v", err)
@@ -96,8 +296,13 @@ func main() {
 				defer conn.Close()
 				// create a client and call snooze
 				client := syml.NewSimpleServiceClient(conn)
-				_, err := client.Snooze(defaultContext, &syml.SnoozeRequest{Id: fmt.Sprint(i), Secs: 10})
-				if err != nil {
+				if *streams {
+					if err := countdown(client, fmt.Sprint(i), *secs, *cancelAfter); err != nil {
+						log.Fatalf("could not count down: %v", err)
+					}
+					return
+				}
+				if err := snooze(client, fmt.Sprint(i), *secs, *deadline); err != nil {
 					log.Fatalf("could not snooze: %v", err)
 				}
 			}(i)
@@ -3,46 +3,235 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/limaechocharlie/cwb/shared/command"
+	"github.com/limaechocharlie/cwb/shared/transform"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
-	"image"
+	"google.golang.org/grpc/status"
+	"io"
 	"log"
 	"net"
+	"strings"
 	"syml"
 	"time"
 	"io/ioutil"
 	"crypto/x509"
 )
 
+const (
+	// defaultInterval is the interval of the countdown progress when the request has none
+	defaultInterval = time.Second
+	// maxParams is the number of parameters a single upload may carry
+	maxParams = 1000
+)
+
 // server will implement the syml.SimpleServiceServer interface
-type server struct{}
+type server struct {
+	maxSnooze time.Duration // longest snooze, longer ones are cut to it
+}
+
+// sleep waits for the duration or until the context is done, returning how long it waited
+func sleep(ctx context.Context, d time.Duration) (time.Duration, error) {
+	start := time.Now()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return time.Since(start), ctx.Err()
+	}
+}
 
-func (s *server) Snooze(ctx context.Context, in *syml.SnoozeRequest) (*syml.Empty, error) {
+// Snooze sleeps until the end of the snooze or the cancellation of the call, whichever comes first
+// The context of the call is done once the client cancels, its deadline passes or its connection is lost, so the
+// server doesn't keep sleeping for a client that stopped waiting.
+func (s *server) Snooze(ctx context.Context, in *syml.SnoozeRequest) (*syml.SnoozeResponse, error) {
+	if in.Secs < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "negative snooze of %d s", in.Secs)
+	}
+	// compared in seconds, since a huge snooze overflows a duration
+	d := s.maxSnooze
+	capped := in.Secs > int64(s.maxSnooze/time.Second)
+	if !capped {
+		d = time.Duration(in.Secs) * time.Second
+	}
 	fmt.Printf("snooze (%s) in:  %s\n", in.Id, time.Now().Format("15:04:05"))
-	time.Sleep(time.Duration(in.Secs) * time.Second)
+	slept, err := sleep(ctx, d)
+	if err != nil {
+		fmt.Printf("snooze (%s) stopped after %v: %v\n", in.Id, slept.Round(time.Millisecond), err)
+		return nil, status.FromContextError(err).Err()
+	}
 	fmt.Printf("snooze (%s) out: %s\n", in.Id, time.Now().Format("15:04:05"))
-	return &syml.Empty{}, nil
+	return &syml.SnoozeResponse{SleptMs: milliseconds(slept), Capped: capped}, nil
 }
 
+// commandCode maps command error kinds onto status codes
+var commandCode = map[command.Kind]codes.Code{
+	command.Internal: codes.Internal,
+	command.Invalid:  codes.InvalidArgument,
+	command.NotFound: codes.NotFound,
+}
+
+// errorDomain is the domain of the ErrorInfo details of the service
+const errorDomain = "syml.SimpleService"
+
+// commandStatus converts a command error into a status with details: an ErrorInfo naming the command, with the
+// registered commands if it is unknown, and a BadRequest with the parameters that don't match if they are invalid
+func commandStatus(name string, e *command.Error) error {
+	info := &errdetails.ErrorInfo{
+		Reason:   e.Kind.String(),
+		Domain:   errorDomain,
+		Metadata: map[string]string{"command": name},
+	}
+	if e.Kind == command.NotFound {
+		info.Metadata["commands"] = strings.Join(command.Default.Names(), ",")
+	}
+	st := status.New(commandCode[e.Kind], e.Message)
+	var err error
+	if e.Kind == command.Invalid {
+		badRequest := new(errdetails.BadRequest)
+		for _, v := range e.Violations {
+			badRequest.FieldViolations = append(badRequest.FieldViolations,
+				&errdetails.BadRequest_FieldViolation{Field: v.Field, Description: v.Description})
+		}
+		st, err = st.WithDetails(info, badRequest)
+	} else {
+		st, err = st.WithDetails(info)
+	}
+	if err != nil {
+		log.Printf("Cannot add details to the status: %v", err)
+		return status.Error(commandCode[e.Kind], e.Message)
+	}
+	return st.Err()
+}
+
+// CustomCommand runs a command of the registry
 func (s *server) CustomCommand(ctx context.Context, in *syml.CommandRequest) (*syml.CommandResponse, error) {
 	fmt.Printf("custom command (%s) name:  %s\n", in.Id, in.Name)
-	response := new(syml.CommandResponse)
-	if in.Name != "area" {
-		return response, fmt.Errorf("Unexpected command name \"%s\"", in.Name)
+	message, err := command.Run(ctx, in.Name, in.Parameters)
+	if err != nil {
+		return nil, commandStatus(in.Name, err.(*command.Error))
+	}
+	return &syml.CommandResponse{Message: message}, nil
+}
+
+func (s *server) ListCommands(ctx context.Context, in *syml.Empty) (*syml.CommandList, error) {
+	list := new(syml.CommandList)
+	for _, c := range command.Commands() {
+		list.Commands = append(list.Commands, &syml.CommandInfo{Name: c.Name, Description: c.Description, Schema: string(c.Schema)})
+	}
+	return list, nil
+}
+
+func milliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// Countdown sleeps like Snooze, streaming the progress, and is capped at the same maximum
+// Send blocks while the client doesn't read its messages and the flow control window is full, and returns an
+// error once the client cancels or its deadline passes, so a slow client slows the countdown messages down but
+// not the countdown itself.
+func (s *server) Countdown(in *syml.CountdownRequest, stream syml.SimpleService_CountdownServer) error {
+	if in.Secs < 0 || in.IntervalMs < 0 {
+		return status.Errorf(codes.InvalidArgument, "negative countdown of %d s every %d ms", in.Secs, in.IntervalMs)
+	}
+	// compared before converting, since huge values overflow a duration
+	d := s.maxSnooze
+	if in.Secs <= int64(s.maxSnooze/time.Second) {
+		d = time.Duration(in.Secs) * time.Second
+	}
+	interval := defaultInterval
+	if in.IntervalMs > int64(d/time.Millisecond) {
+		interval = d
+	} else if in.IntervalMs > 0 {
+		interval = time.Duration(in.IntervalMs) * time.Millisecond
 	}
-	var rect image.Rectangle
-	if err := json.Unmarshal(in.Parameters, &rect); err != nil {
-		return response, err
+	fmt.Printf("countdown (%s) in:  %s\n", in.Id, time.Now().Format("15:04:05"))
+	start := time.Now()
+	end := start.Add(d)
+	for {
+		now := time.Now()
+		remaining := end.Sub(now)
+		if remaining < 0 {
+			remaining = 0
+		}
+		progress := &syml.CountdownProgress{ElapsedMs: milliseconds(now.Sub(start)), RemainingMs: milliseconds(remaining)}
+		if err := stream.Send(progress); err != nil {
+			fmt.Printf("countdown (%s) failed: %v\n", in.Id, err)
+			return err
+		}
+		if remaining == 0 {
+			fmt.Printf("countdown (%s) out: %s\n", in.Id, time.Now().Format("15:04:05"))
+			return nil
+		}
+		wait := interval
+		if remaining < wait {
+			wait = remaining
+		}
+		select {
+		case <-stream.Context().Done():
+			err := stream.Context().Err()
+			fmt.Printf("countdown (%s) stopped: %v\n", in.Id, err)
+			return status.FromContextError(err).Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Chat answers every message as it comes, until the client closes its side of the stream
+// Messages are answered one at a time, so a client that doesn't read the replies is held back by flow control
+// rather than piling them up on the server.
+func (s *server) Chat(stream syml.SimpleService_ChatServer) error {
+	for {
+		in, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// the client cancelled or its deadline passed
+			return err
+		}
+		reply := &syml.ChatMessage{Id: in.Id, Seq: in.Seq, Text: in.Text, Operation: in.Operation}
+		if in.Operation != "" {
+			if reply.Text, err = transform.Apply(in.Operation, in.Text); err != nil {
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+		if err := stream.Send(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// UploadParams counts the parameters of the stream, answering once the client is done
+func (s *server) UploadParams(stream syml.SimpleService_UploadParamsServer) error {
+	summary := new(syml.UploadSummary)
+	for {
+		param, err := stream.Recv()
+		if err == io.EOF {
+			fmt.Printf("upload: %d parameters, %d bytes\n", summary.Count, summary.Size)
+			return stream.SendAndClose(summary)
+		}
+		if err != nil {
+			return err
+		}
+		if summary.Count == maxParams {
+			return status.Errorf(codes.ResourceExhausted, "more than %d parameters", maxParams)
+		}
+		summary.Count++
+		summary.Size += int64(len(param.Value))
+		summary.Names = append(summary.Names, param.Name)
 	}
-	response.Message = fmt.Sprintf("The area of the rectangle is %d", rect.Dx()*rect.Dy())
-	return response, nil
 }
 
 func main() {
 	addr := flag.String("addr", "localhost:9090", "Address to listen to")
+	maxSnooze := flag.Duration("max-snooze", 30*time.Second, "Longest snooze, longer ones are cut to it")
 	flag.Parse()
 
 	lis, err := net.Listen("tcp", *addr)
@@ -73,7 +262,7 @@ func main() {
 		ClientCAs:    certPool,
 	}
 	s := grpc.NewServer(grpc.Creds(credentials.NewTLS(cfg)))
-	syml.RegisterSimpleServiceServer(s, &server{})
+	syml.RegisterSimpleServiceServer(s, &server{maxSnooze: *maxSnooze})
 
 	fmt.Println("Starting the gRPC simple server... on ", *addr)
 	if err := s.Serve(lis); err != nil {
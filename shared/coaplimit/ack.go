@@ -0,0 +1,149 @@
+package coaplimit
+
+import (
+	"context"
+	"errors"
+	"github.com/go-ocf/go-coap"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// RFC 7252 transmission parameters of confirmable messages; see https://tools.ietf.org/html/rfc7252#section-4.8
+const (
+	// DefaultAckTimeout is how long the first transmission of a confirmable message waits for its acknowledgement
+	DefaultAckTimeout = 2 * time.Second
+	// DefaultMaxRetransmit is how many times a confirmable message is retransmitted before the peer is given up on
+	DefaultMaxRetransmit = 4
+	// MaxTransmitWait is how long a confirmable message can wait for its acknowledgement with the defaults
+	MaxTransmitWait = 93 * time.Second
+
+	ackRandomFactor = 1.5
+)
+
+// ErrNoAck is returned when a confirmable message is retransmitted MaxRetransmit times without an acknowledgement
+var ErrNoAck = errors.New("message not acknowledged by the peer")
+
+// ErrReset is returned when the peer rejects a confirmable message with a reset, e.g. because it stopped observing
+var ErrReset = errors.New("message reset by the peer")
+
+// Acks sends confirmable messages on the server's initiative, such as notifications, and waits for them to be
+// acknowledged
+// go-coap doesn't pass empty acknowledgements and resets to handlers, so Acks reads them from the datagrams of the
+// server's UDP socket, which must be wrapped with Conn. Reliable transports have no acknowledgements to wait for.
+type Acks struct {
+	AckTimeout    time.Duration
+	MaxRetransmit int
+
+	mutex   sync.Mutex
+	pending map[messageKey]chan bool // true for an acknowledgement, false for a reset
+	reading bool                     // a socket has been wrapped
+}
+
+// NewAcks creates an Acks with the default ACK_TIMEOUT and MAX_RETRANSMIT of RFC 7252
+func NewAcks() *Acks {
+	return &Acks{AckTimeout: DefaultAckTimeout, MaxRetransmit: DefaultMaxRetransmit, pending: make(map[messageKey]chan bool)}
+}
+
+// ackConn hands the acknowledgements and resets of pending confirmable messages to Acks instead of the server
+type ackConn struct {
+	net.PacketConn
+	acks *Acks
+}
+
+// Conn wraps the UDP socket of a server so that the acknowledgements of its confirmable messages are seen
+func (a *Acks) Conn(conn net.PacketConn) net.PacketConn {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.reading = true
+	return &ackConn{PacketConn: conn, acks: a}
+}
+
+// ReadFrom reads the next datagram that isn't the acknowledgement or reset of a pending confirmable message
+func (c *ackConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+		h, ok := parseHeader(b[:n])
+		if !ok || h.code != coap.Empty || (h.typ != coap.Acknowledgement && h.typ != coap.Reset) {
+			return n, addr, err
+		}
+		if !c.acks.deliver(addr.String(), h.id, h.typ == coap.Acknowledgement) {
+			return n, addr, err
+		}
+	}
+}
+
+// deliver hands an acknowledgement or reset to the sender of the message, reporting false if none is waiting for it
+func (a *Acks) deliver(peer string, id uint16, ack bool) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	reply, ok := a.pending[messageKey{peer, id}]
+	if ok {
+		select {
+		case reply <- ack:
+		default:
+			// a duplicate
+		}
+	}
+	return ok
+}
+
+// confirm writes a message with the ID to the peer until it is acknowledged or reset, with exponential back-off
+func (a *Acks) confirm(ctx context.Context, peer string, id uint16, write func() error) error {
+	key := messageKey{peer, id}
+	reply := make(chan bool, 1)
+	a.mutex.Lock()
+	a.pending[key] = reply
+	a.mutex.Unlock()
+	defer func() {
+		a.mutex.Lock()
+		delete(a.pending, key)
+		a.mutex.Unlock()
+	}()
+
+	timeout := time.Duration(float64(a.AckTimeout) * (1 + rand.Float64()*(ackRandomFactor-1)))
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	for retransmissions := 0; ; retransmissions++ {
+		if err := write(); err != nil {
+			return err
+		}
+		select {
+		case ack := <-reply:
+			if !ack {
+				return ErrReset
+			}
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+		if retransmissions == a.MaxRetransmit {
+			return ErrNoAck
+		}
+		timeout *= 2
+		t.Reset(timeout)
+	}
+}
+
+// SendConfirmable sends the message to the peer of the request as a confirmable message with a new message ID
+// It returns once the peer acknowledges the message, ErrReset if the peer rejects it and ErrNoAck if it never
+// answers. Over a reliable transport, or a socket Acks doesn't read from, the message is only written.
+func (a *Acks) SendConfirmable(ctx context.Context, w coap.ResponseWriter, req *coap.Request, msg coap.Message) error {
+	a.mutex.Lock()
+	reading := a.reading
+	a.mutex.Unlock()
+	addr, ok := req.Client.RemoteAddr().(*net.UDPAddr)
+	if !ok || !reading {
+		return w.WriteMsgWithContext(ctx, msg)
+	}
+	msg.SetType(coap.Confirmable)
+	msg.SetMessageID(coap.GenerateMessageID())
+	return a.confirm(ctx, addr.String(), msg.MessageID(), func() error {
+		return w.WriteMsgWithContext(ctx, msg)
+	})
+}
@@ -0,0 +1,105 @@
+package coaplimit
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestAcks waits a few milliseconds for each acknowledgement
+func newTestAcks() *Acks {
+	a := NewAcks()
+	a.AckTimeout = 5 * time.Millisecond
+	return a
+}
+
+func TestConfirmRetransmits(t *testing.T) {
+	for _, test := range []struct {
+		answer int  // transmission answered, 0 for none
+		ack    bool // answered with an acknowledgement rather than a reset
+		err    error
+		writes int
+	}{
+		{answer: 1, ack: true, writes: 1},
+		{answer: 3, ack: true, writes: 3},
+		{answer: 2, ack: false, err: ErrReset, writes: 2},
+		{err: ErrNoAck, writes: 1 + DefaultMaxRetransmit},
+	} {
+		a := newTestAcks()
+		writes := 0
+		err := a.confirm(context.Background(), "peer", 7, func() error {
+			writes++
+			if writes == test.answer {
+				a.deliver("peer", 7, test.ack)
+			}
+			return nil
+		})
+		if err != test.err || writes != test.writes {
+			t.Errorf("answer to transmission %d: %v after %d transmissions, expected %v after %d",
+				test.answer, err, writes, test.err, test.writes)
+		}
+		if len(a.pending) != 0 {
+			t.Errorf("answer to transmission %d: %d messages still pending", test.answer, len(a.pending))
+		}
+	}
+}
+
+func TestConfirmStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := newTestAcks().confirm(ctx, "peer", 7, func() error { return nil }); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestConnTakesAcks(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	a := newTestAcks()
+	conn := a.Conn(server)
+	read := make(chan []byte)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				close(read)
+				return
+			}
+			read <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+
+	// the client acknowledges message 7 as soon as it is sent
+	err = a.confirm(context.Background(), client.LocalAddr().String(), 7, func() error {
+		_, err := client.WriteTo([]byte{0x60, 0, 0, 7}, server.LocalAddr())
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a request and an acknowledgement nothing waits for reach the server
+	for _, datagram := range [][]byte{{0x40, 1, 0, 8}, {0x60, 0, 0, 9}} {
+		if _, err := client.WriteTo(datagram, server.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case b := <-read:
+			if string(b) != string(datagram) {
+				t.Fatalf("server read %x, expected %x", b, datagram)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("server didn't read %x", datagram)
+		}
+	}
+}
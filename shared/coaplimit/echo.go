@@ -0,0 +1,196 @@
+package coaplimit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/go-ocf/go-coap"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Echo is the number of the Echo option; see https://tools.ietf.org/html/rfc9175#section-2
+const Echo coap.OptionID = 252
+
+// echoSize is the size of an Echo value: a timestamp and a truncated MAC
+const echoSize = 8 + 16
+
+// maxEchoes bounds the Echo values read from datagrams whose requests haven't been handled yet
+const maxEchoes = 1024
+
+// echoHold is how long an Echo value read from a datagram waits for its request to be handled
+const echoHold = 10 * time.Second
+
+// receivedEcho is an Echo value read from the datagram of a request
+type receivedEcho struct {
+	value []byte
+	at    time.Time
+}
+
+// Challenge makes a peer prove that it receives at its source address before the handler runs
+// A request over UDP without a fresh Echo option gets 4.01 Unauthorized with one, which the peer repeats in its
+// retry. The value is a timestamp and a MAC of it and the peer's address, so the server keeps no state per peer and
+// spoofed or reflected requests never reach the handler. Reliable transports prove the address in their own
+// handshake, so their requests aren't challenged.
+//
+// go-coap drops the options it doesn't know when parsing a message, so the server's UDP socket must be wrapped with
+// Conn, which reads the Echo option from the datagrams before go-coap does.
+type Challenge struct {
+	Freshness time.Duration
+
+	secret []byte
+	now    func() time.Time
+
+	mutex  sync.Mutex
+	echoes map[messageKey]receivedEcho
+}
+
+// NewChallenge creates a challenge with a random secret whose Echo values are fresh for the duration
+func NewChallenge(freshness time.Duration) (*Challenge, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return &Challenge{Freshness: freshness, secret: secret, now: time.Now, echoes: make(map[messageKey]receivedEcho)}, nil
+}
+
+// mac authenticates the timestamp for the peer
+func (c *Challenge) mac(timestamp []byte, peer string) []byte {
+	m := hmac.New(sha256.New, c.secret)
+	m.Write(timestamp)
+	m.Write([]byte(peer))
+	return m.Sum(nil)[:echoSize-8]
+}
+
+// value creates an Echo value for the peer
+func (c *Challenge) value(peer string) []byte {
+	v := make([]byte, 8, echoSize)
+	binary.BigEndian.PutUint64(v, uint64(c.now().Unix()))
+	return append(v, c.mac(v, peer)...)
+}
+
+// Verify reports whether the Echo value was made for the peer and is still fresh
+func (c *Challenge) Verify(value []byte, peer string) bool {
+	if len(value) != echoSize || !hmac.Equal(value[8:], c.mac(value[:8], peer)) {
+		return false
+	}
+	age := c.now().Sub(time.Unix(int64(binary.BigEndian.Uint64(value)), 0))
+	return age >= 0 && age <= c.Freshness
+}
+
+// echoConn records the Echo options of the datagrams read for a challenge
+type echoConn struct {
+	net.PacketConn
+	challenge *Challenge
+}
+
+// Conn wraps the UDP socket of a server so that the Echo options of requests are seen
+func (c *Challenge) Conn(conn net.PacketConn) net.PacketConn {
+	return &echoConn{PacketConn: conn, challenge: c}
+}
+
+// ReadFrom reads a datagram, recording its Echo option for the challenge
+func (e *echoConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := e.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	if value, ok := findOption(b[:n], Echo); ok && len(value) == echoSize {
+		h, _ := parseHeader(b[:n])
+		e.challenge.received(messageKey{addr.String(), h.id}, value)
+	}
+	return n, addr, err
+}
+
+// received records the Echo value of a message until its request is handled
+// Once maxEchoes values are waiting, the stale ones are dropped and, if none is, the new one is.
+func (c *Challenge) received(key messageKey, value []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := c.now()
+	if len(c.echoes) >= maxEchoes {
+		for k, e := range c.echoes {
+			if now.Sub(e.at) > echoHold {
+				delete(c.echoes, k)
+			}
+		}
+		if len(c.echoes) >= maxEchoes {
+			return
+		}
+	}
+	c.echoes[key] = receivedEcho{value: append([]byte(nil), value...), at: now}
+}
+
+// echoValue takes the Echo value read from the datagram of the request
+func (c *Challenge) echoValue(req *coap.Request) []byte {
+	key := messageKey{req.Client.RemoteAddr().String(), req.Msg.MessageID()}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.echoes[key]
+	if !ok {
+		return nil
+	}
+	delete(c.echoes, key)
+	if c.now().Sub(e.at) > echoHold {
+		return nil
+	}
+	return e.value
+}
+
+// Require wraps the handler so that it only serves requests with a fresh Echo value
+func (c *Challenge) Require(handler coap.Handler) coap.Handler {
+	return coap.HandlerFunc(func(w coap.ResponseWriter, req *coap.Request) {
+		if _, ok := req.Client.RemoteAddr().(*net.UDPAddr); !ok {
+			handler.ServeCOAP(w, req)
+			return
+		}
+		p := Peer(req)
+		if c.Verify(c.echoValue(req), p) {
+			handler.ServeCOAP(w, req)
+			return
+		}
+		log.Printf("Challenging %s", p)
+		value := c.value(p)
+		msg := w.NewResponse(coap.Unauthorized)
+		msg.SetOption(Echo, value)
+		msg.SetOption(coap.ContentFormat, coap.AppOctets)
+		msg.SetPayload(value)
+		ctx, cancel := context.WithTimeout(req.Ctx, time.Second)
+		defer cancel()
+		if err := w.WriteMsgWithContext(ctx, msg); err != nil {
+			log.Printf("Cannot send response: %v", err)
+		}
+	})
+}
+
+// ExchangeWithEcho sends a request and, if the server challenges it, retries once with the Echo value
+// The request is created by the function so that the retry gets a new message ID and token. go-coap drops the Echo
+// option of the challenge, so the value is taken from its payload, where Challenge also puts it.
+func ExchangeWithEcho(ctx context.Context, conn *coap.ClientConn, newRequest func() (coap.Message, error)) (coap.Message, error) {
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conn.ExchangeWithContext(ctx, req)
+	if err != nil || resp.Code() != coap.Unauthorized {
+		return resp, err
+	}
+	value, ok := resp.Option(Echo).([]byte)
+	if !ok {
+		value = resp.Payload()
+	}
+	if len(value) != echoSize {
+		// not a challenge
+		return resp, nil
+	}
+
+	if req, err = newRequest(); err != nil {
+		return nil, err
+	}
+	req.SetOption(Echo, value)
+	return conn.ExchangeWithContext(ctx, req)
+}
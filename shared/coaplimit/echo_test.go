@@ -0,0 +1,92 @@
+package coaplimit
+
+import (
+	"bytes"
+	"github.com/go-ocf/go-coap"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoRequest is a GET of /ps with token 0xbeef, message ID 0x1234 and the Echo option
+func echoRequest(value []byte) []byte {
+	b := []byte{0x42, 0x01, 0x12, 0x34, 0xbe, 0xef}
+	b = append(b, 0xb2, 'p', 's')
+	// option 252 is 241 after Uri-Path (11) and both the delta and the length of 24 are extended by one byte
+	b = append(b, 0xdd, 241-13, echoSize-13)
+	b = append(b, value...)
+	return append(b, 0xff, 'x')
+}
+
+func TestFindOption(t *testing.T) {
+	value := bytes.Repeat([]byte{0xec}, echoSize)
+	b := echoRequest(value)
+	if v, ok := findOption(b, Echo); !ok || !bytes.Equal(v, value) {
+		t.Fatalf("Echo option %x, %v", v, ok)
+	}
+	if v, ok := findOption(b, coap.URIPath); !ok || string(v) != "ps" {
+		t.Fatalf("Uri-Path option %q, %v", v, ok)
+	}
+	if _, ok := findOption(b, coap.URIQuery); ok {
+		t.Fatal("found a missing option")
+	}
+	if _, ok := findOption(b[:len(b)-10], Echo); ok {
+		t.Fatal("found an option in a truncated datagram")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	c, err := NewChallenge(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+	value := c.value("192.0.2.1")
+	if !c.Verify(value, "192.0.2.1") {
+		t.Fatal("fresh value rejected")
+	}
+	if c.Verify(value, "192.0.2.2") {
+		t.Fatal("value accepted from another peer")
+	}
+	now = now.Add(2 * time.Minute)
+	if c.Verify(value, "192.0.2.1") {
+		t.Fatal("stale value accepted")
+	}
+}
+
+func TestConnRecordsEcho(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	c, err := NewChallenge(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := c.value("127.0.0.1")
+	b := echoRequest(value)
+	if _, err := client.WriteTo(b, server.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 64)
+	n, _, err := c.Conn(server).ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], b) {
+		t.Fatalf("read %x, expected the datagram unchanged", buf[:n])
+	}
+	e, ok := c.echoes[messageKey{client.LocalAddr().String(), 0x1234}]
+	if !ok || !bytes.Equal(e.value, value) {
+		t.Fatalf("recorded %x, %v", e.value, ok)
+	}
+}
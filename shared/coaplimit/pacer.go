@@ -0,0 +1,109 @@
+package coaplimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// RFC 7252 transmission parameters; see https://tools.ietf.org/html/rfc7252#section-4.8
+const (
+	// DefaultNStart is the number of simultaneous outstanding interactions with a peer
+	DefaultNStart = 1
+	// DefaultProbingRate is the average data rate, in bytes per second, to a peer that doesn't respond
+	DefaultProbingRate = 1
+)
+
+// headerSize is an allowance for the header and options of a message, which are counted with its payload
+const headerSize = 16
+
+// ErrPaced is returned when a message to an unresponsive peer would exceed the probing rate
+// A notification can be skipped in that case: the observer gets the state in a later one.
+var ErrPaced = errors.New("probing rate to the peer exceeded")
+
+// pace is the outbound state of a peer
+type pace struct {
+	slots chan struct{} // one per interaction that may be outstanding
+	users int           // sends holding or waiting for a slot
+	next  time.Time     // when the peer may next be probed, zero while it responds
+}
+
+// Pacer holds back messages sent to a peer on the server's initiative, such as notifications
+// No more than NStart messages to a peer are outstanding at a time. Once a message to a peer goes unacknowledged, the
+// peer is deemed unresponsive and messages to it are limited to ProbingRate bytes per second until one is
+// acknowledged.
+type Pacer struct {
+	NStart      int
+	ProbingRate float64
+
+	mutex sync.Mutex
+	peers map[string]*pace
+	now   func() time.Time
+}
+
+// NewPacer creates a pacer with the default NSTART and PROBING_RATE of RFC 7252
+func NewPacer() *Pacer {
+	return &Pacer{NStart: DefaultNStart, ProbingRate: DefaultProbingRate, peers: make(map[string]*pace), now: time.Now}
+}
+
+// acquire finds the state of the peer and counts the caller as one of its users
+func (p *Pacer) acquire(peer string) *pace {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	s, ok := p.peers[peer]
+	if !ok {
+		s = &pace{slots: make(chan struct{}, p.NStart)}
+		p.peers[peer] = s
+	}
+	s.users++
+	return s
+}
+
+// release stops counting the caller as a user, forgetting the peer once it has no users and may be probed
+func (p *Pacer) release(peer string, s *pace) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	s.users--
+	if s.users == 0 && !p.now().Before(s.next) {
+		delete(p.peers, peer)
+	}
+}
+
+// Send calls the function to send a message with a payload of the size to the peer once the pacing allows it
+// It waits for an outstanding interaction with the peer to finish, or the context to be done, and returns ErrPaced
+// without sending if the peer is unresponsive and was probed too recently. The function must return once the message
+// is acknowledged, as Acks.SendConfirmable does, so that the interaction holds its slot until then; ErrNoAck marks the
+// peer unresponsive.
+func (p *Pacer) Send(ctx context.Context, peer string, size int, send func(context.Context) error) error {
+	s := p.acquire(peer)
+	defer p.release(peer, s)
+
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-s.slots }()
+
+	p.mutex.Lock()
+	now := p.now()
+	if now.Before(s.next) {
+		p.mutex.Unlock()
+		return ErrPaced
+	}
+	p.mutex.Unlock()
+
+	err := send(ctx)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	switch err {
+	case ErrNoAck:
+		s.next = now.Add(time.Duration(float64(size+headerSize) / p.ProbingRate * float64(time.Second)))
+	case nil, ErrReset:
+		// the peer answered
+		s.next = time.Time{}
+	}
+	return err
+}
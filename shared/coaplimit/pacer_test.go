@@ -0,0 +1,87 @@
+package coaplimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// sends counts the calls to the function it returns, which answers with the error
+func sends(count *int, err error) func(context.Context) error {
+	return func(context.Context) error {
+		*count++
+		return err
+	}
+}
+
+func TestPacerProbesUnacknowledgedPeer(t *testing.T) {
+	now := time.Unix(0, 0)
+	p := NewPacer()
+	p.now = func() time.Time { return now }
+	count := 0
+
+	if err := p.Send(context.Background(), "peer", 4, sends(&count, ErrNoAck)); err != ErrNoAck {
+		t.Fatalf("expected %v, got %v", ErrNoAck, err)
+	}
+	if err := p.Send(context.Background(), "peer", 4, sends(&count, nil)); err != ErrPaced {
+		t.Fatalf("expected %v right after a missing acknowledgement, got %v", ErrPaced, err)
+	}
+	if err := p.Send(context.Background(), "other", 4, sends(&count, nil)); err != nil {
+		t.Fatalf("another peer is paced: %v", err)
+	}
+
+	// 4 bytes and the header allowance at 1 byte per second
+	now = now.Add((4 + headerSize) * time.Second)
+	if err := p.Send(context.Background(), "peer", 4, sends(&count, nil)); err != nil {
+		t.Fatalf("probe once the probing rate allows it failed: %v", err)
+	}
+	if err := p.Send(context.Background(), "peer", 4, sends(&count, nil)); err != nil {
+		t.Fatalf("acknowledged peer is still paced: %v", err)
+	}
+	if count != 4 {
+		t.Fatalf("%d messages sent, expected 4", count)
+	}
+}
+
+func TestPacerOnlyPacesMissingAcks(t *testing.T) {
+	p := NewPacer()
+	count := 0
+	for _, err := range []error{errors.New("write failed"), ErrReset, context.Canceled} {
+		if got := p.Send(context.Background(), "peer", 4, sends(&count, err)); got != err {
+			t.Fatalf("expected %v, got %v", err, got)
+		}
+	}
+	if err := p.Send(context.Background(), "peer", 4, sends(&count, nil)); err != nil {
+		t.Fatalf("peer paced without a missing acknowledgement: %v", err)
+	}
+}
+
+func TestPacerHoldsSlotUntilAcknowledged(t *testing.T) {
+	p := NewPacer()
+	acked := make(chan struct{})
+	sent := make(chan error)
+	go func() {
+		sent <- p.Send(context.Background(), "peer", 4, func(context.Context) error {
+			<-acked
+			return nil
+		})
+	}()
+
+	// the first message holds the only slot until it is acknowledged
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	count := 0
+	if err := p.Send(ctx, "peer", 4, sends(&count, nil)); err != context.DeadlineExceeded {
+		t.Fatalf("expected the second message to wait for the slot, got %v", err)
+	}
+
+	close(acked)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Send(context.Background(), "peer", 4, sends(&count, nil)); err != nil || count != 1 {
+		t.Fatalf("message after the acknowledgement: %v, sent %d times", err, count)
+	}
+}
@@ -0,0 +1,109 @@
+// Package coaplimit protects CoAP servers from abusive or struggling peers.
+//
+// Limiter rate limits requests per peer with token buckets, Challenge makes a peer prove it can receive at its source
+// address before an expensive handler runs (RFC 9175) and Pacer holds back notifications to a peer to the NSTART
+// and PROBING_RATE limits of RFC 7252, with Acks waiting for each notification to be acknowledged.
+//
+// go-coap doesn't pass the Echo option, acknowledgements or resets to handlers, so Challenge and Acks read them from
+// the datagrams of the server's UDP socket and the socket must be wrapped with their Conn methods.
+package coaplimit
+
+import (
+	"context"
+	"github.com/go-ocf/go-coap"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peer identifies the source of a request by IP address, ignoring the port so that a peer can't get a fresh bucket
+// or Echo value by changing it
+func Peer(req *coap.Request) string {
+	addr := req.Client.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// bucket is a token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter rate limits requests per peer
+// Each peer may make Burst requests at once and Rate requests per second on average.
+type Limiter struct {
+	Rate  float64
+	Burst int
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+// NewLimiter creates a limiter with the rate, in requests per second, and the burst
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{Rate: rate, Burst: burst, buckets: make(map[string]*bucket), now: time.Now}
+}
+
+// Allow takes a token from the bucket of the peer
+// If the bucket is empty it returns false and how long until the next token.
+func (l *Limiter) Allow(peer string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[peer]
+	if !ok {
+		b = &bucket{tokens: float64(l.Burst), last: now}
+		l.buckets[peer] = b
+	}
+	b.tokens = math.Min(float64(l.Burst), b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+}
+
+// sweep forgets the peers whose buckets have refilled, so that the map doesn't grow with every address seen
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	full := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+	for p, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, p)
+		}
+	}
+}
+
+// Limit wraps the handler so that requests over the limit of their peer get 4.29 Too Many Requests, with a Max-Age
+// saying when to try again; see https://tools.ietf.org/html/rfc8516
+func (l *Limiter) Limit(handler coap.Handler) coap.Handler {
+	return coap.HandlerFunc(func(w coap.ResponseWriter, req *coap.Request) {
+		p := Peer(req)
+		if ok, wait := l.Allow(p); !ok {
+			log.Printf("Rate limiting %s", p)
+			msg := w.NewResponse(coap.TooManyRequests)
+			msg.SetOption(coap.MaxAge, uint32(math.Ceil(wait.Seconds())))
+			ctx, cancel := context.WithTimeout(req.Ctx, time.Second)
+			defer cancel()
+			if err := w.WriteMsgWithContext(ctx, msg); err != nil {
+				log.Printf("Cannot send response: %v", err)
+			}
+			return
+		}
+		handler.ServeCOAP(w, req)
+	})
+}
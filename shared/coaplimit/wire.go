@@ -0,0 +1,86 @@
+package coaplimit
+
+import (
+	"encoding/binary"
+	"github.com/go-ocf/go-coap"
+)
+
+// header is the fixed part of a CoAP message over UDP; see https://tools.ietf.org/html/rfc7252#section-3
+type header struct {
+	typ         coap.COAPType
+	code        coap.COAPCode
+	id          uint16
+	tokenLength int
+}
+
+// parseHeader reads the header of a datagram, reporting false if it isn't a CoAP message
+func parseHeader(b []byte) (header, bool) {
+	if len(b) < 4 || b[0]>>6 != 1 {
+		return header{}, false
+	}
+	h := header{
+		typ:         coap.COAPType(b[0] >> 4 & 0x3),
+		code:        coap.COAPCode(b[1]),
+		id:          binary.BigEndian.Uint16(b[2:]),
+		tokenLength: int(b[0] & 0xf),
+	}
+	if h.tokenLength > 8 || len(b) < 4+h.tokenLength {
+		return header{}, false
+	}
+	return h, true
+}
+
+// messageKey identifies a message by the address of the peer and its message ID
+type messageKey struct {
+	peer string
+	id   uint16
+}
+
+// extend adds the extended delta or length that follows an option header to its 4-bit value
+func extend(v int, b []byte) (int, []byte, bool) {
+	switch v {
+	case 13:
+		if len(b) < 1 {
+			return 0, nil, false
+		}
+		return int(b[0]) + 13, b[1:], true
+	case 14:
+		if len(b) < 2 {
+			return 0, nil, false
+		}
+		return int(binary.BigEndian.Uint16(b)) + 269, b[2:], true
+	case 15:
+		return 0, nil, false
+	}
+	return v, b, true
+}
+
+// findOption reads the value of the first instance of the option in a datagram
+// go-coap drops the options it doesn't know when parsing a message, so those are read from the datagram itself.
+func findOption(b []byte, id coap.OptionID) ([]byte, bool) {
+	h, ok := parseHeader(b)
+	if !ok {
+		return nil, false
+	}
+	b = b[4+h.tokenLength:]
+	number := 0
+	for len(b) > 0 && b[0] != 0xff {
+		delta, length := int(b[0]>>4), int(b[0]&0xf)
+		b = b[1:]
+		if delta, b, ok = extend(delta, b); !ok {
+			return nil, false
+		}
+		if length, b, ok = extend(length, b); !ok || len(b) < length {
+			return nil, false
+		}
+		number += delta
+		if number == int(id) {
+			return b[:length], true
+		}
+		if number > int(id) {
+			return nil, false
+		}
+		b = b[length:]
+	}
+	return nil, false
+}
@@ -0,0 +1,13 @@
+// Package coapobserve helps clients make sense of the notifications of an observed resource (RFC 7641).
+package coapobserve
+
+// sequenceLimit is half the range of the 24-bit Observe sequence numbers
+const sequenceLimit = 1 << 23
+
+// Newer reports whether a notification with the new Observe sequence number is newer than the one with the old one
+// Notifications can be reordered, and sequence numbers wrap around, so a notification is newer if its sequence number
+// is ahead by less than half their range; see https://tools.ietf.org/html/rfc7641#section-3.4
+func Newer(oldValue, newValue uint32) bool {
+	return (oldValue < newValue && newValue-oldValue < sequenceLimit) ||
+		(oldValue > newValue && oldValue-newValue > sequenceLimit)
+}
@@ -0,0 +1,23 @@
+package coapobserve
+
+import "testing"
+
+func TestNewer(t *testing.T) {
+	for _, test := range []struct {
+		oldValue, newValue uint32
+		newer              bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{2, 2, false},
+		{0, sequenceLimit - 1, true},
+		{0, sequenceLimit + 1, false},
+		// the sequence number wrapped around
+		{0xfffff0, 5, true},
+		{5, 0xfffff0, false},
+	} {
+		if newer := Newer(test.oldValue, test.newValue); newer != test.newer {
+			t.Errorf("Newer(%d, %d) = %v, expected %v", test.oldValue, test.newValue, newer, test.newer)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package coapproxy
+
+import (
+	"github.com/go-ocf/go-coap"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// statusCodes maps CoAP response codes onto HTTP status codes, see section 7 of RFC 8075
+var statusCodes = map[coap.COAPCode]int{
+	coap.Created:               http.StatusCreated,
+	coap.Deleted:               http.StatusOK,
+	coap.Valid:                 http.StatusNotModified,
+	coap.Changed:               http.StatusOK,
+	coap.Content:               http.StatusOK,
+	coap.BadRequest:            http.StatusBadRequest,
+	coap.Unauthorized:          http.StatusForbidden,
+	coap.BadOption:             http.StatusBadRequest,
+	coap.Forbidden:             http.StatusForbidden,
+	coap.NotFound:              http.StatusNotFound,
+	coap.MethodNotAllowed:      http.StatusBadRequest,
+	coap.NotAcceptable:         http.StatusNotAcceptable,
+	coap.PreconditionFailed:    http.StatusPreconditionFailed,
+	coap.RequestEntityTooLarge: http.StatusRequestEntityTooLarge,
+	coap.UnsupportedMediaType:  http.StatusUnsupportedMediaType,
+	coap.InternalServerError:   http.StatusInternalServerError,
+	coap.NotImplemented:        http.StatusNotImplemented,
+	coap.BadGateway:            http.StatusBadGateway,
+	coap.ServiceUnavailable:    http.StatusServiceUnavailable,
+	coap.GatewayTimeout:        http.StatusGatewayTimeout,
+	coap.ProxyingNotSupported:  http.StatusBadGateway,
+}
+
+// statusCode converts a CoAP response code into an HTTP status code
+// A 2.04 Changed response without a payload has no content to return
+func statusCode(code coap.COAPCode, payload []byte) int {
+	if code == coap.Changed && len(payload) == 0 {
+		return http.StatusNoContent
+	}
+	if s, ok := statusCodes[code]; ok {
+		return s
+	}
+	return http.StatusBadGateway
+}
+
+// contentTypes maps CoAP content formats onto HTTP media types
+var contentTypes = map[coap.MediaType]string{
+	coap.TextPlain:     "text/plain; charset=utf-8",
+	coap.AppLinkFormat: "application/link-format",
+	coap.AppXML:        "application/xml",
+	coap.AppOctets:     "application/octet-stream",
+	coap.AppJSON:       "application/json",
+	coap.AppCBOR:       "application/cbor",
+}
+
+// contentType converts a CoAP content format into an HTTP media type
+func contentType(mt coap.MediaType) (string, bool) {
+	ct, ok := contentTypes[mt]
+	return ct, ok
+}
+
+// mediaType converts an HTTP Content-Type or Accept value into a CoAP content format
+// Parameters such as the charset are ignored
+func mediaType(ct string) (coap.MediaType, bool) {
+	t, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return 0, false
+	}
+	for mt, v := range contentTypes {
+		if vt, _, _ := mime.ParseMediaType(v); vt == t {
+			return mt, true
+		}
+	}
+	return 0, false
+}
+
+// accepts checks whether an Accept header lists the media type, reading each of its entries like mediaType
+// An entry with a quality of 0 refuses the type.
+func accepts(accept, t string) bool {
+	for _, a := range strings.Split(accept, ",") {
+		if at, params, err := mime.ParseMediaType(a); err == nil && at == t && params["q"] != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptedFormat converts the first entry of an Accept header that has a CoAP content format
+func acceptedFormat(accept string) (coap.MediaType, bool) {
+	for _, a := range strings.Split(accept, ",") {
+		if mt, ok := mediaType(a); ok {
+			return mt, true
+		}
+	}
+	return 0, false
+}
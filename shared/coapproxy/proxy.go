@@ -0,0 +1,455 @@
+package coapproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// maxBodySize limits the size of the HTTP request bodies that are forwarded
+const maxBodySize = 1 << 20
+
+var (
+	// errTooManyTargets is returned when every cached connection is in use and no other target can be dialled
+	errTooManyTargets = errors.New("too many targets in use")
+	// errUnsupportedMethod is returned for HTTP methods that have no CoAP equivalent
+	errUnsupportedMethod = errors.New("unsupported method")
+)
+
+// methods are the HTTP methods that map onto CoAP methods, see section 7 of RFC 8075
+var methods = map[string]bool{http.MethodGet: true, http.MethodPost: true, http.MethodPut: true, http.MethodDelete: true}
+
+// schemes maps the CoAP URI schemes onto transports and their default ports
+var schemes = map[string]struct {
+	transport coaptransport.Transport
+	port      string
+}{
+	"coap":      {coaptransport.UDP, "5683"},
+	"coaps":     {coaptransport.DTLS, "5684"},
+	"coap+tcp":  {coaptransport.TCP, "5683"},
+	"coaps+tcp": {coaptransport.TLS, "5684"},
+	"coap+ws":   {coaptransport.WebSocket, "80"},
+}
+
+// Proxy is an HTTP to CoAP cross-proxy, see RFC 8075
+// The target CoAP URI follows the prefix in the HTTP request path e.g. /hc/coap://localhost:5688/resource
+// Only the hosts in Targets are proxied to, so that the proxy can't be used to reach any host its HTTP clients name.
+type Proxy struct {
+	Prefix      string                     // path prefix that precedes the target URI
+	Credentials *coaptransport.Credentials // used to reach coaps and coaps+tcp targets
+	Timeout     time.Duration              // maximum time to wait for a CoAP response
+	// TranscodeJSON converts JSON request bodies into CBOR before forwarding and
+	// converts CBOR responses into JSON if the HTTP client accepts it
+	TranscodeJSON bool
+	// Targets are the host names and the IP networks, in CIDR notation, of the hosts that may be proxied to
+	// A name only matches a target URI with that name, it isn't resolved.
+	Targets []string
+	// MaxConns bounds the number of cached connections, one per target
+	MaxConns int
+	// IdleTimeout is how long an unused connection is kept
+	IdleTimeout time.Duration
+
+	mutex sync.Mutex
+	conns map[string]*cachedConn
+}
+
+// cachedConn is a connection to a target, shared by the requests to it
+type cachedConn struct {
+	key    string
+	co     *coap.ClientConn
+	err    error
+	dialed chan struct{} // closed once the dial is over
+	users  int           // requests holding the connection, it isn't expired or evicted while there are some
+	used   time.Time     // when the last user released it
+}
+
+// NewProxy creates a new cross-proxy that serves requests under the given path prefix to loopback targets
+func NewProxy(prefix string, creds *coaptransport.Credentials) *Proxy {
+	return &Proxy{
+		Prefix:        prefix,
+		Credentials:   creds,
+		Timeout:       5 * time.Second,
+		TranscodeJSON: true,
+		Targets:       []string{"localhost", "127.0.0.0/8", "::1/128"},
+		MaxConns:      64,
+		IdleTimeout:   5 * time.Minute,
+		conns:         make(map[string]*cachedConn),
+	}
+}
+
+// allowed checks the host of a target URI against the targets
+func (p *Proxy) allowed(host string) bool {
+	ip := net.ParseIP(host)
+	for _, t := range p.Targets {
+		if _, network, err := net.ParseCIDR(t); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+		} else if strings.EqualFold(t, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// target extracts the CoAP URI from the HTTP request
+func (p *Proxy) target(r *http.Request) (*url.URL, error) {
+	s := strings.TrimPrefix(r.URL.Path, p.Prefix)
+	// path cleaning may have collapsed the double slash after the scheme
+	if i := strings.Index(s, ":/"); i >= 0 && !strings.HasPrefix(s[i:], "://") {
+		s = s[:i] + "://" + s[i+2:]
+	}
+	target, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := schemes[target.Scheme]; !ok {
+		return nil, fmt.Errorf("unsupported target scheme \"%s\"", target.Scheme)
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("target URI \"%s\" has no host", s)
+	}
+	target.RawQuery = r.URL.RawQuery
+	return target, nil
+}
+
+// conn returns a cached connection to the target, dialling it if necessary, which the caller must release
+// The dial is made without holding the mutex, so that a slow target only holds up the requests to it.
+func (p *Proxy) conn(target *url.URL) (*cachedConn, error) {
+	scheme := schemes[target.Scheme]
+	addr := target.Host
+	if target.Port() == "" {
+		addr = net.JoinHostPort(target.Hostname(), scheme.port)
+	}
+	key := target.Scheme + "://" + addr
+
+	p.mutex.Lock()
+	p.expire()
+	c, ok := p.conns[key]
+	if ok {
+		c.users++
+		p.mutex.Unlock()
+		<-c.dialed
+		if c.err != nil {
+			p.release(c)
+			return nil, c.err
+		}
+		return c, nil
+	}
+	if len(p.conns) >= p.MaxConns && !p.evict() {
+		p.mutex.Unlock()
+		return nil, errTooManyTargets
+	}
+	c = &cachedConn{key: key, dialed: make(chan struct{}), users: 1}
+	p.conns[key] = c
+	p.mutex.Unlock()
+
+	co, err := coaptransport.Dial(scheme.transport, addr, p.Credentials)
+	p.mutex.Lock()
+	c.co, c.err = co, err
+	if err != nil {
+		delete(p.conns, key)
+	}
+	p.mutex.Unlock()
+	close(c.dialed)
+	if err != nil {
+		p.release(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// release ends the use of a connection returned by conn
+func (p *Proxy) release(c *cachedConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	c.users--
+	c.used = time.Now()
+}
+
+// remove takes the connection out of the cache and closes it, the mutex must be held
+func (p *Proxy) remove(c *cachedConn) {
+	if p.conns[c.key] != c {
+		// already removed
+		return
+	}
+	delete(p.conns, c.key)
+	if c.co != nil {
+		c.co.Close()
+	}
+}
+
+// expire removes the connections that have been unused for longer than IdleTimeout, the mutex must be held
+func (p *Proxy) expire() {
+	for _, c := range p.conns {
+		if c.users == 0 && time.Since(c.used) > p.IdleTimeout {
+			p.remove(c)
+		}
+	}
+}
+
+// evict removes the least recently used connection that is unused, the mutex must be held
+// It returns false if every connection is in use.
+func (p *Proxy) evict() bool {
+	var oldest *cachedConn
+	for _, c := range p.conns {
+		if c.users == 0 && (oldest == nil || c.used.Before(oldest.used)) {
+			oldest = c
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	p.remove(oldest)
+	return true
+}
+
+// drop removes a broken connection from the cache
+func (p *Proxy) drop(c *cachedConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.remove(c)
+}
+
+// newRequest converts an HTTP request into a CoAP request for the target
+func (p *Proxy) newRequest(co *coap.ClientConn, r *http.Request, target *url.URL) (coap.Message, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	mt, ok := mediaType(r.Header.Get("Content-Type"))
+	if !ok {
+		mt = coap.AppOctets
+	}
+	if p.TranscodeJSON && mt == coap.AppJSON && len(body) > 0 {
+		if body, err = jsonToCBOR(body); err != nil {
+			return nil, err
+		}
+		mt = coap.AppCBOR
+	}
+
+	var req coap.Message
+	switch r.Method {
+	case http.MethodGet:
+		req, err = co.NewGetRequest(target.Path)
+	case http.MethodPost:
+		req, err = co.NewPostRequest(target.Path, mt, bytes.NewReader(body))
+	case http.MethodPut:
+		req, err = co.NewPutRequest(target.Path, mt, bytes.NewReader(body))
+	case http.MethodDelete:
+		req, err = co.NewDeleteRequest(target.Path)
+	default:
+		err = errUnsupportedMethod
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range strings.Split(target.RawQuery, "&") {
+		if q == "" {
+			continue
+		}
+		if u, err := url.QueryUnescape(q); err == nil {
+			q = u
+		}
+		req.AddOption(coap.URIQuery, q)
+	}
+	if accept, ok := acceptedFormat(r.Header.Get("Accept")); ok {
+		if p.TranscodeJSON && accept == coap.AppJSON {
+			accept = coap.AppCBOR
+		}
+		req.SetOption(coap.Accept, accept)
+	}
+	return req, nil
+}
+
+// acceptsJSON checks whether the HTTP client can handle a JSON response in place of CBOR
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return accept == "" || accepts(accept, "application/json") || accepts(accept, "application/*") ||
+		accepts(accept, "*/*")
+}
+
+// requestStatus maps an error creating the CoAP request onto an HTTP status
+func requestStatus(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case err == errUnsupportedMethod:
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadRequest
+}
+
+// representation converts the payload of a CoAP message into an HTTP body and media type
+func (p *Proxy) representation(r *http.Request, msg coap.Message) (body []byte, ct string) {
+	body = msg.Payload()
+	mt, ok := msg.Option(coap.ContentFormat).(coap.MediaType)
+	if !ok {
+		return body, ""
+	}
+	if p.TranscodeJSON && mt == coap.AppCBOR && acceptsJSON(r) {
+		b, err := cborToJSON(body)
+		if err == nil {
+			return b, "application/json"
+		}
+		log.Printf("Unable to transcode CBOR response; %s", err)
+	}
+	if ct, ok = contentType(mt); !ok {
+		ct = "application/octet-stream"
+	}
+	return body, ct
+}
+
+// ServeHTTP forwards the HTTP request to the target CoAP resource
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target, err := p.target(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !methods[r.Method] {
+		http.Error(w, fmt.Sprintf("Unsupported method %s", r.Method), http.StatusNotImplemented)
+		return
+	}
+	if !p.allowed(target.Hostname()) {
+		http.Error(w, fmt.Sprintf("Target %s is not allowed", target.Hostname()), http.StatusForbidden)
+		return
+	}
+	c, err := p.conn(target)
+	if err == errTooManyTargets {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to reach %s, %s", target.Host, err), http.StatusBadGateway)
+		return
+	}
+	defer p.release(c)
+	co := c.co
+	if r.Method == http.MethodGet && accepts(r.Header.Get("Accept"), "text/event-stream") {
+		p.observe(w, r, c, target)
+		return
+	}
+	req, err := p.newRequest(co, r, target)
+	if err != nil {
+		http.Error(w, err.Error(), requestStatus(err))
+		return
+	}
+	log.Printf("Proxying %s %s", r.Method, target)
+
+	ctx, cancel := context.WithTimeout(r.Context(), p.Timeout)
+	defer cancel()
+	resp, err := co.ExchangeWithContext(ctx, req)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, err.Error(), http.StatusGatewayTimeout)
+			return
+		}
+		p.drop(c)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	body, ct := p.representation(r, resp)
+	if ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	if maxAge, ok := resp.Option(coap.MaxAge).(uint32); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+	}
+	if location := resp.Options(coap.LocationPath); len(location) > 0 {
+		parts := make([]string, len(location))
+		for i, l := range location {
+			parts[i] = fmt.Sprint(l)
+		}
+		w.Header().Set("Location", p.Prefix+target.Scheme+"://"+target.Host+"/"+strings.Join(parts, "/"))
+	}
+	w.WriteHeader(statusCode(resp.Code(), body))
+	w.Write(body)
+}
+
+// sseEvent is a server-sent event
+type sseEvent struct {
+	name string // event type, empty for the default message type
+	data string
+}
+
+// lineBreaks normalises the line breaks of event data, each line of which becomes a data field
+var lineBreaks = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// event converts a notification into a server-sent event, whose data has to be text
+// CBOR is transcoded into JSON if TranscodeJSON is set, whatever the Accept header of the stream. Other payloads
+// that aren't UTF-8 text, or CBOR that can't be transcoded, are sent base64 encoded as events of type base64.
+func (p *Proxy) event(msg coap.Message) sseEvent {
+	body := msg.Payload()
+	if mt, ok := msg.Option(coap.ContentFormat).(coap.MediaType); ok && p.TranscodeJSON && mt == coap.AppCBOR {
+		b, err := cborToJSON(body)
+		if err == nil {
+			return sseEvent{data: string(b)}
+		}
+		log.Printf("Unable to transcode CBOR notification; %s", err)
+	}
+	if utf8.Valid(body) {
+		return sseEvent{data: lineBreaks.Replace(string(body))}
+	}
+	return sseEvent{name: "base64", data: base64.StdEncoding.EncodeToString(body)}
+}
+
+// observe relays CoAP notifications to the HTTP client as server-sent events until the client goes away
+func (p *Proxy) observe(w http.ResponseWriter, r *http.Request, c *cachedConn, target *url.URL) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	notifications := make(chan sseEvent, 8)
+	obs, err := c.co.Observe(target.Path, func(req *coap.Request) {
+		select {
+		case notifications <- p.event(req.Msg):
+		default:
+			log.Printf("Dropping notification for slow client [%x]", req.Msg.Token())
+		}
+	})
+	if err != nil {
+		p.drop(c)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer obs.Cancel()
+	log.Printf("Observing %s", target)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("Stopped observing %s", target)
+			return
+		case event := <-notifications:
+			if event.name != "" {
+				fmt.Fprintf(w, "event: %s\n", event.name)
+			}
+			for _, line := range strings.Split(event.data, "\n") {
+				fmt.Fprintf(w, "data: %s\n", line)
+			}
+			fmt.Fprint(w, "\n")
+			flusher.Flush()
+		}
+	}
+}
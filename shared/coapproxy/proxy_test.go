@@ -0,0 +1,56 @@
+package coapproxy
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestAccepts(t *testing.T) {
+	for _, test := range []struct {
+		accept string
+		ok     bool
+	}{
+		{"text/event-stream", true},
+		{"text/event-stream, */*", true},
+		{"application/json, text/event-stream;q=0.9", true},
+		{"text/event-stream;q=0", false},
+		{"*/*", false},
+		{"", false},
+	} {
+		if ok := accepts(test.accept, "text/event-stream"); ok != test.ok {
+			t.Errorf("accepts(%q) = %v, expected %v", test.accept, ok, test.ok)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	p := NewProxy("/hc/", nil)
+	for host, ok := range map[string]bool{
+		"localhost":       true,
+		"LOCALHOST":       true,
+		"127.0.0.1":       true,
+		"127.1.2.3":       true,
+		"::1":             true,
+		"10.0.0.1":        false,
+		"169.254.169.254": false,
+		"example.com":     false,
+		"localhost.evil":  false,
+	} {
+		if p.allowed(host) != ok {
+			t.Errorf("allowed(%s) = %v, expected %v", host, !ok, ok)
+		}
+	}
+}
+
+func TestRequestStatus(t *testing.T) {
+	for err, status := range map[error]int{
+		&http.MaxBytesError{Limit: maxBodySize}: http.StatusRequestEntityTooLarge,
+		errUnsupportedMethod:                    http.StatusNotImplemented,
+		fmt.Errorf("invalid JSON"):              http.StatusBadRequest,
+	} {
+		if s := requestStatus(err); s != status {
+			t.Errorf("%v: status %d, expected %d", err, s, status)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package coapproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/ugorji/go/codec"
+	"reflect"
+)
+
+// cborHandle decodes CBOR maps with string keys so that they can be marshalled into JSON
+var cborHandle = func() *codec.CborHandle {
+	h := new(codec.CborHandle)
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return h
+}()
+
+// jsonToCBOR transcodes a JSON document into CBOR
+func jsonToCBOR(b []byte) ([]byte, error) {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := codec.NewEncoder(&buf, cborHandle).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// cborToJSON transcodes a CBOR data item into JSON
+func cborToJSON(b []byte) ([]byte, error) {
+	var v interface{}
+	if err := codec.NewDecoderBytes(b, cborHandle).Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
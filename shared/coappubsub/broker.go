@@ -0,0 +1,179 @@
+// Package coappubsub implements a CoAP publish-subscribe broker.
+//
+// Topics live under a collection resource, /ps, and form a hierarchy by path. A topic is created by POSTing its link
+// to the collection, or to a parent topic, published to with PUT or POST, read with GET and subscribed to with
+// Observe. Every topic retains the last value published to it, which subscribers receive as soon as they subscribe.
+// See https://datatracker.ietf.org/doc/draft-ietf-core-coap-pubsub/
+package coappubsub
+
+import (
+	"errors"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaplimit"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoTopic is returned when publishing to a topic that doesn't exist
+	ErrNoTopic = errors.New("no such topic")
+	// ErrTopicExists is returned when creating a topic that already exists
+	ErrTopicExists = errors.New("topic already exists")
+	// ErrWrongFormat is returned when publishing in a content format the topic doesn't accept
+	ErrWrongFormat = errors.New("content format not accepted by the topic")
+)
+
+// Message is a value published to a topic
+type Message struct {
+	Topic     string
+	Format    coap.MediaType
+	Payload   []byte
+	Published time.Time
+}
+
+// topic holds the retained value and the subscribers of a topic
+type topic struct {
+	path        string
+	format      *coap.MediaType // content format accepted by the topic, any if nil
+	retained    *Message
+	sequence    uint32
+	subscribers map[string]*subscriber
+}
+
+// Broker is a publish-subscribe broker
+// Notifications to subscribers are confirmable and paced so that a peer isn't sent more than the Pacer allows; the
+// UDP socket of the server must be wrapped with Acks.Conn for their acknowledgements to be seen. Each subscriber is
+// notified from its own goroutine, so a slow subscriber holds up neither the publisher nor the other subscribers; one
+// that falls behind skips to the latest value.
+type Broker struct {
+	Pacer *coaplimit.Pacer
+	Acks  *coaplimit.Acks
+
+	mutex     sync.Mutex
+	topics    map[string]*topic
+	listeners []func(Message)
+}
+
+// NewBroker creates a broker without topics, pacing and retransmitting notifications with the RFC 7252 defaults
+func NewBroker() *Broker {
+	return &Broker{Pacer: coaplimit.NewPacer(), Acks: coaplimit.NewAcks(), topics: make(map[string]*topic)}
+}
+
+// CleanPath normalises a topic path, e.g. /sensors/temp/ becomes sensors/temp, as the broker does with every path
+func CleanPath(path string) string {
+	return strings.Trim(path, "/")
+}
+
+// CreateTopic creates the topic at the path, which only accepts the content format if it isn't nil
+// The parent of the topic, if any, must already exist.
+func (b *Broker) CreateTopic(path string, format *coap.MediaType) error {
+	path = CleanPath(path)
+	if path == "" {
+		return errors.New("empty topic path")
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.topics[path]; ok {
+		return ErrTopicExists
+	}
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		if _, ok := b.topics[path[:i]]; !ok {
+			return ErrNoTopic
+		}
+	}
+	b.topics[path] = &topic{path: path, format: format, subscribers: make(map[string]*subscriber)}
+	return nil
+}
+
+// RemoveTopic removes the topic and its subtopics, ending every subscription with 4.04 Not Found
+func (b *Broker) RemoveTopic(path string) error {
+	path = CleanPath(path)
+	b.mutex.Lock()
+	if _, ok := b.topics[path]; !ok {
+		b.mutex.Unlock()
+		return ErrNoTopic
+	}
+	var removed []*topic
+	for p, t := range b.topics {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			removed = append(removed, t)
+			delete(b.topics, p)
+		}
+	}
+	b.mutex.Unlock()
+
+	for _, t := range removed {
+		for _, s := range t.subscribers {
+			s.queue(notification{code: coap.NotFound, sequence: t.sequence + 1})
+		}
+	}
+	return nil
+}
+
+// Topics lists the topic paths in alphabetical order
+func (b *Broker) Topics() []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	paths := make([]string, 0, len(b.topics))
+	for p := range b.topics {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Publish retains the message as the value of its topic, queues it for every subscriber and sends it to every listener
+func (b *Broker) Publish(m Message) error {
+	m.Topic = CleanPath(m.Topic)
+	if m.Published.IsZero() {
+		m.Published = time.Now()
+	}
+	b.mutex.Lock()
+	t, ok := b.topics[m.Topic]
+	if !ok {
+		b.mutex.Unlock()
+		return ErrNoTopic
+	}
+	if t.format != nil && *t.format != m.Format {
+		b.mutex.Unlock()
+		return ErrWrongFormat
+	}
+	t.retained = &m
+	t.sequence++
+	sequence := t.sequence
+	subscribers := make([]*subscriber, 0, len(t.subscribers))
+	for _, s := range t.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	listeners := b.listeners
+	b.mutex.Unlock()
+
+	for _, s := range subscribers {
+		s.queue(notification{code: coap.Content, m: &m, sequence: sequence})
+	}
+	for _, l := range listeners {
+		l(m)
+	}
+	return nil
+}
+
+// Retained returns the last message published to the topic, if any
+func (b *Broker) Retained(path string) (*Message, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	t, ok := b.topics[CleanPath(path)]
+	if !ok {
+		return nil, ErrNoTopic
+	}
+	return t.retained, nil
+}
+
+// Listen calls the function with every message published to any topic, e.g. to bridge them to another broker
+// The function is called once the notifications have been queued and must not block.
+func (b *Broker) Listen(f func(Message)) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.listeners = append(b.listeners, f)
+}
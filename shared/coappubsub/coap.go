@@ -0,0 +1,396 @@
+package coappubsub
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaplimit"
+	"github.com/limaechocharlie/cwb/shared/linkformat"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Root is the path of the topic collection
+const Root = "/ps"
+
+// notification is a message waiting to be sent to a subscriber
+type notification struct {
+	code     coap.COAPCode
+	m        *Message
+	sequence uint32
+}
+
+// subscriber is a client observing a topic
+type subscriber struct {
+	key    string
+	topic  string
+	w      coap.ResponseWriter
+	req    *coap.Request
+	broker *Broker
+
+	mutex   sync.Mutex
+	pending *notification // latest notification not sent yet, which replaces any older one
+	final   bool          // a notification ending the subscription has been queued
+	wake    chan struct{}
+	done    chan struct{}
+	stop    sync.Once
+}
+
+// queue hands the notification to the goroutine of the subscriber without waiting for it to be sent
+// An observer only needs the current state, so a notification that hasn't been sent yet is replaced by a newer one.
+func (s *subscriber) queue(n notification) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.final {
+		return
+	}
+	s.final = n.code != coap.Content
+	s.pending = &n
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// already woken
+	}
+}
+
+// run sends the queued notifications until the subscription ends or a notification can't be delivered
+func (s *subscriber) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+		s.mutex.Lock()
+		n := s.pending
+		s.pending = nil
+		s.mutex.Unlock()
+		if n == nil {
+			continue
+		}
+		err := s.notify(n.code, n.m, n.sequence, true)
+		if n.code != coap.Content {
+			return
+		}
+		if err != nil && err != coaplimit.ErrPaced {
+			s.broker.drop(s)
+			return
+		}
+	}
+}
+
+// end stops the goroutine of the subscriber
+func (s *subscriber) end() {
+	s.stop.Do(func() { close(s.done) })
+}
+
+// notify sends the message, or an empty response if there is none, with the observe sequence number
+// A notification, as opposed to the response to the subscription, is confirmable and holds the pacer slot of the
+// subscriber until it is acknowledged or the subscription ends. It returns coaplimit.ErrPaced if the notification is
+// skipped to keep to the probing rate of the subscriber.
+func (s *subscriber) notify(code coap.COAPCode, m *Message, sequence uint32, confirm bool) error {
+	msg := s.w.NewResponse(code)
+	if code == coap.Content {
+		msg.SetOption(coap.Observe, sequence&0xffffff)
+	}
+	if m != nil {
+		msg.SetOption(coap.ContentFormat, m.Format)
+		msg.SetPayload(m.Payload)
+	}
+	timeout := time.Second
+	if confirm {
+		timeout = coaplimit.MaxTransmitWait
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	err := s.broker.Pacer.Send(ctx, coaplimit.Peer(s.req), len(msg.Payload()), func(ctx context.Context) error {
+		if confirm {
+			return s.broker.Acks.SendConfirmable(ctx, s.w, s.req, msg)
+		}
+		return s.w.WriteMsgWithContext(ctx, msg)
+	})
+	switch err {
+	case nil:
+	case coaplimit.ErrPaced:
+		log.Printf("[%x] skipped notification to unresponsive subscriber", s.req.Msg.Token())
+	default:
+		log.Printf("[%x] cannot notify subscriber: %v", s.req.Msg.Token(), err)
+	}
+	return err
+}
+
+// subscriberKey identifies an observation by the client address and token
+func subscriberKey(req *coap.Request) string {
+	return fmt.Sprintf("%s/%x", req.Client.RemoteAddr(), req.Msg.Token())
+}
+
+// subscribe adds the client as an observer of the topic and sends it the retained value
+// The retained value is the response to the request, so it is sent before the goroutine of the subscriber starts
+// sending what is published afterwards.
+func (b *Broker) subscribe(path string, w coap.ResponseWriter, req *coap.Request) error {
+	s := &subscriber{
+		key:    subscriberKey(req),
+		topic:  path,
+		w:      w,
+		req:    req,
+		broker: b,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	b.mutex.Lock()
+	t, ok := b.topics[path]
+	if !ok {
+		b.mutex.Unlock()
+		return ErrNoTopic
+	}
+	if old, ok := t.subscribers[s.key]; ok {
+		// the client registered again with the same token
+		old.end()
+	}
+	t.subscribers[s.key] = s
+	retained, sequence := t.retained, t.sequence
+	b.mutex.Unlock()
+
+	log.Printf("[%x] subscribed to %s", req.Msg.Token(), path)
+	if err := s.notify(coap.Content, retained, sequence, false); err != nil && err != coaplimit.ErrPaced {
+		b.drop(s)
+		return nil
+	}
+	go s.run()
+	return nil
+}
+
+// unsubscribe removes the observer from the topic
+func (b *Broker) unsubscribe(path, key string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if t, ok := b.topics[path]; ok {
+		if s, ok := t.subscribers[key]; ok {
+			s.end()
+			delete(t.subscribers, key)
+		}
+	}
+}
+
+// drop removes the subscriber from its topic, unless it has been replaced by a new registration
+func (b *Broker) drop(s *subscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if t, ok := b.topics[s.topic]; ok && t.subscribers[s.key] == s {
+		delete(t.subscribers, s.key)
+	}
+	s.end()
+}
+
+// RegisterCOAP adds the topic collection, and the /.well-known/core that advertises it, to the CoAP mux
+func (b *Broker) RegisterCOAP(mux *coap.ServeMux) {
+	mux.Handle("/.well-known/core", coap.HandlerFunc(b.wellKnownCore))
+	mux.Handle(Root, coap.HandlerFunc(b.handler))
+	mux.Handle(Root+"/", coap.HandlerFunc(b.handler))
+}
+
+// write sends a response with the code and an optional payload
+func write(w coap.ResponseWriter, req *coap.Request, code coap.COAPCode, format *coap.MediaType, payload []byte, location string) {
+	msg := w.NewResponse(code)
+	if location != "" {
+		for _, segment := range strings.Split(strings.Trim(location, "/"), "/") {
+			msg.AddOption(coap.LocationPath, segment)
+		}
+	}
+	if format != nil {
+		msg.SetOption(coap.ContentFormat, *format)
+	}
+	msg.SetPayload(payload)
+	ctx, cancel := context.WithTimeout(req.Ctx, time.Second)
+	defer cancel()
+	if err := w.WriteMsgWithContext(ctx, msg); err != nil {
+		log.Printf("Cannot send response: %v", err)
+	}
+}
+
+// writeError sends an error code with a diagnostic payload
+func writeError(w coap.ResponseWriter, req *coap.Request, code coap.COAPCode, format string, a ...interface{}) {
+	diagnostic := fmt.Sprintf(format, a...)
+	log.Printf("Pub-sub error: %s", diagnostic)
+	text := coap.TextPlain
+	write(w, req, code, &text, []byte(diagnostic), "")
+}
+
+// writeBrokerError maps a broker error to a response code
+func writeBrokerError(w coap.ResponseWriter, req *coap.Request, path string, err error) {
+	switch err {
+	case ErrNoTopic:
+		writeError(w, req, coap.NotFound, "No topic %s", path)
+	case ErrTopicExists:
+		writeError(w, req, coap.Forbidden, "Topic %s already exists", path)
+	case ErrWrongFormat:
+		writeError(w, req, coap.UnsupportedMediaType, "Topic %s doesn't accept that content format", path)
+	default:
+		writeError(w, req, coap.BadRequest, "%v", err)
+	}
+}
+
+var linkFormat = coap.AppLinkFormat
+
+// wellKnownCore advertises the topic collection
+func (b *Broker) wellKnownCore(w coap.ResponseWriter, req *coap.Request) {
+	if req.Msg.Code() != coap.GET {
+		writeError(w, req, coap.MethodNotAllowed, "Unsupported method %s", req.Msg.Code())
+		return
+	}
+	links := []linkformat.Link{{Target: Root, Params: []linkformat.Param{{Name: "rt", Value: "core.ps"}, {Name: "ct", Value: "40"}}}}
+	write(w, req, coap.Content, &linkFormat, []byte(linkformat.Format(linkformat.Filter(links, req.Msg.Query()))), "")
+}
+
+// topicLinks describes the topics under the parent, or every topic if the parent is empty
+func (b *Broker) topicLinks(parent string) []linkformat.Link {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var links []linkformat.Link
+	for path, t := range b.topics {
+		if parent != "" && !strings.HasPrefix(path, parent+"/") {
+			continue
+		}
+		l := linkformat.Link{Target: Root + "/" + path}
+		if t.format != nil {
+			l.Set("ct", strconv.Itoa(int(*t.format)))
+		}
+		l.Set("obs", "")
+		links = append(links, l)
+	}
+	return links
+}
+
+// handler serves the topic collection and every topic
+func (b *Broker) handler(w coap.ResponseWriter, req *coap.Request) {
+	path := CleanPath(strings.TrimPrefix("/"+CleanPath(req.Msg.PathString()), Root))
+	format, hasFormat := req.Msg.Option(coap.ContentFormat).(coap.MediaType)
+
+	switch req.Msg.Code() {
+	case coap.GET:
+		if path == "" {
+			// discovery
+			links := linkformat.Format(linkformat.Filter(b.topicLinks(""), req.Msg.Query()))
+			write(w, req, coap.Content, &linkFormat, []byte(links), "")
+			return
+		}
+		b.get(path, w, req)
+	case coap.POST:
+		if hasFormat && format == coap.AppLinkFormat {
+			b.create(path, w, req)
+			return
+		}
+		if path == "" {
+			writeError(w, req, coap.UnsupportedMediaType, "Topics are created with a link format payload")
+			return
+		}
+		b.publish(path, format, hasFormat, w, req)
+	case coap.PUT:
+		if path == "" {
+			writeError(w, req, coap.MethodNotAllowed, "Publish to a topic, not the collection")
+			return
+		}
+		b.publish(path, format, hasFormat, w, req)
+	case coap.DELETE:
+		if path == "" {
+			writeError(w, req, coap.MethodNotAllowed, "The collection can't be removed")
+			return
+		}
+		if err := b.RemoveTopic(path); err != nil {
+			writeBrokerError(w, req, path, err)
+			return
+		}
+		log.Printf("Removed topic %s", path)
+		write(w, req, coap.Deleted, nil, nil, "")
+	default:
+		writeError(w, req, coap.MethodNotAllowed, "Unsupported method %s", req.Msg.Code())
+	}
+}
+
+// create creates the topic in the link format payload under the parent
+func (b *Broker) create(parent string, w coap.ResponseWriter, req *coap.Request) {
+	links, err := linkformat.Parse(string(req.Msg.Payload()))
+	if err != nil {
+		writeError(w, req, coap.BadRequest, "%v", err)
+		return
+	}
+	if len(links) != 1 {
+		writeError(w, req, coap.BadRequest, "Create one topic at a time")
+		return
+	}
+	l := links[0]
+	path := CleanPath(l.Target)
+	if strings.HasPrefix(l.Target, Root+"/") {
+		// an absolute target names the topic in full
+		path = CleanPath(strings.TrimPrefix(l.Target, Root))
+	} else if parent != "" {
+		path = parent + "/" + path
+	}
+	var format *coap.MediaType
+	if ct, ok := l.Get("ct"); ok {
+		n, err := strconv.ParseUint(ct, 10, 16)
+		if err != nil {
+			writeError(w, req, coap.BadRequest, "Invalid content format %s", ct)
+			return
+		}
+		mt := coap.MediaType(n)
+		format = &mt
+	}
+	if err := b.CreateTopic(path, format); err != nil {
+		writeBrokerError(w, req, path, err)
+		return
+	}
+	log.Printf("Created topic %s", path)
+	write(w, req, coap.Created, nil, nil, Root+"/"+path)
+}
+
+// publish publishes the payload to the topic
+func (b *Broker) publish(path string, format coap.MediaType, hasFormat bool, w coap.ResponseWriter, req *coap.Request) {
+	if !hasFormat {
+		format = coap.TextPlain
+	}
+	err := b.Publish(Message{Topic: path, Format: format, Payload: req.Msg.Payload()})
+	if err != nil {
+		writeBrokerError(w, req, path, err)
+		return
+	}
+	log.Printf("Published %q to %s", req.Msg.Payload(), path)
+	write(w, req, coap.Changed, nil, nil, "")
+}
+
+// get reads the retained value of the topic, or subscribes to or unsubscribes from it
+func (b *Broker) get(path string, w coap.ResponseWriter, req *coap.Request) {
+	if observe, ok := req.Msg.Option(coap.Observe).(uint32); ok {
+		switch observe {
+		case 0:
+			if err := b.subscribe(path, w, req); err != nil {
+				writeBrokerError(w, req, path, err)
+			}
+			return
+		case 1:
+			log.Printf("[%x] unsubscribed from %s", req.Msg.Token(), path)
+			b.unsubscribe(path, subscriberKey(req))
+		}
+	}
+	m, err := b.Retained(path)
+	if err != nil {
+		writeBrokerError(w, req, path, err)
+		return
+	}
+	if m == nil {
+		// nothing has been published yet
+		write(w, req, coap.Content, nil, nil, "")
+		return
+	}
+	write(w, req, coap.Content, &m.Format, m.Payload, "")
+}
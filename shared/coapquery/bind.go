@@ -0,0 +1,193 @@
+// Package coapquery binds the Uri-Query options of a CoAP request to a typed struct.
+//
+// Each option is expected to be in the form key=value and is bound to the struct field with the matching query tag.
+// Fields may also have a default value and be validated:
+//
+//	type reverseQuery struct {
+//		Text string `query:"text" validate:"required"`
+//		Mode string `query:"mode" default:"runes" validate:"oneof=words runes graphemes"`
+//	}
+package coapquery
+
+import (
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// FieldError describes a problem with a single query parameter
+type FieldError struct {
+	Key    string
+	Reason string
+}
+
+func (e FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Reason)
+}
+
+// Errors collects every problem found while binding a query
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+// field is a struct field that can be bound to a query parameter
+type field struct {
+	key      string
+	value    reflect.Value
+	def      string
+	hasDef   bool
+	required bool
+	oneOf    []string
+}
+
+// fields finds the bindable fields of the struct, in declaration order
+func fields(rv reflect.Value) ([]*field, error) {
+	var fs []*field
+	for i := 0; i < rv.NumField(); i++ {
+		f := rv.Type().Field(i)
+		key, ok := f.Tag.Lookup("query")
+		if !ok || key == "-" {
+			continue
+		}
+		if key == "" {
+			key = strings.ToLower(f.Name)
+		}
+		bf := &field{key: key, value: rv.Field(i)}
+		bf.def, bf.hasDef = f.Tag.Lookup("default")
+		for _, rule := range strings.Split(f.Tag.Get("validate"), ",") {
+			switch {
+			case rule == "":
+			case rule == "required":
+				bf.required = true
+			case strings.HasPrefix(rule, "oneof="):
+				bf.oneOf = strings.Fields(strings.TrimPrefix(rule, "oneof="))
+			default:
+				return nil, fmt.Errorf("unknown validation rule \"%s\" on field %s", rule, f.Name)
+			}
+		}
+		fs = append(fs, bf)
+	}
+	return fs, nil
+}
+
+// set converts the string into the type of the field and stores it
+// Slices accumulate one element per call so that a key can be repeated.
+func set(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("\"%s\" is not a boolean", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("\"%s\" is not an integer", s)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("\"%s\" is not an unsigned integer", s)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("\"%s\" is not a number", s)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := set(elem, s); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+// Bind parses the Uri-Query options of the message into the struct pointed to by v
+// Problems with the query itself are returned as Errors; any other error is a problem with v.
+func Bind(msg coap.Message, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("query must be bound to a pointer to a struct, not %T", v)
+	}
+	ordered, err := fields(rv.Elem())
+	if err != nil {
+		return err
+	}
+	fs := make(map[string]*field)
+	for _, f := range ordered {
+		fs[f.key] = f
+	}
+
+	var errs Errors
+	seen := make(map[string]bool)
+	for _, q := range msg.Query() {
+		parts := strings.SplitN(q, "=", 2)
+		key := parts[0]
+		f, ok := fs[key]
+		if !ok {
+			errs = append(errs, FieldError{Key: key, Reason: "unknown parameter"})
+			continue
+		}
+		if len(parts) == 1 {
+			errs = append(errs, FieldError{Key: key, Reason: "expected key=value"})
+			continue
+		}
+		if seen[key] && f.value.Kind() != reflect.Slice {
+			errs = append(errs, FieldError{Key: key, Reason: "repeated parameter"})
+			continue
+		}
+		seen[key] = true
+		if err := set(f.value, parts[1]); err != nil {
+			errs = append(errs, FieldError{Key: key, Reason: err.Error()})
+		}
+	}
+
+	for _, f := range ordered {
+		key := f.key
+		if !seen[key] {
+			if !f.hasDef {
+				if f.required {
+					errs = append(errs, FieldError{Key: key, Reason: "required"})
+				}
+				continue
+			}
+			if err := set(f.value, f.def); err != nil {
+				return fmt.Errorf("invalid default for %s: %v", key, err)
+			}
+		}
+		if len(f.oneOf) > 0 && !contains(f.oneOf, fmt.Sprint(f.value.Interface())) {
+			errs = append(errs, FieldError{Key: key, Reason: fmt.Sprintf("expected one of %s", strings.Join(f.oneOf, "|"))})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,20 @@
+package coapquery
+
+import (
+	"context"
+	"github.com/go-ocf/go-coap"
+	"log"
+	"time"
+)
+
+// WriteError answers the request with 4.00 Bad Request and the error as a diagnostic payload, see section 5.5.2
+// of RFC 7252
+func WriteError(w coap.ResponseWriter, req *coap.Request, err error) {
+	log.Printf("Bad query: %v", err)
+	w.SetCode(coap.BadRequest)
+	ctx, cancel := context.WithTimeout(req.Ctx, time.Second)
+	defer cancel()
+	if _, err := w.WriteWithContext(ctx, []byte(err.Error())); err != nil {
+		log.Printf("Cannot send response: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package coaprd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/linkformat"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errNotRegistered is returned when refreshing a registration the directory no longer has
+var errNotRegistered = errors.New("not registered")
+
+// Client keeps a device registered with a Resource Directory
+type Client struct {
+	Conn         *coap.ClientConn // connection to the directory
+	Endpoint     string
+	Sector       string
+	EndpointType string
+	Base         string        // base URI of the device, the directory uses the source address if empty
+	Lifetime     time.Duration // DefaultLifetime if zero
+	Links        []linkformat.Link
+
+	location string
+}
+
+// Discover finds the registration resource of the directory with a /.well-known/core query
+func Discover(ctx context.Context, conn *coap.ClientConn) (string, error) {
+	msg, err := conn.NewGetRequest("/.well-known/core")
+	if err != nil {
+		return "", err
+	}
+	msg.AddOption(coap.URIQuery, "rt=core.rd")
+	response, err := conn.ExchangeWithContext(ctx, msg)
+	if err != nil {
+		return "", err
+	}
+	if response.Code() != coap.Content {
+		return "", fmt.Errorf("unexpected discovery response: %s", response.Code())
+	}
+	links, err := linkformat.Parse(string(response.Payload()))
+	if err != nil {
+		return "", err
+	}
+	links = linkformat.Filter(links, []string{"rt=core.rd"})
+	if len(links) == 0 {
+		return "", errors.New("the server isn't a resource directory")
+	}
+	return links[0].Target, nil
+}
+
+// Register registers the device, or replaces its registration
+func (c *Client) Register(ctx context.Context) error {
+	path, err := Discover(ctx, c.Conn)
+	if err != nil {
+		return err
+	}
+	msg, err := c.Conn.NewPostRequest(path, coap.AppLinkFormat, strings.NewReader(linkformat.Format(c.Links)))
+	if err != nil {
+		return err
+	}
+	msg.AddOption(coap.URIQuery, "ep="+c.Endpoint)
+	if c.Sector != "" {
+		msg.AddOption(coap.URIQuery, "d="+c.Sector)
+	}
+	if c.EndpointType != "" {
+		msg.AddOption(coap.URIQuery, "et="+c.EndpointType)
+	}
+	if c.Base != "" {
+		msg.AddOption(coap.URIQuery, "base="+c.Base)
+	}
+	msg.AddOption(coap.URIQuery, "lt="+strconv.Itoa(int(c.lifetime().Seconds())))
+	response, err := c.Conn.ExchangeWithContext(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if response.Code() != coap.Created {
+		return fmt.Errorf("registration failed: %s %s", response.Code(), response.Payload())
+	}
+	var location []string
+	for _, o := range response.Options(coap.LocationPath) {
+		if s, ok := o.(string); ok {
+			location = append(location, s)
+		}
+	}
+	if len(location) == 0 {
+		return errors.New("registration response has no location")
+	}
+	c.location = "/" + strings.Join(location, "/")
+	log.Printf("Registered with the resource directory at %s", c.location)
+	return nil
+}
+
+// Refresh extends the lifetime of the registration
+func (c *Client) Refresh(ctx context.Context) error {
+	if c.location == "" {
+		return errNotRegistered
+	}
+	msg, err := c.Conn.NewPostRequest(c.location, coap.AppLinkFormat, bytes.NewReader(nil))
+	if err != nil {
+		return err
+	}
+	msg.RemoveOption(coap.ContentFormat)
+	msg.AddOption(coap.URIQuery, "lt="+strconv.Itoa(int(c.lifetime().Seconds())))
+	response, err := c.Conn.ExchangeWithContext(ctx, msg)
+	if err != nil {
+		return err
+	}
+	switch response.Code() {
+	case coap.Changed:
+		return nil
+	case coap.NotFound:
+		c.location = ""
+		return errNotRegistered
+	default:
+		return fmt.Errorf("refresh failed: %s %s", response.Code(), response.Payload())
+	}
+}
+
+// Remove deletes the registration
+func (c *Client) Remove(ctx context.Context) error {
+	if c.location == "" {
+		return errNotRegistered
+	}
+	response, err := c.Conn.DeleteWithContext(ctx, c.location)
+	if err != nil {
+		return err
+	}
+	if response.Code() != coap.Deleted && response.Code() != coap.NotFound {
+		return fmt.Errorf("removal failed: %s %s", response.Code(), response.Payload())
+	}
+	c.location = ""
+	return nil
+}
+
+func (c *Client) lifetime() time.Duration {
+	if c.Lifetime == 0 {
+		return DefaultLifetime
+	}
+	return c.Lifetime
+}
+
+// Run registers the device and refreshes the registration at half its lifetime until the context is cancelled, when
+// the registration is removed
+// Failures are logged and retried, registering again if the directory has lost the registration.
+func (c *Client) Run(ctx context.Context, timeout time.Duration) {
+	retry := 5 * time.Second
+	for {
+		var err error
+		exchange, cancel := context.WithTimeout(ctx, timeout)
+		if c.location == "" {
+			err = c.Register(exchange)
+		} else if err = c.Refresh(exchange); err == errNotRegistered {
+			log.Println("Resource directory has lost the registration, registering again")
+			err = c.Register(exchange)
+		}
+		cancel()
+
+		wait := c.lifetime() / 2
+		if err != nil {
+			log.Printf("Resource directory: %v", err)
+			wait = retry
+		}
+		select {
+		case <-ctx.Done():
+			removal, cancel := context.WithTimeout(context.Background(), timeout)
+			if err := c.Remove(removal); err != nil && err != errNotRegistered {
+				log.Printf("Cannot remove registration: %v", err)
+			}
+			cancel()
+			return
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package coaprd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/linkformat"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// paths of the directory resources
+const (
+	registrationPath   = "/rd"
+	endpointLookupPath = "/rd-lookup/ep"
+	resourceLookupPath = "/rd-lookup/res"
+)
+
+// DefaultLifetime is the lifetime of a registration that doesn't set lt, see section 5.3 of the spec
+const DefaultLifetime = 90000 * time.Second
+
+// Directory is a Resource Directory
+// Registrations expire lazily: an expired registration is removed the next time it, or a lookup, is requested.
+type Directory struct {
+	Store  Store
+	Scheme string // scheme of the base URI taken from the source address of a registration, coap by default
+
+	mutex sync.Mutex // serialises registrations so that endpoint names stay unique within a sector
+	now   func() time.Time
+}
+
+// NewDirectory creates a directory that keeps its registrations in the store
+func NewDirectory(store Store) *Directory {
+	return &Directory{Store: store, Scheme: "coap", now: time.Now}
+}
+
+// RegisterCOAP adds the directory resources, and the /.well-known/core that advertises them, to the CoAP mux
+func (d *Directory) RegisterCOAP(mux *coap.ServeMux) {
+	mux.Handle("/.well-known/core", coap.HandlerFunc(d.wellKnownCore))
+	mux.Handle(registrationPath, coap.HandlerFunc(d.registerHandler))
+	mux.Handle(registrationPath+"/", coap.HandlerFunc(d.registrationHandler))
+	mux.Handle(endpointLookupPath, coap.HandlerFunc(d.endpointLookup))
+	mux.Handle(resourceLookupPath, coap.HandlerFunc(d.resourceLookup))
+}
+
+// directoryLinks describe the directory resources
+var directoryLinks = []linkformat.Link{
+	{Target: registrationPath, Params: []linkformat.Param{{Name: "rt", Value: "core.rd"}, {Name: "ct", Value: "40"}}},
+	{Target: endpointLookupPath, Params: []linkformat.Param{{Name: "rt", Value: "core.rd-lookup-ep"}, {Name: "ct", Value: "40"}}},
+	{Target: resourceLookupPath, Params: []linkformat.Param{{Name: "rt", Value: "core.rd-lookup-res"}, {Name: "ct", Value: "40"}}},
+}
+
+// respond writes a response with the code, an optional link format payload and an optional location
+func respond(w coap.ResponseWriter, req *coap.Request, code coap.COAPCode, links *string, location []string) {
+	msg := w.NewResponse(code)
+	for _, segment := range location {
+		msg.AddOption(coap.LocationPath, segment)
+	}
+	if links != nil {
+		msg.SetOption(coap.ContentFormat, coap.AppLinkFormat)
+		msg.SetPayload([]byte(*links))
+	}
+	ctx, cancel := context.WithTimeout(req.Ctx, time.Second)
+	defer cancel()
+	if err := w.WriteMsgWithContext(ctx, msg); err != nil {
+		log.Printf("Cannot send response: %v", err)
+	}
+}
+
+// respondError writes an error code with a diagnostic payload
+func respondError(w coap.ResponseWriter, req *coap.Request, code coap.COAPCode, format string, a ...interface{}) {
+	diagnostic := fmt.Sprintf(format, a...)
+	log.Printf("RD error: %s", diagnostic)
+	msg := w.NewResponse(code)
+	msg.SetOption(coap.ContentFormat, coap.TextPlain)
+	msg.SetPayload([]byte(diagnostic))
+	ctx, cancel := context.WithTimeout(req.Ctx, time.Second)
+	defer cancel()
+	if err := w.WriteMsgWithContext(ctx, msg); err != nil {
+		log.Printf("Cannot send response: %v", err)
+	}
+}
+
+// wellKnownCore advertises the directory, honouring any query filter
+func (d *Directory) wellKnownCore(w coap.ResponseWriter, req *coap.Request) {
+	if req.Msg.Code() != coap.GET {
+		respondError(w, req, coap.MethodNotAllowed, "Unsupported method %s", req.Msg.Code())
+		return
+	}
+	links := linkformat.Format(linkformat.Filter(directoryLinks, req.Msg.Query()))
+	respond(w, req, coap.Content, &links, nil)
+}
+
+// registrationParams are the query parameters of a registration or refresh
+type registrationParams struct {
+	endpoint, sector, endpointType, base string
+	lifetime                             time.Duration
+	others                               []linkformat.Param
+	has                                  map[string]bool
+}
+
+// parseRegistrationParams reads the registration parameters from the query
+func parseRegistrationParams(query []string) (*registrationParams, error) {
+	p := &registrationParams{has: make(map[string]bool)}
+	for _, q := range query {
+		parts := strings.SplitN(q, "=", 2)
+		name, value := parts[0], ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		if p.has[name] {
+			return nil, fmt.Errorf("repeated parameter %s", name)
+		}
+		p.has[name] = true
+		switch name {
+		case "ep":
+			p.endpoint = value
+		case "d":
+			p.sector = value
+		case "et":
+			p.endpointType = value
+		case "base":
+			p.base = value
+		case "lt":
+			lt, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || lt == 0 {
+				return nil, fmt.Errorf("lt must be a positive number of seconds, not \"%s\"", value)
+			}
+			p.lifetime = time.Duration(lt) * time.Second
+		default:
+			p.others = append(p.others, linkformat.Param{Name: name, Value: value})
+		}
+	}
+	return p, nil
+}
+
+// newID generates a registration ID
+func newID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sourceBase derives a base URI from the source address of the request
+func (d *Directory) sourceBase(req *coap.Request) string {
+	return d.Scheme + "://" + req.Client.RemoteAddr().String()
+}
+
+// registerHandler registers an endpoint, replacing any registration with the same endpoint name and sector
+func (d *Directory) registerHandler(w coap.ResponseWriter, req *coap.Request) {
+	if req.Msg.Code() != coap.POST {
+		respondError(w, req, coap.MethodNotAllowed, "Unsupported method %s", req.Msg.Code())
+		return
+	}
+	if mt, ok := req.Msg.Option(coap.ContentFormat).(coap.MediaType); ok && mt != coap.AppLinkFormat {
+		respondError(w, req, coap.UnsupportedMediaType, "Registrations must be in link format, not %d", mt)
+		return
+	}
+	p, err := parseRegistrationParams(req.Msg.Query())
+	if err != nil {
+		respondError(w, req, coap.BadRequest, "%v", err)
+		return
+	}
+	if p.endpoint == "" {
+		respondError(w, req, coap.BadRequest, "Missing endpoint name ep")
+		return
+	}
+	links, err := linkformat.Parse(string(req.Msg.Payload()))
+	if err != nil {
+		respondError(w, req, coap.BadRequest, "%v", err)
+		return
+	}
+
+	r := &Registration{
+		Endpoint:     p.endpoint,
+		Sector:       p.sector,
+		EndpointType: p.endpointType,
+		Base:         p.base,
+		Lifetime:     p.lifetime,
+		Params:       p.others,
+		Links:        links,
+	}
+	if r.Base == "" {
+		r.Base = d.sourceBase(req)
+	}
+	if r.Lifetime == 0 {
+		r.Lifetime = DefaultLifetime
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	registrations, err := d.registrations()
+	if err != nil {
+		respondError(w, req, coap.InternalServerError, "%v", err)
+		return
+	}
+	for _, existing := range registrations {
+		if existing.Endpoint == r.Endpoint && existing.Sector == r.Sector {
+			r.ID = existing.ID
+		}
+	}
+	if r.ID == "" {
+		if r.ID, err = newID(); err != nil {
+			respondError(w, req, coap.InternalServerError, "%v", err)
+			return
+		}
+	}
+	r.Expires = d.now().Add(r.Lifetime)
+	if err := d.Store.Put(r); err != nil {
+		respondError(w, req, coap.InternalServerError, "%v", err)
+		return
+	}
+	log.Printf("Registered %s as %s/%s, lifetime %s", r.Endpoint, registrationPath, r.ID, r.Lifetime)
+	respond(w, req, coap.Created, nil, []string{strings.TrimPrefix(registrationPath, "/"), r.ID})
+}
+
+// registrationHandler reads, refreshes and removes a registration resource
+func (d *Directory) registrationHandler(w coap.ResponseWriter, req *coap.Request) {
+	path := req.Msg.Path()
+	if len(path) != 2 {
+		respondError(w, req, coap.NotFound, "No registration at %s", req.Msg.PathString())
+		return
+	}
+	id := path[1]
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	r, err := d.registration(id)
+	if err == ErrNotFound {
+		respondError(w, req, coap.NotFound, "No registration %s", id)
+		return
+	}
+	if err != nil {
+		respondError(w, req, coap.InternalServerError, "%v", err)
+		return
+	}
+
+	switch req.Msg.Code() {
+	case coap.GET:
+		links := linkformat.Format(linkformat.Filter(r.Links, req.Msg.Query()))
+		respond(w, req, coap.Content, &links, nil)
+	case coap.POST:
+		// registration update, see section 5.3.1 of the spec
+		p, err := parseRegistrationParams(req.Msg.Query())
+		if err != nil {
+			respondError(w, req, coap.BadRequest, "%v", err)
+			return
+		}
+		if p.has["ep"] || p.has["d"] {
+			respondError(w, req, coap.BadRequest, "The endpoint name and sector can't be changed")
+			return
+		}
+		if len(req.Msg.Payload()) > 0 {
+			respondError(w, req, coap.BadRequest, "Links can't be updated with POST, register again instead")
+			return
+		}
+		if p.lifetime > 0 {
+			r.Lifetime = p.lifetime
+		}
+		if p.has["base"] {
+			r.Base = p.base
+			if r.Base == "" {
+				r.Base = d.sourceBase(req)
+			}
+		}
+		if p.has["et"] {
+			r.EndpointType = p.endpointType
+		}
+		params := append([]linkformat.Param(nil), r.Params...)
+		for _, o := range p.others {
+			l := linkformat.Link{Params: params}
+			l.Set(o.Name, o.Value)
+			params = l.Params
+		}
+		r.Params = params
+		r.Expires = d.now().Add(r.Lifetime)
+		if err := d.Store.Put(r); err != nil {
+			respondError(w, req, coap.InternalServerError, "%v", err)
+			return
+		}
+		log.Printf("Refreshed %s, lifetime %s", r.Endpoint, r.Lifetime)
+		respond(w, req, coap.Changed, nil, nil)
+	case coap.DELETE:
+		if err := d.Store.Delete(id); err != nil {
+			respondError(w, req, coap.InternalServerError, "%v", err)
+			return
+		}
+		log.Printf("Removed %s", r.Endpoint)
+		respond(w, req, coap.Deleted, nil, nil)
+	default:
+		respondError(w, req, coap.MethodNotAllowed, "Unsupported method %s", req.Msg.Code())
+	}
+}
+
+// registration gets a registration, removing it if it has expired
+func (d *Directory) registration(id string) (*Registration, error) {
+	r, err := d.Store.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if r.Expired(d.now()) {
+		log.Printf("Registration of %s has expired", r.Endpoint)
+		if err := d.Store.Delete(id); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+	return r, nil
+}
+
+// registrations lists the registrations, removing those that have expired
+func (d *Directory) registrations() ([]*Registration, error) {
+	list, err := d.Store.List()
+	if err != nil {
+		return nil, err
+	}
+	now := d.now()
+	live := list[:0]
+	for _, r := range list {
+		if !r.Expired(now) {
+			live = append(live, r)
+			continue
+		}
+		log.Printf("Registration of %s has expired", r.Endpoint)
+		if err := d.Store.Delete(r.ID); err != nil && err != ErrNotFound {
+			return nil, err
+		}
+	}
+	return live, nil
+}
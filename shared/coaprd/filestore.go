@@ -0,0 +1,131 @@
+package coaprd
+
+import (
+	"encoding/json"
+	"github.com/limaechocharlie/cwb/shared/linkformat"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// record is a registration as written to the file
+// Links are kept in link format so that parameter order survives a restart.
+type record struct {
+	ID           string
+	Endpoint     string
+	Sector       string `json:",omitempty"`
+	EndpointType string `json:",omitempty"`
+	Base         string
+	Lifetime     int64 // seconds
+	Expires      time.Time
+	Params       []linkformat.Param `json:",omitempty"`
+	Links        string
+}
+
+// FileStore keeps registrations in memory and writes them all to a JSON file on every change
+// It suits a directory with a few hundred endpoints; anything larger wants a database behind the Store interface.
+type FileStore struct {
+	path   string
+	mutex  sync.Mutex // serialises writes to the file
+	memory *MemoryStore
+}
+
+// NewFileStore creates a store backed by the file, loading any registrations already in it
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, memory: NewMemoryStore()}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []record
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, err
+	}
+	for _, rec := range records {
+		links, err := linkformat.Parse(rec.Links)
+		if err != nil {
+			return nil, err
+		}
+		s.memory.Put(&Registration{
+			ID:           rec.ID,
+			Endpoint:     rec.Endpoint,
+			Sector:       rec.Sector,
+			EndpointType: rec.EndpointType,
+			Base:         rec.Base,
+			Lifetime:     time.Duration(rec.Lifetime) * time.Second,
+			Expires:      rec.Expires,
+			Params:       rec.Params,
+			Links:        links,
+		})
+	}
+	return s, nil
+}
+
+// save writes every registration to a temporary file and renames it over the store file
+func (s *FileStore) save() error {
+	list, _ := s.memory.List()
+	records := make([]record, len(list))
+	for i, r := range list {
+		records[i] = record{
+			ID:           r.ID,
+			Endpoint:     r.Endpoint,
+			Sector:       r.Sector,
+			EndpointType: r.EndpointType,
+			Base:         r.Base,
+			Lifetime:     int64(r.Lifetime / time.Second),
+			Expires:      r.Expires,
+			Params:       r.Params,
+			Links:        linkformat.Format(r.Links),
+		}
+	}
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Put adds or replaces the registration
+func (s *FileStore) Put(r *Registration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.memory.Put(r)
+	return s.save()
+}
+
+// Get returns a copy of the registration with the ID
+func (s *FileStore) Get(id string) (*Registration, error) {
+	return s.memory.Get(id)
+}
+
+// Delete removes the registration with the ID
+func (s *FileStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.memory.Delete(id); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// List returns copies of every registration, ordered by ID
+func (s *FileStore) List() ([]*Registration, error) {
+	return s.memory.List()
+}
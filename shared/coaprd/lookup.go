@@ -0,0 +1,165 @@
+package coaprd
+
+import (
+	"errors"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/linkformat"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// endpointAttributes are the lookup filters that apply to the registration rather than its links
+// href applies to the registration in endpoint lookup and to the resource in resource lookup.
+var endpointAttributes = map[string]bool{"ep": true, "d": true, "et": true, "base": true, "lt": true}
+
+// endpointLink describes the registration as returned by endpoint lookup
+func (r *Registration) endpointLink() linkformat.Link {
+	l := linkformat.Link{Target: registrationPath + "/" + r.ID}
+	l.Set("ep", r.Endpoint)
+	if r.Sector != "" {
+		l.Set("d", r.Sector)
+	}
+	if r.EndpointType != "" {
+		l.Set("et", r.EndpointType)
+	}
+	l.Set("base", r.Base)
+	l.Set("lt", strconv.FormatInt(int64(r.Lifetime.Seconds()), 10))
+	l.Params = append(l.Params, r.Params...)
+	return l
+}
+
+// resourceLinks returns the links of the registration with absolute targets, anchored at the base
+func (r *Registration) resourceLinks() []linkformat.Link {
+	base, err := url.Parse(r.Base)
+	if err != nil {
+		return nil
+	}
+	links := make([]linkformat.Link, 0, len(r.Links))
+	for _, l := range r.Links {
+		target, err := url.Parse(l.Target)
+		if err != nil {
+			continue
+		}
+		resolved := linkformat.Link{Target: base.ResolveReference(target).String()}
+		resolved.Params = append(resolved.Params, l.Params...)
+		if anchor, ok := l.Get("anchor"); ok {
+			if a, err := url.Parse(anchor); err == nil {
+				resolved.Set("anchor", base.ResolveReference(a).String())
+			}
+		} else {
+			resolved.Set("anchor", base.String())
+		}
+		links = append(links, resolved)
+	}
+	return links
+}
+
+// lookupParams splits the lookup query into paging and filters
+type lookupParams struct {
+	page, count int
+	filters     []string
+}
+
+func parseLookupParams(query []string) (*lookupParams, error) {
+	p := &lookupParams{count: -1}
+	for _, q := range query {
+		parts := strings.SplitN(q, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var err error
+		switch parts[0] {
+		case "page":
+			p.page, err = strconv.Atoi(parts[1])
+		case "count":
+			p.count, err = strconv.Atoi(parts[1])
+		default:
+			p.filters = append(p.filters, q)
+			continue
+		}
+		if err != nil || p.page < 0 || (parts[0] == "count" && p.count < 0) {
+			return nil, errInvalidPaging
+		}
+	}
+	return p, nil
+}
+
+// errInvalidPaging is returned when page or count aren't non-negative numbers
+var errInvalidPaging = errors.New("page and count must be non-negative numbers")
+
+// paginate returns the page of links, see section 7.1 of the spec
+// page and count come from the client, so the page is located by division: page * count can overflow.
+func (p *lookupParams) paginate(links []linkformat.Link) []linkformat.Link {
+	if p.count < 0 {
+		return links
+	}
+	if len(links) == 0 || p.count == 0 || p.page > (len(links)-1)/p.count {
+		return nil
+	}
+	start := p.page * p.count
+	end := len(links)
+	if p.count < end-start {
+		end = start + p.count
+	}
+	return links[start:end]
+}
+
+// split separates the filters on the registration from the filters on its links
+func split(filters []string, endpointHref bool) (endpoint, resource []string) {
+	for _, f := range filters {
+		name := strings.SplitN(f, "=", 2)[0]
+		if endpointAttributes[name] || (endpointHref && name == "href") {
+			endpoint = append(endpoint, f)
+		} else {
+			resource = append(resource, f)
+		}
+	}
+	return endpoint, resource
+}
+
+// lookup runs the query over the registrations and writes the matching links
+func (d *Directory) lookup(w coap.ResponseWriter, req *coap.Request, endpointHref bool, collect func(r *Registration, resource []string) []linkformat.Link) {
+	if req.Msg.Code() != coap.GET {
+		respondError(w, req, coap.MethodNotAllowed, "Unsupported method %s", req.Msg.Code())
+		return
+	}
+	p, err := parseLookupParams(req.Msg.Query())
+	if err != nil {
+		respondError(w, req, coap.BadRequest, "%v", err)
+		return
+	}
+	registrations, err := d.registrations()
+	if err != nil {
+		respondError(w, req, coap.InternalServerError, "%v", err)
+		return
+	}
+	endpointFilters, resourceFilters := split(p.filters, endpointHref)
+	var links []linkformat.Link
+	for _, r := range registrations {
+		if len(linkformat.Filter([]linkformat.Link{r.endpointLink()}, endpointFilters)) == 0 {
+			continue
+		}
+		links = append(links, collect(r, resourceFilters)...)
+	}
+	payload := linkformat.Format(p.paginate(links))
+	respond(w, req, coap.Content, &payload, nil)
+}
+
+// endpointLookup lists the registrations that match the query
+// Filters on resource attributes select the endpoints with at least one matching resource.
+func (d *Directory) endpointLookup(w coap.ResponseWriter, req *coap.Request) {
+	d.lookup(w, req, true, func(r *Registration, resource []string) []linkformat.Link {
+		if len(resource) > 0 && len(linkformat.Filter(r.Links, resource)) == 0 {
+			return nil
+		}
+		return []linkformat.Link{r.endpointLink()}
+	})
+}
+
+// resourceLookup lists the resources that match the query, with absolute URIs
+func (d *Directory) resourceLookup(w coap.ResponseWriter, req *coap.Request) {
+	d.lookup(w, req, false, func(r *Registration, resource []string) []linkformat.Link {
+		return linkformat.Filter(r.resourceLinks(), resource)
+	})
+}
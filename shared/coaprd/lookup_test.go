@@ -0,0 +1,57 @@
+package coaprd
+
+import (
+	"fmt"
+	"github.com/limaechocharlie/cwb/shared/linkformat"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	links := make([]linkformat.Link, 10)
+	for i := range links {
+		links[i].Target = strconv.Itoa(i)
+	}
+	for _, test := range []struct {
+		query []string
+		first string
+		size  int
+	}{
+		{query: nil, first: "0", size: 10},
+		{query: []string{"count=4"}, first: "0", size: 4},
+		{query: []string{"page=1", "count=4"}, first: "4", size: 4},
+		{query: []string{"page=2", "count=4"}, first: "8", size: 2},
+		{query: []string{"page=3", "count=4"}, size: 0},
+		{query: []string{"page=1", "count=0"}, size: 0},
+		{query: []string{"page=1", "count=" + strconv.Itoa(math.MaxInt)}, size: 0},
+		// page * count wraps to a negative start
+		{query: []string{"page=2305843009213693952", "count=4"}, size: 0},
+		{query: []string{"page=" + strconv.Itoa(math.MaxInt), "count=" + strconv.Itoa(math.MaxInt)}, size: 0},
+	} {
+		t.Run(fmt.Sprint(test.query), func(t *testing.T) {
+			p, err := parseLookupParams(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			page := p.paginate(links)
+			if len(page) != test.size {
+				t.Fatalf("page of %d links, expected %d", len(page), test.size)
+			}
+			if test.size > 0 && page[0].Target != test.first {
+				t.Fatalf("page starts at link %s, expected %s", page[0].Target, test.first)
+			}
+		})
+	}
+	if page := (&lookupParams{count: 4}).paginate(nil); len(page) != 0 {
+		t.Fatalf("page of %d links without links", len(page))
+	}
+}
+
+func TestParseLookupParamsRejectsInvalidPaging(t *testing.T) {
+	for _, q := range []string{"page=-1", "count=-1", "page=x", "count=99999999999999999999"} {
+		if _, err := parseLookupParams([]string{q}); err != errInvalidPaging {
+			t.Errorf("%s: expected %v, got %v", q, errInvalidPaging, err)
+		}
+	}
+}
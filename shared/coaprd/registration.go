@@ -0,0 +1,97 @@
+// Package coaprd implements a CoAP Resource Directory and the client devices use to register with one.
+// See https://www.rfc-editor.org/rfc/rfc9176
+package coaprd
+
+import (
+	"errors"
+	"github.com/limaechocharlie/cwb/shared/linkformat"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by a Store when there is no registration with the ID
+var ErrNotFound = errors.New("registration not found")
+
+// Registration is the registration resource of an endpoint
+type Registration struct {
+	ID           string
+	Endpoint     string             // ep
+	Sector       string             // d
+	EndpointType string             // et
+	Base         string             // base URI the resource links are relative to
+	Lifetime     time.Duration      // lt
+	Expires      time.Time          // when the registration is removed unless refreshed
+	Params       []linkformat.Param // any other registration parameters
+	Links        []linkformat.Link
+}
+
+// Expired reports whether the lifetime of the registration has run out
+func (r *Registration) Expired(now time.Time) bool {
+	return !now.Before(r.Expires)
+}
+
+// Store persists registrations
+// Implementations must be safe for concurrent use.
+type Store interface {
+	Put(r *Registration) error
+	Get(id string) (*Registration, error)
+	Delete(id string) error
+	List() ([]*Registration, error)
+}
+
+// MemoryStore keeps registrations in memory, they are lost when the directory stops
+type MemoryStore struct {
+	mutex         sync.RWMutex
+	registrations map[string]*Registration
+}
+
+// NewMemoryStore creates an empty memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{registrations: make(map[string]*Registration)}
+}
+
+// Put adds or replaces the registration
+func (s *MemoryStore) Put(r *Registration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c := *r
+	s.registrations[r.ID] = &c
+	return nil
+}
+
+// Get returns a copy of the registration with the ID
+func (s *MemoryStore) Get(id string) (*Registration, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	r, ok := s.registrations[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	c := *r
+	return &c, nil
+}
+
+// Delete removes the registration with the ID
+func (s *MemoryStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.registrations[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.registrations, id)
+	return nil
+}
+
+// List returns copies of every registration, ordered by ID
+func (s *MemoryStore) List() ([]*Registration, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	list := make([]*Registration, 0, len(s.registrations))
+	for _, r := range s.registrations {
+		c := *r
+		list = append(list, &c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
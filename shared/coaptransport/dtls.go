@@ -0,0 +1,53 @@
+package coaptransport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pion/dtls/v2"
+)
+
+// The DTLS transport only authenticates with pre-shared keys. pion/dtls doesn't negotiate the certificate types of
+// RFC 7250, so raw public keys can't be used, and certificates with a pinned key are no substitute for peers that
+// only speak raw public keys.
+
+// ErrNoPSK is returned when a DTLS configuration is created without a pre-shared key
+var ErrNoPSK = errors.New("DTLS requires a pre-shared key")
+
+// pskCipherSuites are the cipher suites mandated for PSK by RFC 7252
+var pskCipherSuites = []dtls.CipherSuiteID{dtls.TLS_PSK_WITH_AES_128_CCM_8}
+
+// ServerPSKConfig creates a DTLS configuration for a server that accepts the given identities and keys
+func ServerPSKConfig(keys map[string][]byte) (*dtls.Config, error) {
+	if len(keys) == 0 {
+		return nil, ErrNoPSK
+	}
+	for _, key := range keys {
+		if len(key) == 0 {
+			return nil, ErrNoPSK
+		}
+	}
+	return &dtls.Config{
+		PSK: func(identity []byte) ([]byte, error) {
+			key, ok := keys[string(identity)]
+			if !ok {
+				return nil, fmt.Errorf("unknown PSK identity \"%s\"", identity)
+			}
+			return key, nil
+		},
+		CipherSuites: pskCipherSuites,
+	}, nil
+}
+
+// ClientPSKConfig creates a DTLS configuration for a client that identifies itself with a pre-shared key
+func ClientPSKConfig(identity string, key []byte) (*dtls.Config, error) {
+	if len(key) == 0 {
+		return nil, ErrNoPSK
+	}
+	return &dtls.Config{
+		PSK: func([]byte) ([]byte, error) {
+			return key, nil
+		},
+		PSKIdentityHint: []byte(identity),
+		CipherSuites:    pskCipherSuites,
+	}, nil
+}
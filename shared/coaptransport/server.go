@@ -0,0 +1,205 @@
+package coaptransport
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConnWrapper wraps the UDP socket of a server before go-coap reads from it, e.g. to see what go-coap drops
+type ConnWrapper func(net.PacketConn) net.PacketConn
+
+// Server serves CoAP over any transport and can be shut down gracefully
+type Server struct {
+	Transport Transport
+	Addr      string
+	Wrap      []ConnWrapper // applied in order to the socket of the UDP transport, ignored by the others
+
+	// PacketConn, if not nil, carries the UDP transport instead of a socket listening on Addr, e.g. a socket on a
+	// port picked by the system or a simulated network
+	PacketConn net.PacketConn
+
+	coap *coap.Server
+	http *http.Server // WebSocket front end
+
+	// the draining flag and the count of requests in flight change together, so that no request starts once
+	// Shutdown has seen none in flight
+	mutex    sync.Mutex
+	draining bool
+	inFlight int
+	drained  chan struct{} // closed once draining with no request in flight
+}
+
+// NewServer creates a server for the handler on the given address using the chosen transport
+// The credentials are only used by the TLS and DTLS transports and may be nil otherwise
+func NewServer(t Transport, addr string, creds *Credentials, handler coap.Handler) (*Server, error) {
+	s := &Server{Transport: t, Addr: addr, drained: make(chan struct{})}
+	// bodies larger than a message, e.g. batches and streams, are carried by block-wise transfer (RFC 7959)
+	blockWise, szx := true, coap.BlockWiseSzx1024
+	s.coap = &coap.Server{
+		Net:                  string(t),
+		Addr:                 addr,
+		Handler:              s.track(handler),
+		BlockWiseTransfer:    &blockWise,
+		BlockWiseTransferSzx: &szx,
+	}
+	switch t {
+	case UDP, TCP:
+	case TLS:
+		if creds == nil || creds.TLS == nil {
+			return nil, fmt.Errorf("transport %s requires a TLS configuration", t)
+		}
+		s.coap.TLSConfig = creds.TLS
+	case DTLS:
+		if creds == nil || creds.DTLS == nil {
+			return nil, fmt.Errorf("transport %s requires a DTLS configuration", t)
+		}
+		s.coap.DTLSConfig = creds.DTLS
+	case WebSocket:
+		backend, err := loopbackAddr()
+		if err != nil {
+			return nil, err
+		}
+		s.coap.Net, s.coap.Addr = string(TCP), backend
+		s.http = &http.Server{Addr: addr, Handler: webSocketHandler(backend)}
+	default:
+		return nil, fmt.Errorf("unknown transport \"%s\"", t)
+	}
+	return s, nil
+}
+
+// track wraps the handler so that in-flight requests can be drained, and new ones refused, during shutdown
+func (s *Server) track(handler coap.Handler) coap.Handler {
+	return coap.HandlerFunc(func(w coap.ResponseWriter, req *coap.Request) {
+		if !s.begin() {
+			w.SetCode(coap.ServiceUnavailable)
+			ctx, cancel := context.WithTimeout(req.Ctx, time.Second)
+			defer cancel()
+			w.WriteWithContext(ctx, nil)
+			return
+		}
+		defer s.end()
+		handler.ServeCOAP(w, req)
+	})
+}
+
+// begin counts a new request in flight, unless the server is draining
+func (s *Server) begin() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.draining {
+		return false
+	}
+	s.inFlight++
+	return true
+}
+
+// end counts a request out, the last one of a draining server closes drained
+func (s *Server) end() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.inFlight--
+	if s.draining && s.inFlight == 0 {
+		close(s.drained)
+	}
+}
+
+// drain stops new requests, closing drained at once if none is in flight
+func (s *Server) drain() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.draining {
+		return
+	}
+	s.draining = true
+	if s.inFlight == 0 {
+		close(s.drained)
+	}
+}
+
+// Draining reports whether the server has started to shut down
+func (s *Server) Draining() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.draining
+}
+
+// ListenAndServe serves requests until the server is shut down
+// If ready is not nil, it is called once the server is accepting requests.
+func (s *Server) ListenAndServe(ready func()) error {
+	errs := make(chan error, 2)
+	started := make(chan struct{})
+	s.coap.NotifyStartedFunc = func() {
+		close(started)
+	}
+	go func() {
+		errs <- s.serve()
+	}()
+
+	select {
+	case <-started:
+	case err := <-errs:
+		return err
+	}
+	if s.http != nil {
+		l, err := net.Listen("tcp", s.Addr)
+		if err != nil {
+			s.coap.Shutdown()
+			return err
+		}
+		go func() {
+			errs <- s.http.Serve(l)
+		}()
+	}
+	if ready != nil {
+		ready()
+	}
+
+	err := <-errs
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// serve runs the go-coap server, over a socket it listens on itself if the socket is wrapped
+func (s *Server) serve() error {
+	if s.Transport != UDP || (s.PacketConn == nil && len(s.Wrap) == 0) {
+		return s.coap.ListenAndServe()
+	}
+	conn := s.PacketConn
+	if conn == nil {
+		var err error
+		if conn, err = net.ListenPacket("udp", s.Addr); err != nil {
+			return err
+		}
+	}
+	for _, wrap := range s.Wrap {
+		conn = wrap(conn)
+	}
+	s.coap.PacketConn = conn
+	return s.coap.ActivateAndServe()
+}
+
+// Shutdown refuses new requests, waits for in-flight requests to complete or for the context to end, and then stops
+// the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drain()
+	var err error
+	select {
+	case <-s.drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("%s server stopped with requests in flight: %v", s.Transport, ctx.Err())
+	}
+	if s.http != nil {
+		s.http.Shutdown(ctx)
+	}
+	if serr := s.coap.Shutdown(); err == nil {
+		err = serr
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package coaptransport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// loadCertPool reads a PEM file and adds its certificates to a new pool
+func loadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	certPool := x509.NewCertPool()
+	if ok := certPool.AppendCertsFromPEM(b); !ok {
+		return nil, fmt.Errorf("failed to append cert from PEM %s", file)
+	}
+	return certPool, nil
+}
+
+// ServerTLSConfig creates a TLS configuration for a server that requires and verifies client certificates
+func ServerTLSConfig(certFile, keyFile, clientCertFile string) (*tls.Config, error) {
+	serverCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	certPool, err := loadCertPool(clientCertFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert, // set the server's policy for TLS Client Authentication
+		ClientCAs:    certPool,
+	}, nil
+}
+
+// ClientTLSConfig creates a TLS configuration for a client that presents its certificate and verifies the server
+func ClientTLSConfig(certFile, keyFile, serverCertFile string) (*tls.Config, error) {
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	certPool, err := loadCertPool(serverCertFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      certPool,
+	}, nil
+}
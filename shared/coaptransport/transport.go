@@ -0,0 +1,73 @@
+package coaptransport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"github.com/pion/dtls/v2"
+)
+
+// Transport identifies how CoAP messages are carried between a client and a server
+type Transport string
+
+const (
+	UDP       Transport = "udp"      // RFC 7252, the default
+	TCP       Transport = "tcp"      // RFC 8323, CoAP over TCP
+	TLS       Transport = "tcp-tls"  // RFC 8323, CoAP over TLS
+	WebSocket Transport = "ws"       // RFC 8323, CoAP over WebSockets
+	DTLS      Transport = "udp-dtls" // RFC 7252, CoAP over DTLS
+)
+
+// Transports lists every supported transport
+var Transports = []Transport{UDP, TCP, TLS, WebSocket, DTLS}
+
+// Credentials holds the configuration used by the secure transports
+type Credentials struct {
+	TLS  *tls.Config
+	DTLS *dtls.Config
+}
+
+// ParseTransport converts a flag value into a Transport
+func ParseTransport(s string) (Transport, error) {
+	for _, t := range Transports {
+		if string(t) == s {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown transport \"%s\", expected one of %v", s, Transports)
+}
+
+// ListenAndServe serves the handler on the given address using the chosen transport
+// The credentials are only used by the TLS and DTLS transports and may be nil otherwise, as are the wrappers by all
+// but the UDP transport.
+func ListenAndServe(t Transport, addr string, creds *Credentials, handler coap.Handler, wrap ...ConnWrapper) error {
+	s, err := NewServer(t, addr, creds, handler)
+	if err != nil {
+		return err
+	}
+	s.Wrap = wrap
+	return s.ListenAndServe(nil)
+}
+
+// Dial connects to the server at the given address using the chosen transport
+// The credentials are only used by the TLS and DTLS transports and may be nil otherwise
+func Dial(t Transport, addr string, creds *Credentials) (*coap.ClientConn, error) {
+	switch t {
+	case UDP, TCP:
+		return coap.Dial(string(t), addr)
+	case TLS:
+		if creds == nil || creds.TLS == nil {
+			return nil, fmt.Errorf("transport %s requires a TLS configuration", t)
+		}
+		return coap.DialTLS(string(t), addr, creds.TLS)
+	case DTLS:
+		if creds == nil || creds.DTLS == nil {
+			return nil, fmt.Errorf("transport %s requires a DTLS configuration", t)
+		}
+		return coap.DialDTLS(string(t), addr, creds.DTLS)
+	case WebSocket:
+		return dialWebSocket(addr)
+	default:
+		return nil, fmt.Errorf("unknown transport \"%s\"", t)
+	}
+}
@@ -0,0 +1,187 @@
+package coaptransport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"github.com/gorilla/websocket"
+	"io"
+	"log"
+	"net"
+	"net/http"
+)
+
+// The go-coap library speaks CoAP over TCP but not over WebSockets.
+// The two framings in RFC 8323 differ only in the header; over TCP the first nibble (and up to four extended bytes)
+// carries the length of the options and payload, while over WebSockets the nibble is always zero and the length
+// comes from the WebSocket frame. WebSocket connections are therefore bridged onto a loopback CoAP over TCP
+// connection and each message is re-framed as it passes through.
+
+const (
+	webSocketPath        = "/.well-known/coap"
+	webSocketSubprotocol = "coap"
+)
+
+// readTCPFrame reads a single CoAP over TCP message and returns it with WebSocket framing
+func readTCPFrame(r *bufio.Reader) ([]byte, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	tkl := int(first & 0x0f)
+	length := uint64(first >> 4)
+	switch length {
+	case 13, 14, 15:
+		// 13, 14 and 15 are followed by 1, 2 and 4 extended length bytes respectively
+		extended := make([]byte, 1<<(length-13))
+		if _, err := io.ReadFull(r, extended); err != nil {
+			return nil, err
+		}
+		switch length {
+		case 13:
+			length = uint64(extended[0]) + 13
+		case 14:
+			length = uint64(binary.BigEndian.Uint16(extended)) + 269
+		case 15:
+			length = uint64(binary.BigEndian.Uint32(extended)) + 65805
+		}
+	}
+	// code and token come before the options and payload
+	msg := make([]byte, 2+tkl+int(length))
+	msg[0] = byte(tkl)
+	if _, err := io.ReadFull(r, msg[1:]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// tcpFrame converts a CoAP over WebSockets message into one with CoAP over TCP framing
+func tcpFrame(msg []byte) ([]byte, error) {
+	if len(msg) < 2 {
+		return nil, fmt.Errorf("message too short: %d bytes", len(msg))
+	}
+	tkl := int(msg[0] & 0x0f)
+	if msg[0]>>4 != 0 || len(msg) < 2+tkl {
+		return nil, fmt.Errorf("malformed message header %#x", msg[0])
+	}
+	length := len(msg) - 2 - tkl
+
+	var header []byte
+	switch {
+	case length < 13:
+		header = []byte{byte(length<<4 | tkl)}
+	case length < 269:
+		header = []byte{byte(13<<4 | tkl), byte(length - 13)}
+	case length < 65805:
+		header = []byte{byte(14<<4 | tkl), 0, 0}
+		binary.BigEndian.PutUint16(header[1:], uint16(length-269))
+	default:
+		header = []byte{byte(15<<4 | tkl), 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(header[1:], uint32(length-65805))
+	}
+	return append(header, msg[1:]...), nil
+}
+
+// bridge copies messages between a WebSocket connection and a CoAP over TCP connection until either side closes
+func bridge(ws *websocket.Conn, conn net.Conn) {
+	defer ws.Close()
+	defer conn.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		defer func() { done <- struct{}{} }()
+		for {
+			messageType, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if messageType != websocket.BinaryMessage {
+				log.Printf("Ignoring WebSocket message of type %d", messageType)
+				continue
+			}
+			b, err := tcpFrame(msg)
+			if err != nil {
+				log.Printf("Dropping WebSocket message; %s", err)
+				continue
+			}
+			if _, err := conn.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer func() { done <- struct{}{} }()
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := readTCPFrame(r)
+			if err != nil {
+				return
+			}
+			if err := ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return
+			}
+		}
+	}()
+	<-done
+}
+
+// loopbackAddr finds a free port on the loopback interface
+func loopbackAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// webSocketHandler upgrades requests to WebSockets and bridges them onto the CoAP over TCP server at backend
+func webSocketHandler(backend string) http.Handler {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{webSocketSubprotocol},
+	}
+	router := http.NewServeMux()
+	router.HandleFunc(webSocketPath, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Printf("WebSocket upgrade failed: %v", err)
+			return
+		}
+		conn, err := net.Dial("tcp", backend)
+		if err != nil {
+			log.Printf("Unable to reach COAP backend: %v", err)
+			ws.Close()
+			return
+		}
+		go bridge(ws, conn)
+	})
+	return router
+}
+
+// dialWebSocket connects to a CoAP over WebSockets server
+// The returned client talks CoAP over TCP to a loopback listener that is bridged onto the WebSocket
+func dialWebSocket(addr string) (*coap.ClientConn, error) {
+	dialer := websocket.Dialer{
+		Subprotocols: []string{webSocketSubprotocol},
+	}
+	ws, _, err := dialer.Dial("ws://"+addr+webSocketPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			ws.Close()
+			return
+		}
+		bridge(ws, conn)
+	}()
+	return coap.Dial(string(TCP), l.Addr().String())
+}
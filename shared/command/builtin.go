@@ -0,0 +1,68 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/limaechocharlie/cwb/shared/transform"
+	"image"
+)
+
+// pointSchema is the schema of a JSON marshalled image.Point
+const pointSchema = `{
+	"type": "object",
+	"properties": {"X": {"type": "integer"}, "Y": {"type": "integer"}},
+	"required": ["X", "Y"]
+}`
+
+// area computes the area of a JSON marshalled image.Rectangle
+func area(ctx context.Context, params json.RawMessage) (string, error) {
+	var rect image.Rectangle
+	if err := json.Unmarshal(params, &rect); err != nil {
+		return "", Invalidf("", "%v", err)
+	}
+	return fmt.Sprintf("The area of the rectangle is %d", rect.Dx()*rect.Dy()), nil
+}
+
+// transformParams are the parameters of the transform command
+type transformParams struct {
+	Operation string `json:"operation"`
+	Text      string `json:"text"`
+}
+
+// transformText applies an operation of the transform package to a text
+func transformText(ctx context.Context, params json.RawMessage) (string, error) {
+	var p transformParams
+	if err := json.Unmarshal(params, &p); err != nil {
+		return "", Invalidf("", "%v", err)
+	}
+	op, err := transform.Lookup(p.Operation)
+	if err != nil {
+		return "", Invalidf("operation", "%v", err)
+	}
+	return op(p.Text), nil
+}
+
+func init() {
+	Default.MustRegister(Command{
+		Name:        "area",
+		Description: "Computes the area of a rectangle",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"properties": {"Min": ` + pointSchema + `, "Max": ` + pointSchema + `},
+			"required": ["Min", "Max"]
+		}`),
+		Handler: area,
+	})
+	Default.MustRegister(Command{
+		Name:        "transform",
+		Description: "Transforms a text with an operation of the transform package, e.g. reverse",
+		Schema: json.RawMessage(`{
+			"type": "object",
+			"properties": {"operation": {"type": "string"}, "text": {"type": "string"}},
+			"required": ["operation", "text"],
+			"additionalProperties": false
+		}`),
+		Handler: transformText,
+	})
+}
@@ -0,0 +1,149 @@
+// Package command holds the custom commands offered by the RPC example servers.
+//
+// A command is registered once with a name, a JSON schema for its parameters and a handler, and every server
+// dispatches its CustomCommand call through the registry, so the commands, their validation and their errors are
+// the same whatever the RPC framework. The schema is checked before the handler runs, so a handler only has to
+// unmarshal parameters that have the expected shape.
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Handler runs a command with its parameters, which are null if the request had none
+type Handler func(ctx context.Context, params json.RawMessage) (string, error)
+
+// Command is a registered command
+type Command struct {
+	Name        string
+	Description string
+	Schema      json.RawMessage // JSON schema of the parameters, none accepts any parameters
+	Handler     Handler
+
+	schema *schema
+}
+
+// Registry holds commands by name
+type Registry struct {
+	mutex    sync.RWMutex
+	commands map[string]*Command
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{commands: make(map[string]*Command)}
+}
+
+// Register adds the command, replacing any command with the same name
+func (r *Registry) Register(c Command) error {
+	if c.Name == "" {
+		return fmt.Errorf("command without a name")
+	}
+	if c.Handler == nil {
+		return fmt.Errorf("command %s without a handler", c.Name)
+	}
+	s, err := parseSchema(c.Schema)
+	if err != nil {
+		return fmt.Errorf("command %s: %v", c.Name, err)
+	}
+	c.schema = s
+	if len(c.Schema) > 0 {
+		// listed as is, so without the indentation of the source
+		var b bytes.Buffer
+		if err := json.Compact(&b, c.Schema); err != nil {
+			return fmt.Errorf("command %s: %v", c.Name, err)
+		}
+		c.Schema = b.Bytes()
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.commands[c.Name] = &c
+	return nil
+}
+
+// MustRegister adds the command like Register and panics if it can't, for commands registered at start up
+func (r *Registry) MustRegister(c Command) {
+	if err := r.Register(c); err != nil {
+		panic(err)
+	}
+}
+
+// Lookup finds the command with the name
+func (r *Registry) Lookup(name string) (Command, error) {
+	r.mutex.RLock()
+	c, ok := r.commands[name]
+	r.mutex.RUnlock()
+	if !ok {
+		return Command{}, Errorf(NotFound, "Unexpected command name \"%s\", expected one of %s", name,
+			strings.Join(r.Names(), ", "))
+	}
+	return *c, nil
+}
+
+// Names lists the registered commands in alphabetical order
+func (r *Registry) Names() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	names := make([]string, 0, len(r.commands))
+	for name := range r.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Commands lists the registered commands in alphabetical order
+func (r *Registry) Commands() []Command {
+	names := r.Names()
+	commands := make([]Command, 0, len(names))
+	for _, name := range names {
+		if c, err := r.Lookup(name); err == nil {
+			commands = append(commands, c)
+		}
+	}
+	return commands
+}
+
+// Run checks the parameters against the schema of the named command and runs it
+// Errors are always of type *Error: a handler error that isn't one is reported as Internal.
+func (r *Registry) Run(ctx context.Context, name string, params []byte) (string, error) {
+	c, err := r.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	if len(params) == 0 {
+		params = []byte("null")
+	}
+	if err := c.schema.validate(params); err != nil {
+		return "", err
+	}
+	result, err := c.Handler(ctx, params)
+	if err != nil {
+		return "", asError(err)
+	}
+	return result, nil
+}
+
+// Default is the registry of the example servers, holding the built-in commands
+var Default = NewRegistry()
+
+// Register adds the command to the default registry
+func Register(c Command) error {
+	return Default.Register(c)
+}
+
+// Commands lists the commands of the default registry
+func Commands() []Command {
+	return Default.Commands()
+}
+
+// Run runs a command of the default registry
+func Run(ctx context.Context, name string, params []byte) (string, error) {
+	return Default.Run(ctx, name, params)
+}
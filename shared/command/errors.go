@@ -0,0 +1,67 @@
+package command
+
+import "fmt"
+
+// Kind classifies a command error so that it maps onto the same error in every RPC framework
+type Kind int
+
+const (
+	Internal Kind = iota // the command failed
+	Invalid              // the parameters don't match the schema of the command or were refused by it
+	NotFound             // there is no command with the name
+)
+
+// String names the kind, e.g. as the code of a Thrift SimpleError
+func (k Kind) String() string {
+	switch k {
+	case Invalid:
+		return "INVALID_PARAMETERS"
+	case NotFound:
+		return "UNKNOWN_COMMAND"
+	}
+	return "COMMAND_FAILED"
+}
+
+// Violation is a parameter that doesn't match the schema
+type Violation struct {
+	Field       string // path of the parameter, e.g. Min.X, empty for the parameters as a whole
+	Description string
+}
+
+func (v Violation) String() string {
+	if v.Field == "" {
+		return v.Description
+	}
+	return v.Field + ": " + v.Description
+}
+
+// Error is an error with a kind
+// Handlers return an Error to control how the failure is reported, any other error is reported as Internal.
+type Error struct {
+	Kind       Kind
+	Message    string
+	Violations []Violation // the parameters that don't match, for Invalid errors
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf creates a new Error of the given kind
+func Errorf(kind Kind, format string, a ...interface{}) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
+}
+
+// Invalidf creates an Invalid error for a single parameter
+func Invalidf(field, format string, a ...interface{}) error {
+	v := Violation{Field: field, Description: fmt.Sprintf(format, a...)}
+	return &Error{Kind: Invalid, Message: "Invalid parameters: " + v.String(), Violations: []Violation{v}}
+}
+
+// asError converts any error into an Error
+func asError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Kind: Internal, Message: err.Error()}
+}
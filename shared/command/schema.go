@@ -0,0 +1,186 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// schema is the subset of JSON schema the commands use: type, properties, required, additionalProperties, items,
+// enum, minimum and maximum
+// Other keywords are ignored, as JSON schema does with unknown keywords.
+type schema struct {
+	Type                 string             `json:"type"`
+	Properties           map[string]*schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *bool              `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	Minimum              *json.Number       `json:"minimum"`
+	Maximum              *json.Number       `json:"maximum"`
+}
+
+// types are the values of the type keyword
+var types = map[string]bool{
+	"": true, "null": true, "boolean": true, "object": true, "array": true, "number": true, "integer": true,
+	"string": true,
+}
+
+// parseSchema reads a schema, nil if there is none, in which case any parameters are accepted
+func parseSchema(b json.RawMessage) (*schema, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	s := new(schema)
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(s); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	if err := s.check(); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	return s, nil
+}
+
+// check rejects types the validation doesn't know, which would otherwise never match
+func (s *schema) check() error {
+	if !types[s.Type] {
+		return fmt.Errorf("unknown type %s", s.Type)
+	}
+	for _, p := range s.Properties {
+		if err := p.check(); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.check()
+	}
+	return nil
+}
+
+// validate checks the parameters against the schema, returning an Invalid error with every violation
+func (s *schema) validate(params []byte) error {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(params))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return Invalidf("", "not JSON: %v", err)
+	}
+	if s == nil {
+		return nil
+	}
+	var violations []Violation
+	s.walk("", v, &violations)
+	if len(violations) == 0 {
+		return nil
+	}
+	descriptions := make([]string, len(violations))
+	for i, v := range violations {
+		descriptions[i] = v.String()
+	}
+	return &Error{
+		Kind:       Invalid,
+		Message:    "Invalid parameters: " + strings.Join(descriptions, "; "),
+		Violations: violations,
+	}
+}
+
+// typeOf returns the JSON schema type of a decoded value
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	}
+	return "string"
+}
+
+// path joins the path of a value to the name of one of its properties or items
+func path(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// walk adds the violations of the value at the path to the list
+func (s *schema) walk(at string, v interface{}, violations *[]Violation) {
+	add := func(format string, a ...interface{}) {
+		*violations = append(*violations, Violation{Field: at, Description: fmt.Sprintf(format, a...)})
+	}
+	t := typeOf(v)
+	if s.Type != "" && s.Type != t && !(s.Type == "number" && t == "integer") {
+		if v == nil && at == "" {
+			add("missing, expected %s", s.Type)
+		} else {
+			add("%s, expected %s", t, s.Type)
+		}
+		return
+	}
+	if len(s.Enum) > 0 && !s.inEnum(v) {
+		add("%v is not one of %v", v, s.Enum)
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		if s.Minimum != nil {
+			if min, _ := s.Minimum.Float64(); f < min {
+				add("%v is less than %v", v, min)
+			}
+		}
+		if s.Maximum != nil {
+			if max, _ := s.Maximum.Float64(); f > max {
+				add("%v is greater than %v", v, max)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				*violations = append(*violations, Violation{Field: path(at, name), Description: "missing"})
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if p, ok := s.Properties[name]; ok {
+				p.walk(path(at, name), v[name], violations)
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				*violations = append(*violations, Violation{Field: path(at, name), Description: "unexpected"})
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.walk(path(at, fmt.Sprint(i)), item, violations)
+			}
+		}
+	}
+}
+
+// inEnum tells whether the value is one of the enum values
+func (s *schema) inEnum(v interface{}) bool {
+	b, _ := json.Marshal(v)
+	for _, e := range s.Enum {
+		if eb, _ := json.Marshal(e); bytes.Equal(b, eb) {
+			return true
+		}
+	}
+	return false
+}
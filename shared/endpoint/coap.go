@@ -0,0 +1,102 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"log"
+	"time"
+)
+
+// negotiateCOAP chooses the request and response codecs from the Content-Format and Accept options
+// A request without a Content-Format is treated as CBOR and a response is sent in the request representation
+// unless the Accept option asks for another one.
+func negotiateCOAP(msg coap.Message) (request, response *Codec, err error) {
+	request = CBOR
+	if mt, ok := msg.Option(coap.ContentFormat).(coap.MediaType); ok {
+		if request, ok = codecByFormat(mt); !ok {
+			return nil, nil, Errorf(Unsupported, "Unsupported content format %d", mt)
+		}
+	}
+	mt, ok := msg.Option(coap.Accept).(coap.MediaType)
+	if !ok {
+		return request, request, nil
+	}
+	if response, ok = codecByFormat(mt); !ok {
+		return request, nil, Errorf(NotAcceptable, "Accepted content format %d is not supported", mt)
+	}
+	return request, response, nil
+}
+
+// writeCOAP writes the payload and logs any failure
+func writeCOAP(w coap.ResponseWriter, req *coap.Request, payload []byte) {
+	ctx, cancel := context.WithTimeout(req.Ctx, time.Second)
+	defer cancel()
+	if _, err := w.WriteWithContext(ctx, payload); err != nil {
+		log.Printf("Cannot send response: %v", err)
+	}
+}
+
+// writeCOAPError writes the error to the response in the chosen representation, or in CBOR if there isn't one
+func writeCOAPError(w coap.ResponseWriter, req *coap.Request, c *Codec, err *Error) {
+	if c == nil {
+		c = CBOR
+	}
+	log.Printf("COAP error: %s", err.Message)
+	w.SetCode(coapCode[err.Kind])
+	b, merr := c.Marshal(errorBody{Error: err.Message})
+	if merr != nil {
+		return
+	}
+	w.SetContentFormat(c.Format)
+	writeCOAP(w, req, b)
+}
+
+// coapHandler serves the endpoint over CoAP
+func (e *endpoint) coapHandler() coap.HandlerFunc {
+	return func(w coap.ResponseWriter, req *coap.Request) {
+		request, response, err := negotiateCOAP(req.Msg)
+		if err == nil {
+			err = e.checkCodecs(request, response)
+		}
+		if err != nil {
+			writeCOAPError(w, req, response, asError(err))
+			return
+		}
+		if req.Msg.Code() != coap.POST {
+			writeCOAPError(w, req, response, &Error{Kind: NotAllowed, Message: fmt.Sprintf("Unsupported method %s", req.Msg.Code())})
+			return
+		}
+		// block-wise transfers are reassembled before the handler runs, so the whole body is checked
+		if size := len(req.Msg.Payload()); size > maxBodySize {
+			writeCOAPError(w, req, response, &Error{Kind: TooLarge, Message: fmt.Sprintf("Payload of %d bytes exceeds the limit of %d", size, maxBodySize)})
+			return
+		}
+		out, err := e.call(req.Ctx, "COAP", func(v interface{}) error {
+			return request.Unmarshal(req.Msg.Payload(), v)
+		})
+		if err != nil {
+			writeCOAPError(w, req, response, asError(err))
+			return
+		}
+		b, err := response.Marshal(out)
+		if err != nil {
+			writeCOAPError(w, req, response, &Error{Kind: Internal, Message: fmt.Sprintf("Error marshalling response, %s", err)})
+			return
+		}
+		log.Printf("COAP response: %q", b)
+		w.SetContentFormat(response.Format)
+		writeCOAP(w, req, b)
+	}
+}
+
+// RegisterCOAP adds the endpoints to the CoAP mux, streams as newline delimited JSON bodies
+func (s *Service) RegisterCOAP(mux *coap.ServeMux) {
+	for _, e := range s.endpoints {
+		if e.stream {
+			mux.Handle(e.path, e.coapStreamHandler())
+		} else {
+			mux.Handle(e.path, e.coapHandler())
+		}
+	}
+}
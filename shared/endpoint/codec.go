@@ -0,0 +1,94 @@
+package endpoint
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/go-ocf/go-coap"
+	"github.com/ugorji/go/codec"
+	"mime"
+	"reflect"
+)
+
+// Codec marshals values into a single representation
+type Codec struct {
+	ContentType string         // HTTP media type
+	Format      coap.MediaType // CoAP content format
+	Marshal     func(v interface{}) ([]byte, error)
+	Unmarshal   func(b []byte, v interface{}) error
+	// Supports tells whether values of a type can be represented, nil if they all can
+	Supports func(t reflect.Type) bool
+}
+
+// supports tells whether the codec can represent values of the type
+func (c *Codec) supports(t reflect.Type) bool {
+	return c.Supports == nil || c.Supports(t)
+}
+
+// ugorjiCodec creates marshal and unmarshal functions from an ugorji codec handle
+func ugorjiCodec(h codec.Handle) (func(interface{}) ([]byte, error), func([]byte, interface{}) error) {
+	marshal := func(v interface{}) ([]byte, error) {
+		var buf bytes.Buffer
+		if err := codec.NewEncoder(&buf, h).Encode(v); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	unmarshal := func(b []byte, v interface{}) error {
+		return codec.NewDecoderBytes(b, h).Decode(v)
+	}
+	return marshal, unmarshal
+}
+
+var (
+	// JSON is the JSON representation
+	JSON = &Codec{
+		ContentType: "application/json",
+		Format:      coap.AppJSON,
+		Marshal:     json.Marshal,
+		Unmarshal:   json.Unmarshal,
+	}
+
+	// CBOR is the CBOR representation
+	CBOR = func() *Codec {
+		c := &Codec{ContentType: "application/cbor", Format: coap.AppCBOR}
+		c.Marshal, c.Unmarshal = ugorjiCodec(new(codec.CborHandle))
+		return c
+	}()
+
+	// MessagePack is the MessagePack representation
+	// MessagePack has no registered CoAP content format so a number from the experimental range is used
+	MessagePack = func() *Codec {
+		h := new(codec.MsgpackHandle)
+		h.WriteExt = true
+		c := &Codec{ContentType: "application/msgpack", Format: coap.MediaType(65000)}
+		c.Marshal, c.Unmarshal = ugorjiCodec(h)
+		return c
+	}()
+)
+
+// Codecs lists the supported representations in order of preference
+var Codecs = []*Codec{JSON, CBOR, MessagePack, SenMLCBOR}
+
+// codecByContentType finds the codec for an HTTP media type, ignoring any parameters
+func codecByContentType(ct string) (*Codec, bool) {
+	t, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return nil, false
+	}
+	for _, c := range Codecs {
+		if c.ContentType == t {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// codecByFormat finds the codec for a CoAP content format
+func codecByFormat(mt coap.MediaType) (*Codec, bool) {
+	for _, c := range Codecs {
+		if c.Format == mt {
+			return c, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,98 @@
+// Package endpoint serves typed Go functions over both HTTP and CoAP.
+// Every function is registered once and gets an HTTP endpoint and a CoAP resource with the same path, the same
+// content negotiation (JSON, CBOR and MessagePack) and the same error mapping.
+package endpoint
+
+import (
+	"context"
+	"log"
+	"reflect"
+)
+
+// Func is a typed function served by an endpoint
+type Func[In, Out any] func(context.Context, In) (Out, error)
+
+// Validator is implemented by request types that check their own values after decoding
+type Validator interface {
+	Validate() error
+}
+
+// endpoint holds a registered function with its types erased
+type endpoint struct {
+	path    string
+	summary string
+	in      reflect.Type
+	out     reflect.Type
+	stream  bool // the function is applied to each item in a stream of requests
+	// call decodes the request with the supplied function and calls the registered function
+	call func(ctx context.Context, protocol string, decode func(interface{}) error) (interface{}, error)
+}
+
+// Service is a set of endpoints
+type Service struct {
+	Title     string
+	Version   string
+	endpoints []*endpoint
+}
+
+// NewService creates a new service with no endpoints
+func NewService(title, version string) *Service {
+	return &Service{Title: title, Version: version}
+}
+
+// validate runs the validator of the request, if it has one
+func validate(in interface{}) error {
+	if v, ok := in.(Validator); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// checkCodecs rejects the negotiated representations that can't carry the types of the endpoint, e.g. SenML for
+// the arrays of a batch, before the request is decoded or the function called
+func (e *endpoint) checkCodecs(request, response *Codec) error {
+	if !request.supports(e.in) {
+		return Errorf(Unsupported, "%s can't represent a request of type %s", request.ContentType, e.in)
+	}
+	if !response.supports(e.out) {
+		return Errorf(NotAcceptable, "%s can't represent a response of type %s", response.ContentType, e.out)
+	}
+	return nil
+}
+
+// newEndpoint wraps the function so that it can be called with any decoder
+func newEndpoint[In, Out any](path, summary string, stream bool, fn Func[In, Out]) *endpoint {
+	return &endpoint{
+		path:    path,
+		summary: summary,
+		in:      reflect.TypeOf((*In)(nil)).Elem(),
+		out:     reflect.TypeOf((*Out)(nil)).Elem(),
+		stream:  stream,
+		call: func(ctx context.Context, protocol string, decode func(interface{}) error) (interface{}, error) {
+			var in In
+			if err := decode(&in); err != nil {
+				return nil, Errorf(Invalid, "Error reading body, %s", err)
+			}
+			if !stream {
+				log.Printf("%s unmarshalled request: %v", protocol, in)
+			}
+			// the method set of the pointer includes validators with value receivers
+			if err := validate(&in); err != nil {
+				return nil, Errorf(Invalid, "Invalid request, %s", err)
+			}
+			return fn(ctx, in)
+		},
+	}
+}
+
+// Register adds a function to the service under the given path
+func Register[In, Out any](s *Service, path, summary string, fn Func[In, Out]) {
+	s.endpoints = append(s.endpoints, newEndpoint(path, summary, false, fn))
+}
+
+// RegisterStream adds a function to the service that is applied to each request in a stream
+// Streams are newline delimited JSON, read and written line by line over HTTP and carried by block-wise transfer
+// over CoAP, see stream.go.
+func RegisterStream[In, Out any](s *Service, path, summary string, fn Func[In, Out]) {
+	s.endpoints = append(s.endpoints, newEndpoint(path, summary, true, fn))
+}
@@ -0,0 +1,72 @@
+package endpoint
+
+import (
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"net/http"
+)
+
+// Kind classifies an endpoint error so that it maps onto the same status in every protocol
+type Kind int
+
+const (
+	Internal      Kind = iota // the function failed
+	Invalid                   // the request could not be decoded or failed validation
+	NotFound                  // the requested item does not exist
+	Unsupported               // the request representation is not supported
+	NotAcceptable             // none of the accepted response representations are supported
+	NotAllowed                // the method is not supported by the endpoint
+	TooLarge                  // the request payload exceeds the size limit
+)
+
+// httpStatus maps error kinds onto HTTP status codes
+var httpStatus = map[Kind]int{
+	Internal:      http.StatusInternalServerError,
+	Invalid:       http.StatusBadRequest,
+	NotFound:      http.StatusNotFound,
+	Unsupported:   http.StatusUnsupportedMediaType,
+	NotAcceptable: http.StatusNotAcceptable,
+	NotAllowed:    http.StatusMethodNotAllowed,
+	TooLarge:      http.StatusRequestEntityTooLarge,
+}
+
+// coapCode maps error kinds onto CoAP response codes
+var coapCode = map[Kind]coap.COAPCode{
+	Internal:      coap.InternalServerError,
+	Invalid:       coap.BadRequest,
+	NotFound:      coap.NotFound,
+	Unsupported:   coap.UnsupportedMediaType,
+	NotAcceptable: coap.NotAcceptable,
+	NotAllowed:    coap.MethodNotAllowed,
+	TooLarge:      coap.RequestEntityTooLarge,
+}
+
+// Error is an error with a kind
+// Functions served by an endpoint return an Error to control the status of the response, any other error is
+// reported as Internal.
+type Error struct {
+	Kind    Kind
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Errorf creates a new Error of the given kind
+func Errorf(kind Kind, format string, a ...interface{}) error {
+	return &Error{Kind: kind, Message: fmt.Sprintf(format, a...)}
+}
+
+// asError converts any error into an Error
+func asError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return &Error{Kind: Internal, Message: err.Error()}
+}
+
+// errorBody is the representation of an error in a response payload
+type errorBody struct {
+	Error string `json:"error" codec:"error"`
+}
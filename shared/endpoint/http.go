@@ -0,0 +1,126 @@
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// maxBodySize limits the size of request payloads
+const maxBodySize = 1 << 20
+
+// negotiateHTTP chooses the request and response codecs from the request headers
+// A request without a Content-Type is treated as JSON and a response is sent in the request representation unless
+// the Accept header asks for another one. Quality values in the Accept header are ignored; the first supported
+// media type wins.
+func negotiateHTTP(r *http.Request) (request, response *Codec, err error) {
+	request = JSON
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var ok bool
+		if request, ok = codecByContentType(ct); !ok {
+			return nil, nil, Errorf(Unsupported, "Unsupported content type \"%s\"", ct)
+		}
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return request, request, nil
+	}
+	for _, a := range strings.Split(accept, ",") {
+		t, _, err := mime.ParseMediaType(a)
+		if err != nil {
+			continue
+		}
+		if t == "*/*" || t == "application/*" {
+			return request, request, nil
+		}
+		if c, ok := codecByContentType(t); ok {
+			return request, c, nil
+		}
+	}
+	return request, nil, Errorf(NotAcceptable, "None of the accepted media types \"%s\" are supported", accept)
+}
+
+// writeHTTPError writes the error to the response in the chosen representation, or in JSON if there isn't one
+func writeHTTPError(w http.ResponseWriter, c *Codec, err *Error) {
+	if c == nil {
+		c = JSON
+	}
+	log.Printf("HTTP error: %s", err.Message)
+	b, merr := c.Marshal(errorBody{Error: err.Message})
+	if merr != nil {
+		http.Error(w, err.Message, httpStatus[err.Kind])
+		return
+	}
+	w.Header().Set("Content-Type", c.ContentType)
+	w.WriteHeader(httpStatus[err.Kind])
+	w.Write(b)
+}
+
+// httpHandler serves the endpoint over HTTP
+func (e *endpoint) httpHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request, response, err := negotiateHTTP(r)
+		if err == nil {
+			err = e.checkCodecs(request, response)
+		}
+		if err != nil {
+			writeHTTPError(w, response, asError(err))
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeHTTPError(w, response, &Error{Kind: NotAllowed, Message: fmt.Sprintf("Unsupported method %s", r.Method)})
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeHTTPError(w, response, &Error{Kind: TooLarge, Message: fmt.Sprintf("Body exceeds the limit of %d bytes", maxBodySize)})
+			return
+		}
+		if err != nil {
+			writeHTTPError(w, response, &Error{Kind: Invalid, Message: fmt.Sprintf("Error reading body, %s", err)})
+			return
+		}
+		out, err := e.call(r.Context(), "HTTP", func(v interface{}) error {
+			return request.Unmarshal(body, v)
+		})
+		if err != nil {
+			writeHTTPError(w, response, asError(err))
+			return
+		}
+		b, err := response.Marshal(out)
+		if err != nil {
+			writeHTTPError(w, response, &Error{Kind: Internal, Message: fmt.Sprintf("Error marshalling response, %s", err)})
+			return
+		}
+		log.Printf("HTTP response: %q", b)
+		w.Header().Set("Content-Type", response.ContentType)
+		w.Write(b)
+	}
+}
+
+// RegisterHTTP adds the endpoints, and the OpenAPI description at /openapi.json, to the router
+func (s *Service) RegisterHTTP(router *mux.Router) {
+	for _, e := range s.endpoints {
+		if e.stream {
+			router.HandleFunc(e.path, e.streamHandler())
+		} else {
+			router.HandleFunc(e.path, e.httpHandler())
+		}
+	}
+	router.HandleFunc("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		b, err := s.OpenAPI()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	})
+}
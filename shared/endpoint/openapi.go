@@ -0,0 +1,141 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// fieldName returns the name of a struct field in a payload, taken from its JSON tag
+// ok is false if the field is not marshalled
+func fieldName(f reflect.StructField) (name string, omitempty, ok bool) {
+	if f.PkgPath != "" {
+		// unexported
+		return "", false, false
+	}
+	tag, found := f.Tag.Lookup("json")
+	if !found {
+		return f.Name, false, true
+	}
+	if tag == "-" {
+		return "", false, false
+	}
+	parts := strings.SplitN(tag, ",", 2)
+	name = f.Name
+	if parts[0] != "" {
+		name = parts[0]
+	}
+	return name, len(parts) > 1 && strings.Contains(parts[1], "omitempty"), true
+}
+
+// schema describes a Go type as an OpenAPI schema object
+func schema(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schema(t.Elem())}
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, omitempty, ok := fieldName(f)
+			if !ok {
+				continue
+			}
+			properties[name] = schema(f.Type)
+			if !omitempty {
+				required = append(required, name)
+			}
+		}
+		s := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		return s
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// content describes a payload of the given type in every representation that supports it
+func content(t reflect.Type) map[string]interface{} {
+	s := schema(t)
+	c := make(map[string]interface{})
+	for _, codec := range Codecs {
+		if codec.supports(t) {
+			c[codec.ContentType] = map[string]interface{}{"schema": s}
+		}
+	}
+	return c
+}
+
+// OpenAPI generates an OpenAPI 3 description of the HTTP endpoints
+// The CoAP resources share the paths, payloads and error mapping of the HTTP endpoints.
+func (s *Service) OpenAPI() ([]byte, error) {
+	errorResponse := func(status int) map[string]interface{} {
+		return map[string]interface{}{
+			"description": http.StatusText(status),
+			"content":     content(reflect.TypeOf(errorBody{})),
+		}
+	}
+
+	paths := make(map[string]interface{})
+	for _, e := range s.endpoints {
+		responses := map[string]interface{}{
+			"200": map[string]interface{}{
+				"description": "OK",
+				"content":     content(e.out),
+			},
+		}
+		for _, kind := range []Kind{Invalid, NotAcceptable, Unsupported, TooLarge, Internal} {
+			status := httpStatus[kind]
+			responses[strconv.Itoa(status)] = errorResponse(status)
+		}
+		requestContent := content(e.in)
+		if e.stream {
+			// each line of the request and response holds one item
+			requestContent = map[string]interface{}{ndjson: map[string]interface{}{"schema": schema(e.in)}}
+			responses["200"] = map[string]interface{}{
+				"description": "OK, one line per request line; a line that fails holds an error instead",
+				"content":     map[string]interface{}{ndjson: map[string]interface{}{"schema": schema(e.out)}},
+			}
+		}
+		paths[e.path] = map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": e.summary,
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content":  requestContent,
+				},
+				"responses": responses,
+			},
+		}
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   s.Title,
+			"version": s.Version,
+		},
+		"paths": paths,
+	}, "", "  ")
+}
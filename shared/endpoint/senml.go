@@ -0,0 +1,108 @@
+package endpoint
+
+import (
+	"fmt"
+	"github.com/limaechocharlie/cwb/shared/senml"
+	"reflect"
+	"time"
+)
+
+// SenMLCBOR represents a flat struct as a SenML pack with a record per field
+// Records are named after the JSON names of the fields and a unit is taken from the senml tag, e.g. `senml:"rad"`.
+var SenMLCBOR = &Codec{
+	ContentType: senml.CBORContentType,
+	Format:      senml.CBORFormat,
+	Marshal:     marshalSenML,
+	Unmarshal:   unmarshalSenML,
+	Supports: func(t reflect.Type) bool {
+		return t.Kind() == reflect.Struct
+	},
+}
+
+// senmlStruct returns the struct value held by v
+func senmlStruct(v interface{}) (reflect.Value, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return rv, fmt.Errorf("SenML requires a struct, not %s", rv.Type())
+	}
+	return rv, nil
+}
+
+func marshalSenML(v interface{}) ([]byte, error) {
+	rv, err := senmlStruct(v)
+	if err != nil {
+		return nil, err
+	}
+	var pack senml.Pack
+	for i := 0; i < rv.NumField(); i++ {
+		f := rv.Type().Field(i)
+		name, _, ok := fieldName(f)
+		if !ok {
+			continue
+		}
+		record := senml.Record{Name: name, Unit: f.Tag.Get("senml")}
+		if record.Unit != "" && !senml.ValidUnit(record.Unit) {
+			return nil, fmt.Errorf("field %s has unregistered SenML unit \"%s\"", f.Name, record.Unit)
+		}
+		fv := rv.Field(i)
+		switch fv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			record.Value = senml.Float(fv.Convert(reflect.TypeOf(float64(0))).Float())
+		case reflect.String:
+			record.StringValue = senml.String(fv.String())
+		case reflect.Bool:
+			record.BoolValue = senml.Bool(fv.Bool())
+		default:
+			return nil, fmt.Errorf("field %s of type %s can't be represented in SenML", f.Name, f.Type)
+		}
+		pack = append(pack, record)
+	}
+	return senml.EncodeCBOR(pack)
+}
+
+func unmarshalSenML(b []byte, v interface{}) error {
+	rv, err := senmlStruct(v)
+	if err != nil {
+		return err
+	}
+	if !rv.CanSet() {
+		return fmt.Errorf("SenML requires a pointer to a struct")
+	}
+	pack, err := senml.DecodeCBOR(b)
+	if err != nil {
+		return err
+	}
+	// resolve so that records named with a base name match the fields
+	if pack, err = senml.Resolve(pack, time.Now()); err != nil {
+		return err
+	}
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < rv.NumField(); i++ {
+		if name, _, ok := fieldName(rv.Type().Field(i)); ok {
+			fields[name] = rv.Field(i)
+		}
+	}
+	for _, record := range pack {
+		fv, ok := fields[record.Name]
+		if !ok {
+			return fmt.Errorf("unexpected SenML record \"%s\"", record.Name)
+		}
+		var value interface{}
+		switch {
+		case record.Value != nil:
+			value = *record.Value
+		case record.StringValue != nil:
+			value = *record.StringValue
+		case record.BoolValue != nil:
+			value = *record.BoolValue
+		}
+		x := reflect.ValueOf(value)
+		if !x.IsValid() || !x.Type().ConvertibleTo(fv.Type()) || (fv.Kind() == reflect.String) != (x.Kind() == reflect.String) {
+			return fmt.Errorf("SenML record \"%s\" has no value of type %s", record.Name, fv.Type())
+		}
+		fv.Set(x.Convert(fv.Type()))
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package endpoint
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"io"
+	"log"
+	"net/http"
+)
+
+const (
+	// ndjson is the media type of newline delimited JSON
+	ndjson = "application/x-ndjson"
+	// ndjsonFormat is the CoAP content format of newline delimited JSON
+	// It has no registered content format so a number from the experimental range is used, after MessagePack's.
+	ndjsonFormat coap.MediaType = 65001
+	// maxLineSize limits the size of a single item in a stream
+	maxLineSize = 64 * 1024
+	// flushInterval is the number of response lines written between flushes
+	flushInterval = 100
+)
+
+// streamError replaces the response line of a request line that failed
+type streamError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// convertLines applies the function of the endpoint to each line of newline delimited JSON read from r and writes
+// a response line for each to w, calling flush every flushInterval lines
+// Each request line is converted and written out before the next is read, so memory use does not grow with the
+// length of the stream.
+func (e *endpoint) convertLines(ctx context.Context, protocol string, r io.Reader, w io.Writer, flush func()) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxLineSize)
+	encoder := json.NewEncoder(w)
+	line := 0
+	for scanner.Scan() {
+		line++
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		out, err := e.call(ctx, protocol, func(v interface{}) error {
+			return json.Unmarshal(b, v)
+		})
+		if err != nil {
+			out = streamError{Line: line, Error: err.Error()}
+		}
+		if err := encoder.Encode(out); err != nil {
+			return fmt.Errorf("stopped at line %d: %v", line, err)
+		}
+		if line%flushInterval == 0 {
+			flush()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		encoder.Encode(streamError{Line: line + 1, Error: err.Error()})
+	}
+	log.Printf("%s stream of %d lines complete", protocol, line)
+	return nil
+}
+
+// streamHandler serves the endpoint over HTTP as a stream of newline delimited JSON
+// The response is written while the request is still being read.
+func (e *endpoint) streamHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeHTTPError(w, JSON, &Error{Kind: NotAllowed, Message: fmt.Sprintf("Unsupported method %s", r.Method)})
+			return
+		}
+		// HTTP/1 clients expect to read the response while they are still sending the request
+		rc := http.NewResponseController(w)
+		if err := rc.EnableFullDuplex(); err != nil {
+			log.Printf("HTTP stream is not full duplex: %v", err)
+		}
+		w.Header().Set("Content-Type", ndjson)
+		if err := e.convertLines(r.Context(), "HTTP", r.Body, w, func() { rc.Flush() }); err != nil {
+			log.Printf("HTTP stream %v", err)
+			return
+		}
+		rc.Flush()
+	}
+}
+
+// coapStreamHandler serves the endpoint over CoAP as a newline delimited JSON body
+// CoAP has no request streams, so the stream is carried by block-wise transfer: the library reassembles the
+// request blocks before the handler runs and sends the response in blocks. Unlike over HTTP the whole stream is
+// held in memory, so it is limited to maxBodySize and longer streams have to go over HTTP.
+func (e *endpoint) coapStreamHandler() coap.HandlerFunc {
+	return func(w coap.ResponseWriter, req *coap.Request) {
+		if mt, ok := req.Msg.Option(coap.ContentFormat).(coap.MediaType); ok && mt != ndjsonFormat {
+			writeCOAPError(w, req, JSON, &Error{Kind: Unsupported, Message: fmt.Sprintf("Unsupported content format %d, streams are newline delimited JSON (%d)", mt, ndjsonFormat)})
+			return
+		}
+		if mt, ok := req.Msg.Option(coap.Accept).(coap.MediaType); ok && mt != ndjsonFormat {
+			writeCOAPError(w, req, JSON, &Error{Kind: NotAcceptable, Message: fmt.Sprintf("Accepted content format %d is not supported, streams are newline delimited JSON (%d)", mt, ndjsonFormat)})
+			return
+		}
+		if req.Msg.Code() != coap.POST {
+			writeCOAPError(w, req, JSON, &Error{Kind: NotAllowed, Message: fmt.Sprintf("Unsupported method %s", req.Msg.Code())})
+			return
+		}
+		payload := req.Msg.Payload()
+		if len(payload) > maxBodySize {
+			writeCOAPError(w, req, JSON, &Error{Kind: TooLarge, Message: fmt.Sprintf("Payload of %d bytes exceeds the limit of %d", len(payload), maxBodySize)})
+			return
+		}
+		var out bytes.Buffer
+		if err := e.convertLines(req.Ctx, "COAP", bytes.NewReader(payload), &out, func() {}); err != nil {
+			writeCOAPError(w, req, JSON, &Error{Kind: Internal, Message: err.Error()})
+			return
+		}
+		w.SetContentFormat(ndjsonFormat)
+		writeCOAP(w, req, out.Bytes())
+	}
+}
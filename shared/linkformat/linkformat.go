@@ -0,0 +1,271 @@
+// Package linkformat parses and writes the CoRE Link Format served at /.well-known/core.
+// See https://tools.ietf.org/html/rfc6690
+package linkformat
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Param is a single link parameter
+// A parameter without a value, e.g. obs, has an empty Value.
+type Param struct {
+	Name  string
+	Value string
+}
+
+// Link is a single web link
+type Link struct {
+	Target string
+	Params []Param
+}
+
+// Get returns the value of the first parameter with the name
+func (l Link) Get(name string) (string, bool) {
+	for _, p := range l.Params {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set replaces the value of the parameter with the name, or adds the parameter if the link doesn't have it
+func (l *Link) Set(name, value string) {
+	for i, p := range l.Params {
+		if p.Name == name {
+			l.Params[i].Value = value
+			return
+		}
+	}
+	l.Params = append(l.Params, Param{Name: name, Value: value})
+}
+
+// Matches reports whether the link passes the query filter name=value
+// The value may end in * to match by prefix, href is matched against the target and the space separated values of
+// rt, if and rel are matched individually; see section 4.1 of the spec.
+func (l Link) Matches(name, value string) bool {
+	match := func(s string) bool {
+		if strings.HasSuffix(value, "*") {
+			return strings.HasPrefix(s, strings.TrimSuffix(value, "*"))
+		}
+		return s == value
+	}
+	if name == "href" {
+		return match(l.Target)
+	}
+	for _, p := range l.Params {
+		if p.Name != name {
+			continue
+		}
+		if name == "rt" || name == "if" || name == "rel" {
+			for _, v := range strings.Fields(p.Value) {
+				if match(v) {
+					return true
+				}
+			}
+		} else if match(p.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// String writes the link in link format
+func (l Link) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%s>", l.Target)
+	for _, p := range l.Params {
+		b.WriteString(";" + p.Name)
+		if p.Value == "" {
+			continue
+		}
+		if isToken(p.Value) {
+			b.WriteString("=" + p.Value)
+		} else {
+			b.WriteString("=" + quote(p.Value))
+		}
+	}
+	return b.String()
+}
+
+// MarshalJSON writes the link as an object with the target in href and a member for each parameter
+// Parameters without a value are written as true.
+func (l Link) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{"href": l.Target}
+	for _, p := range l.Params {
+		if p.Value == "" {
+			m[p.Name] = true
+		} else {
+			m[p.Name] = p.Value
+		}
+	}
+	return json.Marshal(m)
+}
+
+// Format writes the links in link format
+func Format(links []Link) string {
+	s := make([]string, len(links))
+	for i, l := range links {
+		s[i] = l.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// Filter returns the links that pass every query filter
+// Filters are in the form name=value, as found in the Uri-Query options of a discovery request.
+func Filter(links []Link, filters []string) []Link {
+	var matched []Link
+next:
+	for _, l := range links {
+		for _, f := range filters {
+			parts := strings.SplitN(f, "=", 2)
+			if len(parts) != 2 || !l.Matches(parts[0], parts[1]) {
+				continue next
+			}
+		}
+		matched = append(matched, l)
+	}
+	return matched
+}
+
+// Parse reads links in link format
+func Parse(s string) ([]Link, error) {
+	p := &parser{s: s}
+	var links []Link
+	for {
+		p.skipSpace()
+		if p.done() {
+			return links, nil
+		}
+		l, err := p.link()
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+		p.skipSpace()
+		if p.done() {
+			return links, nil
+		}
+		if p.next() != ',' {
+			return nil, p.errorf("expected ','")
+		}
+	}
+}
+
+// parser reads link format one character at a time
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *parser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *parser) next() byte {
+	c := p.peek()
+	p.pos++
+	return c
+}
+
+func (p *parser) skipSpace() {
+	for !p.done() && (p.peek() == ' ' || p.peek() == '\t' || p.peek() == '\r' || p.peek() == '\n') {
+		p.pos++
+	}
+}
+
+func (p *parser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("link format: %s at offset %d", fmt.Sprintf(format, a...), p.pos)
+}
+
+// link reads <target> followed by any parameters
+func (p *parser) link() (Link, error) {
+	var l Link
+	if p.next() != '<' {
+		return l, p.errorf("expected '<'")
+	}
+	end := strings.IndexByte(p.s[p.pos:], '>')
+	if end < 0 {
+		return l, p.errorf("unterminated target")
+	}
+	l.Target = p.s[p.pos : p.pos+end]
+	p.pos += end + 1
+	for {
+		p.skipSpace()
+		if p.peek() != ';' {
+			return l, nil
+		}
+		p.pos++
+		p.skipSpace()
+		param, err := p.param()
+		if err != nil {
+			return l, err
+		}
+		l.Params = append(l.Params, param)
+	}
+}
+
+// param reads name, name=token or name="quoted string"
+func (p *parser) param() (Param, error) {
+	start := p.pos
+	for !p.done() && p.peek() != '=' && p.peek() != ';' && p.peek() != ',' && p.peek() != ' ' {
+		p.pos++
+	}
+	param := Param{Name: p.s[start:p.pos]}
+	if param.Name == "" {
+		return param, p.errorf("expected a parameter name")
+	}
+	if p.peek() != '=' {
+		return param, nil
+	}
+	p.pos++
+	if p.peek() != '"' {
+		start = p.pos
+		for !p.done() && p.peek() != ';' && p.peek() != ',' {
+			p.pos++
+		}
+		param.Value = strings.TrimSpace(p.s[start:p.pos])
+		return param, nil
+	}
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.done() {
+			return param, p.errorf("unterminated quoted string")
+		}
+		c := p.next()
+		if c == '"' {
+			break
+		}
+		if c == '\\' && !p.done() {
+			c = p.next()
+		}
+		b.WriteByte(c)
+	}
+	param.Value = b.String()
+	return param, nil
+}
+
+// isToken reports whether the value can be written without quotes
+func isToken(s string) bool {
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'()*+-.:<=>?@[]^_`{|}~/", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// quote writes the value as a quoted string
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,77 @@
+package netsim
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time on which packets cross the links of a network
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the time of the system
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// ManualClock is a clock that only moves when advanced
+type ManualClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []waiter
+}
+
+// waiter is a call to After that hasn't fired yet
+type waiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+// NewManualClock creates a clock stopped at the time
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the time the clock has been advanced to
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the time once the clock has been advanced by d
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{at: c.now.Add(d), c: ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, firing the calls to After that are due
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+		} else {
+			w.c <- c.now
+		}
+	}
+	c.waiters = waiters
+}
@@ -0,0 +1,231 @@
+package netsim_test
+
+import (
+	"context"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/coaplimit"
+	"github.com/limaechocharlie/cwb/shared/coapobserve"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
+	"github.com/limaechocharlie/cwb/shared/netsim"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serve starts a CoAP server for the handler on a loopback port and returns its address
+func serve(t *testing.T, handler coap.Handler, wrap ...coaptransport.ConnWrapper) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := conn.LocalAddr().String()
+	s, err := coaptransport.NewServer(coaptransport.UDP, addr, nil, handler)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	s.PacketConn = conn
+	s.Wrap = wrap
+	ready := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.ListenAndServe(func() { close(ready) })
+	}()
+	select {
+	case <-ready:
+	case err := <-errs:
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+	return addr
+}
+
+// dial connects a client to the server at the address through a relay across the network
+func dial(t *testing.T, n *netsim.Network, addr string) (*coap.ClientConn, *netsim.Relay) {
+	t.Helper()
+	relay, err := n.Relay(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { relay.Close() })
+	co, err := coaptransport.Dial(coaptransport.UDP, relay.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { co.Close() })
+	return co, relay
+}
+
+// observer is the registration of a client observing a resource
+type observer struct {
+	w   coap.ResponseWriter
+	req *coap.Request
+}
+
+// observers answers registrations with sequence number 0 and hands them to the test, which sends the notifications
+type observers chan observer
+
+func (o observers) ServeCOAP(w coap.ResponseWriter, req *coap.Request) {
+	resp := w.NewResponse(coap.Content)
+	register, ok := req.Msg.Option(coap.Observe).(uint32)
+	if ok && register == 0 {
+		resp.SetOption(coap.Observe, uint32(0))
+	}
+	if err := w.WriteMsg(resp); err != nil || !ok || register != 0 {
+		return
+	}
+	o <- observer{w, req}
+}
+
+// register waits for the client to register
+func (o observers) register(t *testing.T) observer {
+	t.Helper()
+	select {
+	case registration := <-o:
+		return registration
+	case <-time.After(5 * time.Second):
+		t.Fatal("observation not registered")
+		return observer{}
+	}
+}
+
+// notification creates a non-confirmable notification with the sequence number
+func notification(w coap.ResponseWriter, sequence uint32) coap.Message {
+	msg := w.NewResponse(coap.Content)
+	msg.SetType(coap.NonConfirmable)
+	msg.SetMessageID(coap.GenerateMessageID())
+	msg.SetOption(coap.Observe, sequence)
+	msg.SetPayload([]byte(strconv.Itoa(int(sequence))))
+	return msg
+}
+
+// sequences collects the sequence numbers of the notifications a client receives
+type sequences struct {
+	mutex    sync.Mutex
+	received []uint32
+	accepted []uint32 // the received ones that are newer than those accepted before
+}
+
+func (s *sequences) handle(req *coap.Request) {
+	sequence, ok := req.Msg.Option(coap.Observe).(uint32)
+	if !ok {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.received = append(s.received, sequence)
+	if len(s.accepted) == 0 || coapobserve.Newer(s.accepted[len(s.accepted)-1], sequence) {
+		s.accepted = append(s.accepted, sequence)
+	}
+}
+
+// has reports whether the notification with the sequence number was accepted
+func (s *sequences) has(sequence uint32) bool {
+	for _, accepted := range s.accepted {
+		if accepted == sequence {
+			return true
+		}
+	}
+	return false
+}
+
+func TestObserveReorderedNotifications(t *testing.T) {
+	const notifications = 30
+	registrations := make(observers, 1)
+	addr := serve(t, registrations)
+	n := netsim.NewNetwork(7, netsim.Conditions{})
+	defer n.Close()
+	co, relay := dial(t, n, addr)
+	client, target := relay.Ends(0)
+	n.SetConditions(target, client, netsim.Conditions{Reorder: 0.3})
+
+	var s sequences
+	obs, err := co.Observe("/resource", s.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obs.Cancel()
+	o := registrations.register(t)
+	for i := uint32(1); i <= notifications; i++ {
+		if err := o.w.WriteMsg(notification(o.w, i)); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// a notification held back at the end is delivered after at most 200ms
+	time.Sleep(300 * time.Millisecond)
+
+	if stats := n.Stats(); stats.Reordered == 0 {
+		t.Fatalf("no notification reordered: %+v", stats)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.accepted) == 0 || s.accepted[len(s.accepted)-1] != notifications {
+		t.Fatalf("received %v, accepted %v, expected to end with notification %d", s.received, s.accepted, notifications)
+	}
+	for i := 1; i < len(s.accepted); i++ {
+		if s.accepted[i] <= s.accepted[i-1] {
+			t.Fatalf("accepted %v, with stale notifications", s.accepted)
+		}
+	}
+}
+
+func TestConfirmableNotificationsRetransmitted(t *testing.T) {
+	registrations := make(observers, 1)
+	acks := coaplimit.NewAcks()
+	acks.AckTimeout = 50 * time.Millisecond
+	addr := serve(t, registrations, acks.Conn)
+	n := netsim.NewNetwork(1, netsim.Conditions{})
+	defer n.Close()
+	co, relay := dial(t, n, addr)
+	client, target := relay.Ends(0)
+
+	var s sequences
+	obs, err := co.Observe("/resource", s.handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obs.Cancel()
+	o := registrations.register(t)
+	pacer := coaplimit.NewPacer()
+	send := func(sequence uint32) error {
+		return pacer.Send(context.Background(), coaplimit.Peer(o.req), 1, func(ctx context.Context) error {
+			return acks.SendConfirmable(ctx, o.w, o.req, notification(o.w, sequence))
+		})
+	}
+
+	// the first acknowledgements are lost, a retransmission once the link recovers is acknowledged
+	n.SetConditions(client, target, netsim.Conditions{Loss: 1})
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		n.SetConditions(client, target, netsim.Conditions{})
+	}()
+	if err := send(1); err != nil {
+		t.Fatalf("notification not acknowledged once the link recovered: %v", err)
+	}
+	if stats := n.Stats(); stats.Lost == 0 {
+		t.Fatalf("no acknowledgement lost: %+v", stats)
+	}
+
+	// without acknowledgements the notification is given up on, and the client is probed at the probing rate
+	n.SetConditions(client, target, netsim.Conditions{Loss: 1})
+	if err := send(2); err != coaplimit.ErrNoAck {
+		t.Fatalf("expected %v without acknowledgements, got %v", coaplimit.ErrNoAck, err)
+	}
+	if err := send(3); err != coaplimit.ErrPaced {
+		t.Fatalf("expected %v right after a missing acknowledgement, got %v", coaplimit.ErrPaced, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.has(1) || !s.has(2) {
+		t.Fatalf("received %v, expected notifications 1 and 2", s.received)
+	}
+}
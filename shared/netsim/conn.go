@@ -0,0 +1,178 @@
+package netsim
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned when using a closed PacketConn
+var ErrClosed = errors.New("netsim: use of closed connection")
+
+// datagram is a packet waiting to be read
+type datagram struct {
+	payload []byte
+	from    net.Addr
+}
+
+// PacketConn is an endpoint on a simulated network
+// Addresses are UDP addresses so that code which expects them keeps working.
+type PacketConn struct {
+	network *Network
+	addr    *net.UDPAddr
+	inbox   chan datagram
+	closed  chan struct{}
+	once    sync.Once
+
+	mutex         sync.Mutex
+	readDeadline  time.Time
+	deadlineReset chan struct{} // closed when the read deadline changes
+}
+
+// ListenPacket creates an endpoint at the address, in the form host:port
+// A port of 0 picks a free port.
+func (n *Network) ListenPacket(address string) (*PacketConn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if host == "" {
+		ip = net.IPv4(127, 0, 0, 1)
+	} else if ip == nil {
+		return nil, fmt.Errorf("netsim: %s is not an IP address", host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("netsim: invalid port %s", port)
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	addr := &net.UDPAddr{IP: ip, Port: p}
+	for p == 0 {
+		addr.Port = n.nextPort
+		n.nextPort++
+		if _, ok := n.conns[addr.String()]; !ok {
+			break
+		}
+	}
+	if _, ok := n.conns[addr.String()]; ok {
+		return nil, fmt.Errorf("netsim: address %s already in use", addr)
+	}
+	c := &PacketConn{
+		network:       n,
+		addr:          addr,
+		inbox:         make(chan datagram, 256),
+		closed:        make(chan struct{}),
+		deadlineReset: make(chan struct{}),
+	}
+	n.conns[addr.String()] = c
+	return c, nil
+}
+
+// conn finds the endpoint at the address
+func (n *Network) conn(addr string) (*PacketConn, bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	c, ok := n.conns[addr]
+	return c, ok
+}
+
+// ReadFrom reads the next packet sent to the endpoint
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mutex.Lock()
+		deadline, reset := c.readDeadline, c.deadlineReset
+		c.mutex.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			t := time.NewTimer(d)
+			timeout = t.C
+			defer t.Stop()
+		}
+
+		select {
+		case <-c.closed:
+			return 0, nil, ErrClosed
+		case d := <-c.inbox:
+			return copy(b, d.payload), d.from, nil
+		case <-timeout:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-reset:
+			// the deadline has changed, wait again with the new one
+		}
+	}
+}
+
+// WriteTo sends the packet to the address across the simulated link
+// As with UDP, a packet to an address nobody is listening on is silently lost.
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, ErrClosed
+	default:
+	}
+	from, to := c.addr.String(), addr.String()
+	c.network.link(from, to).send(b, func(payload []byte) {
+		dest, ok := c.network.conn(to)
+		if !ok {
+			return
+		}
+		select {
+		case dest.inbox <- datagram{payload: payload, from: c.addr}:
+		default:
+			// the receive buffer is full, drop the packet as a socket would
+		}
+	})
+	return len(b), nil
+}
+
+// Close removes the endpoint from the network, unblocking any reads
+func (c *PacketConn) Close() error {
+	err := ErrClosed
+	c.once.Do(func() {
+		close(c.closed)
+		c.network.mutex.Lock()
+		delete(c.network.conns, c.addr.String())
+		c.network.mutex.Unlock()
+		err = nil
+	})
+	return err
+}
+
+// LocalAddr returns the address of the endpoint
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline sets the read deadline; writes never block
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the time after which reads fail, a zero time means reads never time out
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.readDeadline = t
+	close(c.deadlineReset)
+	c.deadlineReset = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing since writes never block
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+var _ net.PacketConn = (*PacketConn)(nil)
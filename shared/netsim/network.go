@@ -0,0 +1,267 @@
+// Package netsim simulates a lossy datagram network in process, so that CoAP exchanges can be exercised without
+// real sockets or real packet loss.
+//
+// A Network hands out PacketConns that implement net.PacketConn. Every packet written to a PacketConn crosses the
+// link from its source to its destination, and the Conditions of the link decide whether it is lost, duplicated,
+// reordered or delayed. The decisions are taken by a random source seeded from the network seed and the name of the
+// link, so the nth packet on a link suffers the same fate on every run whatever the interleaving of other links.
+// Links between PacketConns are named after their addresses, which are handed out in order, and the links of a Relay
+// after the order in which its clients appear rather than their ephemeral ports.
+//
+// Packets cross the links on the time of a Clock. The real clock is used by default; a ManualClock only moves when
+// advanced, so that delays and held packets don't depend on the scheduler in tests.
+//
+// A CoAP server runs over any net.PacketConn, including a simulated one, through coaptransport.Server.PacketConn. A
+// go-coap client dials its own UDP socket, so a Relay forwards between a loopback UDP socket and the server across the
+// simulated links; point the client at the relay address instead of the server. The CoAP tests of this package run
+// observations through a relay this way.
+package netsim
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Conditions describes how a link impairs the packets sent over it
+// Probabilities are between 0 and 1.
+type Conditions struct {
+	Loss      float64       // probability that a packet is dropped
+	Duplicate float64       // probability that a packet is delivered twice
+	Reorder   float64       // probability that a packet is held back until after the next packet on the link, at most holdTime
+	Delay     time.Duration // time taken to cross the link
+	Jitter    time.Duration // maximum extra delay, packets are never reordered by it
+}
+
+// holdTime is how long a reordered packet waits for the next packet on the link before it is delivered anyway
+const holdTime = 200 * time.Millisecond
+
+// Stats counts what happened to the packets sent over the network
+type Stats struct {
+	Sent       int
+	Lost       int
+	Duplicated int
+	Reordered  int
+	Delivered  int
+}
+
+// Network is a simulated datagram network
+type Network struct {
+	seed     int64
+	mutex    sync.Mutex
+	clock    Clock
+	defaults Conditions
+	links    map[linkID]*link
+	conns    map[string]*PacketConn
+	nextPort int
+	relays   int
+	stats    Stats
+}
+
+// NewNetwork creates a network whose links all start with the same conditions
+func NewNetwork(seed int64, conditions Conditions) *Network {
+	return &Network{
+		seed:     seed,
+		clock:    realClock{},
+		defaults: conditions,
+		links:    make(map[linkID]*link),
+		conns:    make(map[string]*PacketConn),
+		nextPort: 49152,
+	}
+}
+
+// SetClock changes the clock of the links created from now on, so it should be called before any packet is sent
+func (n *Network) SetClock(c Clock) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.clock = c
+}
+
+// SetConditions changes the conditions of the link in one direction, from and to are addresses or, for the links of a
+// Relay, the names returned by Relay.Ends
+func (n *Network) SetConditions(from, to string, conditions Conditions) {
+	l := n.link(from, to)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.conditions = conditions
+}
+
+// Stats returns the packet counts so far
+func (n *Network) Stats() Stats {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.stats
+}
+
+func (n *Network) count(f func(s *Stats)) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	f(&n.stats)
+}
+
+// Close stops delivering packets and closes every endpoint
+func (n *Network) Close() error {
+	n.mutex.Lock()
+	links := n.links
+	conns := n.conns
+	n.links = make(map[linkID]*link)
+	n.conns = make(map[string]*PacketConn)
+	n.mutex.Unlock()
+
+	for _, l := range links {
+		l.mutex.Lock()
+		l.closed = true
+		close(l.queue)
+		l.mutex.Unlock()
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	return nil
+}
+
+// linkID identifies a link by the names of its ends
+type linkID struct {
+	from, to string
+}
+
+// link carries packets in one direction between two addresses
+type link struct {
+	network    *Network
+	id         linkID
+	clock      Clock
+	mutex      sync.Mutex
+	conditions Conditions
+	rand       *rand.Rand
+	held       *packet
+	holds      int       // number of packets held so far, so a late hold timer can tell whether its packet has gone
+	last       time.Time // delivery time of the latest packet, so jitter can't reorder
+	queue      chan packet
+	closed     bool
+}
+
+// packet is a datagram in flight
+type packet struct {
+	payload []byte
+	at      time.Time
+	deliver func(payload []byte)
+}
+
+// link returns the link between the named ends, creating it if needed
+func (n *Network) link(from, to string) *link {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	id := linkID{from, to}
+	if l, ok := n.links[id]; ok {
+		return l
+	}
+	h := fnv.New64a()
+	h.Write([]byte(from + ">" + to))
+	l := &link{
+		network:    n,
+		id:         id,
+		clock:      n.clock,
+		conditions: n.defaults,
+		rand:       rand.New(rand.NewSource(n.seed ^ int64(h.Sum64()))),
+		queue:      make(chan packet, 1024),
+	}
+	n.links[id] = l
+	go l.run()
+	return l
+}
+
+// send decides the fate of the packet and queues it for delivery
+// deliver is called on the link goroutine, in delivery order, once the packet has crossed the link.
+func (l *link) send(payload []byte, deliver func(payload []byte)) {
+	p := packet{payload: append([]byte(nil), payload...), deliver: deliver}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return
+	}
+	c := l.conditions
+	// always draw the same numbers so that the fate of a packet doesn't depend on the fate of the previous ones
+	lost, duplicated, reordered := l.rand.Float64() < c.Loss, l.rand.Float64() < c.Duplicate, l.rand.Float64() < c.Reorder
+	var jitter time.Duration
+	if c.Jitter > 0 {
+		jitter = time.Duration(l.rand.Int63n(int64(c.Jitter)))
+	}
+	l.network.count(func(s *Stats) {
+		s.Sent++
+		if lost {
+			s.Lost++
+		}
+	})
+	if lost {
+		return
+	}
+
+	p.at = l.clock.Now().Add(c.Delay + jitter)
+	if p.at.Before(l.last) {
+		p.at = l.last
+	}
+	l.last = p.at
+
+	packets := []packet{p}
+	if duplicated {
+		packets = append(packets, p)
+		l.network.count(func(s *Stats) { s.Duplicated++ })
+	}
+	if reordered && l.held == nil {
+		l.held = &packets[0]
+		packets = packets[1:]
+		l.holds++
+		l.network.count(func(s *Stats) { s.Reordered++ })
+		// asked for now, so that a manual clock advanced right after the send releases the packet
+		timeout, hold := l.clock.After(holdTime), l.holds
+		go func() {
+			<-timeout
+			l.release(hold)
+		}()
+	} else if l.held != nil {
+		packets = append(packets, *l.held)
+		l.held = nil
+	}
+	for _, p := range packets {
+		l.enqueue(p)
+	}
+}
+
+// release delivers the held packet if no packet has followed it by the end of its hold
+func (l *link) release(hold int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed || l.held == nil || l.holds != hold {
+		return
+	}
+	p := *l.held
+	l.held = nil
+	if now := l.clock.Now(); now.After(l.last) {
+		l.last = now
+	}
+	p.at = l.last
+	l.enqueue(p)
+}
+
+// enqueue queues the packet for delivery, the link mutex must be held
+func (l *link) enqueue(p packet) {
+	select {
+	case l.queue <- p:
+	default:
+		// the link is congested, drop the packet as a router would
+		l.network.count(func(s *Stats) { s.Lost++ })
+	}
+}
+
+// run delivers the queued packets once they have crossed the link
+func (l *link) run() {
+	for p := range l.queue {
+		if d := p.at.Sub(l.clock.Now()); d > 0 {
+			<-l.clock.After(d)
+		}
+		l.network.count(func(s *Stats) { s.Delivered++ })
+		p.deliver(p.payload)
+	}
+}
@@ -0,0 +1,146 @@
+package netsim
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// conditions drop, duplicate and reorder enough packets for a short run to show each
+var conditions = Conditions{Loss: 0.2, Duplicate: 0.1, Reorder: 0.2}
+
+// receive reads packets until none arrives for a while
+func receive(t *testing.T, c net.PacketConn) []byte {
+	t.Helper()
+	var received []byte
+	buf := make([]byte, maxDatagramSize)
+	for {
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := c.ReadFrom(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return received
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, buf[:n]...)
+	}
+}
+
+// exchange sends numbered packets across a network with the seed and returns them in the order they arrive
+func exchange(t *testing.T, seed int64) ([]byte, Stats) {
+	clock := NewManualClock(time.Unix(0, 0))
+	n := NewNetwork(seed, conditions)
+	n.SetClock(clock)
+	defer n.Close()
+	a, err := n.ListenPacket(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := n.ListenPacket(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := a.WriteTo([]byte{byte(i)}, b.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// releases a packet held at the end of the run
+	clock.Advance(holdTime)
+	return receive(t, b), n.Stats()
+}
+
+func TestSeedReplaysRun(t *testing.T) {
+	first, stats := exchange(t, 7)
+	if stats.Lost == 0 || stats.Duplicated == 0 || stats.Reordered == 0 {
+		t.Fatalf("expected losses, duplicates and reorders, got %+v", stats)
+	}
+	if len(first) != stats.Delivered {
+		t.Fatalf("received %d packets, %d delivered", len(first), stats.Delivered)
+	}
+	reordered := false
+	for i := 1; i < len(first); i++ {
+		reordered = reordered || first[i] < first[i-1]
+	}
+	if !reordered {
+		t.Fatalf("expected packets out of order, got %v", first)
+	}
+
+	for run := 0; run < 3; run++ {
+		again, _ := exchange(t, 7)
+		if !reflect.DeepEqual(first, again) {
+			t.Fatalf("run %d with the same seed differs:\n%v\n%v", run, first, again)
+		}
+	}
+	if other, _ := exchange(t, 8); reflect.DeepEqual(first, other) {
+		t.Fatalf("runs with different seeds are the same: %v", first)
+	}
+}
+
+func TestHeldPacketIsDelivered(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	n := NewNetwork(1, Conditions{Reorder: 1})
+	n.SetClock(clock)
+	defer n.Close()
+	a, _ := n.ListenPacket(":0")
+	b, _ := n.ListenPacket(":0")
+	a.WriteTo([]byte("last"), b.LocalAddr())
+	if received := receive(t, b); len(received) != 0 {
+		t.Fatalf("held packet delivered before the end of its hold: %q", received)
+	}
+	clock.Advance(holdTime)
+	if received := receive(t, b); string(received) != "last" {
+		t.Fatalf("expected the held packet after its hold, got %q", received)
+	}
+}
+
+// relayed sends numbered packets through a relay to an echo server and returns the echoes that arrive
+// The client gets a new port on every call, which must not change the fate of the packets.
+func relayed(t *testing.T, seed int64) []byte {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	n := NewNetwork(seed, Conditions{Loss: 0.3})
+	defer n.Close()
+	relay, err := n.Relay(echo.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < 50; i++ {
+		client.WriteTo([]byte{byte(i)}, relay.Addr())
+	}
+	return receive(t, client)
+}
+
+func TestRelayReplaysRun(t *testing.T) {
+	first := relayed(t, 7)
+	if len(first) == 0 || len(first) == 50 {
+		t.Fatalf("expected some of the 50 packets to be lost, got %v", first)
+	}
+	if again := relayed(t, 7); !reflect.DeepEqual(first, again) {
+		t.Fatalf("run with the same seed from another client port differs:\n%v\n%v", first, again)
+	}
+}
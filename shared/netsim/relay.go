@@ -0,0 +1,127 @@
+package netsim
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// maxDatagramSize is large enough for any UDP payload
+const maxDatagramSize = 65535
+
+// Relay forwards datagrams between clients and a real UDP server across simulated links
+// Each client gets its own socket towards the server, so the server sees one peer per client as it would without
+// the relay. The links are named after the order in which the clients appear, since their ports change from run to
+// run, so that a seed replays a run with a single client.
+type Relay struct {
+	network *Network
+	name    string // e.g. relay0, prefixes the names of the link ends
+	target  *net.UDPAddr
+	front   *net.UDPConn
+
+	mutex    sync.Mutex
+	backends map[string]*backend // by client address
+	closed   bool
+}
+
+// backend is the socket of a client towards the target
+type backend struct {
+	conn         *net.UDPConn
+	client, host string // names of the link ends
+}
+
+// Relay starts a relay on a loopback port that forwards to the UDP server at the target address
+func (n *Network) Relay(target string) (*Relay, error) {
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	n.mutex.Lock()
+	name := fmt.Sprintf("relay%d", n.relays)
+	n.relays++
+	n.mutex.Unlock()
+	r := &Relay{network: n, name: name, target: addr, front: front, backends: make(map[string]*backend)}
+	go r.serve()
+	return r, nil
+}
+
+// Addr returns the address clients should send to instead of the target
+func (r *Relay) Addr() net.Addr {
+	return r.front.LocalAddr()
+}
+
+// Ends returns the names of the ends of the links of a client, counted from 0 in the order the clients appear, and of
+// the target, for SetConditions
+func (r *Relay) Ends(client int) (string, string) {
+	return fmt.Sprintf("%s/client%d", r.name, client), r.name + "/target"
+}
+
+// serve forwards datagrams from the clients towards the target
+func (r *Relay) serve() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, client, err := r.front.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		backend, err := r.backend(client)
+		if err != nil {
+			continue
+		}
+		r.network.link(backend.client, backend.host).send(buf[:n], func(payload []byte) {
+			backend.conn.Write(payload)
+		})
+	}
+}
+
+// backend returns the socket towards the target for the client, creating it and its reader if needed
+func (r *Relay) backend(client *net.UDPAddr) (*backend, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if b, ok := r.backends[client.String()]; ok {
+		return b, nil
+	}
+	if r.closed {
+		return nil, net.ErrClosed
+	}
+	conn, err := net.DialUDP("udp", nil, r.target)
+	if err != nil {
+		return nil, err
+	}
+	b := &backend{conn: conn}
+	b.client, b.host = r.Ends(len(r.backends))
+	r.backends[client.String()] = b
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := conn.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				// e.g. the target isn't listening yet
+				continue
+			}
+			r.network.link(b.host, b.client).send(buf[:n], func(payload []byte) {
+				r.front.WriteToUDP(payload, client)
+			})
+		}
+	}()
+	return b, nil
+}
+
+// Close stops the relay
+func (r *Relay) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.closed = true
+	for _, b := range r.backends {
+		b.conn.Close()
+	}
+	return r.front.Close()
+}
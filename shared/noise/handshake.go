@@ -1,6 +1,7 @@
 package noise
 
 import (
+	"crypto/rand"
 	"encoding/binary"
 	"github.com/flynn/noise"
 )
@@ -90,3 +91,75 @@ func ServerHandshake(server ServerMessenger, initiator []byte) (id ChannelID, cs
 	}
 	return handshakeState.ChannelBinding(), csPair, nil
 }
+
+// GenerateKeypair creates the static key pair of a server that clients handshake with over NK
+func GenerateKeypair() (noise.DHKey, error) {
+	return diffieHellman.GenerateKeypair(rand.Reader)
+}
+
+// ClientHandshakeNK handshakes with the server whose static public key the client knows beforehand
+// Only the holder of the private key can complete the handshake, so the server is authenticated. The payload is
+// encrypted to the server's static key, which makes it fit for credentials of the client.
+func ClientHandshakeNK(client ClientMessenger, peerStatic []byte, payload []byte) (id ChannelID, csPair CipherStatePair, err error) {
+
+	cs := noise.NewCipherSuite(diffieHellman, cipher, hash)
+
+	handshakeState, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite: cs,
+		Pattern:     noise.HandshakeNK,
+		Initiator:   true,
+		PeerStatic:  peerStatic,
+	})
+	if err != nil {
+		return id, csPair, err
+	}
+	msg, _, _, err := handshakeState.WriteMessage(nil, payload)
+	if err != nil {
+		return id, csPair, err
+	}
+	encryptedReply, err := client.Exchange(msg)
+	if err != nil {
+		return id, csPair, err
+	}
+	_, csPair.Encrypter, csPair.Decrypter, err = handshakeState.ReadMessage(nil, encryptedReply)
+	if err != nil {
+		return id, csPair, err
+	}
+	return handshakeState.ChannelBinding(), csPair, nil
+}
+
+// ServerHandshakeNK answers the handshake of a client with the server's static key pair
+// The payload of the client is passed to accept before the reply is sent, an error from it refuses the client and is
+// returned.
+func ServerHandshakeNK(server ServerMessenger, staticKey noise.DHKey, initiator []byte, accept func(payload []byte) error) (id ChannelID, csPair CipherStatePair, err error) {
+
+	cs := noise.NewCipherSuite(diffieHellman, cipher, hash)
+
+	handshakeState, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   cs,
+		Pattern:       noise.HandshakeNK,
+		Initiator:     false,
+		StaticKeypair: staticKey,
+	})
+	if err != nil {
+		return id, csPair, err
+	}
+	payload, _, _, err := handshakeState.ReadMessage(nil, initiator)
+	if err != nil {
+		return id, csPair, err
+	}
+	if err := accept(payload); err != nil {
+		return id, csPair, err
+	}
+
+	var encodedReply []byte
+	encodedReply, csPair.Decrypter, csPair.Encrypter, err = handshakeState.WriteMessage(nil, nil)
+	if err != nil {
+		return id, csPair, err
+	}
+	err = server.Send(encodedReply)
+	if err != nil {
+		return id, csPair, err
+	}
+	return handshakeState.ChannelBinding(), csPair, nil
+}
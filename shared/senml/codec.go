@@ -0,0 +1,277 @@
+package senml
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"github.com/ugorji/go/codec"
+)
+
+// Media types and CoAP content formats of the representations
+const (
+	JSONContentType = "application/senml+json"
+	CBORContentType = "application/senml+cbor"
+
+	JSONFormat coap.MediaType = 110
+	CBORFormat coap.MediaType = 112
+)
+
+// label names a field in JSON and numbers it in CBOR, see section 6
+type label struct {
+	name   string
+	number int
+}
+
+var (
+	labelBaseVersion = label{"bver", -1}
+	labelBaseName    = label{"bn", -2}
+	labelBaseTime    = label{"bt", -3}
+	labelBaseUnit    = label{"bu", -4}
+	labelBaseValue   = label{"bv", -5}
+	labelBaseSum     = label{"bs", -6}
+	labelName        = label{"n", 0}
+	labelUnit        = label{"u", 1}
+	labelValue       = label{"v", 2}
+	labelStringValue = label{"vs", 3}
+	labelBoolValue   = label{"vb", 4}
+	labelSum         = label{"s", 5}
+	labelTime        = label{"t", 6}
+	labelUpdateTime  = label{"ut", 7}
+	labelDataValue   = label{"vd", 8}
+)
+
+// encodeRecord calls put with every field of the record that is set
+// Data values are passed as bytes, which JSON has to encode as base64url.
+func encodeRecord(r *Record, put func(l label, v interface{})) {
+	if r.BaseVersion != 0 {
+		put(labelBaseVersion, r.BaseVersion)
+	}
+	if r.BaseName != "" {
+		put(labelBaseName, r.BaseName)
+	}
+	if r.BaseTime != 0 {
+		put(labelBaseTime, r.BaseTime)
+	}
+	if r.BaseUnit != "" {
+		put(labelBaseUnit, r.BaseUnit)
+	}
+	if r.BaseValue != 0 {
+		put(labelBaseValue, r.BaseValue)
+	}
+	if r.BaseSum != 0 {
+		put(labelBaseSum, r.BaseSum)
+	}
+	if r.Name != "" {
+		put(labelName, r.Name)
+	}
+	if r.Unit != "" {
+		put(labelUnit, r.Unit)
+	}
+	if r.Value != nil {
+		put(labelValue, *r.Value)
+	}
+	if r.StringValue != nil {
+		put(labelStringValue, *r.StringValue)
+	}
+	if r.BoolValue != nil {
+		put(labelBoolValue, *r.BoolValue)
+	}
+	if r.DataValue != nil {
+		put(labelDataValue, r.DataValue)
+	}
+	if r.Sum != nil {
+		put(labelSum, *r.Sum)
+	}
+	if r.Time != 0 {
+		put(labelTime, r.Time)
+	}
+	if r.UpdateTime != 0 {
+		put(labelUpdateTime, r.UpdateTime)
+	}
+}
+
+// number converts a decoded number into a float
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// decodeRecord fills a record from the fields get finds
+// Data values are expected as bytes, JSON decoding turns them from base64url first.
+func decodeRecord(get func(l label) (interface{}, bool)) (Record, error) {
+	var r Record
+	var err error
+	str := func(l label, dst *string) {
+		if v, ok := get(l); ok && err == nil {
+			if s, ok := v.(string); ok {
+				*dst = s
+			} else {
+				err = fmt.Errorf("%s is not a string", l.name)
+			}
+		}
+	}
+	num := func(l label, dst *float64) bool {
+		if v, ok := get(l); ok && err == nil {
+			if n, ok := number(v); ok {
+				*dst = n
+				return true
+			}
+			err = fmt.Errorf("%s is not a number", l.name)
+		}
+		return false
+	}
+
+	var f float64
+	if num(labelBaseVersion, &f) {
+		r.BaseVersion = int(f)
+	}
+	str(labelBaseName, &r.BaseName)
+	num(labelBaseTime, &r.BaseTime)
+	str(labelBaseUnit, &r.BaseUnit)
+	num(labelBaseValue, &r.BaseValue)
+	num(labelBaseSum, &r.BaseSum)
+	str(labelName, &r.Name)
+	str(labelUnit, &r.Unit)
+	if num(labelValue, &f) {
+		r.Value = Float(f)
+	}
+	var s string
+	if _, ok := get(labelStringValue); ok {
+		str(labelStringValue, &s)
+		r.StringValue = String(s)
+	}
+	if v, ok := get(labelBoolValue); ok && err == nil {
+		if b, ok := v.(bool); ok {
+			r.BoolValue = Bool(b)
+		} else {
+			err = fmt.Errorf("%s is not a boolean", labelBoolValue.name)
+		}
+	}
+	if v, ok := get(labelDataValue); ok && err == nil {
+		if b, ok := v.([]byte); ok {
+			r.DataValue = b
+		} else {
+			err = fmt.Errorf("%s is not binary", labelDataValue.name)
+		}
+	}
+	if num(labelSum, &f) {
+		r.Sum = Float(f)
+	}
+	num(labelTime, &r.Time)
+	num(labelUpdateTime, &r.UpdateTime)
+	return r, err
+}
+
+// EncodeJSON writes the pack as SenML JSON
+func EncodeJSON(p Pack) ([]byte, error) {
+	records := make([]map[string]interface{}, len(p))
+	for i := range p {
+		m := make(map[string]interface{})
+		encodeRecord(&p[i], func(l label, v interface{}) {
+			if b, ok := v.([]byte); ok {
+				v = base64.RawURLEncoding.EncodeToString(b)
+			}
+			m[l.name] = v
+		})
+		records[i] = m
+	}
+	return json.Marshal(records)
+}
+
+// DecodeJSON reads a SenML JSON pack
+func DecodeJSON(b []byte) (Pack, error) {
+	var records []map[string]interface{}
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, err
+	}
+	p := make(Pack, len(records))
+	for i, m := range records {
+		var err error
+		p[i], err = decodeRecord(func(l label) (interface{}, bool) {
+			v, ok := m[l.name]
+			if s, isString := v.(string); ok && isString && l == labelDataValue {
+				b, decodeErr := base64.RawURLEncoding.DecodeString(s)
+				if decodeErr != nil {
+					return nil, true
+				}
+				return b, true
+			}
+			return v, ok
+		})
+		if err != nil {
+			return nil, &RecordError{i, err}
+		}
+	}
+	return p, nil
+}
+
+var cborHandle = new(codec.CborHandle)
+
+// EncodeCBOR writes the pack as SenML CBOR
+func EncodeCBOR(p Pack) ([]byte, error) {
+	records := make([]map[int]interface{}, len(p))
+	for i := range p {
+		m := make(map[int]interface{})
+		encodeRecord(&p[i], func(l label, v interface{}) {
+			m[l.number] = v
+		})
+		records[i] = m
+	}
+	var b []byte
+	err := codec.NewEncoderBytes(&b, cborHandle).Encode(records)
+	return b, err
+}
+
+// DecodeCBOR reads a SenML CBOR pack
+func DecodeCBOR(b []byte) (Pack, error) {
+	var records []map[int]interface{}
+	if err := codec.NewDecoderBytes(b, cborHandle).Decode(&records); err != nil {
+		return nil, err
+	}
+	p := make(Pack, len(records))
+	for i, m := range records {
+		var err error
+		p[i], err = decodeRecord(func(l label) (interface{}, bool) {
+			v, ok := m[l.number]
+			return v, ok
+		})
+		if err != nil {
+			return nil, &RecordError{i, err}
+		}
+	}
+	return p, nil
+}
+
+// Encode writes the pack in the content format, SenML JSON or CBOR
+func Encode(format coap.MediaType, p Pack) ([]byte, error) {
+	switch format {
+	case JSONFormat:
+		return EncodeJSON(p)
+	case CBORFormat:
+		return EncodeCBOR(p)
+	}
+	return nil, fmt.Errorf("content format %d is not SenML", format)
+}
+
+// Decode reads a pack in the content format, SenML JSON or CBOR
+func Decode(format coap.MediaType, b []byte) (Pack, error) {
+	switch format {
+	case JSONFormat:
+		return DecodeJSON(b)
+	case CBORFormat:
+		return DecodeCBOR(b)
+	}
+	return nil, fmt.Errorf("content format %d is not SenML", format)
+}
@@ -0,0 +1,176 @@
+// Package senml implements the Sensor Measurement Lists data model, see https://tools.ietf.org/html/rfc8428
+//
+// A Pack is a list of Records. Base fields, such as the base name and base time, apply to their record and every
+// later one until they are changed; Resolve folds them into each record so that a record can be read on its own.
+package senml
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Version is the SenML version implemented
+const Version = 10
+
+// relativeTime is the threshold below which a resolved time is relative to the time of resolution, about 8.5 years
+const relativeTime = 1 << 28
+
+// Record is a single SenML record
+// Optional values are pointers so that a zero value can be told from no value.
+type Record struct {
+	BaseName    string
+	BaseTime    float64
+	BaseUnit    string
+	BaseValue   float64
+	BaseSum     float64
+	BaseVersion int
+
+	Name        string
+	Unit        string
+	Value       *float64
+	StringValue *string
+	BoolValue   *bool
+	DataValue   []byte
+	Sum         *float64
+	Time        float64
+	UpdateTime  float64
+}
+
+// Pack is a list of records
+type Pack []Record
+
+// Float returns a pointer to the value, for the Value and Sum of a record
+func Float(v float64) *float64 {
+	return &v
+}
+
+// String returns a pointer to the value, for the StringValue of a record
+func String(v string) *string {
+	return &v
+}
+
+// Bool returns a pointer to the value, for the BoolValue of a record
+func Bool(v bool) *bool {
+	return &v
+}
+
+// ErrVersion is returned when resolving a pack of a later version than this package implements
+var ErrVersion = errors.New("unsupported SenML version")
+
+// RecordError is an invalid record of a pack
+type RecordError struct {
+	Index int
+	Err   error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("SenML record %d: %v", e.Index, e.Err)
+}
+
+// values counts the values of the record, not counting the sum
+func (r *Record) values() int {
+	n := 0
+	if r.Value != nil {
+		n++
+	}
+	if r.StringValue != nil {
+		n++
+	}
+	if r.BoolValue != nil {
+		n++
+	}
+	if r.DataValue != nil {
+		n++
+	}
+	return n
+}
+
+// validName reports whether the name only has the characters allowed by section 4.5.1 and doesn't start with a
+// symbol
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case i > 0 && (c == '-' || c == ':' || c == '.' || c == '/' || c == '_'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Resolve returns the resolved form of the pack, see section 4.6
+// Each resolved record has a name, a unit if any, a value or sum and an absolute time; relative times are resolved
+// against now. Records with an invalid name, an unregistered unit, several values or no value at all are rejected.
+func Resolve(p Pack, now time.Time) (Pack, error) {
+	var base Record
+	resolved := make(Pack, 0, len(p))
+	for i, r := range p {
+		if r.BaseVersion > Version {
+			return nil, &RecordError{i, ErrVersion}
+		}
+		// base fields apply until they are changed
+		if r.BaseName != "" {
+			base.BaseName = r.BaseName
+		}
+		if r.BaseTime != 0 {
+			base.BaseTime = r.BaseTime
+		}
+		if r.BaseUnit != "" {
+			base.BaseUnit = r.BaseUnit
+		}
+		if r.BaseValue != 0 {
+			base.BaseValue = r.BaseValue
+		}
+		if r.BaseSum != 0 {
+			base.BaseSum = r.BaseSum
+		}
+
+		out := Record{
+			Name:        base.BaseName + r.Name,
+			Unit:        r.Unit,
+			StringValue: r.StringValue,
+			BoolValue:   r.BoolValue,
+			DataValue:   r.DataValue,
+			Time:        base.BaseTime + r.Time,
+			UpdateTime:  r.UpdateTime,
+		}
+		if out.Unit == "" {
+			out.Unit = base.BaseUnit
+		}
+		if r.Value != nil {
+			out.Value = Float(base.BaseValue + *r.Value)
+		}
+		if r.Sum != nil {
+			out.Sum = Float(base.BaseSum + *r.Sum)
+		}
+		if out.Time < relativeTime {
+			t := float64(now.UnixNano())/1e9 + out.Time
+			out.Time = math.Round(t*1e6) / 1e6
+		}
+
+		switch {
+		case !validName(out.Name):
+			return nil, &RecordError{i, fmt.Errorf("invalid name \"%s\"", out.Name)}
+		case out.Unit != "" && !ValidUnit(out.Unit):
+			return nil, &RecordError{i, fmt.Errorf("unregistered unit \"%s\"", out.Unit)}
+		case out.values() > 1:
+			return nil, &RecordError{i, errors.New("more than one value")}
+		case out.values() == 0 && out.Sum == nil:
+			return nil, &RecordError{i, errors.New("no value or sum")}
+		}
+		resolved = append(resolved, out)
+	}
+	return resolved, nil
+}
+
+// At returns the time of a resolved record
+func (r *Record) At() time.Time {
+	sec, frac := math.Modf(r.Time)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
@@ -0,0 +1,31 @@
+package senml
+
+// units are the units registered by section 12.1
+// The units marked with * in the registry are accepted but shouldn't be produced; Preferred maps them to a
+// replacement where there is one.
+var units = map[string]bool{
+	"m": true, "kg": true, "g": true, "s": true, "A": true, "K": true, "cd": true, "mol": true, "Hz": true,
+	"rad": true, "sr": true, "N": true, "Pa": true, "J": true, "W": true, "C": true, "V": true, "F": true,
+	"Ohm": true, "S": true, "Wb": true, "T": true, "H": true, "Cel": true, "lm": true, "lx": true, "Bq": true,
+	"Gy": true, "Sv": true, "kat": true, "m2": true, "m3": true, "l": true, "m/s": true, "m/s2": true,
+	"m3/s": true, "l/s": true, "W/m2": true, "cd/m2": true, "bit": true, "bit/s": true, "lat": true, "lon": true,
+	"pH": true, "dB": true, "dBW": true, "Bspl": true, "count": true, "/": true, "%": true, "%RH": true,
+	"%EL": true, "EL": true, "1/s": true, "1/min": true, "beat/min": true, "beats": true, "S/m": true, "B": true,
+	"VA": true, "VAs": true, "var": true, "vars": true, "J/m": true, "kg/m3": true, "deg": true,
+}
+
+// Preferred maps the units that shouldn't be produced to the unit to use instead
+var Preferred = map[string]string{
+	"g":        "kg",
+	"l":        "m3",
+	"l/s":      "m3/s",
+	"Bspl":     "dB",
+	"1/min":    "1/s",
+	"beat/min": "1/s",
+	"deg":      "rad",
+}
+
+// ValidUnit reports whether the unit is registered
+func ValidUnit(unit string) bool {
+	return units[unit]
+}
@@ -0,0 +1,107 @@
+// Package transform holds the text transformations offered by the example servers.
+//
+// Transformations are Unicode aware so every server gives the same answer whatever its transport.
+// Reverse, the transformation used by the reverse services, reverses the user-perceived characters (grapheme
+// clusters) of the text, so combining marks, emoji sequences and multi-byte UTF-8 survive the round trip.
+// Other operations can be added with Register and chosen by name with Lookup.
+package transform
+
+import (
+	"fmt"
+	"github.com/rivo/uniseg"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Operation transforms text
+type Operation func(text string) string
+
+var (
+	mutex      sync.RWMutex
+	operations = map[string]Operation{
+		"reverse":       Reverse,
+		"reverse-runes": ReverseRunes,
+		"reverse-words": ReverseWords,
+		"upper":         strings.ToUpper,
+		"lower":         strings.ToLower,
+	}
+)
+
+// Register adds the operation, replacing any operation with the same name
+func Register(name string, op Operation) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	operations[name] = op
+}
+
+// Lookup finds the operation with the name
+func Lookup(name string) (Operation, error) {
+	mutex.RLock()
+	op, ok := operations[name]
+	mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown operation \"%s\", expected one of %s", name, strings.Join(Names(), ", "))
+	}
+	return op, nil
+}
+
+// Names lists the registered operations in alphabetical order
+func Names() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	names := make([]string, 0, len(operations))
+	for name := range operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Apply transforms the text with the named operation
+func Apply(name, text string) (string, error) {
+	op, err := Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return op(text), nil
+}
+
+// reverse joins the units in reverse order
+func reverse(units []string, sep string) string {
+	for i, j := 0, len(units)-1; i < j; i, j = i+1, j-1 {
+		units[i], units[j] = units[j], units[i]
+	}
+	return strings.Join(units, sep)
+}
+
+// Reverse reverses the order of the grapheme clusters of the text
+func Reverse(text string) string {
+	var units []string
+	g := uniseg.NewGraphemes(text)
+	for g.Next() {
+		units = append(units, g.Str())
+	}
+	return reverse(units, "")
+}
+
+// ReverseRunes reverses the order of the code points of the text
+// Combining marks end up on the wrong character, use Reverse unless that is what you want.
+func ReverseRunes(text string) string {
+	var units []string
+	for _, r := range text {
+		units = append(units, string(r))
+	}
+	return reverse(units, "")
+}
+
+// ReverseWords reverses the order of the whitespace separated words of the text
+// The words are joined by single spaces.
+func ReverseWords(text string) string {
+	return reverse(strings.Fields(text), " ")
+}
+
+// ReverseBytes reverses the grapheme clusters of UTF-8 encoded text
+func ReverseBytes(text []byte) []byte {
+	return []byte(Reverse(string(text)))
+}
@@ -0,0 +1,13 @@
+// Package zmqcurve secures ZMQ sockets with the CURVE mechanism of ZMTP, see http://rfc.zeromq.org/spec:26
+//
+// The server authenticates clients with a ZAP handler that only lets in the public keys of an allow-list file.
+// Keys are written in Z85, the text encoding ZMQ uses for them.
+//
+// CURVE is built into libzmq, so the sockets of the pure-Go backend of the zmqsocket package can't be secured: in
+// builds with the zmtp tag SecureServer and ClientSockets return ErrNoCurve.
+package zmqcurve
+
+import "errors"
+
+// ErrNoCurve is returned when securing a socket without libzmq, which only has the NULL mechanism
+var ErrNoCurve = errors.New("CURVE needs libzmq, build without the zmtp tag")
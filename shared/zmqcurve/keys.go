@@ -0,0 +1,106 @@
+//go:build !zmtp
+// +build !zmtp
+
+package zmqcurve
+
+import (
+	"bufio"
+	"fmt"
+	zmq "github.com/pebbe/zmq4/draft"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Keypair is a CURVE keypair in Z85
+type Keypair struct {
+	Public string
+	Secret string
+}
+
+// GenerateKeypair creates a new keypair
+func GenerateKeypair() (Keypair, error) {
+	public, secret, err := zmq.NewCurveKeypair()
+	return Keypair{Public: public, Secret: secret}, err
+}
+
+// readKeyFile reads the name = value lines of a key file, skipping blank lines and comments
+func readKeyFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: expected name = value, not \"%s\"", path, line)
+		}
+		values[strings.TrimSpace(parts[0])] = strings.Trim(strings.TrimSpace(parts[1]), `"`)
+	}
+	return values, scanner.Err()
+}
+
+// validKey reports whether the text is a Z85 encoded 32 byte key
+func validKey(key string) bool {
+	return len(key) == 40 && len(zmq.Z85decode(key)) == 32
+}
+
+// LoadKeypair reads a keypair file written by Save
+func LoadKeypair(path string) (Keypair, error) {
+	values, err := readKeyFile(path)
+	if err != nil {
+		return Keypair{}, err
+	}
+	k := Keypair{Public: values["public"], Secret: values["secret"]}
+	if !validKey(k.Public) || !validKey(k.Secret) {
+		return Keypair{}, fmt.Errorf("%s: expected a Z85 public and secret key", path)
+	}
+	return k, nil
+}
+
+// LoadPublicKey reads the public key from a keypair file or a public key file written by SavePublic
+func LoadPublicKey(path string) (string, error) {
+	values, err := readKeyFile(path)
+	if err != nil {
+		return "", err
+	}
+	if !validKey(values["public"]) {
+		return "", fmt.Errorf("%s: expected a Z85 public key", path)
+	}
+	return values["public"], nil
+}
+
+// Save writes the keypair to a file only the user can read
+func (k Keypair) Save(path string) error {
+	content := fmt.Sprintf("# ZMQ CURVE keypair, keep it secret\npublic = \"%s\"\nsecret = \"%s\"\n", k.Public, k.Secret)
+	return ioutil.WriteFile(path, []byte(content), 0600)
+}
+
+// SavePublic writes the public key alone, to be given to peers
+func (k Keypair) SavePublic(path string) error {
+	content := fmt.Sprintf("# ZMQ CURVE public key\npublic = \"%s\"\n", k.Public)
+	return ioutil.WriteFile(path, []byte(content), 0644)
+}
+
+// LoadOrGenerateKeypair reads the keypair file, creating it with a new keypair, and its public key file next to it,
+// if it doesn't exist
+func LoadOrGenerateKeypair(path string) (Keypair, error) {
+	k, err := LoadKeypair(path)
+	if !os.IsNotExist(err) {
+		return k, err
+	}
+	if k, err = GenerateKeypair(); err != nil {
+		return k, err
+	}
+	if err := k.Save(path); err != nil {
+		return k, err
+	}
+	return k, k.SavePublic(strings.TrimSuffix(path, ".key") + ".pub")
+}
@@ -0,0 +1,59 @@
+//go:build !zmtp
+// +build !zmtp
+
+package zmqcurve
+
+import (
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
+	"log"
+)
+
+// SecureServer sets up the SERVER socket as a CURVE server that lets in the clients of the allow-list file
+// The server keypair is generated on the first run, its public key is written next to it for the clients. The ZAP
+// handler is served until the process exits, so a process has one CURVE server.
+func SecureServer(socket zmqsocket.Socket, keyFile, allowFile string) error {
+	native := zmqsocket.Native(socket)
+	if native == nil {
+		return ErrNoCurve
+	}
+	keys, err := LoadOrGenerateKeypair(keyFile)
+	if err != nil {
+		return err
+	}
+	allow, err := NewAllowList(allowFile)
+	if err != nil {
+		return err
+	}
+	zap, err := NewZAPHandler(allow)
+	if err != nil {
+		return err
+	}
+	go zap.Serve()
+	log.Printf("Server public key %s", keys.Public)
+	return native.ServerAuthCurve("global", keys.Secret)
+}
+
+// ClientSockets returns a function opening CURVE CLIENT sockets of the server with the public key in the file
+// The client keypair is generated on the first run, its public key has to be added to the allow-list of the server.
+func ClientSockets(keyFile, serverKeyFile string) (func() (zmqsocket.Socket, error), error) {
+	keys, err := LoadOrGenerateKeypair(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := LoadPublicKey(serverKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Client public key %s", keys.Public)
+	return func() (zmqsocket.Socket, error) {
+		socket, err := zmqsocket.NewSocket(zmqsocket.Client)
+		if err != nil {
+			return nil, err
+		}
+		if err := zmqsocket.Native(socket).ClientAuthCurve(serverKey, keys.Public, keys.Secret); err != nil {
+			socket.Close()
+			return nil, err
+		}
+		return socket, nil
+	}, nil
+}
@@ -0,0 +1,157 @@
+//go:build !zmtp
+// +build !zmtp
+
+package zmqcurve
+
+import (
+	"bufio"
+	"fmt"
+	zmq "github.com/pebbe/zmq4/draft"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zapEndpoint is where libzmq sends authentication requests, see http://rfc.zeromq.org/spec:27
+const zapEndpoint = "inproc://zeromq.zap.01"
+
+const zapVersion = "1.0"
+
+// AllowList holds the client public keys allowed in, read from a file with a Z85 key per line
+// The file is read again when it changes, so keys can be added and revoked while the server runs.
+type AllowList struct {
+	path string
+
+	mutex    sync.Mutex
+	keys     map[string]bool
+	modified time.Time
+}
+
+// NewAllowList reads the allow-list file
+func NewAllowList(path string) (*AllowList, error) {
+	l := &AllowList{path: path}
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reload reads the file if it changed since it was last read
+func (l *AllowList) reload() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(l.modified) && l.keys != nil {
+		return nil
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			// a comment, which may follow a key to say whose it is
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		if !validKey(line) {
+			return fmt.Errorf("%s:%d: \"%s\" is not a Z85 public key", l.path, n, line)
+		}
+		keys[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	l.keys, l.modified = keys, info.ModTime()
+	return nil
+}
+
+// Allowed reports whether the Z85 public key is on the list
+// If the file can no longer be read the keys read last are kept.
+func (l *AllowList) Allowed(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.reload(); err != nil {
+		log.Printf("Cannot reload allow-list: %v", err)
+	}
+	return l.keys[key]
+}
+
+// ZAPHandler answers the authentication requests of the CURVE sockets of the default ZMQ context, where the
+// zmqsocket package creates its sockets
+type ZAPHandler struct {
+	socket *zmq.Socket
+	allow  *AllowList
+}
+
+// NewZAPHandler binds the ZAP endpoint of the default context, which must be done before a CURVE server socket is
+// bound
+func NewZAPHandler(allow *AllowList) (*ZAPHandler, error) {
+	socket, err := zmq.NewSocket(zmq.REP)
+	if err != nil {
+		return nil, err
+	}
+	if err := socket.Bind(zapEndpoint); err != nil {
+		socket.Close()
+		return nil, err
+	}
+	return &ZAPHandler{socket: socket, allow: allow}, nil
+}
+
+// authenticate decides on a request, returning the ZAP status code and text
+// Requests are version, request ID, domain, address, routing ID, mechanism and the credentials, the client public
+// key for CURVE.
+func (h *ZAPHandler) authenticate(request [][]byte) (string, string) {
+	if len(request) < 6 || string(request[0]) != zapVersion {
+		return "500", "Malformed request"
+	}
+	address, mechanism := string(request[3]), string(request[5])
+	if mechanism != "CURVE" || len(request) != 7 || len(request[6]) != 32 {
+		log.Printf("Denied %s: %s mechanism", address, mechanism)
+		return "400", "CURVE required"
+	}
+	key := zmq.Z85encode(string(request[6]))
+	if !h.allow.Allowed(key) {
+		log.Printf("Denied %s: key %s is not allowed", address, key)
+		return "400", "Key not allowed"
+	}
+	log.Printf("Allowed %s with key %s", address, key)
+	return "200", "OK"
+}
+
+// Serve answers authentication requests until the context is terminated
+func (h *ZAPHandler) Serve() error {
+	defer h.socket.Close()
+	for {
+		request, err := h.socket.RecvMessageBytes(0)
+		if err != nil {
+			if zmq.AsErrno(err) == zmq.ETERM {
+				return err
+			}
+			log.Printf("Cannot receive ZAP request: %v", err)
+			continue
+		}
+		requestID := []byte{}
+		if len(request) > 1 {
+			requestID = request[1]
+		}
+		code, text := h.authenticate(request)
+		// the user ID is the client key, which the server may read from the metadata of the messages
+		userID := ""
+		if code == "200" {
+			userID = zmq.Z85encode(string(request[6]))
+		}
+		if _, err := h.socket.SendMessage(zapVersion, requestID, code, text, userID, ""); err != nil {
+			log.Printf("Cannot send ZAP reply: %v", err)
+		}
+	}
+}
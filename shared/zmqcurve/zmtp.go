@@ -0,0 +1,16 @@
+//go:build zmtp
+// +build zmtp
+
+package zmqcurve
+
+import "github.com/limaechocharlie/cwb/shared/zmqsocket"
+
+// SecureServer returns ErrNoCurve, the sockets of the zmtp backend have no CURVE
+func SecureServer(socket zmqsocket.Socket, keyFile, allowFile string) error {
+	return ErrNoCurve
+}
+
+// ClientSockets returns ErrNoCurve, the sockets of the zmtp backend have no CURVE
+func ClientSockets(keyFile, serverKeyFile string) (func() (zmqsocket.Socket, error), error) {
+	return nil, ErrNoCurve
+}
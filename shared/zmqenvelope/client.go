@@ -0,0 +1,62 @@
+package zmqenvelope
+
+import (
+	"log"
+	"time"
+)
+
+// Transport sends a request and waits for its reply until the deadline, if not zero
+// ReceiveWithDeadline waits for another reply to the last request without sending it again, for when the reply that
+// came was a late one to an earlier request. zmqpattern.LazyPirate is a transport that times out and retries over a
+// CLIENT socket.
+type Transport interface {
+	RequestWithDeadline(request []byte, deadline time.Time) ([]byte, error)
+	ReceiveWithDeadline(deadline time.Time) ([]byte, error)
+}
+
+// Client sends requests in envelopes over a transport and matches the replies to them
+type Client struct {
+	transport Transport
+	last      uint32 // request ID of the last request
+}
+
+// NewClient creates a client on the transport
+func NewClient(transport Transport) *Client {
+	return &Client{transport: transport}
+}
+
+// nextRequestID returns a new request ID, never zero
+func (c *Client) nextRequestID() uint32 {
+	c.last++
+	if c.last == 0 {
+		c.last++
+	}
+	return c.last
+}
+
+// Request sends a request and waits for its reply
+// An Error reply is returned as a *RemoteError.
+func (c *Client) Request(t Type, channelID uint64, payload []byte) (Envelope, error) {
+	return c.RequestWithDeadline(t, channelID, payload, time.Time{})
+}
+
+// RequestWithDeadline sends a request and waits for its reply until the deadline, if not zero
+// Replies to earlier requests, which may still come after they were given up on, are dropped.
+func (c *Client) RequestWithDeadline(t Type, channelID uint64, payload []byte, deadline time.Time) (Envelope, error) {
+	req := Envelope{Type: t, ChannelID: channelID, RequestID: c.nextRequestID(), Payload: payload}
+	b, err := c.transport.RequestWithDeadline(req.Marshal(), deadline)
+	for {
+		if err != nil {
+			return Envelope{}, err
+		}
+		var reply Envelope
+		if reply, err = Unmarshal(b); err != nil {
+			return Envelope{}, err
+		}
+		if reply.RequestID == req.RequestID || (reply.Type == Error && reply.RequestID == 0) {
+			return reply, reply.Err()
+		}
+		log.Printf("Dropping stale reply to request %d, waiting for the reply to %d", reply.RequestID, req.RequestID)
+		b, err = c.transport.ReceiveWithDeadline(deadline)
+	}
+}
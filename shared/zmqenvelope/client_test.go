@@ -0,0 +1,56 @@
+package zmqenvelope
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// queuedTransport answers with the replies queued on it, whatever the request
+type queuedTransport struct {
+	replies [][]byte
+	sent    int
+}
+
+var errNoReply = errors.New("no reply queued")
+
+func (q *queuedTransport) RequestWithDeadline(request []byte, deadline time.Time) ([]byte, error) {
+	q.sent++
+	return q.ReceiveWithDeadline(deadline)
+}
+
+func (q *queuedTransport) ReceiveWithDeadline(deadline time.Time) ([]byte, error) {
+	if len(q.replies) == 0 {
+		return nil, errNoReply
+	}
+	reply := q.replies[0]
+	q.replies = q.replies[1:]
+	return reply, nil
+}
+
+func TestClientDropsStaleReplies(t *testing.T) {
+	transport := &queuedTransport{}
+	c := NewClient(transport)
+	// requests 1 and 2 timed out, their replies come before the reply to request 3
+	for _, id := range []uint32{1, 2, 3} {
+		transport.replies = append(transport.replies, Reply(Envelope{Type: Reverse, RequestID: id}, []byte{byte(id)}).Marshal())
+	}
+	c.last = 2
+	reply, err := c.Request(Reverse, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.RequestID != 3 || string(reply.Payload) != "\x03" {
+		t.Fatalf("got reply to request %d with %q, expected the reply to request 3", reply.RequestID, reply.Payload)
+	}
+	if transport.sent != 1 {
+		t.Fatalf("request sent %d times, expected once", transport.sent)
+	}
+}
+
+func TestClientStopsWithoutReply(t *testing.T) {
+	transport := &queuedTransport{replies: [][]byte{Reply(Envelope{Type: Reverse, RequestID: 7}, nil).Marshal()}}
+	if _, err := NewClient(transport).Request(Reverse, 0, nil); err != errNoReply {
+		t.Fatalf("expected %v once the stale reply is dropped, got %v", errNoReply, err)
+	}
+}
@@ -0,0 +1,189 @@
+// Package zmqenvelope frames the messages of the ZMQ Noise examples.
+//
+// Every request and reply is an envelope: a fixed header followed by the payload.
+//
+//	0       1       2                              10              14
+//	+-------+-------+------------------------------+---------------+---------
+//	|version| type  |          channel ID          |  request ID   | payload
+//	+-------+-------+------------------------------+---------------+---------
+//
+// Numbers are big-endian. The channel ID identifies the cipher states of a Noise channel, the request ID is chosen
+// by the client and copied into the reply so that the client can match them. Failures are answered with an Error
+// envelope whose payload is an error code followed by a diagnostic message.
+package zmqenvelope
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Version is the envelope version written by this package
+// The version byte stays first in every later version so that a peer can always tell which one it got.
+const Version = 1
+
+// HeaderSize is the size of the envelope header
+const HeaderSize = 14
+
+// Type says what an envelope carries
+type Type uint8
+
+const (
+	// Error replies to a request that failed
+	Error Type = iota
+	// Handshake carries a Noise handshake message
+	Handshake
+	// Reverse carries text to reverse, encrypted with the cipher states of the channel
+	Reverse
+	// PublicKey asks for the static public key of the server, which the reply carries
+	PublicKey
+	// GroupKey asks for the key of a pub-sub group, the group name and the key are encrypted with the cipher
+	// states of the channel
+	GroupKey
+)
+
+var typeNames = map[Type]string{
+	Error:     "error",
+	Handshake: "handshake",
+	Reverse:   "reverse",
+	PublicKey: "public key",
+	GroupKey:  "group key",
+}
+
+func (t Type) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type %d", uint8(t))
+}
+
+// Envelope is a request or a reply
+type Envelope struct {
+	Version   uint8
+	Type      Type
+	ChannelID uint64
+	RequestID uint32
+	Payload   []byte
+}
+
+var (
+	// ErrShort is returned when unmarshalling a message shorter than the header
+	ErrShort = errors.New("message shorter than the envelope header")
+	// ErrVersion is returned when unmarshalling an envelope of a version this package doesn't read
+	ErrVersion = errors.New("unsupported envelope version")
+)
+
+// Marshal writes the envelope, with the current version if it has none
+func (e Envelope) Marshal() []byte {
+	if e.Version == 0 {
+		e.Version = Version
+	}
+	b := make([]byte, HeaderSize, HeaderSize+len(e.Payload))
+	b[0] = e.Version
+	b[1] = byte(e.Type)
+	binary.BigEndian.PutUint64(b[2:10], e.ChannelID)
+	binary.BigEndian.PutUint32(b[10:14], e.RequestID)
+	return append(b, e.Payload...)
+}
+
+// Unmarshal reads an envelope
+// An envelope of another version is returned with only its version set, along with ErrVersion.
+func Unmarshal(b []byte) (Envelope, error) {
+	if len(b) < HeaderSize {
+		return Envelope{}, ErrShort
+	}
+	if b[0] != Version {
+		return Envelope{Version: b[0]}, ErrVersion
+	}
+	return Envelope{
+		Version:   b[0],
+		Type:      Type(b[1]),
+		ChannelID: binary.BigEndian.Uint64(b[2:10]),
+		RequestID: binary.BigEndian.Uint32(b[10:14]),
+		Payload:   b[HeaderSize:],
+	}, nil
+}
+
+// Code says why a request failed
+type Code uint8
+
+const (
+	// BadEnvelope means the request couldn't be read as an envelope
+	BadEnvelope Code = iota + 1
+	// UnsupportedVersion means the request is of an envelope version the server doesn't read
+	UnsupportedVersion
+	// UnknownType means the server doesn't handle requests of that type
+	UnknownType
+	// UnknownChannel means the server has no cipher states for the channel ID, the client should handshake again
+	UnknownChannel
+	// HandshakeFailed means the Noise handshake message was rejected
+	HandshakeFailed
+	// DecryptFailed means the payload couldn't be decrypted with the cipher states of the channel
+	DecryptFailed
+	// Internal means the server failed for a reason of its own
+	Internal
+	// Busy means the client has too many requests waiting, it should retry later
+	Busy
+	// Forbidden means the client isn't allowed what it asked for
+	Forbidden
+)
+
+var codeNames = map[Code]string{
+	BadEnvelope:        "bad envelope",
+	UnsupportedVersion: "unsupported version",
+	UnknownType:        "unknown type",
+	UnknownChannel:     "unknown channel",
+	HandshakeFailed:    "handshake failed",
+	DecryptFailed:      "decryption failed",
+	Internal:           "internal error",
+	Busy:               "busy",
+	Forbidden:          "forbidden",
+}
+
+func (c Code) String() string {
+	if name, ok := codeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code %d", uint8(c))
+}
+
+// RemoteError is a failure reported by the server in an Error envelope
+type RemoteError struct {
+	Code    Code
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	if e.Message == "" {
+		return e.Code.String()
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Reply creates the reply to the request with the payload
+func Reply(req Envelope, payload []byte) Envelope {
+	return Envelope{Type: req.Type, ChannelID: req.ChannelID, RequestID: req.RequestID, Payload: payload}
+}
+
+// ErrorReply creates an Error reply to the request
+// A request that couldn't be read has a zero request ID, which the client takes as a reply to its pending request.
+func ErrorReply(req Envelope, code Code, format string, a ...interface{}) Envelope {
+	payload := append([]byte{byte(code)}, fmt.Sprintf(format, a...)...)
+	return Envelope{Type: Error, ChannelID: req.ChannelID, RequestID: req.RequestID, Payload: payload}
+}
+
+// Err returns the failure reported by an Error envelope as a *RemoteError, nil for other envelopes
+func (e Envelope) Err() error {
+	if e.Type != Error {
+		return nil
+	}
+	return remoteError(e)
+}
+
+// remoteError reads the payload of an Error envelope
+func remoteError(e Envelope) *RemoteError {
+	if len(e.Payload) == 0 {
+		return &RemoteError{Code: Internal}
+	}
+	return &RemoteError{Code: Code(e.Payload[0]), Message: string(e.Payload[1:])}
+}
@@ -0,0 +1,112 @@
+package zmqpattern
+
+import (
+	"errors"
+	"github.com/limaechocharlie/cwb/shared/noise"
+	"github.com/limaechocharlie/cwb/shared/zmqenvelope"
+	"log"
+	"time"
+)
+
+// Channel sends requests encrypted with the cipher states of a Noise NN or NK channel, handshaking when needed
+// The channel is opened again when the server reports that it has no such channel, e.g. after a restart, or that
+// it can't decrypt a request, which happens when a retry reaches the server after the request itself. A reply that
+// can't be decrypted, e.g. one lost while the server moved on, also opens the channel again. The request is then
+// sent once more on the new channel.
+type Channel struct {
+	client      *zmqenvelope.Client
+	serverKey   []byte // static public key of the server for NK, nil for NN
+	credentials []byte // payload of the NK handshake
+
+	id     uint64
+	csPair noise.CipherStatePair
+	open   bool
+}
+
+// NewChannel creates an NN channel over the client, the handshake is made on the first request
+func NewChannel(client *zmqenvelope.Client) *Channel {
+	return &Channel{client: client}
+}
+
+// NewChannelNK creates an NK channel over the client to the server with the static public key, the handshake is made
+// on the first request and carries the credentials
+func NewChannelNK(client *zmqenvelope.Client, serverKey []byte, credentials []byte) *Channel {
+	return &Channel{client: client, serverKey: serverKey, credentials: credentials}
+}
+
+// channelMessenger satisfies the ClientMessenger in the noise wrapper library
+type channelMessenger struct {
+	client   *zmqenvelope.Client
+	deadline time.Time
+}
+
+func (m channelMessenger) Exchange(message []byte) ([]byte, error) {
+	reply, err := m.client.RequestWithDeadline(zmqenvelope.Handshake, 0, message, m.deadline)
+	return reply.Payload, err
+}
+
+// handshake opens a new channel
+func (c *Channel) handshake(deadline time.Time) error {
+	messenger := channelMessenger{client: c.client, deadline: deadline}
+	var channelID noise.ChannelID
+	var csPair noise.CipherStatePair
+	var err error
+	if c.serverKey == nil {
+		channelID, csPair, err = noise.ClientHandshake(messenger)
+	} else {
+		channelID, csPair, err = noise.ClientHandshakeNK(messenger, c.serverKey, c.credentials)
+	}
+	if err != nil {
+		return err
+	}
+	id, ok := channelID.UInt64()
+	if !ok {
+		return errors.New("unable to encode channel ID into an integer")
+	}
+	c.id, c.csPair, c.open = id, csPair, true
+	log.Printf("Handshake complete [id: %d]", id)
+	return nil
+}
+
+// errDecrypt is returned by exchange when the reply can't be decrypted
+var errDecrypt = errors.New("cannot decrypt reply")
+
+// exchange sends the payload encrypted over the channel, opening it first if needed, and decrypts the reply
+func (c *Channel) exchange(t zmqenvelope.Type, payload []byte, deadline time.Time) ([]byte, error) {
+	if !c.open {
+		if err := c.handshake(deadline); err != nil {
+			return nil, err
+		}
+	}
+	encrypted := c.csPair.Encrypter.Encrypt(nil, nil, payload)
+	reply, err := c.client.RequestWithDeadline(t, c.id, encrypted, deadline)
+	if err != nil {
+		return nil, err
+	}
+	decrypted, err := c.csPair.Decrypter.Decrypt(nil, nil, reply.Payload)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return decrypted, nil
+}
+
+// stale reports whether the error means the cipher states of the channel are no longer those of the server
+func stale(err error) bool {
+	if err == errDecrypt {
+		return true
+	}
+	remote, ok := err.(*zmqenvelope.RemoteError)
+	return ok && (remote.Code == zmqenvelope.UnknownChannel || remote.Code == zmqenvelope.DecryptFailed)
+}
+
+// Request sends a request of the type with the payload and returns the decrypted payload of the reply
+// The request and the reply are over once the deadline, if not zero, passes, handshakes included.
+func (c *Channel) Request(t zmqenvelope.Type, payload []byte, deadline time.Time) ([]byte, error) {
+	reply, err := c.exchange(t, payload, deadline)
+	if !stale(err) {
+		return reply, err
+	}
+	log.Printf("Channel %d is stale, handshaking again: %v", c.id, err)
+	c.open = false
+	return c.exchange(t, payload, deadline)
+}
@@ -0,0 +1,176 @@
+package zmqpattern
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// MaxGroupLength is the longest group name RADIO and DISH sockets take
+	MaxGroupLength = 15
+	// KeySize is the size of a group key, for AES-256-GCM
+	KeySize = 32
+
+	epochSize = 4
+)
+
+var (
+	// ErrShortMessage is returned when opening a message too short to be sealed
+	ErrShortMessage = errors.New("message too short to be sealed")
+	// ErrEpoch is returned when opening a message sealed with a key of another epoch
+	ErrEpoch = errors.New("message sealed with a key of another epoch")
+)
+
+// GroupKey encrypts the messages published to a group
+// A key is replaced by one of the next epoch when the group is rotated, messages carry the epoch of their key so
+// that subscribers know when to fetch the new one.
+type GroupKey struct {
+	Epoch uint32
+	Key   []byte
+}
+
+// NewGroupKey creates a random key
+func NewGroupKey(epoch uint32) (GroupKey, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return GroupKey{}, err
+	}
+	return GroupKey{Epoch: epoch, Key: key}, nil
+}
+
+// validGroup checks that RADIO and DISH sockets take the group name
+func validGroup(group string) error {
+	if group == "" || len(group) > MaxGroupLength {
+		return fmt.Errorf("group name \"%s\" must be 1 to %d bytes long", group, MaxGroupLength)
+	}
+	return nil
+}
+
+func (k GroupKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts a message to the group, which authenticates the group name along with the message
+// Sealed messages are the epoch of the key, a random nonce and the ciphertext.
+func (k GroupKey) Seal(group string, plaintext []byte) ([]byte, error) {
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, epochSize+aead.NonceSize(), epochSize+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	binary.BigEndian.PutUint32(b, k.Epoch)
+	nonce := b[epochSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(b, nonce, plaintext, []byte(group)), nil
+}
+
+// Open decrypts a message sealed by Seal
+func (k GroupKey) Open(group string, message []byte) ([]byte, error) {
+	epoch, ok := Epoch(message)
+	if !ok {
+		return nil, ErrShortMessage
+	}
+	if epoch != k.Epoch {
+		return nil, ErrEpoch
+	}
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(message) < epochSize+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrShortMessage
+	}
+	nonce, ciphertext := message[epochSize:epochSize+aead.NonceSize()], message[epochSize+aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(group))
+}
+
+// Epoch reads the epoch of the key a message was sealed with
+func Epoch(message []byte) (uint32, bool) {
+	if len(message) < epochSize {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(message), true
+}
+
+// marshal writes the key to be sent to a subscriber
+func (k GroupKey) marshal() []byte {
+	b := make([]byte, epochSize, epochSize+len(k.Key))
+	binary.BigEndian.PutUint32(b, k.Epoch)
+	return append(b, k.Key...)
+}
+
+// unmarshalGroupKey reads a key written by marshal
+func unmarshalGroupKey(b []byte) (GroupKey, error) {
+	if len(b) != epochSize+KeySize {
+		return GroupKey{}, fmt.Errorf("group key of %d bytes, expected %d", len(b), epochSize+KeySize)
+	}
+	return GroupKey{Epoch: binary.BigEndian.Uint32(b), Key: b[epochSize:]}, nil
+}
+
+// GroupKeys holds the current key of every group, shared by the publisher and the key server
+type GroupKeys struct {
+	mutex sync.Mutex
+	keys  map[string]GroupKey
+}
+
+// NewGroupKeys creates an empty set of keys, the key of a group is created when it is first asked for
+func NewGroupKeys() *GroupKeys {
+	return &GroupKeys{keys: make(map[string]GroupKey)}
+}
+
+// Key returns the current key of the group
+func (g *GroupKeys) Key(group string) (GroupKey, error) {
+	if err := validGroup(group); err != nil {
+		return GroupKey{}, err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if key, ok := g.keys[group]; ok {
+		return key, nil
+	}
+	key, err := NewGroupKey(1)
+	if err != nil {
+		return GroupKey{}, err
+	}
+	g.keys[group] = key
+	return key, nil
+}
+
+// Rotate replaces the key of the group with a key of the next epoch
+// Rotation limits how much is sealed under one key. It also shuts out the subscribers taken off the allow-list of the
+// KeyServer, which no longer hands them keys, from the messages sealed afterwards.
+func (g *GroupKeys) Rotate(group string) (GroupKey, error) {
+	if err := validGroup(group); err != nil {
+		return GroupKey{}, err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	key, err := NewGroupKey(g.keys[group].Epoch + 1)
+	if err != nil {
+		return GroupKey{}, err
+	}
+	g.keys[group] = key
+	return key, nil
+}
+
+// Groups lists the groups that have a key
+func (g *GroupKeys) Groups() []string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	groups := make([]string, 0, len(g.keys))
+	for group := range g.keys {
+		groups = append(groups, group)
+	}
+	return groups
+}
@@ -0,0 +1,254 @@
+package zmqpattern
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	flynn "github.com/flynn/noise"
+	"github.com/limaechocharlie/cwb/shared/noise"
+	"github.com/limaechocharlie/cwb/shared/zmqenvelope"
+	"github.com/limaechocharlie/cwb/shared/zmqpool"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Grant is what a subscriber on the allow-list of a KeyServer may fetch
+type Grant struct {
+	Token  []byte   // secret the subscriber proves its name with
+	Groups []string // groups whose keys the subscriber gets, "*" for all of them
+}
+
+// allows reports whether the grant covers the group
+func (g Grant) allows(group string) bool {
+	for _, allowed := range g.Groups {
+		if allowed == "*" || allowed == group {
+			return true
+		}
+	}
+	return false
+}
+
+// Grants is the allow-list of a KeyServer, by subscriber name
+type Grants map[string]Grant
+
+// ReadGrants reads an allow-list with a subscriber per line: its name, its token in hex and the comma separated groups
+// it may join, or *
+// Blank lines and lines starting with # are skipped.
+func ReadGrants(r io.Reader) (Grants, error) {
+	grants := make(Grants)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected a name, a token and groups", line)
+		}
+		token, err := hex.DecodeString(fields[1])
+		if err != nil || len(token) == 0 {
+			return nil, fmt.Errorf("line %d: token isn't hex", line)
+		}
+		if _, err := marshalCredentials(fields[0], token); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if _, ok := grants[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: subscriber %s listed twice", line, fields[0])
+		}
+		groups := strings.Split(fields[2], ",")
+		for _, group := range groups {
+			if err := validGroup(group); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		grants[fields[0]] = Grant{Token: token, Groups: groups}
+	}
+	return grants, scanner.Err()
+}
+
+// errCredentials is returned when the credentials of a handshake can't be read
+var errCredentials = errors.New("malformed credentials")
+
+// marshalCredentials encodes the name and token a subscriber sends in its handshake, the name prefixed by its length
+func marshalCredentials(name string, token []byte) ([]byte, error) {
+	if name == "" || len(name) > 255 {
+		return nil, fmt.Errorf("subscriber name of %d bytes, expected 1 to 255", len(name))
+	}
+	b := make([]byte, 0, 1+len(name)+len(token))
+	b = append(b, byte(len(name)))
+	b = append(b, name...)
+	return append(b, token...), nil
+}
+
+// unmarshalCredentials decodes the name and token of a handshake
+func unmarshalCredentials(b []byte) (string, []byte, error) {
+	if len(b) < 1 || b[0] == 0 || len(b) < 1+int(b[0]) {
+		return "", nil, errCredentials
+	}
+	return string(b[1 : 1+b[0]]), b[1+b[0]:], nil
+}
+
+// errForbidden is returned when a subscriber isn't on the allow-list or its token doesn't match
+var errForbidden = errors.New("unknown subscriber or wrong token")
+
+// KeyServer hands out group keys over Noise NK channels, answering the requests of a zmqpool
+// A client that knows the server's static public key handshakes with its name and token, then asks for the key of a
+// group with a GroupKey envelope whose payload is the group name, encrypted with the cipher states of the channel like
+// the key in the reply. NK authenticates the server to the client and keeps the token from eavesdroppers; the server
+// authenticates the client against its allow-list and only hands out the keys of the groups granted to it.
+type KeyServer struct {
+	keys      *GroupKeys
+	staticKey flynn.DHKey
+
+	mutex    sync.Mutex
+	grants   Grants
+	channels map[uint64]keyChannel
+}
+
+// keyChannel is the channel of an authenticated subscriber
+type keyChannel struct {
+	csPair     noise.CipherStatePair
+	subscriber string
+}
+
+// NewKeyServer creates a server of the keys with the static key pair, for the subscribers of the allow-list
+func NewKeyServer(keys *GroupKeys, staticKey flynn.DHKey, grants Grants) *KeyServer {
+	return &KeyServer{keys: keys, staticKey: staticKey, grants: grants, channels: make(map[uint64]keyChannel)}
+}
+
+// SetGrants replaces the allow-list
+// Subscribers taken off it are refused any further key, including the keys of the groups rotated afterwards.
+func (s *KeyServer) SetGrants(grants Grants) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.grants = grants
+}
+
+// authenticate checks the credentials of a handshake against the allow-list and returns the name of the subscriber
+func (s *KeyServer) authenticate(credentials []byte) (string, error) {
+	name, token, err := unmarshalCredentials(credentials)
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	grant, ok := s.grants[name]
+	s.mutex.Unlock()
+	if !ok || !hmac.Equal(token, grant.Token) {
+		return "", errForbidden
+	}
+	return name, nil
+}
+
+// handshakeMessenger satisfies the ServerMessenger in the noise wrapper library by keeping the reply to the
+// handshake request, which the pool sends
+type handshakeMessenger struct {
+	request zmqenvelope.Envelope
+	reply   []byte
+}
+
+func (m *handshakeMessenger) Send(message []byte) error {
+	m.reply = zmqenvelope.Reply(m.request, message).Marshal()
+	return nil
+}
+
+// fail logs the failure and creates the reply that reports it to the client
+func fail(req zmqenvelope.Envelope, code zmqenvelope.Code, format string, a ...interface{}) []byte {
+	reply := zmqenvelope.ErrorReply(req, code, format, a...)
+	log.Printf("Request %d failed: %s", req.RequestID, reply.Payload[1:])
+	return reply.Marshal()
+}
+
+// Handle answers a request, with an error if it fails
+func (s *KeyServer) Handle(r zmqpool.Request) []byte {
+	req, err := zmqenvelope.Unmarshal(r.Payload)
+	switch err {
+	case nil:
+	case zmqenvelope.ErrVersion:
+		return fail(req, zmqenvelope.UnsupportedVersion, "version %d, expected %d", req.Version, zmqenvelope.Version)
+	default:
+		return fail(req, zmqenvelope.BadEnvelope, "%v", err)
+	}
+
+	switch req.Type {
+	case zmqenvelope.Handshake:
+		messenger := &handshakeMessenger{request: req}
+		var subscriber string
+		channelID, csPair, err := noise.ServerHandshakeNK(messenger, s.staticKey, req.Payload, func(credentials []byte) error {
+			name, err := s.authenticate(credentials)
+			subscriber = name
+			return err
+		})
+		switch {
+		case err == errForbidden || err == errCredentials:
+			return fail(req, zmqenvelope.Forbidden, "%v", err)
+		case err != nil:
+			return fail(req, zmqenvelope.HandshakeFailed, "%v", err)
+		}
+		id, ok := channelID.UInt64()
+		if !ok {
+			return fail(req, zmqenvelope.Internal, "unable to encode channel ID into an integer")
+		}
+		s.mutex.Lock()
+		s.channels[id] = keyChannel{csPair: csPair, subscriber: subscriber}
+		s.mutex.Unlock()
+		log.Printf("Handshake with subscriber %s completed [id: %d]", subscriber, id)
+		return messenger.reply
+	case zmqenvelope.GroupKey:
+		// a reconnected client may have a retry of a request in flight on its old connection, so the cipher states
+		// of a channel are used by one request at a time
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		channel, ok := s.channels[req.ChannelID]
+		if !ok {
+			return fail(req, zmqenvelope.UnknownChannel, "no channel %d", req.ChannelID)
+		}
+		group, err := channel.csPair.Decrypter.Decrypt(nil, nil, req.Payload)
+		if err != nil {
+			return fail(req, zmqenvelope.DecryptFailed, "%v", err)
+		}
+		if !s.grants[channel.subscriber].allows(string(group)) {
+			return fail(req, zmqenvelope.Forbidden, "subscriber %s may not join %s", channel.subscriber, group)
+		}
+		key, err := s.keys.Key(string(group))
+		if err != nil {
+			return fail(req, zmqenvelope.Internal, "%v", err)
+		}
+		log.Printf("Sending key of group %s, epoch %d, to subscriber %s", group, key.Epoch, channel.subscriber)
+		return zmqenvelope.Reply(req, channel.csPair.Encrypter.Encrypt(nil, nil, key.marshal())).Marshal()
+	default:
+		return fail(req, zmqenvelope.UnknownType, "unknown message type %s", req.Type)
+	}
+}
+
+// KeyClient fetches group keys from a KeyServer over a Channel
+type KeyClient struct {
+	channel *Channel
+}
+
+// NewKeyClient creates a client that sends its requests with the pirate to the key server with the static public key,
+// as the subscriber with the name and token
+func NewKeyClient(pirate *LazyPirate, serverKey []byte, name string, token []byte) (*KeyClient, error) {
+	credentials, err := marshalCredentials(name, token)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyClient{channel: NewChannelNK(zmqenvelope.NewClient(pirate), serverKey, credentials)}, nil
+}
+
+// Fetch asks for the current key of the group
+func (c *KeyClient) Fetch(group string) (GroupKey, error) {
+	if err := validGroup(group); err != nil {
+		return GroupKey{}, err
+	}
+	b, err := c.channel.Request(zmqenvelope.GroupKey, []byte(group), time.Time{})
+	if err != nil {
+		return GroupKey{}, err
+	}
+	return unmarshalGroupKey(b)
+}
@@ -0,0 +1,100 @@
+package zmqpattern
+
+import (
+	"errors"
+	"github.com/limaechocharlie/cwb/shared/noise"
+	"github.com/limaechocharlie/cwb/shared/zmqenvelope"
+	"github.com/limaechocharlie/cwb/shared/zmqpool"
+	"strings"
+	"testing"
+	"time"
+)
+
+// handlerTransport passes the requests straight to a KeyServer
+type handlerTransport struct {
+	server *KeyServer
+}
+
+func (t handlerTransport) RequestWithDeadline(request []byte, deadline time.Time) ([]byte, error) {
+	return t.server.Handle(zmqpool.Request{Payload: request}), nil
+}
+
+func (t handlerTransport) ReceiveWithDeadline(deadline time.Time) ([]byte, error) {
+	return nil, errors.New("no reply")
+}
+
+// newKeyClient creates a client of the server as the subscriber with the name and token
+func newKeyClient(t *testing.T, server *KeyServer, serverKey []byte, name string, token []byte) *KeyClient {
+	t.Helper()
+	credentials, err := marshalCredentials(name, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &KeyClient{channel: NewChannelNK(zmqenvelope.NewClient(handlerTransport{server}), serverKey, credentials)}
+}
+
+// forbidden reports whether the error is a Forbidden error reply
+func forbidden(err error) bool {
+	remote, ok := err.(*zmqenvelope.RemoteError)
+	return ok && remote.Code == zmqenvelope.Forbidden
+}
+
+func TestKeyServerAllowList(t *testing.T) {
+	staticKey, err := noise.GenerateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	grants, err := ReadGrants(strings.NewReader("# name token groups\nreader 0102 temperature\n\nadmin 0304 *\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := NewGroupKeys()
+	server := NewKeyServer(keys, staticKey, grants)
+
+	reader := newKeyClient(t, server, staticKey.Public, "reader", []byte{1, 2})
+	key, err := reader.Fetch("temperature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := keys.Key("temperature")
+	if string(key.Key) != string(expected.Key) {
+		t.Fatal("fetched key isn't the key of the group")
+	}
+	if _, err := reader.Fetch("pressure"); !forbidden(err) {
+		t.Fatalf("expected a forbidden error for a group not granted, got %v", err)
+	}
+	if _, err := newKeyClient(t, server, staticKey.Public, "admin", []byte{3, 4}).Fetch("pressure"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newKeyClient(t, server, staticKey.Public, "reader", []byte{3, 4}).Fetch("temperature"); !forbidden(err) {
+		t.Fatalf("expected a forbidden error for a wrong token, got %v", err)
+	}
+	if _, err := newKeyClient(t, server, staticKey.Public, "writer", []byte{1, 2}).Fetch("temperature"); !forbidden(err) {
+		t.Fatalf("expected a forbidden error for an unknown subscriber, got %v", err)
+	}
+
+	// a client with another public key doesn't complete the handshake with the server
+	impostor, err := noise.GenerateKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newKeyClient(t, server, impostor.Public, "reader", []byte{1, 2}).Fetch("temperature")
+	if remote, ok := err.(*zmqenvelope.RemoteError); !ok || remote.Code != zmqenvelope.HandshakeFailed {
+		t.Fatalf("expected a failed handshake with the wrong server key, got %v", err)
+	}
+
+	// taken off the allow-list, an open channel gets no more keys
+	server.SetGrants(Grants{})
+	if _, err := reader.Fetch("temperature"); !forbidden(err) {
+		t.Fatalf("expected a forbidden error once off the allow-list, got %v", err)
+	}
+}
+
+func TestReadGrantsRejectsMalformedLines(t *testing.T) {
+	for _, line := range []string{"reader 0102", "reader xyz temperature", "reader 0102 temperature,", "reader 0102 a\nreader 0304 b"} {
+		if _, err := ReadGrants(strings.NewReader(line)); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
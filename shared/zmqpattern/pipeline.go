@@ -0,0 +1,145 @@
+package zmqpattern
+
+import (
+	"encoding/binary"
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
+	"log"
+	"time"
+)
+
+// Messages of the pipeline are multipart: tasks are the batch ID, the index of the task and its payload, results
+// are the same with the payload of the result, and the announcement of a batch to the sink has the number of tasks
+// in place of the index and no payload. The first frame tells results from announcements.
+const (
+	announceFrame = "batch"
+	resultFrame   = "result"
+)
+
+// Distributor pushes batches of tasks to the workers, announcing every batch to the sink
+type Distributor struct {
+	workers zmqsocket.PipelineSocket
+	sink    zmqsocket.PipelineSocket
+	last    uint64 // ID of the last batch
+}
+
+// NewDistributor creates a distributor on a PUSH socket the workers connect to and a PUSH socket connected to the sink
+// PUSH sockets hand messages to the connected peers in turn, so tasks are spread over the workers.
+func NewDistributor(workers, sink zmqsocket.PipelineSocket) *Distributor {
+	// batch IDs start from the clock so that a restarted distributor doesn't reuse those the sink has seen
+	return &Distributor{workers: workers, sink: sink, last: uint64(time.Now().UnixNano())}
+}
+
+func uint64Frame(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+func uint32Frame(n uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, n)
+	return b
+}
+
+// Distribute sends the tasks of a new batch, returning its ID
+func (d *Distributor) Distribute(tasks [][]byte) (uint64, error) {
+	d.last++
+	batch := uint64Frame(d.last)
+	if err := d.sink.SendParts([][]byte{[]byte(announceFrame), batch, uint32Frame(uint32(len(tasks)))}, -1); err != nil {
+		return 0, err
+	}
+	for i, task := range tasks {
+		if err := d.workers.SendParts([][]byte{batch, uint32Frame(uint32(i)), task}, -1); err != nil {
+			return 0, err
+		}
+	}
+	return d.last, nil
+}
+
+// Work pulls tasks, handles them and pushes the results to the sink until the tasks socket is closed
+func Work(tasks, results zmqsocket.PipelineSocket, handler func(task []byte) []byte) error {
+	for {
+		task, err := tasks.RecvParts(-1)
+		if err != nil {
+			if err == zmqsocket.ErrClosed {
+				return err
+			}
+			log.Printf("Cannot receive task: %v", err)
+			continue
+		}
+		if len(task) != 3 || len(task[0]) != 8 || len(task[1]) != 4 {
+			log.Printf("Discarding malformed task of %d frames", len(task))
+			continue
+		}
+		result := handler(task[2])
+		if err := results.SendParts([][]byte{[]byte(resultFrame), task[0], task[1], result}, -1); err != nil {
+			log.Printf("Cannot send result: %v", err)
+		}
+	}
+}
+
+// batch gathers the results of a batch
+type batch struct {
+	announced bool
+	size      uint32
+	results   map[uint32][]byte
+}
+
+func (b *batch) complete() bool {
+	return b.announced && uint32(len(b.results)) == b.size
+}
+
+// Sink pulls the results of the workers and puts the batches back together
+// Results can arrive before the announcement of their batch, they come over other connections.
+type Sink struct {
+	socket  zmqsocket.PipelineSocket
+	batches map[uint64]*batch
+}
+
+// NewSink creates a sink on a bound PULL socket the distributor and the workers connect to
+func NewSink(socket zmqsocket.PipelineSocket) *Sink {
+	return &Sink{socket: socket, batches: make(map[uint64]*batch)}
+}
+
+// Collect waits for a batch to be complete, returning its ID and its results in the order of the tasks
+func (s *Sink) Collect() (uint64, [][]byte, error) {
+	for {
+		msg, err := s.socket.RecvParts(-1)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(msg) < 3 || len(msg[1]) != 8 || len(msg[2]) != 4 {
+			log.Printf("Discarding malformed message of %d frames", len(msg))
+			continue
+		}
+		id, n := binary.BigEndian.Uint64(msg[1]), binary.BigEndian.Uint32(msg[2])
+		b, ok := s.batches[id]
+		if !ok {
+			b = &batch{results: make(map[uint32][]byte)}
+			s.batches[id] = b
+		}
+		switch {
+		case string(msg[0]) == announceFrame:
+			b.announced, b.size = true, n
+			for i := range b.results {
+				if i >= n {
+					delete(b.results, i)
+				}
+			}
+		case string(msg[0]) == resultFrame && len(msg) == 4 && !(b.announced && n >= b.size):
+			b.results[n] = msg[3]
+		default:
+			log.Printf("Discarding message %q of batch %d", msg[0], id)
+			continue
+		}
+		if !b.complete() {
+			continue
+		}
+		delete(s.batches, id)
+		results := make([][]byte, b.size)
+		for i := range results {
+			results[i] = b.results[uint32(i)]
+		}
+		return id, results, nil
+	}
+}
@@ -0,0 +1,154 @@
+// Package zmqpattern implements the ZMQ messaging patterns of the examples beyond plain request-reply.
+//
+// LazyPirate makes request-reply over a CLIENT socket reliable, Publisher and Subscriber encrypt RADIO/DISH
+// pub-sub with group keys handed out by a KeyServer over Noise channels, and Distributor, Work and Sink spread
+// batches of tasks over PUSH/PULL pipelines. See http://zguide.zeromq.org for the patterns.
+//
+// The patterns run on the sockets of the zmqsocket package, so they build with either of its backends.
+package zmqpattern
+
+import (
+	"errors"
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
+	"log"
+	"time"
+)
+
+const (
+	// DefaultTimeout is how long LazyPirate waits for a reply by default
+	DefaultTimeout = 2500 * time.Millisecond
+	// DefaultRetries is how many times LazyPirate sends a request again by default
+	DefaultRetries = 3
+)
+
+var (
+	// ErrNoReply is returned when the server didn't reply to a request nor to any retry
+	ErrNoReply = errors.New("no reply from the server")
+	// ErrDeadline is returned when the deadline of a request passed before its reply came
+	ErrDeadline = errors.New("request deadline exceeded")
+	// ErrNoRequest is returned when waiting for another reply before any request was sent
+	ErrNoRequest = errors.New("no request to wait for")
+)
+
+// LazyPirate sends requests over a CLIENT socket, sending them again on a new socket when no reply comes in time
+// Closing the socket of an unanswered request discards most late replies to it, but a reply that was already queued
+// on the socket when the next request was sent is still received, so the envelope client checks request IDs. The
+// server has to cope with requests received more than once.
+type LazyPirate struct {
+	Endpoint string
+	// Timeout is how long to wait for each reply
+	Timeout time.Duration
+	// Retries is how many times a request is sent again before giving up
+	Retries int
+	// Open creates the socket of every connection, e.g. set up for CURVE, a zmqsocket CLIENT socket if nil
+	Open func() (zmqsocket.Socket, error)
+
+	socket  zmqsocket.Socket
+	request []byte // the last request, sent again by retries
+}
+
+// NewLazyPirate creates a client of the endpoint with the default timeout and retries, it connects on the first request
+func NewLazyPirate(endpoint string) *LazyPirate {
+	return &LazyPirate{Endpoint: endpoint, Timeout: DefaultTimeout, Retries: DefaultRetries}
+}
+
+// connect opens a new socket to the endpoint
+func (p *LazyPirate) connect() error {
+	open := p.Open
+	if open == nil {
+		open = func() (zmqsocket.Socket, error) {
+			return zmqsocket.NewSocket(zmqsocket.Client)
+		}
+	}
+	socket, err := open()
+	if err != nil {
+		return err
+	}
+	if err := socket.Connect(p.Endpoint); err != nil {
+		socket.Close()
+		return err
+	}
+	p.socket = socket
+	return nil
+}
+
+// Close closes the socket, the next request opens a new one
+func (p *LazyPirate) Close() error {
+	if p.socket == nil {
+		return nil
+	}
+	err := p.socket.Close()
+	p.socket = nil
+	return err
+}
+
+// attempt sends the last request, unless it only waits for another reply, and waits for the reply, returning
+// zmqsocket.ErrTimeout if it doesn't come in time
+// Sending waits for a connection, which counts against the time.
+func (p *LazyPirate) attempt(send bool, wait time.Duration) ([]byte, error) {
+	start := time.Now()
+	if send {
+		if err := p.socket.Send(p.request, 0, wait); err != nil {
+			return nil, err
+		}
+	}
+	left := wait - time.Since(start)
+	if left < 0 {
+		left = 0
+	}
+	reply, _, err := p.socket.Recv(left)
+	return reply, err
+}
+
+// Request sends the request and waits for its reply
+func (p *LazyPirate) Request(request []byte) ([]byte, error) {
+	return p.RequestWithDeadline(request, time.Time{})
+}
+
+// RequestWithDeadline sends the request and waits for its reply until the deadline, if not zero
+// The last attempt before the deadline waits only until the deadline.
+func (p *LazyPirate) RequestWithDeadline(request []byte, deadline time.Time) ([]byte, error) {
+	p.request = request
+	return p.retry(true, deadline)
+}
+
+// ReceiveWithDeadline waits for another reply to the last request until the deadline, if not zero
+// The request isn't sent again unless no reply comes in time, in which case it is retried as by RequestWithDeadline.
+func (p *LazyPirate) ReceiveWithDeadline(deadline time.Time) ([]byte, error) {
+	if p.request == nil {
+		return nil, ErrNoRequest
+	}
+	return p.retry(p.socket == nil, deadline)
+}
+
+// retry makes the attempts of the last request, the first only sending it if send is set
+func (p *LazyPirate) retry(send bool, deadline time.Time) ([]byte, error) {
+	for attempt := 0; attempt <= p.Retries; attempt++ {
+		wait := p.Timeout
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return nil, ErrDeadline
+			}
+			if left < wait {
+				wait = left
+			}
+		}
+		if p.socket == nil {
+			if err := p.connect(); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := p.attempt(send, wait)
+		if err != zmqsocket.ErrTimeout {
+			return reply, err
+		}
+		log.Printf("No reply from %s within %v, reconnecting", p.Endpoint, wait)
+		p.Close()
+		send = true
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return nil, ErrDeadline
+	}
+	return nil, ErrNoReply
+}
@@ -0,0 +1,97 @@
+package zmqpattern
+
+import (
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
+	"log"
+)
+
+// Publisher publishes messages sealed with the group keys on a RADIO socket
+type Publisher struct {
+	socket zmqsocket.GroupSocket
+	keys   *GroupKeys
+}
+
+// NewPublisher creates a publisher on the bound or connected RADIO socket
+func NewPublisher(socket zmqsocket.GroupSocket, keys *GroupKeys) *Publisher {
+	return &Publisher{socket: socket, keys: keys}
+}
+
+// Publish seals the message with the current key of the group and sends it to the group
+func (p *Publisher) Publish(group string, message []byte) error {
+	key, err := p.keys.Key(group)
+	if err != nil {
+		return err
+	}
+	sealed, err := key.Seal(group, message)
+	if err != nil {
+		return err
+	}
+	// a subscriber that doesn't take the message as long as a reply may take misses it
+	return p.socket.SendGroup(sealed, group, DefaultTimeout)
+}
+
+// Subscriber receives the messages of the groups it joined on a DISH socket and opens them with the group keys
+type Subscriber struct {
+	socket zmqsocket.GroupSocket
+	keys   *KeyClient
+	groups map[string]GroupKey
+}
+
+// NewSubscriber creates a subscriber on the bound or connected DISH socket, which fetches keys with the client
+func NewSubscriber(socket zmqsocket.GroupSocket, keys *KeyClient) *Subscriber {
+	return &Subscriber{socket: socket, keys: keys, groups: make(map[string]GroupKey)}
+}
+
+// Join fetches the key of the group and joins it
+func (s *Subscriber) Join(group string) error {
+	key, err := s.keys.Fetch(group)
+	if err != nil {
+		return err
+	}
+	if err := s.socket.Join(group); err != nil {
+		return err
+	}
+	s.groups[group] = key
+	return nil
+}
+
+// Leave leaves the group and forgets its key
+func (s *Subscriber) Leave(group string) error {
+	delete(s.groups, group)
+	return s.socket.Leave(group)
+}
+
+// open decrypts a message of the group, fetching the key of the group again when the message is of a newer epoch
+func (s *Subscriber) open(group string, message []byte) ([]byte, error) {
+	key, ok := s.groups[group]
+	if !ok {
+		return nil, ErrEpoch
+	}
+	if epoch, ok := Epoch(message); ok && epoch > key.Epoch {
+		log.Printf("Group %s rotated to epoch %d, fetching its key", group, epoch)
+		newKey, err := s.keys.Fetch(group)
+		if err != nil {
+			return nil, err
+		}
+		key = newKey
+		s.groups[group] = key
+	}
+	return key.Open(group, message)
+}
+
+// Receive waits for the next message that can be opened, returning it with its group
+// Messages that can't be opened, e.g. those in flight when a group was rotated, are logged and skipped.
+func (s *Subscriber) Receive() (string, []byte, error) {
+	for {
+		b, group, err := s.socket.RecvGroup(-1)
+		if err != nil {
+			return "", nil, err
+		}
+		message, err := s.open(group, b)
+		if err != nil {
+			log.Printf("Cannot open message of group %s: %v", group, err)
+			continue
+		}
+		return group, message, nil
+	}
+}
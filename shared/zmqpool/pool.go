@@ -0,0 +1,184 @@
+// Package zmqpool serves the requests of a ZMQ SERVER socket with a pool of workers.
+//
+// A single reader receives from the socket and a single writer sends the replies; handlers never touch the socket.
+// Requests from the same client, as told by the routing ID, are handled one at a time and answered in the order
+// they arrived, while requests from different clients are handled concurrently.
+package zmqpool
+
+import (
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
+	"log"
+	"runtime"
+	"sync"
+)
+
+// Request is a message received from a client
+type Request struct {
+	RoutingID uint32
+	Payload   []byte
+}
+
+// Handler answers a request, nothing is sent back if the reply is nil
+type Handler func(req Request) []byte
+
+// Options bound the work the pool takes on
+type Options struct {
+	// Workers is the number of requests handled at once, the number of CPUs if zero
+	Workers int
+	// QueueSize is the number of requests waiting for a worker, as many as there are workers if zero
+	// The socket isn't read while the queue is full, so clients are held back by the high-water marks of ZMQ.
+	QueueSize int
+	// MaxPending is the number of requests of a single client waiting behind the one being handled, 16 if zero
+	MaxPending int
+	// Busy answers a request over MaxPending, which is dropped if Busy is nil or returns nil
+	Busy Handler
+}
+
+// reply is a reply waiting to be sent
+type reply struct {
+	routingID uint32
+	payload   []byte
+}
+
+// client holds the requests of a client waiting behind the one being handled
+type client struct {
+	pending []Request
+}
+
+// pool dispatches requests to the workers
+type pool struct {
+	opts    Options
+	handler Handler
+	work    chan Request
+	replies chan reply
+
+	mutex   sync.Mutex
+	clients map[uint32]*client // clients with a request being handled
+}
+
+// Serve reads requests from the socket and answers them with the handler until the socket is closed
+// SERVER sockets are thread-safe, which lets the reader and the writer use the socket from their own goroutines.
+func Serve(socket zmqsocket.Socket, opts Options, handler Handler) error {
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = opts.Workers
+	}
+	if opts.MaxPending <= 0 {
+		opts.MaxPending = 16
+	}
+	p := &pool{
+		opts:    opts,
+		handler: handler,
+		work:    make(chan Request, opts.QueueSize),
+		replies: make(chan reply, opts.Workers),
+		clients: make(map[uint32]*client),
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			p.worker()
+		}()
+	}
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		p.writer(socket)
+	}()
+
+	err := p.reader(socket)
+	close(p.work)
+	workers.Wait()
+	close(p.replies)
+	<-written
+	return err
+}
+
+// reader receives requests until the socket is closed, queueing those of idle clients for a worker
+func (p *pool) reader(socket zmqsocket.Socket) error {
+	for {
+		b, routingID, err := socket.Recv(-1)
+		if err != nil {
+			if err == zmqsocket.ErrClosed {
+				return err
+			}
+			log.Printf("Cannot receive request: %v", err)
+			continue
+		}
+		req := Request{RoutingID: routingID, Payload: b}
+
+		p.mutex.Lock()
+		c, busy := p.clients[routingID]
+		queued := false
+		if !busy {
+			p.clients[routingID] = &client{}
+		} else if len(c.pending) < p.opts.MaxPending {
+			c.pending = append(c.pending, req)
+			queued = true
+		}
+		p.mutex.Unlock()
+
+		switch {
+		case !busy:
+			// blocks while the queue is full
+			p.work <- req
+		case !queued:
+			p.overloaded(req)
+		}
+	}
+}
+
+// overloaded answers a request over the limit of its client with the Busy handler, if any
+// The reply may overtake the replies to the requests the client is waiting for.
+func (p *pool) overloaded(req Request) {
+	log.Printf("Client %d has too many pending requests", req.RoutingID)
+	if p.opts.Busy == nil {
+		return
+	}
+	if b := p.opts.Busy(req); b != nil {
+		p.replies <- reply{routingID: req.RoutingID, payload: b}
+	}
+}
+
+// next takes the next pending request of the client, forgetting the client if it has none
+func (p *pool) next(routingID uint32) (Request, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	c := p.clients[routingID]
+	if len(c.pending) == 0 {
+		delete(p.clients, routingID)
+		return Request{}, false
+	}
+	req := c.pending[0]
+	c.pending = c.pending[1:]
+	return req, true
+}
+
+// worker handles queued requests, then the requests their client sent in the meantime, so that the requests of a
+// client are handled in order
+func (p *pool) worker() {
+	for req := range p.work {
+		for {
+			if b := p.handler(req); b != nil {
+				p.replies <- reply{routingID: req.RoutingID, payload: b}
+			}
+			var ok bool
+			if req, ok = p.next(req.RoutingID); !ok {
+				break
+			}
+		}
+	}
+}
+
+// writer sends the replies, the only sender on the socket
+func (p *pool) writer(socket zmqsocket.Socket) {
+	for r := range p.replies {
+		if err := socket.Send(r.payload, r.routingID, -1); err != nil {
+			log.Printf("Cannot send reply to client %d: %v", r.routingID, err)
+		}
+	}
+}
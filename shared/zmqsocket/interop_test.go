@@ -0,0 +1,206 @@
+//go:build zmtp && cgo
+// +build zmtp,cgo
+
+package zmqsocket
+
+import (
+	zmq "github.com/pebbe/zmq4/draft"
+	"net"
+	"testing"
+	"time"
+)
+
+// The tests of this file check the zmtp backend against libzmq peers, through the cgo wrapper of the default backend
+
+// freeEndpoint returns the endpoint of a loopback port free for libzmq to bind
+func freeEndpoint(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return "tcp://" + l.Addr().String()
+}
+
+// newLibzmq creates a libzmq socket of the type with a receive timeout
+func newLibzmq(t *testing.T, typ zmq.Type) *zmq.Socket {
+	t.Helper()
+	s, err := zmq.NewSocket(typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRcvtimeo(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetLinger(0); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestInteropLibzmqServer(t *testing.T) {
+	endpoint := freeEndpoint(t)
+	server := newLibzmq(t, zmq.SERVER)
+	defer server.Close()
+	if err := server.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	client := connect(t, Client, endpoint)
+	defer client.Close()
+
+	if err := client.Send([]byte("hello"), 0, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	request, opts, err := server.RecvBytesWithOpts(0, zmq.OptRoutingId(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(request) != "hello" {
+		t.Fatalf("libzmq SERVER received %q", request)
+	}
+	routingID, _ := opts[0].(zmq.OptRoutingId)
+	if _, err := server.SendBytes([]byte("olleh"), 0, routingID); err != nil {
+		t.Fatal(err)
+	}
+	reply, _, err := client.Recv(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "olleh" {
+		t.Fatalf("received %q from the libzmq SERVER", reply)
+	}
+}
+
+func TestInteropLibzmqClient(t *testing.T) {
+	server, endpoint := bind(t, Server)
+	defer server.Close()
+	client := newLibzmq(t, zmq.CLIENT)
+	defer client.Close()
+	if err := client.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.SendBytes([]byte("hello"), 0); err != nil {
+		t.Fatal(err)
+	}
+	request, routingID, err := server.Recv(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(request) != "hello" {
+		t.Fatalf("received %q from the libzmq CLIENT", request)
+	}
+	if err := server.Send([]byte("olleh"), routingID, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := client.RecvBytes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "olleh" {
+		t.Fatalf("libzmq CLIENT received %q", reply)
+	}
+}
+
+func TestInteropLibzmqDish(t *testing.T) {
+	radio, endpoint := bind(t, Radio)
+	defer radio.Close()
+	dish := newLibzmq(t, zmq.DISH)
+	defer dish.Close()
+	if err := dish.Join("temperature"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dish.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	joinedGroup(t, radio, "temperature")
+
+	for _, group := range []string{"humidity", "temperature"} {
+		if err := radio.SendGroup([]byte("reading of "+group), group, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message, opts, err := dish.RecvBytesWithOpts(0, zmq.OptGroup(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group, _ := opts[0].(zmq.OptGroup); group != "temperature" || string(message) != "reading of temperature" {
+		t.Fatalf("libzmq DISH received %q of group %s, expected the reading of temperature", message, group)
+	}
+}
+
+func TestInteropLibzmqRadio(t *testing.T) {
+	endpoint := freeEndpoint(t)
+	radio := newLibzmq(t, zmq.RADIO)
+	defer radio.Close()
+	if err := radio.Bind(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	dish := connect(t, Dish, endpoint)
+	defer dish.Close()
+	if err := dish.Join("temperature"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the libzmq RADIO socket drops the messages sent before it sees the join, so they are sent until one comes
+	for i := 0; i < 50; i++ {
+		if _, err := radio.SendBytes([]byte("reading"), 0, zmq.OptGroup("temperature")); err != nil {
+			t.Fatal(err)
+		}
+		message, group, err := dish.RecvGroup(100 * time.Millisecond)
+		if err == ErrTimeout {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group != "temperature" || string(message) != "reading" {
+			t.Fatalf("received %q of group %s from the libzmq RADIO", message, group)
+		}
+		return
+	}
+	t.Fatal("no message from the libzmq RADIO")
+}
+
+func TestInteropLibzmqPull(t *testing.T) {
+	push, endpoint := bind(t, Push)
+	defer push.Close()
+	pull := newLibzmq(t, zmq.PULL)
+	defer pull.Close()
+	if err := pull.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := push.SendParts([][]byte{[]byte("task"), []byte("1")}, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	parts, err := pull.RecvMessageBytes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 2 || string(parts[0]) != "task" || string(parts[1]) != "1" {
+		t.Fatalf("libzmq PULL received %q", parts)
+	}
+}
+
+func TestInteropLibzmqPush(t *testing.T) {
+	pull, endpoint := bind(t, Pull)
+	defer pull.Close()
+	push := newLibzmq(t, zmq.PUSH)
+	defer push.Close()
+	if err := push.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := push.SendMessage("result", []byte("1"), ""); err != nil {
+		t.Fatal(err)
+	}
+	parts, err := pull.RecvParts(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 3 || string(parts[0]) != "result" || string(parts[1]) != "1" || len(parts[2]) != 0 {
+		t.Fatalf("received %q from the libzmq PUSH", parts)
+	}
+}
@@ -0,0 +1,213 @@
+//go:build !zmtp
+// +build !zmtp
+
+package zmqsocket
+
+import (
+	zmq "github.com/pebbe/zmq4/draft"
+	"time"
+)
+
+// libzmqSocket is a socket of libzmq
+type libzmqSocket struct {
+	socket *zmq.Socket
+	t      Type
+}
+
+// zmqTypes are the libzmq socket types of the types
+var zmqTypes = map[Type]zmq.Type{
+	Server: zmq.SERVER,
+	Client: zmq.CLIENT,
+	Radio:  zmq.RADIO,
+	Dish:   zmq.DISH,
+	Push:   zmq.PUSH,
+	Pull:   zmq.PULL,
+}
+
+// newSocket creates a socket of the type in the default ZMQ context
+func newSocket(t Type) (*libzmqSocket, error) {
+	socket, err := zmq.NewSocket(zmqTypes[t])
+	if err != nil {
+		return nil, err
+	}
+	return &libzmqSocket{socket: socket, t: t}, nil
+}
+
+// NewSocket creates a CLIENT or SERVER socket in the default ZMQ context
+// CLIENT sockets queue messages only to completed connections and drop them when closed, so that a message can't
+// wait for a connection longer than the send timeout.
+func NewSocket(t Type) (Socket, error) {
+	if err := checkType(t, Server, Client); err != nil {
+		return nil, err
+	}
+	s, err := newSocket(t)
+	if err != nil {
+		return nil, err
+	}
+	if t == Client {
+		if err := s.socket.SetLinger(0); err != nil {
+			s.socket.Close()
+			return nil, err
+		}
+		if err := s.socket.SetImmediate(true); err != nil {
+			s.socket.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// NewGroupSocket creates a RADIO or DISH socket in the default ZMQ context
+func NewGroupSocket(t Type) (GroupSocket, error) {
+	if err := checkType(t, Radio, Dish); err != nil {
+		return nil, err
+	}
+	return newSocket(t)
+}
+
+// NewPipelineSocket creates a PUSH or PULL socket in the default ZMQ context
+func NewPipelineSocket(t Type) (PipelineSocket, error) {
+	if err := checkType(t, Push, Pull); err != nil {
+		return nil, err
+	}
+	return newSocket(t)
+}
+
+// Wrap turns a libzmq socket of the type, e.g. set up for CURVE, into a Socket
+func Wrap(socket *zmq.Socket, t Type) Socket {
+	return &libzmqSocket{socket: socket, t: t}
+}
+
+// Native returns the libzmq socket of a socket created by this backend, nil for others
+func Native(s Socket) *zmq.Socket {
+	if l, ok := s.(*libzmqSocket); ok {
+		return l.socket
+	}
+	return nil
+}
+
+// convert turns the errors of libzmq into those of this package
+func convert(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == zmq.ErrorSocketClosed {
+		return ErrClosed
+	}
+	switch zmq.AsErrno(err) {
+	case zmq.ETERM:
+		return ErrClosed
+	case zmq.EAGAIN:
+		return ErrTimeout
+	case zmq.EHOSTUNREACH:
+		return ErrUnreachable
+	case zmq.ENOTSUP:
+		return ErrNotSupported
+	}
+	return err
+}
+
+// zmqTimeout converts a timeout, libzmq takes -1 for forever
+func zmqTimeout(timeout time.Duration) time.Duration {
+	if timeout < 0 {
+		return -1
+	}
+	return timeout
+}
+
+func (s *libzmqSocket) Bind(endpoint string) error {
+	return convert(s.socket.Bind(endpoint))
+}
+
+func (s *libzmqSocket) Connect(endpoint string) error {
+	return convert(s.socket.Connect(endpoint))
+}
+
+func (s *libzmqSocket) Send(message []byte, routingID uint32, timeout time.Duration) error {
+	if err := s.socket.SetSndtimeo(zmqTimeout(timeout)); err != nil {
+		return convert(err)
+	}
+	var err error
+	if s.t == Server {
+		_, err = s.socket.SendBytes(message, 0, zmq.OptRoutingId(routingID))
+	} else {
+		_, err = s.socket.SendBytes(message, 0)
+	}
+	if err != nil {
+		return convert(err)
+	}
+	return nil
+}
+
+func (s *libzmqSocket) Recv(timeout time.Duration) ([]byte, uint32, error) {
+	if err := s.socket.SetRcvtimeo(zmqTimeout(timeout)); err != nil {
+		return nil, 0, convert(err)
+	}
+	if s.t != Server {
+		b, err := s.socket.RecvBytes(0)
+		if err != nil {
+			return nil, 0, convert(err)
+		}
+		return b, 0, nil
+	}
+	b, opts, err := s.socket.RecvBytesWithOpts(0, zmq.OptRoutingId(0))
+	if err != nil {
+		return nil, 0, convert(err)
+	}
+	routingID, _ := opts[0].(zmq.OptRoutingId)
+	return b, uint32(routingID), nil
+}
+
+func (s *libzmqSocket) Join(group string) error {
+	return convert(s.socket.Join(group))
+}
+
+func (s *libzmqSocket) Leave(group string) error {
+	return convert(s.socket.Leave(group))
+}
+
+func (s *libzmqSocket) SendGroup(message []byte, group string, timeout time.Duration) error {
+	if err := s.socket.SetSndtimeo(zmqTimeout(timeout)); err != nil {
+		return convert(err)
+	}
+	_, err := s.socket.SendBytes(message, 0, zmq.OptGroup(group))
+	return convert(err)
+}
+
+func (s *libzmqSocket) RecvGroup(timeout time.Duration) ([]byte, string, error) {
+	if err := s.socket.SetRcvtimeo(zmqTimeout(timeout)); err != nil {
+		return nil, "", convert(err)
+	}
+	b, opts, err := s.socket.RecvBytesWithOpts(0, zmq.OptGroup(""))
+	if err != nil {
+		return nil, "", convert(err)
+	}
+	group, _ := opts[0].(zmq.OptGroup)
+	return b, string(group), nil
+}
+
+func (s *libzmqSocket) SendParts(parts [][]byte, timeout time.Duration) error {
+	if len(parts) == 0 {
+		return errNoParts
+	}
+	if err := s.socket.SetSndtimeo(zmqTimeout(timeout)); err != nil {
+		return convert(err)
+	}
+	_, err := s.socket.SendMessage(parts)
+	return convert(err)
+}
+
+func (s *libzmqSocket) RecvParts(timeout time.Duration) ([][]byte, error) {
+	if err := s.socket.SetRcvtimeo(zmqTimeout(timeout)); err != nil {
+		return nil, convert(err)
+	}
+	parts, err := s.socket.RecvMessageBytes(0)
+	if err != nil {
+		return nil, convert(err)
+	}
+	return parts, nil
+}
+
+func (s *libzmqSocket) Close() error {
+	return convert(s.socket.Close())
+}
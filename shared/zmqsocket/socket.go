@@ -0,0 +1,138 @@
+// Package zmqsocket abstracts the ZMQ sockets of the examples over two backends: CLIENT and SERVER, RADIO and DISH,
+// PUSH and PULL.
+//
+// The default backend wraps libzmq through github.com/pebbe/zmq4/draft, which needs libzmq built with the draft
+// APIs and cgo. Building with the zmtp tag selects a pure-Go implementation of ZMTP 3.1, see
+// http://rfc.zeromq.org/spec:37, which speaks to libzmq peers over tcp with the NULL security mechanism:
+//
+//	go run -tags zmtp src/server.go
+//
+// Its tests need the tag too. Without cgo they run in pure Go, with cgo they also check the backend against libzmq
+// peers, which needs libzmq as for the default backend:
+//
+//	CGO_ENABLED=0 go test -tags zmtp ./shared/zmqsocket
+//	go test -tags zmtp ./shared/zmqsocket
+//
+// Messages of CLIENT, SERVER, RADIO and DISH sockets are single-part, with the routing ID of the peer on SERVER
+// sockets and the group on RADIO and DISH sockets. Messages of PUSH and PULL sockets have one or more parts.
+package zmqsocket
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Type is the type of a socket
+type Type int
+
+const (
+	// Server sockets talk to many clients, telling them apart by routing ID
+	Server Type = iota
+	// Client sockets talk to a server
+	Client
+	// Radio sockets send messages to the groups DISH sockets joined
+	Radio
+	// Dish sockets receive the messages of the groups they joined
+	Dish
+	// Push sockets hand their messages to the connected PULL sockets in turn
+	Push
+	// Pull sockets receive the messages of all the connected PUSH sockets
+	Pull
+)
+
+func (t Type) String() string {
+	switch t {
+	case Server:
+		return "SERVER"
+	case Client:
+		return "CLIENT"
+	case Radio:
+		return "RADIO"
+	case Dish:
+		return "DISH"
+	case Push:
+		return "PUSH"
+	case Pull:
+		return "PULL"
+	}
+	return fmt.Sprintf("type %d", int(t))
+}
+
+// checkType returns an error unless the type is one of those a constructor creates
+func checkType(t Type, types ...Type) error {
+	for _, supported := range types {
+		if t == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s sockets not supported", t)
+}
+
+var (
+	// ErrTimeout is returned when a message couldn't be sent or received in time
+	ErrTimeout = errors.New("zmq socket timeout")
+	// ErrClosed is returned by the operations on a closed socket
+	ErrClosed = errors.New("zmq socket closed")
+	// ErrUnreachable is returned when sending to a routing ID of no connected peer
+	ErrUnreachable = errors.New("zmq peer unreachable")
+	// ErrNotSupported is returned by the operations the type of the socket doesn't have, e.g. Join on a RADIO socket
+	ErrNotSupported = errors.New("zmq operation not supported by the socket type")
+
+	errNoParts = errors.New("zmq message of no parts")
+)
+
+// Socket is a CLIENT or SERVER socket
+// SERVER sockets are safe for concurrent use, which lets a reader and a writer share them.
+type Socket interface {
+	// Bind listens on a tcp endpoint, e.g. tcp://127.0.0.1:5556 or tcp://*:5556
+	Bind(endpoint string) error
+	// Connect connects to a tcp endpoint, connecting again whenever the connection is lost
+	Connect(endpoint string) error
+	// Send sends a message to the peer with the routing ID, which is ignored on CLIENT sockets
+	// A CLIENT socket waits for a connection. The timeout is forever if negative.
+	Send(message []byte, routingID uint32, timeout time.Duration) error
+	// Recv waits for a message, returning the routing ID of its peer on SERVER sockets
+	// The timeout is forever if negative.
+	Recv(timeout time.Duration) (message []byte, routingID uint32, err error)
+	// Close closes the socket, dropping the messages not yet sent
+	Close() error
+}
+
+// GroupSocket is a RADIO or DISH socket
+// A DISH socket only receives the messages sent to the groups it joined once the RADIO socket saw it join.
+type GroupSocket interface {
+	// Bind listens on a tcp endpoint, e.g. tcp://127.0.0.1:5556 or tcp://*:5556
+	Bind(endpoint string) error
+	// Connect connects to a tcp endpoint, connecting again whenever the connection is lost
+	Connect(endpoint string) error
+	// Join makes a DISH socket receive the messages of the group
+	Join(group string) error
+	// Leave makes a DISH socket stop receiving the messages of the group
+	Leave(group string) error
+	// SendGroup sends a message to the DISH peers of a RADIO socket that joined the group
+	// Peers that don't take the message within the timeout miss it. The timeout is forever if negative.
+	SendGroup(message []byte, group string, timeout time.Duration) error
+	// RecvGroup waits for a message on a DISH socket, returning its group
+	// The timeout is forever if negative.
+	RecvGroup(timeout time.Duration) (message []byte, group string, err error)
+	// Close closes the socket, dropping the messages not yet sent
+	Close() error
+}
+
+// PipelineSocket is a PUSH or PULL socket
+type PipelineSocket interface {
+	// Bind listens on a tcp endpoint, e.g. tcp://127.0.0.1:5556 or tcp://*:5556
+	Bind(endpoint string) error
+	// Connect connects to a tcp endpoint, connecting again whenever the connection is lost
+	Connect(endpoint string) error
+	// SendParts sends a message of one or more parts on a PUSH socket to the next of its peers, waiting for a
+	// connection
+	// The timeout is forever if negative.
+	SendParts(parts [][]byte, timeout time.Duration) error
+	// RecvParts waits for a message on a PULL socket
+	// The timeout is forever if negative.
+	RecvParts(timeout time.Duration) ([][]byte, error)
+	// Close closes the socket, dropping the messages not yet sent
+	Close() error
+}
@@ -0,0 +1,569 @@
+//go:build zmtp
+// +build zmtp
+
+package zmqsocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// reconnectInterval is the time between attempts to connect, the default of libzmq
+	reconnectInterval = 100 * time.Millisecond
+	// queueSize is the number of received messages waiting for Recv, the default high-water mark of libzmq
+	queueSize = 1000
+)
+
+// message is a received message
+type message struct {
+	parts     [][]byte
+	routingID uint32
+	group     string
+}
+
+// peer is a connection that completed its handshake
+type peer struct {
+	conn      net.Conn
+	routingID uint32
+	groups    map[string]bool // groups the DISH peer of a RADIO socket joined, guarded by the mutex of the socket
+
+	mutex sync.Mutex // writes of frames
+}
+
+// write writes a frame, closing the connection if it fails since part of the frame may have been written
+func (p *peer) write(flags byte, body []byte, deadline time.Time) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	err := p.conn.SetWriteDeadline(deadline)
+	if err == nil {
+		err = writeFrame(p.conn, flags, body)
+	}
+	if err != nil {
+		p.conn.Close()
+	}
+	return err
+}
+
+// writeMessage writes the parts of a message as frames, closing the connection if it fails
+func (p *peer) writeMessage(parts [][]byte, deadline time.Time) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	err := p.conn.SetWriteDeadline(deadline)
+	for i := 0; err == nil && i < len(parts); i++ {
+		var flags byte
+		if i < len(parts)-1 {
+			flags = flagMore
+		}
+		err = writeFrame(p.conn, flags, parts[i])
+	}
+	if err != nil {
+		p.conn.Close()
+	}
+	return err
+}
+
+// zmtpSocket is a socket speaking ZMTP 3.1 with the NULL mechanism over tcp
+type zmtpSocket struct {
+	t        Type
+	incoming chan message
+	closed   chan struct{}
+	once     sync.Once
+
+	mutex     sync.Mutex
+	peers     map[uint32]*peer
+	last      uint32          // routing ID of the last peer
+	next      uint32          // routing ID of the peer a PUSH socket sent to last
+	joined    map[string]bool // groups of a DISH socket
+	changed   chan struct{}   // closed when a peer is added
+	listeners []net.Listener
+}
+
+// NewSocket creates a CLIENT or SERVER socket
+func NewSocket(t Type) (Socket, error) {
+	if err := checkType(t, Server, Client); err != nil {
+		return nil, err
+	}
+	return newSocket(t)
+}
+
+// NewGroupSocket creates a RADIO or DISH socket
+func NewGroupSocket(t Type) (GroupSocket, error) {
+	if err := checkType(t, Radio, Dish); err != nil {
+		return nil, err
+	}
+	return newSocket(t)
+}
+
+// NewPipelineSocket creates a PUSH or PULL socket
+func NewPipelineSocket(t Type) (PipelineSocket, error) {
+	if err := checkType(t, Push, Pull); err != nil {
+		return nil, err
+	}
+	return newSocket(t)
+}
+
+// newSocket creates a socket of the type
+func newSocket(t Type) (*zmtpSocket, error) {
+	// routing IDs start at random, like in libzmq
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	return &zmtpSocket{
+		t:        t,
+		incoming: make(chan message, queueSize),
+		closed:   make(chan struct{}),
+		peers:    make(map[uint32]*peer),
+		last:     binary.BigEndian.Uint32(b[:]),
+		joined:   make(map[string]bool),
+		changed:  make(chan struct{}),
+	}, nil
+}
+
+// tcpAddress reads the address of a tcp endpoint, * standing for all interfaces when binding
+func tcpAddress(endpoint string) (string, error) {
+	const prefix = "tcp://"
+	if !strings.HasPrefix(endpoint, prefix) {
+		return "", fmt.Errorf("%s: only tcp endpoints are supported", endpoint)
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(endpoint, prefix), "*"), nil
+}
+
+func (s *zmtpSocket) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *zmtpSocket) Bind(endpoint string) error {
+	address, err := tcpAddress(endpoint)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isClosed() {
+		l.Close()
+		return ErrClosed
+	}
+	s.listeners = append(s.listeners, l)
+	go s.accept(l)
+	return nil
+}
+
+// accept serves the connections to the listener until the socket is closed
+func (s *zmtpSocket) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return
+			}
+			log.Printf("Cannot accept connection: %v", err)
+			time.Sleep(reconnectInterval)
+			continue
+		}
+		go s.serve(conn)
+	}
+}
+
+func (s *zmtpSocket) Connect(endpoint string) error {
+	address, err := tcpAddress(endpoint)
+	if err != nil {
+		return err
+	}
+	if s.isClosed() {
+		return ErrClosed
+	}
+	go s.dial(address)
+	return nil
+}
+
+// dial connects to the address, and again whenever the connection is lost, until the socket is closed
+func (s *zmtpSocket) dial(address string) {
+	dialer := net.Dialer{Timeout: handshakeTimeout}
+	for {
+		if conn, err := dialer.Dial("tcp", address); err == nil {
+			s.serve(conn)
+		}
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+// serve handshakes on a new connection, then reads its messages until it is lost or the socket is closed
+func (s *zmtpSocket) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if err := handshake(conn, r, s.t); err != nil {
+		log.Printf("Handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	p := s.add(conn)
+	if p == nil {
+		return
+	}
+	defer s.remove(p)
+
+	var parts [][]byte
+	size := 0
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF && !s.isClosed() {
+				log.Printf("Connection to %s lost: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if f.command() {
+			if !s.handleCommand(p, f) {
+				return
+			}
+			continue
+		}
+		parts = append(parts, f.body)
+		if size += len(f.body); size > maxFrameSize {
+			log.Printf("Closing connection to %s: message of more than %d bytes", conn.RemoteAddr(), maxFrameSize)
+			return
+		}
+		if f.more() {
+			continue
+		}
+		m, ok := s.message(p, parts)
+		parts, size = nil, 0
+		if !ok {
+			continue
+		}
+		select {
+		case s.incoming <- m:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// message makes a message of the parts received from the peer, false if the socket doesn't take it
+// Messages of CLIENT and SERVER sockets are single parts, those of more are dropped. RADIO peers send the group of a
+// message, then its body.
+func (s *zmtpSocket) message(p *peer, parts [][]byte) (message, bool) {
+	switch s.t {
+	case Server:
+		return message{parts: parts, routingID: p.routingID}, len(parts) == 1
+	case Client, Pull:
+		return message{parts: parts}, s.t == Pull || len(parts) == 1
+	case Dish:
+		if len(parts) != 2 {
+			return message{}, false
+		}
+		group := string(parts[0])
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return message{parts: parts[1:], group: group}, s.joined[group]
+	}
+	return message{}, false
+}
+
+// handleCommand answers the heartbeats of the peer and keeps track of the groups it joined, returning false if the connection has to be closed
+func (s *zmtpSocket) handleCommand(p *peer, f frame) bool {
+	name, data, err := parseCommand(f.body)
+	if err != nil {
+		log.Printf("Closing connection to %s: %v", p.conn.RemoteAddr(), err)
+		return false
+	}
+	switch name {
+	case "PING":
+		// the ping context follows its 2 byte time to live, the pong sends it back
+		if len(data) < 2 {
+			return false
+		}
+		return p.write(flagCommand, command("PONG", data[2:]), time.Now().Add(handshakeTimeout)) == nil
+	case "ERROR":
+		log.Printf("Closing connection to %s: %s", p.conn.RemoteAddr(), reason(data))
+		return false
+	case "JOIN", "LEAVE":
+		// the data of the commands a DISH peer sends is the group
+		if s.t != Radio {
+			return true
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if name == "JOIN" {
+			p.groups[string(data)] = true
+		} else {
+			delete(p.groups, string(data))
+		}
+	}
+	return true
+}
+
+// add registers the peer of a connection, nil if the socket is closed
+// A DISH socket joins its groups on the new connection.
+func (s *zmtpSocket) add(conn net.Conn) *peer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isClosed() {
+		return nil
+	}
+	for {
+		s.last++
+		if _, ok := s.peers[s.last]; s.last != 0 && !ok {
+			break
+		}
+	}
+	p := &peer{conn: conn, routingID: s.last, groups: make(map[string]bool)}
+	s.peers[p.routingID] = p
+	close(s.changed)
+	s.changed = make(chan struct{})
+	for group := range s.joined {
+		p.write(flagCommand, command("JOIN", []byte(group)), time.Now().Add(handshakeTimeout))
+	}
+	return p
+}
+
+func (s *zmtpSocket) remove(p *peer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.peers[p.routingID] == p {
+		delete(s.peers, p.routingID)
+	}
+}
+
+// pick returns the peer to send to, nil if there is none, and a channel closed when a peer is added
+// A PUSH socket picks its peers in turn, by routing ID.
+func (s *zmtpSocket) pick(routingID uint32) (*peer, <-chan struct{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isClosed() {
+		return nil, nil, ErrClosed
+	}
+	switch s.t {
+	case Server:
+		return s.peers[routingID], s.changed, nil
+	case Push:
+		var first, next *peer
+		for id, p := range s.peers {
+			if first == nil || id < first.routingID {
+				first = p
+			}
+			if id > s.next && (next == nil || id < next.routingID) {
+				next = p
+			}
+		}
+		if next == nil {
+			next = first
+		}
+		if next != nil {
+			s.next = next.routingID
+		}
+		return next, s.changed, nil
+	}
+	for _, p := range s.peers {
+		return p, s.changed, nil
+	}
+	return nil, s.changed, nil
+}
+
+// send sends a message to a peer picked for the routing ID, waiting for a connection on CLIENT and PUSH sockets
+func (s *zmtpSocket) send(parts [][]byte, routingID uint32, timeout time.Duration) error {
+	var deadline time.Time
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		p, changed, err := s.pick(routingID)
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			err := p.writeMessage(parts, deadline)
+			if err == nil {
+				return nil
+			}
+			s.remove(p)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return ErrTimeout
+			}
+			if s.t != Server {
+				// wait for the connection to be made again
+				continue
+			}
+			return ErrUnreachable
+		}
+		if s.t == Server {
+			return ErrUnreachable
+		}
+		select {
+		case <-changed:
+		case <-s.closed:
+			return ErrClosed
+		case <-expired:
+			return ErrTimeout
+		}
+	}
+}
+
+// receive waits for a message
+func (s *zmtpSocket) receive(timeout time.Duration) (message, error) {
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case m := <-s.incoming:
+		return m, nil
+	case <-s.closed:
+		return message{}, ErrClosed
+	case <-expired:
+		return message{}, ErrTimeout
+	}
+}
+
+func (s *zmtpSocket) Send(payload []byte, routingID uint32, timeout time.Duration) error {
+	if s.t != Server && s.t != Client {
+		return ErrNotSupported
+	}
+	return s.send([][]byte{payload}, routingID, timeout)
+}
+
+func (s *zmtpSocket) Recv(timeout time.Duration) ([]byte, uint32, error) {
+	if s.t != Server && s.t != Client {
+		return nil, 0, ErrNotSupported
+	}
+	m, err := s.receive(timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	return m.parts[0], m.routingID, nil
+}
+
+func (s *zmtpSocket) SendParts(parts [][]byte, timeout time.Duration) error {
+	if s.t != Push {
+		return ErrNotSupported
+	}
+	if len(parts) == 0 {
+		return errNoParts
+	}
+	return s.send(parts, 0, timeout)
+}
+
+func (s *zmtpSocket) RecvParts(timeout time.Duration) ([][]byte, error) {
+	if s.t != Pull {
+		return nil, ErrNotSupported
+	}
+	m, err := s.receive(timeout)
+	return m.parts, err
+}
+
+// subscribe joins or leaves a group on a DISH socket, sending the command to the connected peers
+func (s *zmtpSocket) subscribe(name, group string) error {
+	if s.t != Dish {
+		return ErrNotSupported
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.isClosed() {
+		return ErrClosed
+	}
+	join := name == "JOIN"
+	if s.joined[group] == join {
+		return nil
+	}
+	if join {
+		s.joined[group] = true
+	} else {
+		delete(s.joined, group)
+	}
+	// a peer whose connection fails gets the groups again when it is connected again
+	for _, p := range s.peers {
+		p.write(flagCommand, command(name, []byte(group)), time.Now().Add(handshakeTimeout))
+	}
+	return nil
+}
+
+func (s *zmtpSocket) Join(group string) error {
+	return s.subscribe("JOIN", group)
+}
+
+func (s *zmtpSocket) Leave(group string) error {
+	return s.subscribe("LEAVE", group)
+}
+
+func (s *zmtpSocket) SendGroup(payload []byte, group string, timeout time.Duration) error {
+	if s.t != Radio {
+		return ErrNotSupported
+	}
+	var deadline time.Time
+	if timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	s.mutex.Lock()
+	if s.isClosed() {
+		s.mutex.Unlock()
+		return ErrClosed
+	}
+	var peers []*peer
+	for _, p := range s.peers {
+		if p.groups[group] {
+			peers = append(peers, p)
+		}
+	}
+	s.mutex.Unlock()
+	for _, p := range peers {
+		// the connection of a peer that doesn't take the message is closed, part of it may have been written
+		if err := p.writeMessage([][]byte{[]byte(group), payload}, deadline); err != nil {
+			s.remove(p)
+		}
+	}
+	return nil
+}
+
+func (s *zmtpSocket) RecvGroup(timeout time.Duration) ([]byte, string, error) {
+	if s.t != Dish {
+		return nil, "", ErrNotSupported
+	}
+	m, err := s.receive(timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	return m.parts[0], m.group, nil
+}
+
+func (s *zmtpSocket) Close() error {
+	s.once.Do(func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		close(s.closed)
+		for _, l := range s.listeners {
+			l.Close()
+		}
+		for _, p := range s.peers {
+			p.conn.Close()
+		}
+	})
+	return nil
+}
@@ -0,0 +1,256 @@
+//go:build zmtp
+// +build zmtp
+
+package zmqsocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 255, 256, 70000} {
+		body := bytes.Repeat([]byte{'x'}, size)
+		var b bytes.Buffer
+		if err := writeFrame(&b, flagMore, body); err != nil {
+			t.Fatal(err)
+		}
+		header := 2
+		if size > 255 {
+			header = 9
+		}
+		if b.Len() != header+size {
+			t.Errorf("frame of %d bytes encoded in %d bytes, expected %d", size, b.Len(), header+size)
+		}
+		if long := b.Bytes()[0]&flagLong != 0; long != (size > 255) {
+			t.Errorf("frame of %d bytes has long flag %v", size, long)
+		}
+
+		f, err := readFrame(bufio.NewReader(&b))
+		if err != nil {
+			t.Fatalf("frame of %d bytes: %v", size, err)
+		}
+		if !f.more() || f.command() {
+			t.Errorf("frame of %d bytes read with flags %#x", size, f.flags)
+		}
+		if !bytes.Equal(f.body, body) {
+			t.Errorf("frame of %d bytes read with a body of %d bytes", size, len(f.body))
+		}
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	b := make([]byte, 9)
+	b[0] = flagLong
+	binary.BigEndian.PutUint64(b[1:], maxFrameSize+1)
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(b))); err == nil {
+		t.Fatal("frame larger than maxFrameSize accepted")
+	}
+}
+
+func TestCommandRoundTrip(t *testing.T) {
+	props := map[string]string{"Socket-Type": "CLIENT"}
+	name, data, err := parseCommand(command("READY", properties(props)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "READY" {
+		t.Fatalf("command %s, expected READY", name)
+	}
+	parsed, err := parseProperties(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed["Socket-Type"] != "CLIENT" || len(parsed) != 1 {
+		t.Fatalf("properties %v, expected %v", parsed, props)
+	}
+	if err := checkGreeting(greeting()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// bind creates a socket of the type listening on a free loopback port and returns its endpoint
+func bind(t *testing.T, typ Type) (*zmtpSocket, string) {
+	t.Helper()
+	s, err := newSocket(typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Bind("tcp://127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	return s, "tcp://" + s.listeners[0].Addr().String()
+}
+
+// connect creates a socket of the type connected to the endpoint
+func connect(t *testing.T, typ Type, endpoint string) *zmtpSocket {
+	t.Helper()
+	s, err := newSocket(typ)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Connect(endpoint); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestClientServerLoopback(t *testing.T) {
+	server, endpoint := bind(t, Server)
+	defer server.Close()
+
+	// two clients, so that the replies have to be routed
+	clients := make([]Socket, 2)
+	for i := range clients {
+		clients[i] = connect(t, Client, endpoint)
+		defer clients[i].Close()
+	}
+
+	for round := 0; round < 3; round++ {
+		routingIDs := make(map[string]uint32)
+		for i, c := range clients {
+			if err := c.Send([]byte(fmt.Sprintf("request %d from %d", round, i)), 0, 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for range clients {
+			request, routingID, err := server.Recv(5 * time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			routingIDs[string(request)] = routingID
+		}
+		if len(routingIDs) != len(clients) {
+			t.Fatalf("received %v", routingIDs)
+		}
+		for request, routingID := range routingIDs {
+			if err := server.Send([]byte("reply to "+request), routingID, 5*time.Second); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, c := range clients {
+			reply, _, err := c.Recv(5 * time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := fmt.Sprintf("reply to request %d from %d", round, i); string(reply) != expected {
+				t.Fatalf("client %d received %q, expected %q", i, reply, expected)
+			}
+		}
+	}
+
+	if _, _, err := clients[0].Recv(10 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("expected a timeout with nothing to receive, got %v", err)
+	}
+	if err := server.Send([]byte("lost"), 0, time.Second); err != ErrUnreachable {
+		t.Fatalf("expected an unreachable routing ID, got %v", err)
+	}
+}
+
+// joinedGroup waits for the RADIO socket to see a DISH peer join the group
+func joinedGroup(t *testing.T, radio *zmtpSocket, group string) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		radio.mutex.Lock()
+		joined := false
+		for _, p := range radio.peers {
+			joined = joined || p.groups[group]
+		}
+		radio.mutex.Unlock()
+		if joined {
+			return
+		}
+	}
+	t.Fatalf("no DISH peer joined %s", group)
+}
+
+func TestRadioDishLoopback(t *testing.T) {
+	radio, endpoint := bind(t, Radio)
+	defer radio.Close()
+	dish := connect(t, Dish, endpoint)
+	defer dish.Close()
+	if err := dish.Join("temperature"); err != nil {
+		t.Fatal(err)
+	}
+	joinedGroup(t, radio, "temperature")
+
+	for _, group := range []string{"humidity", "temperature"} {
+		if err := radio.SendGroup([]byte("reading of "+group), group, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	message, group, err := dish.RecvGroup(5 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group != "temperature" || string(message) != "reading of temperature" {
+		t.Fatalf("received %q of group %s, expected the reading of temperature", message, group)
+	}
+
+	if err := dish.Leave("temperature"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dish.Join("humidity"); err != nil {
+		t.Fatal(err)
+	}
+	joinedGroup(t, radio, "humidity")
+	for _, group := range []string{"temperature", "humidity"} {
+		if err := radio.SendGroup([]byte("reading of "+group), group, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, group, err := dish.RecvGroup(5 * time.Second); err != nil || group != "humidity" {
+		t.Fatalf("received a message of group %s (%v), expected humidity once temperature is left", group, err)
+	}
+
+	if err := radio.Join("temperature"); err != ErrNotSupported {
+		t.Fatalf("expected %v joining on a RADIO socket, got %v", ErrNotSupported, err)
+	}
+}
+
+func TestPushPullLoopback(t *testing.T) {
+	push, endpoint := bind(t, Push)
+	defer push.Close()
+	pulls := make([]*zmtpSocket, 2)
+	for i := range pulls {
+		pulls[i] = connect(t, Pull, endpoint)
+		defer pulls[i].Close()
+	}
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		push.mutex.Lock()
+		connected := len(push.peers)
+		push.mutex.Unlock()
+		if connected == len(pulls) {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%d PULL peers connected, expected %d", connected, len(pulls))
+		}
+	}
+
+	// the messages are handed to the peers in turn, with all their parts
+	for i := 0; i < 2*len(pulls); i++ {
+		if err := push.SendParts([][]byte{[]byte("task"), {byte(i)}, nil}, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, pull := range pulls {
+		for n := 0; n < 2; n++ {
+			parts, err := pull.RecvParts(5 * time.Second)
+			if err != nil {
+				t.Fatalf("PULL socket %d: %v", i, err)
+			}
+			if len(parts) != 3 || string(parts[0]) != "task" || len(parts[2]) != 0 {
+				t.Fatalf("PULL socket %d received %q", i, parts)
+			}
+		}
+	}
+
+	if err := push.SendParts(nil, time.Second); err != errNoParts {
+		t.Fatalf("expected %v for a message of no parts, got %v", errNoParts, err)
+	}
+}
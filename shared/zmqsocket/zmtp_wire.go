@@ -0,0 +1,232 @@
+//go:build zmtp
+// +build zmtp
+
+package zmqsocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	greetingSize = 64
+	// handshakeTimeout bounds the greeting and the READY commands
+	handshakeTimeout = 10 * time.Second
+	// maxFrameSize guards against a peer announcing a frame too large to hold
+	maxFrameSize = 64 << 20
+
+	flagMore    = 0x01
+	flagLong    = 0x02
+	flagCommand = 0x04
+)
+
+// greeting is sent first on every connection: the signature, version 3.1, the NULL mechanism and the as-server
+// field, which NULL doesn't use
+func greeting() []byte {
+	g := make([]byte, greetingSize)
+	g[0], g[9] = 0xFF, 0x7F
+	g[10], g[11] = 3, 1
+	copy(g[12:32], "NULL")
+	return g
+}
+
+// checkGreeting checks that the peer speaks ZMTP 3 with the NULL mechanism
+func checkGreeting(g []byte) error {
+	if g[0] != 0xFF || g[9]&0x01 == 0 {
+		return errors.New("not a ZMTP peer")
+	}
+	if g[10] < 3 {
+		return fmt.Errorf("ZMTP %d.%d not supported", g[10], g[11])
+	}
+	if mechanism := string(bytes.TrimRight(g[12:32], "\x00")); mechanism != "NULL" {
+		return fmt.Errorf("%s mechanism not supported", mechanism)
+	}
+	return nil
+}
+
+// frame is a message frame or a command
+type frame struct {
+	flags byte
+	body  []byte
+}
+
+func (f frame) more() bool {
+	return f.flags&flagMore != 0
+}
+
+func (f frame) command() bool {
+	return f.flags&flagCommand != 0
+}
+
+// writeFrame writes the frame in a single write, with a long size if the body needs it
+func writeFrame(w io.Writer, flags byte, body []byte) error {
+	var b []byte
+	if len(body) > 255 {
+		b = make([]byte, 9, 9+len(body))
+		b[0] = flags | flagLong
+		binary.BigEndian.PutUint64(b[1:], uint64(len(body)))
+	} else {
+		b = make([]byte, 2, 2+len(body))
+		b[0], b[1] = flags, byte(len(body))
+	}
+	_, err := w.Write(append(b, body...))
+	return err
+}
+
+// readFrame reads a frame
+func readFrame(r *bufio.Reader) (frame, error) {
+	flags, err := r.ReadByte()
+	if err != nil {
+		return frame{}, err
+	}
+	var size uint64
+	if flags&flagLong != 0 {
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return frame{}, err
+		}
+		size = binary.BigEndian.Uint64(b[:])
+	} else {
+		b, err := r.ReadByte()
+		if err != nil {
+			return frame{}, err
+		}
+		size = uint64(b)
+	}
+	if size > maxFrameSize {
+		return frame{}, fmt.Errorf("frame of %d bytes, at most %d", size, maxFrameSize)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return frame{}, err
+	}
+	return frame{flags: flags, body: body}, nil
+}
+
+// command writes the body of a command
+func command(name string, data []byte) []byte {
+	return append(append([]byte{byte(len(name))}, name...), data...)
+}
+
+// parseCommand reads the name and the data of a command
+func parseCommand(body []byte) (string, []byte, error) {
+	if len(body) == 0 || len(body) < 1+int(body[0]) {
+		return "", nil, errors.New("malformed command")
+	}
+	return string(body[1 : 1+body[0]]), body[1+body[0]:], nil
+}
+
+// properties writes the metadata of a READY command
+func properties(props map[string]string) []byte {
+	var b []byte
+	for name, value := range props {
+		b = append(b, byte(len(name)))
+		b = append(b, name...)
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(value)))
+		b = append(b, size[:]...)
+		b = append(b, value...)
+	}
+	return b
+}
+
+// parseProperties reads the metadata of a READY command
+func parseProperties(b []byte) (map[string]string, error) {
+	props := make(map[string]string)
+	for len(b) > 0 {
+		n := int(b[0])
+		if len(b) < 1+n+4 {
+			return nil, errors.New("malformed property")
+		}
+		name := string(b[1 : 1+n])
+		size := int(binary.BigEndian.Uint32(b[1+n:]))
+		b = b[1+n+4:]
+		if len(b) < size {
+			return nil, errors.New("malformed property")
+		}
+		props[name] = string(b[:size])
+		b = b[size:]
+	}
+	return props, nil
+}
+
+// peerType is the only socket type a socket of the type talks to
+func peerType(t Type) Type {
+	switch t {
+	case Server:
+		return Client
+	case Client:
+		return Server
+	case Radio:
+		return Dish
+	case Dish:
+		return Radio
+	case Push:
+		return Pull
+	}
+	return Push
+}
+
+// handshake exchanges the greetings and the READY commands of the NULL mechanism on a new connection
+func handshake(conn net.Conn, r *bufio.Reader, t Type) error {
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(greeting()); err != nil {
+		return err
+	}
+	g := make([]byte, greetingSize)
+	if _, err := io.ReadFull(r, g); err != nil {
+		return err
+	}
+	if err := checkGreeting(g); err != nil {
+		return err
+	}
+
+	ready := command("READY", properties(map[string]string{"Socket-Type": t.String()}))
+	if err := writeFrame(conn, flagCommand, ready); err != nil {
+		return err
+	}
+	f, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if !f.command() {
+		return errors.New("expected a READY command")
+	}
+	name, data, err := parseCommand(f.body)
+	if err != nil {
+		return err
+	}
+	switch name {
+	case "READY":
+	case "ERROR":
+		return fmt.Errorf("peer refused: %s", reason(data))
+	default:
+		return fmt.Errorf("expected a READY command, not %s", name)
+	}
+	props, err := parseProperties(data)
+	if err != nil {
+		return err
+	}
+	if props["Socket-Type"] != peerType(t).String() {
+		reply := fmt.Sprintf("%s socket can't talk to %s", t, props["Socket-Type"])
+		writeFrame(conn, flagCommand, command("ERROR", append([]byte{byte(len(reply))}, reply...)))
+		return errors.New(reply)
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// reason reads the reason of an ERROR command
+func reason(data []byte) string {
+	if len(data) == 0 || len(data) < 1+int(data[0]) {
+		return "no reason"
+	}
+	return string(data[1 : 1+data[0]])
+}
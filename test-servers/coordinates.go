@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// cartesian point
+type cartesian struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+func (c cartesian) String() string {
+	return fmt.Sprintf("( x:%v, y:%v )", c.X, c.Y)
+}
+
+// polar point
+type polar struct {
+	R     float64 `json:"r"`
+	Theta float64 `json:"theta" senml:"rad"`
+}
+
+func (p polar) String() string {
+	return fmt.Sprintf("( r:%v, theta:%v )", p.R, p.Theta)
+}
+
+// 3D cartesian point
+type cartesian3D struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+func (c cartesian3D) String() string {
+	return fmt.Sprintf("( x:%v, y:%v, z:%v )", c.X, c.Y, c.Z)
+}
+
+// spherical point, theta is the polar angle from the z axis and phi the azimuth
+type spherical struct {
+	R     float64 `json:"r"`
+	Theta float64 `json:"theta" senml:"rad"`
+	Phi   float64 `json:"phi" senml:"rad"`
+}
+
+func (s spherical) String() string {
+	return fmt.Sprintf("( r:%v, theta:%v, phi:%v )", s.R, s.Theta, s.Phi)
+}
+
+// cylindrical point
+type cylindrical struct {
+	Rho float64 `json:"rho"`
+	Phi float64 `json:"phi" senml:"rad"`
+	Z   float64 `json:"z"`
+}
+
+func (c cylindrical) String() string {
+	return fmt.Sprintf("( rho:%v, phi:%v, z:%v )", c.Rho, c.Phi, c.Z)
+}
+
+func cartesianToPolar(c cartesian) polar {
+	return polar{R: math.Sqrt(c.X*c.X + c.Y*c.Y), Theta: math.Atan2(c.Y, c.X)}
+}
+
+func polarToCartesian(p polar) cartesian {
+	return cartesian{X: p.R * math.Cos(p.Theta), Y: p.R * math.Sin(p.Theta)}
+}
+
+func cartesianToSpherical(c cartesian3D) spherical {
+	r := math.Sqrt(c.X*c.X + c.Y*c.Y + c.Z*c.Z)
+	if r == 0 {
+		return spherical{}
+	}
+	return spherical{R: r, Theta: math.Acos(c.Z / r), Phi: math.Atan2(c.Y, c.X)}
+}
+
+func sphericalToCartesian(s spherical) cartesian3D {
+	return cartesian3D{
+		X: s.R * math.Sin(s.Theta) * math.Cos(s.Phi),
+		Y: s.R * math.Sin(s.Theta) * math.Sin(s.Phi),
+		Z: s.R * math.Cos(s.Theta),
+	}
+}
+
+func cartesianToCylindrical(c cartesian3D) cylindrical {
+	return cylindrical{Rho: math.Sqrt(c.X*c.X + c.Y*c.Y), Phi: math.Atan2(c.Y, c.X), Z: c.Z}
+}
+
+func cylindricalToCartesian(c cylindrical) cartesian3D {
+	return cartesian3D{X: c.Rho * math.Cos(c.Phi), Y: c.Rho * math.Sin(c.Phi), Z: c.Z}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-ocf/go-coap"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serving states reported by the health endpoints
+const (
+	starting int32 = iota
+	ready
+	draining
+)
+
+var stateNames = map[int32]string{starting: "starting", ready: "ready", draining: "draining"}
+
+// health holds the serving state shared by the health endpoints of every server
+type health struct {
+	state int32
+}
+
+func (h *health) set(state int32) {
+	atomic.StoreInt32(&h.state, state)
+}
+
+// status returns the name of the current state and whether requests are being served
+func (h *health) status() (string, bool) {
+	state := atomic.LoadInt32(&h.state)
+	return stateNames[state], state == ready
+}
+
+// httpHandler reports the serving state over HTTP
+func (h *health) httpHandler(w http.ResponseWriter, r *http.Request) {
+	status, ok := h.status()
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
+
+// coapHandler reports the serving state over COAP
+func (h *health) coapHandler(w coap.ResponseWriter, req *coap.Request) {
+	if req.Msg.Code() != coap.GET {
+		w.SetCode(coap.MethodNotAllowed)
+		return
+	}
+	status, ok := h.status()
+	if !ok {
+		w.SetCode(coap.ServiceUnavailable)
+	}
+	w.SetContentFormat(coap.TextPlain)
+	ctx, cancel := context.WithTimeout(req.Ctx, time.Second)
+	defer cancel()
+	if _, err := w.WriteWithContext(ctx, []byte(status)); err != nil {
+		log.Printf("Cannot send response: %v", err)
+	}
+}
+
+// managedServer is a server that reports when it is ready and can be shut down gracefully
+type managedServer struct {
+	name     string
+	serve    func(ready func()) error
+	shutdown func(ctx context.Context) error
+}
+
+// httpServer manages an HTTP server
+func httpServer(name string, server *http.Server) managedServer {
+	return managedServer{
+		name: name,
+		serve: func(ready func()) error {
+			l, err := net.Listen("tcp", server.Addr)
+			if err != nil {
+				return err
+			}
+			ready()
+			if err := server.Serve(l); err != http.ErrServerClosed {
+				return err
+			}
+			return nil
+		},
+		shutdown: server.Shutdown,
+	}
+}
+
+// runServers starts the servers and blocks until a server fails or the process receives SIGINT or SIGTERM
+// The servers are then shut down, with in-flight requests given up to the timeout to complete.
+func runServers(servers []managedServer, h *health, timeout time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	errs := make(chan error, len(servers))
+	var started sync.WaitGroup
+	started.Add(len(servers))
+	for _, s := range servers {
+		log.Printf("Starting %s server...", s.name)
+		go func(s managedServer) {
+			var once sync.Once
+			err := s.serve(func() {
+				once.Do(func() {
+					log.Printf("%s server ready", s.name)
+					started.Done()
+				})
+			})
+			if err != nil {
+				errs <- fmt.Errorf("%s server failed: %v", s.name, err)
+			}
+		}(s)
+	}
+	go func() {
+		started.Wait()
+		h.set(ready)
+		log.Println("All servers ready")
+	}()
+
+	var err error
+	select {
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down...", sig)
+	case err = <-errs:
+		log.Printf("%v, shutting down...", err)
+	}
+	h.set(draining)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	wg.Add(len(servers))
+	for _, s := range servers {
+		go func(s managedServer) {
+			defer wg.Done()
+			if err := s.shutdown(ctx); err != nil {
+				log.Printf("%s server shutdown: %v", s.name, err)
+				return
+			}
+			log.Printf("%s server stopped", s.name)
+		}(s)
+	}
+	wg.Wait()
+	return err
+}
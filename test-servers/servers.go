@@ -1,124 +1,188 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/go-ocf/go-coap"
 	"github.com/gorilla/mux"
-	"github.com/ugorji/go/codec"
-	"io/ioutil"
+	"github.com/limaechocharlie/cwb/shared/coapproxy"
+	"github.com/limaechocharlie/cwb/shared/coaptransport"
+	"github.com/limaechocharlie/cwb/shared/endpoint"
 	"log"
-	"math"
 	"net/http"
+	"strings"
 	"time"
 )
 
-// cartesian point
-type cartesian struct {
-	X float64 `json:"x"`
-	Y float64 `json:"y"`
-}
-
-func (c cartesian) String() string {
-	return fmt.Sprintf("( x:%v, y:%v )", c.X, c.Y)
-}
+// proxyPrefix precedes the target COAP URI in requests to the HTTP to COAP proxy
+// e.g. /hc/coap://localhost:5688/cartesian-to-polar
+const proxyPrefix = "/hc/"
 
-// polar point
-type polar struct {
-	R     float64 `json:"r"`
-	Theta float64 `json:"theta"`
+// newService registers the conversion functions once for both the HTTP and the COAP servers
+func newService() *endpoint.Service {
+	service := endpoint.NewService("Test servers", "1.0.0")
+	registerConversion(service, "/cartesian-to-polar", "Convert a cartesian point into a polar point", cartesianToPolar)
+	registerConversion(service, "/polar-to-cartesian", "Convert a polar point into a cartesian point", polarToCartesian)
+	registerConversion(service, "/cartesian-to-spherical", "Convert a 3D cartesian point into a spherical point", cartesianToSpherical)
+	registerConversion(service, "/spherical-to-cartesian", "Convert a spherical point into a 3D cartesian point", sphericalToCartesian)
+	registerConversion(service, "/cartesian-to-cylindrical", "Convert a 3D cartesian point into a cylindrical point", cartesianToCylindrical)
+	registerConversion(service, "/cylindrical-to-cartesian", "Convert a cylindrical point into a 3D cartesian point", cylindricalToCartesian)
+	return service
 }
 
-func (p polar) String() string {
-	return fmt.Sprintf("( r:%v, theta:%v )", p.R, p.Theta)
-}
+// maxBatchSize bounds the number of points converted by a single batch request
+const maxBatchSize = 10000
 
-func cartesianToPolar(c cartesian) polar {
-	return polar{R: math.Sqrt(c.X*c.X + c.Y*c.Y), Theta: math.Atan2(c.Y, c.X)}
-}
-
-func startHTTPServer(port string) error {
-	router := mux.NewRouter()
-	router.HandleFunc("/cartesian-to-polar",
-		func(w http.ResponseWriter, r *http.Request) {
-			body, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error reading body, %s", err.Error()), http.StatusBadRequest)
-				return
-			}
-			var c cartesian
-			if err := json.Unmarshal(body, &c); err != nil {
-				http.Error(w, fmt.Sprintf("Error reading body, %s", err.Error()), http.StatusBadRequest)
-				return
+// registerConversion registers a conversion for a single point at the path, for an array of points at
+// path/batch and for a stream of points at path/stream
+func registerConversion[In, Out any](service *endpoint.Service, path, summary string, convert func(In) Out) {
+	endpoint.Register(service, path, summary,
+		func(_ context.Context, in In) (Out, error) {
+			return convert(in), nil
+		})
+	endpoint.Register(service, path+"/batch", summary+", for each point in an array",
+		func(_ context.Context, in []In) ([]Out, error) {
+			if len(in) > maxBatchSize {
+				return nil, endpoint.Errorf(endpoint.Invalid, "Batch of %d points exceeds the limit of %d", len(in), maxBatchSize)
 			}
-			log.Println("HTTP unmarshalled request:", c)
-			p := cartesianToPolar(c)
-			b, err := json.Marshal(p)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Error marshalling response, %s", err.Error()), http.StatusBadRequest)
-				return
+			out := make([]Out, len(in))
+			for i, p := range in {
+				out[i] = convert(p)
 			}
-			log.Println("HTTP response", string(b))
-			w.Write(b)
+			return out, nil
+		})
+	endpoint.RegisterStream(service, path+"/stream", summary+", for each point in a stream",
+		func(_ context.Context, in In) (Out, error) {
+			return convert(in), nil
 		})
-	return http.ListenAndServe(fmt.Sprintf(":%s", port), router)
 }
 
-func startCOAPServer(port string) error {
+func newHTTPServer(port string, service *endpoint.Service, proxyCreds *coaptransport.Credentials, proxyTargets []string, h *health, m *mirror) *http.Server {
+	router := mux.NewRouter()
+	// don't clean the path so that the target URI of proxy requests keeps its double slash
+	router.SkipClean(true)
+	proxy := coapproxy.NewProxy(proxyPrefix, proxyCreds)
+	proxy.Targets = proxyTargets
+	router.PathPrefix(proxyPrefix).Handler(proxy)
+	router.HandleFunc("/health", h.httpHandler)
+	if m != nil {
+		router.HandleFunc("/telemetry", m.httpHandler).Methods(http.MethodGet)
+	}
+	service.RegisterHTTP(router)
+	return &http.Server{Addr: fmt.Sprintf(":%s", port), Handler: router}
+}
+
+func newCOAPMux(service *endpoint.Service, h *health) *coap.ServeMux {
 	mux := coap.NewServeMux()
-	mux.Handle("/cartesian-to-polar", coap.HandlerFunc(func(w coap.ResponseWriter, req *coap.Request) {
-		handle := new(codec.CborHandle)
-		if mt, ok := req.Msg.Option(coap.ContentFormat).(coap.MediaType); ok {
-			log.Println("COAP request media type:", mt)
-		} else {
-			log.Println("COAP request NO media type")
-		}
+	mux.Handle("/health", coap.HandlerFunc(h.coapHandler))
+	service.RegisterCOAP(mux)
+	return mux
+}
 
-		payload := req.Msg.Payload()
-		var c cartesian
-		d := codec.NewDecoderBytes(payload, handle)
-		if err := d.Decode(&c); err != nil {
-			w.SetCode(coap.BadRequest)
-			return
-		}
-		log.Println("COAP unmarshalled request:", c)
-		p := cartesianToPolar(c)
+// loadCredentials creates the credentials for the TLS and DTLS COAP servers
+// and the client credentials used by the HTTP to COAP proxy to reach them
+// Without a pre-shared key there are no DTLS credentials, and no DTLS server.
+func loadCredentials(pskIdentity, psk string) (server, client *coaptransport.Credentials, err error) {
+	server, client = new(coaptransport.Credentials), new(coaptransport.Credentials)
+	if server.TLS, err = coaptransport.ServerTLSConfig("testdata/server-cert.pem", "testdata/server-key.pem", "testdata/client-cert.pem"); err != nil {
+		return nil, nil, err
+	}
+	if client.TLS, err = coaptransport.ClientTLSConfig("testdata/client-cert.pem", "testdata/client-key.pem", "testdata/server-cert.pem"); err != nil {
+		return nil, nil, err
+	}
+	if psk == "" {
+		return server, client, nil
+	}
+	if server.DTLS, err = coaptransport.ServerPSKConfig(map[string][]byte{pskIdentity: []byte(psk)}); err != nil {
+		return nil, nil, err
+	}
+	if client.DTLS, err = coaptransport.ClientPSKConfig(pskIdentity, []byte(psk)); err != nil {
+		return nil, nil, err
+	}
+	return server, client, nil
+}
 
-		w.SetContentFormat(coap.AppCBOR)
-		ctx, cancel := context.WithTimeout(req.Ctx, time.Second)
-		defer cancel()
+// config holds the command line configuration
+type config struct {
+	httpPort        string
+	coapPorts       map[coaptransport.Transport]string
+	pskIdentity     string
+	psk             string
+	shutdownTimeout time.Duration
+	telemetryAddr   string
+	proxyTargets    []string
+}
 
-		var buf bytes.Buffer
-		e := codec.NewEncoder(&buf, handle)
-		if err := e.Encode(p); err != nil {
-			w.SetCode(coap.BadRequest)
-			return
-		}
-		log.Println("COAP response:", buf.Bytes())
-		if _, err := w.WriteWithContext(ctx, buf.Bytes()); err != nil {
-			log.Printf("Cannot send response: %v", err)
-		}
-	}))
-	return coap.ListenAndServe("udp", ":"+port, mux)
+func parseConfig() config {
+	httpPort := flag.String("http-port", "8001", "Port on which HTTP server listens")
+	coapPort := flag.String("coap-port", "5688", "Port on which COAP server listens (UDP and TCP)")
+	coapsPort := flag.String("coaps-port", "5684", "Port on which COAP over TLS server listens")
+	coapWSPort := flag.String("coap-ws-port", "8002", "Port on which COAP over WebSockets server listens")
+	coapDTLSPort := flag.String("coap-dtls-port", "5685", "Port on which COAP over DTLS server listens")
+	pskIdentity := flag.String("psk-identity", "client", "Identity of the client pre-shared key")
+	psk := flag.String("psk", "", "Client pre-shared key; no COAP over DTLS server if empty")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "Time allowed for in-flight requests to complete on shutdown")
+	telemetryAddr := flag.String("telemetry", "", "Address of a COAP device whose telemetry is mirrored at /telemetry, e.g. localhost:5690; no mirror if empty")
+	proxyTargets := flag.String("proxy-targets", "localhost,127.0.0.0/8,::1/128", "Comma separated host names and CIDR networks the HTTP to COAP proxy may reach")
+	flag.Parse()
+
+	return config{
+		httpPort: *httpPort,
+		coapPorts: map[coaptransport.Transport]string{
+			coaptransport.UDP:       *coapPort,
+			coaptransport.TCP:       *coapPort,
+			coaptransport.TLS:       *coapsPort,
+			coaptransport.WebSocket: *coapWSPort,
+			coaptransport.DTLS:      *coapDTLSPort,
+		},
+		pskIdentity:     *pskIdentity,
+		psk:             *psk,
+		shutdownTimeout: *shutdownTimeout,
+		telemetryAddr:   *telemetryAddr,
+		proxyTargets:    strings.Split(*proxyTargets, ","),
+	}
 }
 
 func main() {
-	httpPort := flag.String("http-port", "8001", "Port on which HTTP server listens")
-	coapPort := flag.String("coap-port", "5688", "Port on which COAP server listens")
+	cfg := parseConfig()
+	creds, proxyCreds, err := loadCredentials(cfg.pskIdentity, cfg.psk)
+	if err != nil {
+		log.Fatalf("failed to load credentials: %v", err)
+	}
+	service := newService()
+	h := new(health)
+	var m *mirror
+	if cfg.telemetryAddr != "" {
+		m = newMirror(cfg.telemetryAddr)
+	}
 
-	log.Println("Starting HTTP server")
-	go func() {
-		log.Fatal(startHTTPServer(*httpPort))
-	}()
-	log.Println("HTTP server started")
-	log.Println("Starting COAP server...")
-	go func() {
-		log.Fatal(startCOAPServer(*coapPort))
-	}()
-	log.Println("COAP server started")
+	servers := []managedServer{httpServer("HTTP", newHTTPServer(cfg.httpPort, service, proxyCreds, cfg.proxyTargets, h, m))}
+	if m != nil {
+		servers = append(servers, mirrorServer(m))
+	}
+	for _, transport := range coaptransport.Transports {
+		port, ok := cfg.coapPorts[transport]
+		if !ok {
+			continue
+		}
+		if transport == coaptransport.DTLS && creds.DTLS == nil {
+			log.Printf("No -psk, not serving COAP over %s", transport)
+			continue
+		}
+		s, err := coaptransport.NewServer(transport, ":"+port, creds, newCOAPMux(service, h))
+		if err != nil {
+			log.Fatalf("failed to create COAP server over %s: %v", transport, err)
+		}
+		servers = append(servers, managedServer{
+			name:     fmt.Sprintf("COAP over %s", transport),
+			serve:    s.ListenAndServe,
+			shutdown: s.Shutdown,
+		})
+	}
 
-	select {}
+	if err := runServers(servers, h, cfg.shutdownTimeout); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Exiting...")
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"github.com/go-ocf/go-coap"
+	"github.com/limaechocharlie/cwb/shared/senml"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// telemetryPath is the observable SenML resource of the devices in the observe example
+const telemetryPath = "/device/telemetry"
+
+// maxMirrored bounds the number of records the mirror keeps
+const maxMirrored = 1000
+
+// mirror observes the telemetry of a COAP device and serves the records it has received over HTTP
+// Records are kept resolved, so that each one carries its full name and an absolute time.
+type mirror struct {
+	addr    string
+	mutex   sync.Mutex
+	records senml.Pack // oldest first
+}
+
+func newMirror(addr string) *mirror {
+	return &mirror{addr: addr}
+}
+
+// add resolves the pack and keeps its records
+func (m *mirror) add(p senml.Pack) error {
+	resolved, err := senml.Resolve(p, time.Now())
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.records = append(m.records, resolved...)
+	if n := len(m.records) - maxMirrored; n > 0 {
+		m.records = append(senml.Pack(nil), m.records[n:]...)
+	}
+	return nil
+}
+
+// observe follows the telemetry of the device until the context is done, observing it again whenever the device
+// can't be reached
+func (m *mirror) observe(ctx context.Context) {
+	for {
+		if err := m.observeOnce(ctx); err != nil {
+			log.Printf("Cannot observe telemetry at %s: %v", m.addr, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// observeOnce registers with the device and keeps the records of every notification until the context is done
+// Notifications are asked for in SenML CBOR, the smaller of the two representations.
+func (m *mirror) observeOnce(ctx context.Context) error {
+	conn, err := coap.Dial("udp", m.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	registerCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	obs, err := conn.ObserveWithContext(registerCtx, telemetryPath, func(req *coap.Request) {
+		format, _ := req.Msg.Option(coap.ContentFormat).(coap.MediaType)
+		p, err := senml.Decode(format, req.Msg.Payload())
+		if err == nil {
+			err = m.add(p)
+		}
+		if err != nil {
+			log.Printf("Cannot mirror telemetry: %v", err)
+		}
+	}, func(msg coap.Message) {
+		msg.SetOption(coap.Accept, senml.CBORFormat)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Mirroring telemetry of %s", m.addr)
+	<-ctx.Done()
+	// the observation context is done, so the deregistration gets its own
+	cancelCtx, cancelCancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelCancel()
+	return obs.CancelWithContext(cancelCtx)
+}
+
+// mirrorServer manages the mirror along with the servers, so that the observation is cancelled at the device when
+// they shut down
+// The mirror is ready at once: the device may come up later, the mirror observes it then.
+func mirrorServer(m *mirror) managedServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	return managedServer{
+		name: "Telemetry mirror",
+		serve: func(ready func()) error {
+			defer close(done)
+			ready()
+			m.observe(ctx)
+			return nil
+		},
+		shutdown: func(shutdownCtx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-shutdownCtx.Done():
+				return shutdownCtx.Err()
+			}
+		},
+	}
+}
+
+// httpHandler serves the records, in SenML CBOR if it is accepted and SenML JSON otherwise
+// The n query parameter only returns the records with that name.
+func (m *mirror) httpHandler(w http.ResponseWriter, r *http.Request) {
+	contentType, format := senml.JSONContentType, senml.JSONFormat
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(accept); err == nil && t == senml.CBORContentType {
+			contentType, format = senml.CBORContentType, senml.CBORFormat
+			break
+		}
+	}
+	name := r.URL.Query().Get("n")
+
+	m.mutex.Lock()
+	p := make(senml.Pack, 0, len(m.records))
+	for _, record := range m.records {
+		if name == "" || record.Name == name {
+			p = append(p, record)
+		}
+	}
+	m.mutex.Unlock()
+
+	body, err := senml.Encode(format, p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
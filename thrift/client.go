@@ -41,6 +41,15 @@ var defaultCtx = context.Background()
 func fullHandler(client *syml.SimpleServiceClient) (err error) {
 	const id = "holl"
 	var reply string
+	fmt.Println("list custom commands")
+	commands, err := client.ListCommands(defaultCtx)
+	if err != nil {
+		return err
+	}
+	for _, c := range commands {
+		fmt.Printf("%s: %s %s\n", c.Name, c.Description, c.Schema)
+	}
+
 	fmt.Println("run custom command")
 	b, _ := json.Marshal(image.Rect(1,2,3,5))
 	if reply, err = client.CustomCommand(defaultCtx, id, &syml.Command{"area", b}); err != nil {
@@ -48,33 +57,59 @@ func fullHandler(client *syml.SimpleServiceClient) (err error) {
 	}
 	fmt.Println(reply)
 
-	fmt.Println("run custom command with unexpected command name")
-	_, expectedErr := client.CustomCommand(defaultCtx, id, &syml.Command{"wrong", b})
-	switch v := expectedErr.(type){
-	case *syml.SimpleError:
-		fmt.Println(v.Message)
-	default:
-		fmt.Println(expectedErr)
+	fmt.Println("run transform command")
+	b, _ = json.Marshal(map[string]string{"operation": "reverse", "text": "hello"})
+	if reply, err = client.CustomCommand(defaultCtx, id, &syml.Command{"transform", b}); err != nil {
+		return err
 	}
+	fmt.Println(reply)
+
+	fmt.Println("run custom command with invalid parameters")
+	_, expectedErr := client.CustomCommand(defaultCtx, id, &syml.Command{"area", []byte(`{"Min":{"X":1}}`)})
+	printError(expectedErr)
+
+	fmt.Println("run custom command with unexpected command name")
+	_, expectedErr = client.CustomCommand(defaultCtx, id, &syml.Command{"wrong", b})
+	printError(expectedErr)
 
 	fmt.Println("run snooze")
-	if err = client.Snooze(defaultCtx, id, 2); err != nil {
+	var result *syml.SnoozeResult
+	if result, err = client.Snooze(defaultCtx, id, 2); err != nil {
 		return err
 	}
+	fmt.Printf("slept %v\n", time.Duration(result.SleptMs)*time.Millisecond)
 	return err
 }
 
+// printError prints an error, with its code if it is a SimpleError
+func printError(err error) {
+	switch v := err.(type) {
+	case *syml.SimpleError:
+		fmt.Printf("%s: %s\n", v.Code, v.Message)
+	default:
+		fmt.Println(err)
+	}
+}
+
 func createSnoozeHandler(i , secs int) func(client *syml.SimpleServiceClient) error {
 	return func(client *syml.SimpleServiceClient) (err error) {
 		fmt.Printf("start snooze %d\n", i)
-		if err = client.Snooze(defaultCtx, fmt.Sprintf("%d", i), int64(secs)); err != nil {
+		result, err := client.Snooze(defaultCtx, fmt.Sprintf("%d", i), int64(secs))
+		if err != nil {
 			return err
 		}
-		fmt.Printf("end snooze %d\n", i)
-		return err
+		slept := time.Duration(result.SleptMs) * time.Millisecond
+		if result.Capped {
+			fmt.Printf("end snooze %d, slept %v, cut to the maximum of the server\n", i, slept)
+		} else {
+			fmt.Printf("end snooze %d, slept %v\n", i, slept)
+		}
+		return nil
 	}
 }
-func runClient(handler func(client *syml.SimpleServiceClient) error, transportFactory thrift.TTransportFactory, protocolFactory thrift.TProtocolFactory, addr string) error {
+// runClient connects to the server and runs the handler, closing the connection once the deadline passes if it
+// isn't zero: thrift calls don't carry a deadline, so the server only stops when it notices the closed connection
+func runClient(handler func(client *syml.SimpleServiceClient) error, transportFactory thrift.TTransportFactory, protocolFactory thrift.TProtocolFactory, addr string, deadline time.Duration) error {
 	var transport thrift.TTransport
 	var err error
 
@@ -113,7 +148,16 @@ func runClient(handler func(client *syml.SimpleServiceClient) error, transportFa
 	defer transport.Close()
 	iprot := protocolFactory.GetProtocol(transport)
 	oprot := protocolFactory.GetProtocol(transport)
-	return handler(syml.NewSimpleServiceClient(thrift.NewTStandardClient(iprot, oprot)))
+	client := syml.NewSimpleServiceClient(thrift.NewTStandardClient(iprot, oprot))
+	if deadline <= 0 {
+		return handler(client)
+	}
+	timer := time.AfterFunc(deadline, func() { transport.Close() })
+	err = handler(client)
+	if !timer.Stop() {
+		return fmt.Errorf("cancelled by its %v deadline: %v", deadline, err)
+	}
+	return err
 }
 
 func clientUsage() {
@@ -130,6 +174,8 @@ func main() {
 	flag.Usage = clientUsage
 	addr := flag.String("addr", "localhost:9090", "Address to listen to")
 	nClients := flag.Int("multi", 0, "Number of clients")
+	secs := flag.Int("secs", 10, "Length in seconds of the snooze of each -multi client")
+	deadline := flag.Duration("deadline", 0, "Deadline of the snooze of each -multi client, none if 0")
 
 	flag.Parse()
 
@@ -137,7 +183,7 @@ func main() {
 	transportFactory := thrift.NewTTransportFactory()
 
 	if *nClients == 0 {
-		if err := runClient(fullHandler, transportFactory, protocolFactory, *addr); err != nil {
+		if err := runClient(fullHandler, transportFactory, protocolFactory, *addr, 0); err != nil {
 			fmt.Println("error running client:", err)
 		}
 	} else {
@@ -146,7 +192,9 @@ func main() {
 		for i := 0; i < *nClients; i++ {
 			go func(i int) {
 				defer wg.Done()
-				runClient(createSnoozeHandler(i, 10), transportFactory, protocolFactory, *addr)
+				if err := runClient(createSnoozeHandler(i, *secs), transportFactory, protocolFactory, *addr, *deadline); err != nil {
+					fmt.Printf("snooze %d: %v\n", i, err)
+				}
 			}(i)
 			time.Sleep(time.Second)
 		}
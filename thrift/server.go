@@ -23,11 +23,10 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/apache/thrift/lib/go/thrift"
-	"image"
+	"github.com/limaechocharlie/cwb/shared/command"
 	"io/ioutil"
 	"os"
 	"syml"
@@ -35,32 +34,63 @@ import (
 )
 
 type simpleHandler struct {
+	maxSnooze time.Duration // longest snooze, longer ones are cut to it
 }
 
+// CustomCommand runs a command of the registry, a command without parameters is run with null ones
 func (p *simpleHandler) CustomCommand(ctx context.Context, id string, cmd *syml.Command) (r string, err error) {
 	fmt.Printf("custom command (%s) name:  %s\n", id, cmd.Name)
-	if cmd.Name != "area" {
+	r, err = command.Run(ctx, cmd.Name, cmd.Parameters)
+	if err != nil {
+		e := err.(*command.Error)
 		simpleErr := syml.NewSimpleError()
-		simpleErr.Message = fmt.Sprintf("Unexpected command name \"%s\"", cmd.Name)
+		simpleErr.Message = e.Message
+		simpleErr.Code = e.Kind.String()
 		return "", simpleErr
 	}
-	var rect image.Rectangle
-	if !cmd.IsSetParameters() {
-		fmt.Println("nil array")
-	} else if err := json.Unmarshal(cmd.Parameters, &rect); err != nil {
-		return "", err
+	return r, nil
+}
+
+func (p *simpleHandler) ListCommands(ctx context.Context) (r []*syml.CommandInfo, err error) {
+	for _, c := range command.Commands() {
+		r = append(r, &syml.CommandInfo{Name: c.Name, Description: c.Description, Schema: string(c.Schema)})
 	}
-	return fmt.Sprintf("The area of the rectangle is %d", rect.Dx()*rect.Dy()), nil
+	return r, nil
 }
 
-func (p *simpleHandler) Snooze(ctx context.Context, id string, secs int64) (err error) {
+// Snooze sleeps until the end of the snooze or the cancellation of the call, whichever comes first
+// Thrift calls have no deadline on the wire: the context is cancelled when the server notices that the client
+// closed its connection, which recent versions of the thrift library check for while a call runs.
+func (p *simpleHandler) Snooze(ctx context.Context, id string, secs int64) (r *syml.SnoozeResult, err error) {
+	if secs < 0 {
+		simpleErr := syml.NewSimpleError()
+		simpleErr.Message = fmt.Sprintf("negative snooze of %d s", secs)
+		simpleErr.Code = command.Invalid.String()
+		return nil, simpleErr
+	}
+	// compared in seconds, since a huge snooze overflows a duration
+	d := p.maxSnooze
+	r = syml.NewSnoozeResult()
+	r.Capped = secs > int64(p.maxSnooze/time.Second)
+	if !r.Capped {
+		d = time.Duration(secs) * time.Second
+	}
 	fmt.Printf("snooze (%s) in:  %s\n", id, time.Now().Format("15:04:05"))
-	time.Sleep(time.Duration(secs) * time.Second)
+	start := time.Now()
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		fmt.Printf("snooze (%s) stopped after %v: %v\n", id, time.Since(start).Round(time.Millisecond), ctx.Err())
+		return nil, ctx.Err()
+	}
+	r.SleptMs = int64(time.Since(start) / time.Millisecond)
 	fmt.Printf("snooze (%s) out: %s\n", id, time.Now().Format("15:04:05"))
-	return nil
+	return r, nil
 }
 
-func runServer(transportFactory thrift.TTransportFactory, protocolFactory thrift.TProtocolFactory, addr string) error {
+func runServer(transportFactory thrift.TTransportFactory, protocolFactory thrift.TProtocolFactory, addr string, maxSnooze time.Duration) error {
 	// load server certificate
 	serverCert, err := tls.LoadX509KeyPair("testdata/server-cert.pem", "testdata/server-key.pem")
 	if err != nil {
@@ -87,7 +117,7 @@ func runServer(transportFactory thrift.TTransportFactory, protocolFactory thrift
 	if err != nil {
 		return err
 	}
-	processor := syml.NewSimpleServiceProcessor(&simpleHandler{})
+	processor := syml.NewSimpleServiceProcessor(&simpleHandler{maxSnooze: maxSnooze})
 	server := thrift.NewTSimpleServer4(processor, transport, transportFactory, protocolFactory)
 
 	fmt.Println("Starting the Thrift simple server... on ", addr)
@@ -103,13 +133,14 @@ func serverUsage() {
 func main() {
 	flag.Usage = serverUsage
 	addr := flag.String("addr", "localhost:9090", "Address to listen to")
+	maxSnooze := flag.Duration("max-snooze", 30*time.Second, "Longest snooze, longer ones are cut to it")
 
 	flag.Parse()
 
 	protocolFactory := thrift.NewTBinaryProtocolFactoryDefault()
 	transportFactory := thrift.NewTTransportFactory()
 
-	if err := runServer(transportFactory, protocolFactory, *addr); err != nil {
+	if err := runServer(transportFactory, protocolFactory, *addr, *maxSnooze); err != nil {
 		fmt.Println("error running server:", err)
 	}
 }
@@ -8,13 +8,31 @@ struct Command {
 }
 
 /**
- * exception containing an error message
+ * description of a custom command, with the JSON schema of its parameters
+ */
+struct CommandInfo {
+	1: string name,
+	2: string description,
+	3: string schema,
+}
+
+/**
+ * result of a snooze: how long the server actually slept and whether it cut the snooze to its maximum
+ */
+struct SnoozeResult {
+	1: i64 sleptMs,
+	2: bool capped,
+}
+
+/**
+ * exception containing an error message and its code, e.g. UNKNOWN_COMMAND or INVALID_PARAMETERS
  * exceptions convert into a GO error.
  * By default, all service methods return an error but exceptions are handy if you require an error type that is
  * visible in both the client and server side code.
  */
 exception SimpleError {
-	1: string message
+	1: string message,
+	2: string code,
 }
 
 service SimpleService {
@@ -24,7 +42,13 @@ service SimpleService {
 	string customCommand(1:string id, 2:Command cmd) throws (1:SimpleError err),
 
 	/**
-     * snooze sleeps for the supplied number of seconds
+	* listCommands describes the custom commands the server runs, in alphabetical order
+	*/
+	list<CommandInfo> listCommands(),
+
+	/**
+     * snooze sleeps for the supplied number of seconds, at most the maximum of the server, and stops early if the
+     * client goes away
      */
-    void snooze(1:string id, 2:i64 secs),
+    SnoozeResult snooze(1:string id, 2:i64 secs) throws (1:SimpleError err),
 }
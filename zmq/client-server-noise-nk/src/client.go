@@ -3,37 +3,35 @@ package main
 import (
 	"bufio"
 	"crypto/rand"
+	"flag"
 	"github.com/flynn/noise"
-	zmq "github.com/pebbe/zmq4/draft"
+	"github.com/limaechocharlie/cwb/shared/zmqenvelope"
+	"github.com/limaechocharlie/cwb/shared/zmqpattern"
 	"log"
 	"os"
+	"time"
 )
 
 func main() {
+	timeout := flag.Duration("timeout", zmqpattern.DefaultTimeout, "Time to wait for each reply")
+	retries := flag.Int("retries", zmqpattern.DefaultRetries, "Number of times a request is sent again on a new connection")
+	deadline := flag.Duration("deadline", 0, "Time a request may take with its retries, no limit if 0")
+	flag.Parse()
+
 	log.Println("Zeromq Client")
 	const endpoint = "tcp://127.0.0.1:5556"
-	socket, err := zmq.NewSocket(zmq.CLIENT)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer socket.Close()
-
-	err = socket.SetImmediate(true)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if err := socket.Connect(endpoint); err != nil {
-		log.Fatal(err)
-	}
-	defer socket.Disconnect(endpoint)
+	// every message is a handshake of its own, which the server may well answer twice
+	pirate := zmqpattern.NewLazyPirate(endpoint)
+	pirate.Timeout, pirate.Retries = *timeout, *retries
+	defer pirate.Close()
 
 	// get public static key of server
-	socket.Send("publicKey", 0)
-	peerStatic, err := socket.RecvBytes(0)
+	client := zmqenvelope.NewClient(pirate)
+	key, err := client.Request(zmqenvelope.PublicKey, 0, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
+	peerStatic := key.Payload
 	log.Printf("Got server public key %q", peerStatic)
 
 	cs := noise.NewCipherSuite(noise.DH25519, noise.CipherAESGCM, noise.HashSHA256)
@@ -62,11 +60,16 @@ func main() {
 			log.Fatal(err)
 		}
 		log.Printf("Sending \"%s\", encrypted %q", scanner.Text(), encryptedMessage)
-		socket.SendBytes(encryptedMessage, 0)
-		encryptedReply, err := socket.RecvBytes(0)
+		var requestDeadline time.Time
+		if *deadline > 0 {
+			requestDeadline = time.Now().Add(*deadline)
+		}
+		response, err := client.RequestWithDeadline(zmqenvelope.Reverse, 0, encryptedMessage, requestDeadline)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("Request failed: %v", err)
+			continue
 		}
+		encryptedReply := response.Payload
 		reply, _, _, err := hs.ReadMessage(nil, encryptedReply)
 		if err != nil {
 			log.Fatal(err)
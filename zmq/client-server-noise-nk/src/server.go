@@ -2,20 +2,73 @@ package main
 
 import (
 	"crypto/rand"
+	"flag"
 	"github.com/flynn/noise"
-	zmq "github.com/pebbe/zmq4/draft"
+	"github.com/limaechocharlie/cwb/shared/transform"
+	"github.com/limaechocharlie/cwb/shared/zmqenvelope"
+	"github.com/limaechocharlie/cwb/shared/zmqpool"
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
 	"log"
 )
 
-func main() {
-	log.Println("Zeromq Server")
-	zmqContext, err := zmq.NewContext()
+// handle answers a request for the public key or a handshake carrying text to reverse, with an error if it fails
+func handle(cs noise.CipherSuite, staticKey noise.DHKey, b []byte) zmqenvelope.Envelope {
+	req, err := zmqenvelope.Unmarshal(b)
+	switch err {
+	case nil:
+	case zmqenvelope.ErrVersion:
+		return zmqenvelope.ErrorReply(req, zmqenvelope.UnsupportedVersion, "version %d, expected %d", req.Version, zmqenvelope.Version)
+	default:
+		return zmqenvelope.ErrorReply(req, zmqenvelope.BadEnvelope, "%v", err)
+	}
+
+	switch req.Type {
+	case zmqenvelope.PublicKey:
+		return zmqenvelope.Reply(req, staticKey.Public)
+	case zmqenvelope.Reverse:
+		hs, err := noise.NewHandshakeState(noise.Config{
+			CipherSuite:   cs,
+			Random:        rand.Reader,
+			Pattern:       noise.HandshakeNK,
+			StaticKeypair: staticKey,
+		})
+		if err != nil {
+			return zmqenvelope.ErrorReply(req, zmqenvelope.Internal, "%v", err)
+		}
+
+		message, _, _, err := hs.ReadMessage(nil, req.Payload)
+		if err != nil {
+			return zmqenvelope.ErrorReply(req, zmqenvelope.HandshakeFailed, "%v", err)
+		}
+		log.Printf("Received %q, decrypted \"%s\"", string(req.Payload), string(message))
+		message = transform.ReverseBytes(message)
+		reply, _, _, err := hs.WriteMessage(nil, message)
+		if err != nil {
+			return zmqenvelope.ErrorReply(req, zmqenvelope.Internal, "%v", err)
+		}
+		log.Printf("Replying \"%s\", encrypted %q", string(message), string(reply))
+		return zmqenvelope.Reply(req, reply)
+	default:
+		return zmqenvelope.ErrorReply(req, zmqenvelope.UnknownType, "unknown message type %s", req.Type)
+	}
+}
+
+// busy tells a client with too many pending requests to retry later
+func busy(r zmqpool.Request) []byte {
+	req, err := zmqenvelope.Unmarshal(r.Payload)
 	if err != nil {
-		log.Fatal(err)
+		return nil
 	}
-	defer zmqContext.Term()
+	log.Printf("Request %d failed: too many pending requests", req.RequestID)
+	return zmqenvelope.ErrorReply(req, zmqenvelope.Busy, "too many pending requests").Marshal()
+}
 
-	soc, err := zmqContext.NewSocket(zmq.SERVER)
+func main() {
+	workers := flag.Int("workers", 0, "Number of requests handled at once, the number of CPUs if 0")
+	flag.Parse()
+
+	log.Println("Zeromq Server")
+	soc, err := zmqsocket.NewSocket(zmqsocket.Server)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -31,41 +84,11 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	for {
-		if rawMessage, opts, err := soc.RecvBytesWithOpts(0, zmq.OptRoutingId(0)); err == nil {
-			routingId, ok := opts[0].(zmq.OptRoutingId)
-			var reply []byte
-			if !ok {
-				log.Fatalf("%T is not of type OptRoutingId", opts[0])
-			}
-			if string(rawMessage) == "publicKey" {
-				reply = staticKey.Public
-			} else {
-				hs, err := noise.NewHandshakeState(noise.Config{
-					CipherSuite:   cs,
-					Random:        rand.Reader,
-					Pattern:       noise.HandshakeNK,
-					StaticKeypair: staticKey,
-				})
-				if err != nil {
-					log.Fatal(err)
-				}
-
-				message, _, _, err := hs.ReadMessage(nil, rawMessage)
-				if err != nil {
-					log.Fatal(err)
-				}
-				log.Printf("Received %q, decrypted \"%s\"", string(rawMessage), string(message))
-				for i, j := 0, len(message)-1; i < j; i, j = i+1, j-1 {
-					message[i], message[j] = message[j], message[i]
-				}
-				reply, _, _, err = hs.WriteMessage(nil, message)
-				if err != nil {
-					log.Fatal(err)
-				}
-				log.Printf("Replying \"%s\", encrypted %q", string(message), string(reply))
-			}
-			soc.SendBytes(reply, 0, routingId)
+	log.Fatal(zmqpool.Serve(soc, zmqpool.Options{Workers: *workers, Busy: busy}, func(r zmqpool.Request) []byte {
+		reply := handle(cs, staticKey, r.Payload)
+		if reply.Type == zmqenvelope.Error {
+			log.Printf("Request %d failed: %s", reply.RequestID, reply.Payload[1:])
 		}
-	}
+		return reply.Marshal()
+	}))
 }
@@ -0,0 +1,30 @@
+#!/bin/bash
+# Runs the client against the server for every pairing of the libzmq and the pure-Go ZMTP backends
+status=0
+build() {
+    if [ "$1" = zmtp ]; then
+        go build -tags zmtp -o "$2" "$3"
+    else
+        go build -o "$2" "$3"
+    fi
+}
+for server in libzmq zmtp; do
+    for client in libzmq zmtp; do
+        build $server /tmp/interop-server src/server.go || exit 1
+        build $client /tmp/interop-client src/client.go || exit 1
+        /tmp/interop-server 2>/dev/null &
+        pid=$!
+        sleep 1
+        output=$(printf 'hello\nq\n' | /tmp/interop-client 2>&1)
+        kill $pid
+        wait $pid 2>/dev/null
+        if echo "$output" | grep -q 'Received "olleh"'; then
+            echo "$server server, $client client: ok"
+        else
+            echo "$server server, $client client: failed"
+            echo "$output"
+            status=1
+        fi
+    done
+done
+exit $status
@@ -2,66 +2,28 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
-	"github.com/limaechocharlie/cwb/shared/noise"
-	zmq "github.com/pebbe/zmq4/draft"
+	"flag"
+	"github.com/limaechocharlie/cwb/shared/zmqenvelope"
+	"github.com/limaechocharlie/cwb/shared/zmqpattern"
 	"log"
 	"os"
+	"time"
 )
 
-const (
-	handshakeType = 0
-	reverseType = 1
-)
-
-type requestMessage struct {
-	MessageType int // 0 = handshake, 1 = reverse
-	ChannelID   noise.ChannelID
-	Payload     []byte
-}
-
-type zmqClientMessenger struct {
-	*zmq.Socket
-}
-
-func (z zmqClientMessenger) Exchange(message []byte) (reply []byte, err error) {
-	request, err := json.Marshal(requestMessage{MessageType: handshakeType, Payload: message})
-	if err != nil {
-		return
-	}
-	_, err = z.SendBytes(request, 0)
-	if err != nil {
-		return
-	}
-	return z.RecvBytes(0)
-}
-
 func main() {
+	timeout := flag.Duration("timeout", zmqpattern.DefaultTimeout, "Time to wait for each reply")
+	retries := flag.Int("retries", zmqpattern.DefaultRetries, "Number of times a request is sent again on a new connection")
+	deadline := flag.Duration("deadline", 0, "Time a request may take with its retries and handshakes, no limit if 0")
+	flag.Parse()
+
 	log.Println("Zeromq Client")
 	const endpoint = "tcp://127.0.0.1:5556"
-	socket, err := zmq.NewSocket(zmq.CLIENT)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer socket.Close()
+	pirate := zmqpattern.NewLazyPirate(endpoint)
+	pirate.Timeout, pirate.Retries = *timeout, *retries
+	defer pirate.Close()
 
-	// set immediate so that messages shall be queued only to completed connections (avoid lost messages)
-	err = socket.SetImmediate(true)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if err := socket.Connect(endpoint); err != nil {
-		log.Fatal(err)
-	}
-	defer socket.Disconnect(endpoint)
-
-	log.Printf("Initiate client handshake")
-	channelID, csPair, err := noise.ClientHandshake(zmqClientMessenger{socket})
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println("Handshake complete")
+	// the channel handshakes on the first message, and again when the server no longer knows it
+	channel := zmqpattern.NewChannel(zmqenvelope.NewClient(pirate))
 
 	log.Println("Type messages to send, enter 'q' to exit.")
 	scanner := bufio.NewScanner(os.Stdin)
@@ -69,28 +31,17 @@ func main() {
 		if scanner.Text() == "q" {
 			break
 		}
-		encryptedMessage := csPair.Encrypter.Encrypt(nil, nil, scanner.Bytes())
-		log.Printf("Sending \"%s\", encrypted %q", scanner.Text(), encryptedMessage)
-		request, err := json.Marshal(requestMessage{MessageType: reverseType, ChannelID: channelID, Payload: encryptedMessage})
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		_, err = socket.SendBytes(request, 0)
-		if err != nil {
-			log.Fatal(err)
+		var requestDeadline time.Time
+		if *deadline > 0 {
+			requestDeadline = time.Now().Add(*deadline)
 		}
-
-		encryptedReply, err := socket.RecvBytes(0)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		reply, err := csPair.Decrypter.Decrypt(nil, nil, encryptedReply)
+		log.Printf("Sending \"%s\"", scanner.Text())
+		reply, err := channel.Request(zmqenvelope.Reverse, scanner.Bytes(), requestDeadline)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("Request failed: %v", err)
+			continue
 		}
-		log.Printf("Received %q, decrypted \"%s\"", encryptedReply, string(reply))
+		log.Printf("Received \"%s\"", string(reply))
 	}
 
 	log.Println("Exiting...")
@@ -1,37 +1,114 @@
 package main
 
 import (
+	"flag"
 	"log"
-	zmq "github.com/pebbe/zmq4/draft"
+	"sync"
 	"github.com/limaechocharlie/cwb/shared/noise"
-	"encoding/json"
+	"github.com/limaechocharlie/cwb/shared/transform"
+	"github.com/limaechocharlie/cwb/shared/zmqenvelope"
+	"github.com/limaechocharlie/cwb/shared/zmqpool"
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
 )
 
+// zmqServerMessenger satisfies the ServerMessenger in the noise wrapper library by keeping the reply to the
+// handshake request, which the pool sends
 type zmqServerMessenger struct {
-	*zmq.Socket
-	routingId zmq.OptRoutingId
+	request zmqenvelope.Envelope
+	reply   []byte
 }
 
 func (z *zmqServerMessenger) Send(message []byte) (err error)  {
-	_, err = z.SendBytes(message,0, z.routingId)
+	z.reply = zmqenvelope.Reply(z.request, message).Marshal()
 	return
 }
 
-type inboundMessage struct {
-	MessageType int // o = handshake, 1 = reverse
-	ChannelID   noise.ChannelID
-	Payload     []byte
+// channel holds the cipher states of a client
+// The pool may handle several requests of a client at once, e.g. a retry with the original still in flight, and the
+// nonces of the cipher states must advance in step with the client, so a channel is used by one request at a time.
+type channel struct {
+	mutex  sync.Mutex
+	csPair noise.CipherStatePair
 }
 
-func main() {
-	log.Println("Zeromq Server")
-	zmqContext, err := zmq.NewContext()
+type server struct {
+	mutex   sync.Mutex
+	clients map[uint64]*channel
+}
+
+// fail logs the failure and creates the reply that reports it to the client
+func fail(req zmqenvelope.Envelope, code zmqenvelope.Code, format string, a ...interface{}) []byte {
+	reply := zmqenvelope.ErrorReply(req, code, format, a...)
+	log.Printf("Request %d failed: %s", req.RequestID, reply.Payload[1:])
+	return reply.Marshal()
+}
+
+// handle answers a request, with an error if it fails
+func (s *server) handle(r zmqpool.Request) []byte {
+	req, err := zmqenvelope.Unmarshal(r.Payload)
+	switch err {
+	case nil:
+	case zmqenvelope.ErrVersion:
+		return fail(req, zmqenvelope.UnsupportedVersion, "version %d, expected %d", req.Version, zmqenvelope.Version)
+	default:
+		return fail(req, zmqenvelope.BadEnvelope, "%v", err)
+	}
+
+	switch req.Type {
+	case zmqenvelope.Handshake:
+		log.Println("Client has initiated handshake")
+		messenger := &zmqServerMessenger{request: req}
+		channelID, csPair, err := noise.ServerHandshake(messenger, req.Payload)
+		if err != nil {
+			return fail(req, zmqenvelope.HandshakeFailed, "%v", err)
+		}
+		id, ok := channelID.UInt64()
+		if !ok {
+			return fail(req, zmqenvelope.Internal, "unable to encode channel ID into an integer")
+		}
+		s.mutex.Lock()
+		s.clients[id] = &channel{csPair: csPair}
+		s.mutex.Unlock()
+		log.Printf("Handshake with client completed [id: %d]", id)
+		return messenger.reply
+	case zmqenvelope.Reverse:
+		s.mutex.Lock()
+		c, ok := s.clients[req.ChannelID]
+		s.mutex.Unlock()
+		if !ok {
+			return fail(req, zmqenvelope.UnknownChannel, "no channel %d", req.ChannelID)
+		}
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		payload, err := c.csPair.Decrypter.Decrypt(nil, nil, req.Payload)
+		if err != nil {
+			return fail(req, zmqenvelope.DecryptFailed, "%v", err)
+		}
+		log.Printf("Received %q, decrypted \"%s\"", req.Payload, string(payload))
+		payload = transform.ReverseBytes(payload)
+		encryptedReply := c.csPair.Encrypter.Encrypt(nil, nil, payload)
+		log.Printf("Replying \"%s\", encrypted %q", string(payload), string(encryptedReply))
+		return zmqenvelope.Reply(req, encryptedReply).Marshal()
+	default:
+		return fail(req, zmqenvelope.UnknownType, "unknown message type %s", req.Type)
+	}
+}
+
+// busy tells a client with too many pending requests to retry later
+func busy(r zmqpool.Request) []byte {
+	req, err := zmqenvelope.Unmarshal(r.Payload)
 	if err != nil {
-		log.Fatal(err)
+		return nil
 	}
-	defer zmqContext.Term()
+	return fail(req, zmqenvelope.Busy, "too many pending requests")
+}
+
+func main() {
+	workers := flag.Int("workers", 0, "Number of requests handled at once, the number of CPUs if 0")
+	flag.Parse()
 
-	socket, err := zmqContext.NewSocket(zmq.SERVER)
+	log.Println("Zeromq Server")
+	socket, err := zmqsocket.NewSocket(zmqsocket.Server)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -41,67 +118,6 @@ func main() {
 		log.Fatal(err)
 	}
 
-	clients := make(map[uint64]noise.CipherStatePair)
-
-forLoop:
-	for {
-		if b, opts, err := socket.RecvBytesWithOpts(0, zmq.OptRoutingId(0)); err == nil {
-			routingId, ok := opts[0].(zmq.OptRoutingId)
-			if !ok {
-				log.Printf("%T is not of type OptRoutingId", opts[0])
-				continue forLoop
-			}
-			inbound := inboundMessage{}
-			if err := json.Unmarshal(b, &inbound); err != nil {
-				log.Println(err)
-				continue forLoop
-			}
-			switch inbound.MessageType {
-			case 0:
-				// handshake
-				log.Println("Client has initiated handshake")
-				channelID, csPair, err := noise.ServerHandshake(
-					&zmqServerMessenger{socket, routingId},
-					inbound.Payload)
-				if err != nil {
-					log.Println(err)
-					continue forLoop
-				}
-
-				id, ok := channelID.UInt64()
-				if !ok {
-					log.Println("Unable to encode channel ID into an integer")
-					continue forLoop
-				}
-				clients[id] = csPair
-				log.Printf("Handshake with client completed [id: %d]", id)
-			case 1:
-				// reverse
-				id, ok := inbound.ChannelID.UInt64()
-				if !ok {
-					log.Println("Unable to encode channel ID into an integer")
-					continue forLoop
-				}
-				csPair, ok := clients[id]
-				if!ok {
-					log.Printf("Can't find channel id %d", id)
-					continue forLoop
-				}
-				payload, err := csPair.Decrypter.Decrypt(nil, nil, inbound.Payload)
-				if err != nil {
-					log.Printf("Failed to decrypt payload; %s", err)
-					continue forLoop
-				}
-				log.Printf("Received %q, decrypted \"%s\"", string(b), string(payload))
-				for i, j := 0, len(payload)-1; i < j; i, j = i+1, j-1 {
-					payload[i], payload[j] = payload[j], payload[i]
-				}
-				encryptedReply := csPair.Encrypter.Encrypt(nil, nil, payload)
-				log.Printf("Replying \"%s\", encrypted %q", string(payload), string(encryptedReply))
-				socket.SendBytes(encryptedReply,0, routingId)
-			default:
-				log.Printf("Unknown message type %d", inbound.MessageType)
-			}
-		}
-	}
+	s := &server{clients: make(map[uint64]*channel)}
+	log.Fatal(zmqpool.Serve(socket, zmqpool.Options{Workers: *workers, Busy: busy}, s.handle))
 }
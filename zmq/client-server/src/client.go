@@ -1,31 +1,42 @@
 package main
 
 import (
+	"flag"
 	"log"
-	zmq "github.com/pebbe/zmq4/draft"
+	"time"
+	"github.com/limaechocharlie/cwb/shared/zmqcurve"
+	"github.com/limaechocharlie/cwb/shared/zmqpattern"
 	"bufio"
 	"os"
 )
 
 func main() {
+	security := flag.String("security", "none", "Security mechanism, none or curve")
+	keyFile := flag.String("key", "client.key", "Client CURVE keypair file, created if missing")
+	serverKeyFile := flag.String("server-key", "server.pub", "Server CURVE public key file")
+	timeout := flag.Duration("timeout", zmqpattern.DefaultTimeout, "Time to wait for each reply")
+	retries := flag.Int("retries", zmqpattern.DefaultRetries, "Number of times a request is sent again on a new connection")
+	deadline := flag.Duration("deadline", 0, "Time a request may take with its retries, no limit if 0")
+	flag.Parse()
+
 	log.Println("Zeromq Client")
 	const endpoint = "tcp://127.0.0.1:5556"
- 	socket, err := zmq.NewSocket(zmq.CLIENT)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer socket.Close()
-
-	// set immediate so that messages shall be queued only to completed connections (avoid lost messages)
-	err = socket.SetImmediate(true)
-	if err != nil {
-		log.Fatal(err)
-	}
+	// the pirate sends requests again on a new socket when no reply comes, a reversal can be done twice
+	pirate := zmqpattern.NewLazyPirate(endpoint)
+	pirate.Timeout, pirate.Retries = *timeout, *retries
+	defer pirate.Close()
 
-	if err := socket.Connect(endpoint); err != nil {
-		log.Fatal(err)
+	switch *security {
+	case "none":
+	case "curve":
+		open, err := zmqcurve.ClientSockets(*keyFile, *serverKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pirate.Open = open
+	default:
+		log.Fatalf("Unknown security mechanism %s", *security)
 	}
-	defer socket.Disconnect(endpoint)
 
 	log.Println("Type messages to send, enter 'q' to exit.")
 	scanner := bufio.NewScanner(os.Stdin)
@@ -33,10 +44,14 @@ func main() {
 		if scanner.Text() == "q" {
 			break
 		}
-		socket.SendBytes(scanner.Bytes(),0)
-		reply, err := socket.Recv(0)
+		var requestDeadline time.Time
+		if *deadline > 0 {
+			requestDeadline = time.Now().Add(*deadline)
+		}
+		reply, err := pirate.RequestWithDeadline(scanner.Bytes(), requestDeadline)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("Request failed: %v", err)
+			continue
 		}
 		log.Printf("Received repky '%s'", reply)
 	}
@@ -1,39 +1,44 @@
 package main
 
 import (
+	"flag"
 	"log"
-	zmq "github.com/pebbe/zmq4/draft"
+	"github.com/limaechocharlie/cwb/shared/transform"
+	"github.com/limaechocharlie/cwb/shared/zmqcurve"
+	"github.com/limaechocharlie/cwb/shared/zmqpool"
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
 )
 
 func main() {
+	workers := flag.Int("workers", 0, "Number of requests handled at once, the number of CPUs if 0")
+	security := flag.String("security", "none", "Security mechanism, none or curve")
+	keyFile := flag.String("key", "server.key", "Server CURVE keypair file, created if missing")
+	allowFile := flag.String("allow", "allowed.keys", "File of the client public keys allowed in with CURVE")
+	flag.Parse()
+
 	log.Println("Zeromq Server")
-	zmqContext, err := zmq.NewContext()
+	soc, err := zmqsocket.NewSocket(zmqsocket.Server)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer zmqContext.Term()
+	defer soc.Close()
 
-	soc, err := zmqContext.NewSocket(zmq.SERVER)
-	if err != nil {
-		log.Fatal(err)
+	switch *security {
+	case "none":
+	case "curve":
+		if err := zmqcurve.SecureServer(soc, *keyFile, *allowFile); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("Unknown security mechanism %s", *security)
 	}
-	defer soc.Close()
 
 	if err := soc.Bind("tcp://127.0.0.1:5556"); err != nil {
 		log.Fatal(err)
 	}
 
-	for {
-		if msg, opts, err := soc.RecvBytesWithOpts(0, zmq.OptRoutingId(0)); err == nil {
-			routingId, ok := opts[0].(zmq.OptRoutingId)
-			if !ok {
-				log.Fatalf("%T is not of type OptRoutingId", opts[0])
-			}
-			log.Printf("Received message '%s', replying with reversed message", string(msg))
-			for i, j := 0, len(msg)-1; i < j; i, j = i+1, j-1 {
-				msg[i], msg[j] = msg[j], msg[i]
-			}
-			soc.SendBytes(msg,0, routingId)
-		}
-	}
+	log.Fatal(zmqpool.Serve(soc, zmqpool.Options{Workers: *workers}, func(req zmqpool.Request) []byte {
+		log.Printf("Received message '%s', replying with reversed message", string(req.Payload))
+		return transform.ReverseBytes(req.Payload)
+	}))
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"github.com/limaechocharlie/cwb/shared/zmqpattern"
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
+	"log"
+	"os"
+	"strings"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "tcp://127.0.0.1:5557", "Endpoint the workers pull tasks from")
+	sinkEndpoint := flag.String("sink", "tcp://127.0.0.1:5558", "Endpoint of the sink")
+	flag.Parse()
+
+	log.Println("Zeromq Distributor")
+	workers, err := zmqsocket.NewPipelineSocket(zmqsocket.Push)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer workers.Close()
+	if err := workers.Bind(*endpoint); err != nil {
+		log.Fatal(err)
+	}
+
+	sink, err := zmqsocket.NewPipelineSocket(zmqsocket.Push)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sink.Close()
+	if err := sink.Connect(*sinkEndpoint); err != nil {
+		log.Fatal(err)
+	}
+
+	distributor := zmqpattern.NewDistributor(workers, sink)
+	log.Println("Start the workers, then type sentences to reverse word by word, enter 'q' to exit.")
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		if scanner.Text() == "q" {
+			break
+		}
+		var tasks [][]byte
+		for _, word := range strings.Fields(scanner.Text()) {
+			tasks = append(tasks, []byte(word))
+		}
+		id, err := distributor.Distribute(tasks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Distributed batch %d of %d tasks", id, len(tasks))
+	}
+
+	log.Println("Exiting...")
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
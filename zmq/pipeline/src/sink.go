@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"github.com/limaechocharlie/cwb/shared/zmqpattern"
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
+	"log"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "tcp://127.0.0.1:5558", "Endpoint the distributor and the workers push to")
+	flag.Parse()
+
+	log.Println("Zeromq Sink")
+	socket, err := zmqsocket.NewPipelineSocket(zmqsocket.Pull)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer socket.Close()
+	if err := socket.Bind(*endpoint); err != nil {
+		log.Fatal(err)
+	}
+
+	sink := zmqpattern.NewSink(socket)
+	for {
+		id, results, err := sink.Collect()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Batch %d: %s", id, bytes.Join(results, []byte(" ")))
+	}
+}
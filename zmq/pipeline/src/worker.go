@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"github.com/limaechocharlie/cwb/shared/transform"
+	"github.com/limaechocharlie/cwb/shared/zmqpattern"
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
+	"log"
+	"time"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "tcp://127.0.0.1:5557", "Endpoint of the distributor")
+	sinkEndpoint := flag.String("sink", "tcp://127.0.0.1:5558", "Endpoint of the sink")
+	delay := flag.Duration("delay", 0, "Time spent on every task, to watch the tasks spread over the workers")
+	flag.Parse()
+
+	log.Println("Zeromq Worker")
+	tasks, err := zmqsocket.NewPipelineSocket(zmqsocket.Pull)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer tasks.Close()
+	if err := tasks.Connect(*endpoint); err != nil {
+		log.Fatal(err)
+	}
+
+	results, err := zmqsocket.NewPipelineSocket(zmqsocket.Push)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer results.Close()
+	if err := results.Connect(*sinkEndpoint); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Fatal(zmqpattern.Work(tasks, results, func(task []byte) []byte {
+		time.Sleep(*delay)
+		log.Printf("Reversing '%s'", task)
+		return transform.ReverseBytes(task)
+	}))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	flynn "github.com/flynn/noise"
+	"github.com/limaechocharlie/cwb/shared/noise"
+	"github.com/limaechocharlie/cwb/shared/zmqpattern"
+	"github.com/limaechocharlie/cwb/shared/zmqpool"
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// sensors are the groups the publisher publishes to, with the unit of their readings
+var sensors = map[string]string{"temperature": "Cel", "humidity": "%RH", "pressure": "hPa"}
+
+// loadKeypair reads the static key pair of the key server from the file, its private and public keys in hex, or
+// creates the file with a new key pair if it doesn't exist
+func loadKeypair(path string) (flynn.DHKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := noise.GenerateKeypair()
+		if err != nil {
+			return key, err
+		}
+		log.Printf("Writing a new key pair to %s", path)
+		return key, ioutil.WriteFile(path, []byte(hex.EncodeToString(key.Private)+"\n"+hex.EncodeToString(key.Public)+"\n"), 0600)
+	}
+	if err != nil {
+		return flynn.DHKey{}, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return flynn.DHKey{}, fmt.Errorf("%s: expected a private and a public key", path)
+	}
+	var key flynn.DHKey
+	if key.Private, err = hex.DecodeString(fields[0]); err != nil {
+		return key, fmt.Errorf("%s: %v", path, err)
+	}
+	if key.Public, err = hex.DecodeString(fields[1]); err != nil {
+		return key, fmt.Errorf("%s: %v", path, err)
+	}
+	return key, nil
+}
+
+// readGrants reads the allow-list of the subscribers from the file
+func readGrants(path string) (zmqpattern.Grants, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return zmqpattern.ReadGrants(f)
+}
+
+// serveKeys hands out the group keys to the subscribers
+func serveKeys(endpoint string, server *zmqpattern.KeyServer, workers int) error {
+	socket, err := zmqsocket.NewSocket(zmqsocket.Server)
+	if err != nil {
+		return err
+	}
+	defer socket.Close()
+	if err := socket.Bind(endpoint); err != nil {
+		return err
+	}
+	return zmqpool.Serve(socket, zmqpool.Options{Workers: workers}, server.Handle)
+}
+
+func main() {
+	keysEndpoint := flag.String("keys", "tcp://127.0.0.1:5557", "Endpoint of the key server")
+	endpoint := flag.String("endpoint", "tcp://127.0.0.1:5558", "Endpoint of the RADIO socket")
+	interval := flag.Duration("interval", time.Second, "Time between readings")
+	rotate := flag.Duration("rotate", time.Minute, "Time between group key rotations, never if 0")
+	workers := flag.Int("workers", 0, "Number of key requests handled at once, the number of CPUs if 0")
+	keyFile := flag.String("key-file", "publisher.key", "File of the static key pair of the key server, created if missing")
+	subscribers := flag.String("subscribers", "", "File of the subscribers allowed to fetch keys, read again at each rotation")
+	flag.Parse()
+	if *subscribers == "" {
+		log.Fatal("No -subscribers allow-list given")
+	}
+
+	log.Println("Zeromq Publisher")
+	staticKey, err := loadKeypair(*keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Public key of the key server: %s", hex.EncodeToString(staticKey.Public))
+	grants, err := readGrants(*subscribers)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	keys := zmqpattern.NewGroupKeys()
+	server := zmqpattern.NewKeyServer(keys, staticKey, grants)
+	go func() {
+		log.Fatal(serveKeys(*keysEndpoint, server, *workers))
+	}()
+
+	socket, err := zmqsocket.NewGroupSocket(zmqsocket.Radio)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer socket.Close()
+	if err := socket.Bind(*endpoint); err != nil {
+		log.Fatal(err)
+	}
+	publisher := zmqpattern.NewPublisher(socket, keys)
+
+	var rotation <-chan time.Time
+	if *rotate > 0 {
+		rotation = time.Tick(*rotate)
+	}
+	readings := time.Tick(*interval)
+	for {
+		select {
+		case <-rotation:
+			if grants, err := readGrants(*subscribers); err != nil {
+				log.Printf("Cannot read the allow-list, keeping the previous one: %v", err)
+			} else {
+				server.SetGrants(grants)
+			}
+			for _, group := range keys.Groups() {
+				key, err := keys.Rotate(group)
+				if err != nil {
+					log.Fatal(err)
+				}
+				log.Printf("Rotated key of group %s to epoch %d", group, key.Epoch)
+			}
+		case <-readings:
+			for group, unit := range sensors {
+				reading := fmt.Sprintf("%.1f %s", 20+rand.Float64()*10, unit)
+				if err := publisher.Publish(group, []byte(reading)); err != nil {
+					log.Printf("Cannot publish to %s: %v", group, err)
+				}
+			}
+		}
+	}
+}
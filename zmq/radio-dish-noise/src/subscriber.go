@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"github.com/limaechocharlie/cwb/shared/zmqpattern"
+	"github.com/limaechocharlie/cwb/shared/zmqsocket"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+func main() {
+	keysEndpoint := flag.String("keys", "tcp://127.0.0.1:5557", "Endpoint of the key server")
+	endpoint := flag.String("endpoint", "tcp://127.0.0.1:5558", "Endpoint of the RADIO socket")
+	groups := flag.String("groups", "temperature,humidity", "Comma separated groups to join")
+	timeout := flag.Duration("timeout", zmqpattern.DefaultTimeout, "Time to wait for the key server to reply")
+	retries := flag.Int("retries", zmqpattern.DefaultRetries, "Number of times a key request is sent again")
+	publisherKey := flag.String("publisher-key", "", "Public key of the key server in hex, as logged by the publisher")
+	name := flag.String("name", "", "Name of the subscriber in the allow-list of the publisher")
+	tokenFile := flag.String("token-file", "", "File of the token of the subscriber in hex")
+	flag.Parse()
+	if *publisherKey == "" || *name == "" || *tokenFile == "" {
+		log.Fatal("-publisher-key, -name and -token-file are required")
+	}
+	serverKey, err := hex.DecodeString(*publisherKey)
+	if err != nil {
+		log.Fatalf("Cannot decode -publisher-key: %v", err)
+	}
+	b, err := ioutil.ReadFile(*tokenFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	token, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		log.Fatalf("Cannot decode %s: %v", *tokenFile, err)
+	}
+
+	log.Println("Zeromq Subscriber")
+	pirate := zmqpattern.NewLazyPirate(*keysEndpoint)
+	pirate.Timeout, pirate.Retries = *timeout, *retries
+	defer pirate.Close()
+
+	socket, err := zmqsocket.NewGroupSocket(zmqsocket.Dish)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer socket.Close()
+	if err := socket.Connect(*endpoint); err != nil {
+		log.Fatal(err)
+	}
+
+	keyClient, err := zmqpattern.NewKeyClient(pirate, serverKey, *name, token)
+	if err != nil {
+		log.Fatal(err)
+	}
+	subscriber := zmqpattern.NewSubscriber(socket, keyClient)
+	for _, group := range strings.Split(*groups, ",") {
+		if err := subscriber.Join(group); err != nil {
+			log.Fatalf("Cannot join %s: %v", group, err)
+		}
+		log.Printf("Joined %s", group)
+	}
+
+	for {
+		group, message, err := subscriber.Receive()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("%s: %s", group, message)
+	}
+}